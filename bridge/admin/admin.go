@@ -0,0 +1,230 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/celerway/metamorphosis/bridge/logging"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The admin API lets an operator poke at a running bridge without restarting it.
+// Everything is JSON and every request must carry the bearer token.
+
+const requestTimeout = 15 * time.Second // Flushing can take a while if Kafka is slow.
+
+func Initialize(params Params) (*admin, error) {
+	if params.Token == "" {
+		return nil, errors.New("admin API requires a token")
+	}
+	return &admin{
+		port:   params.Port,
+		token:  params.Token,
+		kafka:  params.Kafka,
+		mqtt:   params.Mqtt,
+		logger: logging.Module("admin"),
+	}, nil
+}
+
+// Run serves the admin API. Blocks until the context is cancelled.
+func (a *admin) Run(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", a.port),
+		Handler: a.Handler(),
+	}
+	a.logger.Infof("Admin API listening on %s", srv.Addr)
+	errCh := make(chan error, 1)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			errCh <- err
+		}
+	}()
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("admin API: %w", err)
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	wg.Wait()
+	if err != nil {
+		return fmt.Errorf("admin API shutdown: %w", err)
+	}
+	return nil
+}
+
+// Handler returns the http handler for the admin API.
+func (a *admin) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/status", a.method(http.MethodGet, a.handleStatus))
+	mux.HandleFunc("/admin/flush", a.method(http.MethodPost, a.handleFlush))
+	mux.HandleFunc("/admin/mqtt/pause", a.method(http.MethodPost, a.handlePause))
+	mux.HandleFunc("/admin/mqtt/resume", a.method(http.MethodPost, a.handleResume))
+	mux.HandleFunc("/admin/mqtt/subscriptions", a.handleSubscriptions)
+	mux.HandleFunc("/admin/log-level", a.handleLogLevel)
+	return a.authenticate(mux)
+}
+
+func (a *admin) authenticate(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + a.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, expected) != 1 {
+			a.logger.Warnf("Unauthorized admin request from %s to %s", r.RemoteAddr, r.URL.Path)
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *admin) method(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (a *admin) handleStatus(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	kStatus, err := a.kafka.Status(ctx)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJson(w, http.StatusOK, status{
+		Kafka: kStatus,
+		Mqtt: mqttStatus{
+			Paused:        a.mqtt.Paused(),
+			Subscriptions: a.mqtt.Subscriptions(),
+		},
+		LogLevels: logLevels{Level: log.GetLevel().String(), Modules: logging.Levels()},
+	})
+}
+
+func (a *admin) handleFlush(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	a.logger.Warn("Forced flush requested through the admin API")
+	err := a.kafka.Flush(ctx)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	kStatus, err := a.kafka.Status(ctx)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJson(w, http.StatusOK, kStatus)
+}
+
+func (a *admin) handlePause(w http.ResponseWriter, _ *http.Request) {
+	if err := a.mqtt.Pause(); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	a.writeMqttStatus(w)
+}
+
+func (a *admin) handleResume(w http.ResponseWriter, _ *http.Request) {
+	if err := a.mqtt.Resume(); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	a.writeMqttStatus(w)
+}
+
+// handleSubscriptions lists (GET), adds (POST) or removes (DELETE) subscriptions.
+func (a *admin) handleSubscriptions(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		a.writeMqttStatus(w)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	var req topicRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decoding request: %w", err))
+		return
+	}
+	if strings.TrimSpace(req.Topic) == "" {
+		writeError(w, http.StatusBadRequest, errors.New("topic can't be empty"))
+		return
+	}
+	var err error
+	if r.Method == http.MethodPost {
+		a.logger.Warnf("Adding subscription '%s' through the admin API", req.Topic)
+		err = a.mqtt.Subscribe(req.Topic)
+	} else {
+		a.logger.Warnf("Removing subscription '%s' through the admin API", req.Topic)
+		err = a.mqtt.Unsubscribe(req.Topic)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	a.writeMqttStatus(w)
+}
+
+// handleLogLevel shows (GET) or changes (PUT) the log level. If a module is given only that module is changed.
+func (a *admin) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req logLevelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("decoding request: %w", err))
+			return
+		}
+		level, err := log.ParseLevel(req.Level)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Module != "" {
+			a.logger.Warnf("Log level for module %s changed to %s through the admin API", req.Module, level)
+			logging.SetModuleLevel(req.Module, level)
+		} else {
+			a.logger.Warnf("Log level changed to %s through the admin API", level)
+			logging.SetLevel(level)
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeJson(w, http.StatusOK, logLevels{Level: log.GetLevel().String(), Modules: logging.Levels()})
+}
+
+func (a *admin) writeMqttStatus(w http.ResponseWriter) {
+	writeJson(w, http.StatusOK, mqttStatus{
+		Paused:        a.mqtt.Paused(),
+		Subscriptions: a.mqtt.Subscriptions(),
+	})
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJson(w, code, errorResponse{Error: err.Error()})
+}
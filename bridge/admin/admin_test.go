@@ -0,0 +1,158 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/celerway/metamorphosis/bridge/kafka"
+	is2 "github.com/matryer/is"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testToken = "sekrit"
+
+type fakeKafka struct {
+	flushes int
+	failing bool
+}
+
+func (f *fakeKafka) Status(_ context.Context) (kafka.Status, error) {
+	return kafka.Status{Buffered: 42, FailureState: f.failing}, nil
+}
+
+func (f *fakeKafka) Flush(_ context.Context) error {
+	f.flushes++
+	if f.failing {
+		return errors.New("kafka is down")
+	}
+	return nil
+}
+
+type fakeMqtt struct {
+	paused bool
+	topics []string
+}
+
+func (f *fakeMqtt) Pause() error             { f.paused = true; return nil }
+func (f *fakeMqtt) Resume() error            { f.paused = false; return nil }
+func (f *fakeMqtt) Paused() bool             { return f.paused }
+func (f *fakeMqtt) Subscriptions() []string  { return f.topics }
+func (f *fakeMqtt) Subscribe(t string) error { f.topics = append(f.topics, t); return nil }
+func (f *fakeMqtt) Unsubscribe(t string) error {
+	for i, topic := range f.topics {
+		if topic == t {
+			f.topics = append(f.topics[:i], f.topics[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("not subscribed")
+}
+
+func makeTestServer(t *testing.T) (*httptest.Server, *fakeKafka, *fakeMqtt) {
+	k := &fakeKafka{}
+	m := &fakeMqtt{topics: []string{"a/#"}}
+	a, err := Initialize(Params{Token: testToken, Kafka: k, Mqtt: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(a.Handler())
+	t.Cleanup(srv.Close)
+	return srv, k, m
+}
+
+func doRequest(srv *httptest.Server, method, path, token string, body interface{}) (*http.Response, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		_ = json.NewEncoder(&buf).Encode(body)
+	}
+	req, err := http.NewRequest(method, srv.URL+path, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return srv.Client().Do(req)
+}
+
+func TestAdmin_Auth(t *testing.T) {
+	is := is2.New(t)
+	srv, _, _ := makeTestServer(t)
+	resp, err := doRequest(srv, http.MethodGet, "/admin/status", "", nil)
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusUnauthorized)
+	resp, err = doRequest(srv, http.MethodGet, "/admin/status", "wrong", nil)
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusUnauthorized)
+	_, err = Initialize(Params{})
+	is.True(err != nil) // no token, no admin API.
+}
+
+func TestAdmin_Status(t *testing.T) {
+	is := is2.New(t)
+	srv, _, _ := makeTestServer(t)
+	resp, err := doRequest(srv, http.MethodGet, "/admin/status", testToken, nil)
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	var s status
+	is.NoErr(json.NewDecoder(resp.Body).Decode(&s))
+	is.Equal(s.Kafka.Buffered, 42)
+	is.Equal(s.Mqtt.Subscriptions, []string{"a/#"})
+}
+
+func TestAdmin_Flush(t *testing.T) {
+	is := is2.New(t)
+	srv, k, _ := makeTestServer(t)
+	resp, err := doRequest(srv, http.MethodGet, "/admin/flush", testToken, nil)
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusMethodNotAllowed)
+	resp, err = doRequest(srv, http.MethodPost, "/admin/flush", testToken, nil)
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	k.failing = true
+	resp, err = doRequest(srv, http.MethodPost, "/admin/flush", testToken, nil)
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusBadGateway)
+	is.Equal(k.flushes, 2)
+}
+
+func TestAdmin_Mqtt(t *testing.T) {
+	is := is2.New(t)
+	srv, _, m := makeTestServer(t)
+	resp, err := doRequest(srv, http.MethodPost, "/admin/mqtt/pause", testToken, nil)
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.True(m.paused)
+	resp, err = doRequest(srv, http.MethodPost, "/admin/mqtt/resume", testToken, nil)
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.True(!m.paused)
+	resp, err = doRequest(srv, http.MethodPost, "/admin/mqtt/subscriptions", testToken, topicRequest{Topic: "b/+"})
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(m.topics, []string{"a/#", "b/+"})
+	resp, err = doRequest(srv, http.MethodDelete, "/admin/mqtt/subscriptions", testToken, topicRequest{Topic: "a/#"})
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(m.topics, []string{"b/+"})
+	resp, err = doRequest(srv, http.MethodDelete, "/admin/mqtt/subscriptions", testToken, topicRequest{Topic: "a/#"})
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+}
+
+func TestAdmin_LogLevel(t *testing.T) {
+	is := is2.New(t)
+	srv, _, _ := makeTestServer(t)
+	defer log.SetLevel(log.GetLevel())
+	resp, err := doRequest(srv, http.MethodPut, "/admin/log-level", testToken, logLevelRequest{Level: "debug"})
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(log.GetLevel(), log.DebugLevel)
+	resp, err = doRequest(srv, http.MethodPut, "/admin/log-level", testToken, logLevelRequest{Level: "loud"})
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+}
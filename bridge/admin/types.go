@@ -0,0 +1,67 @@
+package admin
+
+import (
+	"context"
+	"github.com/celerway/metamorphosis/bridge/kafka"
+	log "github.com/sirupsen/logrus"
+)
+
+// KafkaController is implemented by the kafka buffer.
+type KafkaController interface {
+	Status(ctx context.Context) (kafka.Status, error)
+	Flush(ctx context.Context) error
+}
+
+// MqttController is implemented by the mqtt client.
+type MqttController interface {
+	Pause() error
+	Resume() error
+	Paused() bool
+	Subscriptions() []string
+	Subscribe(topic string) error
+	Unsubscribe(topic string) error
+}
+
+type Params struct {
+	Port  int
+	Token string // bearer token required for all requests.
+	Kafka KafkaController
+	Mqtt  MqttController
+}
+
+type admin struct {
+	port   int
+	token  string
+	kafka  KafkaController
+	mqtt   MqttController
+	logger *log.Entry
+}
+
+type mqttStatus struct {
+	Paused        bool     `json:"paused"`
+	Subscriptions []string `json:"subscriptions"`
+}
+
+type logLevels struct {
+	Level   string            `json:"level"`
+	Modules map[string]string `json:"modules"`
+}
+
+type status struct {
+	Kafka     kafka.Status `json:"kafka"`
+	Mqtt      mqttStatus   `json:"mqtt"`
+	LogLevels logLevels    `json:"log_levels"`
+}
+
+type topicRequest struct {
+	Topic string `json:"topic"`
+}
+
+type logLevelRequest struct {
+	Level  string `json:"level"`
+	Module string `json:"module,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
@@ -3,10 +3,14 @@ package bridge
 import (
 	kafka "github.com/celerway/metamorphosis/bridge/kafka"
 	"github.com/celerway/metamorphosis/bridge/mqtt"
+	"github.com/celerway/metamorphosis/bridge/observability"
+	"github.com/celerway/metamorphosis/bridge/processor"
+	"github.com/celerway/metamorphosis/bridge/tracing"
 )
 
 // Here I put the stuff that glues the mqtt to the kafka.
 // Not sure if this should be a separate package. Let's keep things simple atm.
+// Transformations are done by the processor chains, see the processor package.
 
 // Note that this code doesn't used contexts or waitgroups.
 // When we exit there is no cleanup to be done.
@@ -17,10 +21,61 @@ func (br bridge) mainloop() {
 }
 
 func (br bridge) glueMsgHandler(msg mqtt.ChannelMessage) {
+	span := br.tracer.Start(msg.Trace, "bridge", tracing.KindInternal)
+	defer span.End()
+	quarantine := false
+	if br.rateLimiter != nil {
+		switch br.rateLimiter.check(msg) {
+		case rateDrop:
+			br.logger.Tracef("dropping message over the rate limit on topic %s", msg.Topic)
+			span.SetAttribute("metamorphosis.dropped", "rate-limit")
+			return
+		case rateQuarantine:
+			span.SetAttribute("metamorphosis.quarantined", "rate-limit")
+			quarantine = true
+		}
+	}
+	if br.dedupe != nil && br.dedupe.isDuplicate(msg) {
+		br.logger.Tracef("dropping duplicate message on topic %s", msg.Topic)
+		span.SetAttribute("metamorphosis.dropped", "duplicate")
+		br.obsChannel <- observability.DedupeDropped
+		return
+	}
 	kafkaMsg := kafka.Message{
-		Topic:   msg.Topic,
-		Content: msg.Content,
+		Source:     msg.Source,
+		Topic:      msg.Topic,
+		Content:    msg.Content,
+		Trace:      span.Context(),
+		Quarantine: quarantine,
+	}
+	// Quarantined messages are kept as they were received.
+	if br.processors != nil && !quarantine {
+		processed, action, err := br.processors.Process(processor.Message{Source: msg.Source, Topic: msg.Topic, Content: msg.Content})
+		switch action {
+		case processor.Drop:
+			if err != nil {
+				br.logger.Debugf("dropping message on topic %s: %s", msg.Topic, err)
+			}
+			span.SetAttribute("metamorphosis.dropped", "processor")
+			return
+		case processor.DeadLetter:
+			br.logger.Debugf("dead lettering message on topic %s: %s", msg.Topic, err)
+			span.SetAttribute("metamorphosis.dead_letter", err.Error())
+			kafkaMsg.Error = err.Error()
+		default:
+			kafkaMsg.Topic, kafkaMsg.Content = processed.Topic, processed.Content
+		}
+	}
+	// Payloads that don't match their schema go to the dead letter topic.
+	if br.validator != nil && kafkaMsg.Error == "" && !quarantine {
+		if err := br.validator.Validate(kafkaMsg); err != nil {
+			br.logger.Debugf("dead lettering message on topic %s: %s", kafkaMsg.Topic, err)
+			span.SetAttribute("metamorphosis.dead_letter", err.Error())
+			kafkaMsg.Error = err.Error()
+		}
+	}
+	if br.traceSampler.Sample() {
+		br.logger.Trace("bridge pushed a message to kafka")
 	}
-	br.logger.Trace("bridge pushed a message to kafka")
 	br.kafkaCh <- kafkaMsg
 }
@@ -0,0 +1,163 @@
+package bridge
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/celerway/metamorphosis/bridge/mqtt"
+	"strings"
+	"time"
+)
+
+// Dedupe drops messages we've already seen within a time window.
+// QoS 1 redeliveries and the overlap between two instances during a rolling restart both produce
+// duplicates. The state is bounded both in time (window) and in size (maxEntries), so a flood of
+// unique messages can't make us grow without limit.
+
+const defaultDedupeMaxEntries = 100000
+
+type fingerprintFunc func(msg mqtt.ChannelMessage) (string, bool)
+
+type dedupeEntry struct {
+	key  string
+	seen time.Time
+}
+
+type dedupe struct {
+	window      time.Duration
+	maxEntries  int
+	fingerprint fingerprintFunc
+	seen        map[string]time.Time
+	queue       []dedupeEntry // insertion order, oldest first. Used to expire entries.
+	now         func() time.Time
+}
+
+// newDedupe creates the dedupe stage. keySpec selects the fingerprint:
+//   - "hash" (or empty): a hash of the topic and the payload.
+//   - "json:<path>": the value of a field in a JSON payload. Nested fields are separated by dots.
+//   - "property:<name>": an MQTT 5 user property. Needs MQTT_PROTOCOL_VERSION=5.
+func newDedupe(window time.Duration, maxEntries int, keySpec string) (*dedupe, error) {
+	if window <= 0 {
+		return nil, errors.New("dedupe window must be positive")
+	}
+	if maxEntries <= 0 {
+		maxEntries = defaultDedupeMaxEntries
+	}
+	fp, err := parseFingerprint(keySpec)
+	if err != nil {
+		return nil, err
+	}
+	return &dedupe{
+		window:      window,
+		maxEntries:  maxEntries,
+		fingerprint: fp,
+		seen:        make(map[string]time.Time),
+		queue:       make([]dedupeEntry, 0, 1024),
+		now:         time.Now,
+	}, nil
+}
+
+func parseFingerprint(spec string) (fingerprintFunc, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "", "hash":
+		return hashFingerprint, nil
+	case "json":
+		if arg == "" {
+			return nil, errors.New("dedupe key 'json' needs a field, like 'json:id'")
+		}
+		return jsonFingerprint(strings.Split(arg, ".")), nil
+	case "property":
+		if arg == "" {
+			return nil, errors.New("dedupe key 'property' needs a name, like 'property:msgid'")
+		}
+		return propertyFingerprint(arg), nil
+	default:
+		return nil, fmt.Errorf("unknown dedupe key '%s' (hash|json:<field>|property:<name>)", spec)
+	}
+}
+
+func hashFingerprint(msg mqtt.ChannelMessage) (string, bool) {
+	h := sha256.New()
+	h.Write([]byte(msg.Topic))
+	h.Write([]byte{0}) // separator, so topic "a/b" + "c" differs from "a/" + "bc"
+	h.Write(msg.Content)
+	return string(h.Sum(nil)), true
+}
+
+// jsonFingerprint looks up a field in the payload. The topic is part of the key, so
+// identical ids on different topics aren't considered duplicates.
+func jsonFingerprint(path []string) fingerprintFunc {
+	return func(msg mqtt.ChannelMessage) (string, bool) {
+		var doc interface{}
+		if err := json.Unmarshal(msg.Content, &doc); err != nil {
+			return "", false
+		}
+		for _, field := range path {
+			obj, ok := doc.(map[string]interface{})
+			if !ok {
+				return "", false
+			}
+			doc, ok = obj[field]
+			if !ok {
+				return "", false
+			}
+		}
+		value, err := json.Marshal(doc)
+		if err != nil {
+			return "", false
+		}
+		return msg.Topic + "\x00" + string(value), true
+	}
+}
+
+// propertyFingerprint uses an MQTT 5 user property. Like jsonFingerprint, the topic is part of the key.
+func propertyFingerprint(name string) fingerprintFunc {
+	return func(msg mqtt.ChannelMessage) (string, bool) {
+		value, ok := msg.Property(name)
+		if !ok {
+			return "", false
+		}
+		return msg.Topic + "\x00" + value, true
+	}
+}
+
+// isDuplicate returns true if the message has been seen within the window.
+// Messages we can't fingerprint are never considered duplicates.
+func (d *dedupe) isDuplicate(msg mqtt.ChannelMessage) bool {
+	key, ok := d.fingerprint(msg)
+	if !ok {
+		return false
+	}
+	now := d.now()
+	d.expire(now)
+	if seen, found := d.seen[key]; found && now.Sub(seen) < d.window {
+		return true
+	}
+	if len(d.queue) >= d.maxEntries {
+		d.evictOldest()
+	}
+	d.seen[key] = now
+	d.queue = append(d.queue, dedupeEntry{key: key, seen: now})
+	return false
+}
+
+// expire removes entries that have fallen out of the window.
+func (d *dedupe) expire(now time.Time) {
+	for len(d.queue) > 0 && now.Sub(d.queue[0].seen) >= d.window {
+		d.evictOldest()
+	}
+	if len(d.queue) == 0 && cap(d.queue) > 1024 {
+		d.queue = make([]dedupeEntry, 0, 1024) // release the memory after a burst.
+	}
+}
+
+func (d *dedupe) evictOldest() {
+	e := d.queue[0]
+	d.queue = d.queue[1:]
+	// The key might have been seen again later, in which case the map holds the newer timestamp.
+	if seen, ok := d.seen[e.key]; ok && seen.Equal(e.seen) {
+		delete(d.seen, e.key)
+	}
+}
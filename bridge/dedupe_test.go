@@ -0,0 +1,86 @@
+package bridge
+
+import (
+	"github.com/celerway/metamorphosis/bridge/mqtt"
+	is2 "github.com/matryer/is"
+	"testing"
+	"time"
+)
+
+func TestDedupe_Hash(t *testing.T) {
+	is := is2.New(t)
+	d, err := newDedupe(time.Minute, 0, "hash")
+	is.NoErr(err)
+	now := time.Unix(1000, 0)
+	d.now = func() time.Time { return now }
+	msg := mqtt.ChannelMessage{Topic: "a/b", Content: []byte("payload")}
+	is.True(!d.isDuplicate(msg))
+	is.True(d.isDuplicate(msg))
+	// Same payload, different topic isn't a duplicate.
+	is.True(!d.isDuplicate(mqtt.ChannelMessage{Topic: "a/c", Content: []byte("payload")}))
+	// Once the window has passed the message is let through again.
+	now = now.Add(time.Minute)
+	is.True(!d.isDuplicate(msg))
+	is.True(d.isDuplicate(msg))
+}
+
+func TestDedupe_JsonField(t *testing.T) {
+	is := is2.New(t)
+	d, err := newDedupe(time.Minute, 0, "json:meta.id")
+	is.NoErr(err)
+	first := mqtt.ChannelMessage{Topic: "t", Content: []byte(`{"meta":{"id":42},"value":1}`)}
+	second := mqtt.ChannelMessage{Topic: "t", Content: []byte(`{"meta":{"id":42},"value":2}`)}
+	other := mqtt.ChannelMessage{Topic: "t", Content: []byte(`{"meta":{"id":43},"value":2}`)}
+	is.True(!d.isDuplicate(first))
+	is.True(d.isDuplicate(second))
+	is.True(!d.isDuplicate(other))
+	// Messages without the field, or that aren't JSON, are never dropped.
+	noField := mqtt.ChannelMessage{Topic: "t", Content: []byte(`{"value":1}`)}
+	is.True(!d.isDuplicate(noField))
+	is.True(!d.isDuplicate(noField))
+	notJson := mqtt.ChannelMessage{Topic: "t", Content: []byte(`hello`)}
+	is.True(!d.isDuplicate(notJson))
+	is.True(!d.isDuplicate(notJson))
+}
+
+func TestDedupe_Property(t *testing.T) {
+	is := is2.New(t)
+	d, err := newDedupe(time.Minute, 0, "property:msgid")
+	is.NoErr(err)
+	props := func(id string) []mqtt.UserProperty {
+		return []mqtt.UserProperty{{Key: "source", Value: "gw"}, {Key: "msgid", Value: id}}
+	}
+	first := mqtt.ChannelMessage{Topic: "t", Content: []byte("1"), Properties: props("42")}
+	second := mqtt.ChannelMessage{Topic: "t", Content: []byte("2"), Properties: props("42")}
+	is.True(!d.isDuplicate(first))
+	is.True(d.isDuplicate(second))
+	is.True(!d.isDuplicate(mqtt.ChannelMessage{Topic: "t", Properties: props("43")}))
+	is.True(!d.isDuplicate(mqtt.ChannelMessage{Topic: "u", Properties: props("42")})) // other topic
+	// Messages without the property, like everything from MQTT 3.1.1, are never dropped.
+	is.True(!d.isDuplicate(mqtt.ChannelMessage{Topic: "t", Content: []byte("1")}))
+	is.True(!d.isDuplicate(mqtt.ChannelMessage{Topic: "t", Content: []byte("1")}))
+}
+
+func TestDedupe_Bounded(t *testing.T) {
+	is := is2.New(t)
+	d, err := newDedupe(time.Hour, 10, "hash")
+	is.NoErr(err)
+	for i := 0; i < 100; i++ {
+		is.True(!d.isDuplicate(mqtt.ChannelMessage{Topic: "t", Content: []byte{byte(i)}}))
+	}
+	is.Equal(len(d.seen), 10)
+	is.Equal(len(d.queue), 10)
+	// The oldest have been evicted, the newest are still there.
+	is.True(!d.isDuplicate(mqtt.ChannelMessage{Topic: "t", Content: []byte{0}}))
+	is.True(d.isDuplicate(mqtt.ChannelMessage{Topic: "t", Content: []byte{99}}))
+}
+
+func TestDedupe_BadKey(t *testing.T) {
+	is := is2.New(t)
+	_, err := newDedupe(time.Minute, 0, "property:")
+	is.True(err != nil)
+	_, err = newDedupe(time.Minute, 0, "json:")
+	is.True(err != nil)
+	_, err = newDedupe(time.Minute, 0, "bogus")
+	is.True(err != nil)
+}
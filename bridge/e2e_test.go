@@ -0,0 +1,589 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/celerway/metamorphosis/bridge/kafka"
+	"github.com/celerway/metamorphosis/bridge/kafka/kafkatest"
+	"github.com/celerway/metamorphosis/bridge/mqtt"
+	"github.com/celerway/metamorphosis/bridge/mqtt/mqtttest"
+	"github.com/celerway/metamorphosis/bridge/processor"
+	"github.com/celerway/metamorphosis/bridge/schema"
+	"github.com/celerway/metamorphosis/bridge/schema/schematest"
+	"github.com/celerway/metamorphosis/bridge/tracing"
+	is2 "github.com/matryer/is"
+	gokafka "github.com/segmentio/kafka-go"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// These tests run the whole bridge in-process against mqtttest.Broker and kafkatest.Writer.
+
+const e2eTopic = "devices/#"
+
+type e2eBridge struct {
+	broker *mqtttest.Broker
+	writer *kafkatest.Writer
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func startBridge(t *testing.T, tweak func(p *Params)) *e2eBridge {
+	broker, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(broker.Close)
+	writer := kafkatest.NewWriter()
+	params := Params{
+		MqttBroker:         broker.Host(),
+		MqttPort:           broker.Port(),
+		MqttTopic:          e2eTopic,
+		MqttClientId:       "e2e-" + t.Name(),
+		KafkaTopic:         "mqtt",
+		KafkaWriter:        writer,
+		KafkaRetryInterval: 100 * time.Millisecond,
+		KafkaInterval:      100 * time.Millisecond,
+		KafkaBatchSize:     10,
+		KafkaMaxBatchSize:  100,
+		HealthAddr:         "127.0.0.1:0",
+		TestMessageTopic:   "test",
+	}
+	if tweak != nil {
+		tweak(&params)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &e2eBridge{broker: broker, writer: writer, cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(b.done)
+		Run(ctx, params)
+	}()
+	t.Cleanup(b.stop)
+	if !b.waitForSubscription(e2eTopic, 10*time.Second) {
+		t.Fatal("bridge didn't subscribe")
+	}
+	return b
+}
+
+func (b *e2eBridge) waitForSubscription(filter string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if b.broker.Subscribed(filter) {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// stop shuts the bridge down and waits for Run to return.
+func (b *e2eBridge) stop() {
+	b.cancel()
+	<-b.done
+}
+
+func (b *e2eBridge) publish(from, to int) {
+	for i := from; i < to; i++ {
+		b.broker.Publish(fmt.Sprintf("devices/%d/telemetry", i), []byte(fmt.Sprintf(`{"seq":%d}`, i)), 1, false)
+	}
+}
+
+// waitForMessages waits until n messages (not counting test messages) have been written.
+func (b *e2eBridge) waitForMessages(n int, timeout time.Duration) bool {
+	return b.writer.WaitFor(timeout, func(records []gokafka.Message) bool {
+		return len(payloads(records)) >= n
+	})
+}
+
+// payloads decodes the records and returns the payloads of everything but the test messages.
+func payloads(records []gokafka.Message) []string {
+	var out []string
+	for _, r := range records {
+		var msg kafka.Message
+		if err := json.Unmarshal(r.Value, &msg); err != nil || msg.Topic == "test" {
+			continue
+		}
+		out = append(out, string(msg.Content))
+	}
+	return out
+}
+
+func expectedPayloads(from, to int) []string {
+	var out []string
+	for i := from; i < to; i++ {
+		out = append(out, fmt.Sprintf(`{"seq":%d}`, i))
+	}
+	return out
+}
+
+func TestE2E_Flow(t *testing.T) {
+	is := is2.New(t)
+	b := startBridge(t, nil)
+	b.publish(0, 50)
+	is.True(b.waitForMessages(50, 10*time.Second))
+	msgs, err := b.writer.Messages()
+	is.NoErr(err)
+	is.Equal(msgs[0].Topic, "test") // the bridge writes a test message on startup.
+	is.Equal(msgs[1].Topic, "devices/0/telemetry")
+	is.Equal(payloads(b.writer.Records()), expectedPayloads(0, 50))
+}
+
+func TestE2E_ShutdownFlushes(t *testing.T) {
+	is := is2.New(t)
+	b := startBridge(t, func(p *Params) {
+		p.KafkaInterval = time.Hour // nothing is written until we shut down.
+		p.KafkaBatchSize = 1000
+	})
+	b.publish(0, 20)
+	time.Sleep(200 * time.Millisecond) // let the messages reach the Kafka buffer.
+	is.Equal(len(payloads(b.writer.Records())), 0)
+	b.stop()
+	is.Equal(payloads(b.writer.Records()), expectedPayloads(0, 20))
+}
+
+func TestE2E_KafkaOutage(t *testing.T) {
+	is := is2.New(t)
+	b := startBridge(t, nil)
+	b.writer.SetFailing(true)
+	b.publish(0, 30)
+	is.True(b.writer.WaitFor(5*time.Second, func(_ []gokafka.Message) bool {
+		_, failures := b.writer.Writes()
+		return failures >= 2 // at least one retry.
+	}))
+	b.writer.SetFailing(false)
+	b.publish(30, 40)
+	is.True(b.waitForMessages(40, 10*time.Second))
+	is.Equal(payloads(b.writer.Records()), expectedPayloads(0, 40)) // nothing lost, order kept.
+}
+
+func TestE2E_MqttReconnect(t *testing.T) {
+	is := is2.New(t)
+	b := startBridge(t, nil)
+	b.publish(0, 10)
+	is.True(b.waitForMessages(10, 10*time.Second))
+	b.broker.DisconnectAll()
+	time.Sleep(50 * time.Millisecond)
+	is.True(b.waitForSubscription(e2eTopic, 10*time.Second)) // reconnected and subscribed again.
+	b.publish(10, 20)
+	is.True(b.waitForMessages(20, 10*time.Second))
+	is.Equal(payloads(b.writer.Records()), expectedPayloads(0, 20))
+}
+
+func TestE2E_SlowBroker(t *testing.T) {
+	is := is2.New(t)
+	b := startBridge(t, nil)
+	b.broker.SetLatency(300 * time.Millisecond)
+	b.writer.SetLatency(100 * time.Millisecond)
+	start := time.Now()
+	b.publish(0, 5)
+	is.True(b.waitForMessages(5, 10*time.Second))
+	is.True(time.Since(start) >= 400*time.Millisecond)
+	is.Equal(payloads(b.writer.Records()), expectedPayloads(0, 5))
+}
+
+func TestE2E_Workers(t *testing.T) {
+	is := is2.New(t)
+	b := startBridge(t, func(p *Params) {
+		p.KafkaWorkers = 4
+	})
+	b.publish(0, 100)
+	is.True(b.waitForMessages(100, 10*time.Second))
+	got := payloads(b.writer.Records())
+	sort.Strings(got)
+	want := expectedPayloads(0, 100)
+	sort.Strings(want)
+	is.Equal(got, want) // every topic is unique here, so there is no order to check.
+}
+
+func TestE2E_Heartbeat(t *testing.T) {
+	is := is2.New(t)
+	b := startBridge(t, func(p *Params) {
+		p.NoTestMessage = true
+		p.HeartbeatInterval = 50 * time.Millisecond
+		p.Version = "v-e2e"
+	})
+	b.publish(0, 20)
+	// heartbeats returns the heartbeats and the total number of messages they say were written.
+	heartbeats := func(records []gokafka.Message) ([]kafka.Heartbeat, int64) {
+		var out []kafka.Heartbeat
+		var written int64
+		for _, r := range records {
+			var msg kafka.Message
+			var hb kafka.Heartbeat
+			if json.Unmarshal(r.Value, &msg) != nil || msg.Topic != kafka.HeartbeatTopic || json.Unmarshal(msg.Content, &hb) != nil {
+				continue
+			}
+			out = append(out, hb)
+			written += hb.Written
+		}
+		return out, written
+	}
+	is.True(b.writer.WaitFor(10*time.Second, func(records []gokafka.Message) bool {
+		_, written := heartbeats(records)
+		return written == 20
+	}))
+	hbs, _ := heartbeats(b.writer.Records())
+	is.Equal(hbs[0].Id, "e2e-TestE2E_Heartbeat")
+	is.Equal(hbs[0].Version, "v-e2e")
+	msgs, err := b.writer.Messages()
+	is.NoErr(err)
+	for _, m := range msgs {
+		is.True(m.Topic != "test") // the test message is turned off
+	}
+}
+
+func TestE2E_Status(t *testing.T) {
+	is := is2.New(t)
+	const statusTopic = "bridge/status"
+	b := startBridge(t, func(p *Params) {
+		p.MqttStatusTopic = statusTopic
+		p.MqttStatusInterval = 50 * time.Millisecond
+		p.Version = "v-e2e"
+	})
+	// waitForStatus waits for a retained status matching cond.
+	waitForStatus := func(cond func(s mqtt.Status) bool) mqtt.Status {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			var status mqtt.Status
+			if msg, ok := b.broker.Retained(statusTopic); ok && json.Unmarshal(msg.Payload, &status) == nil && cond(status) {
+				return status
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("timed out waiting for status")
+		return mqtt.Status{}
+	}
+	status := waitForStatus(func(s mqtt.Status) bool { return s.State == "online" && s.Kafka != nil })
+	is.Equal(status.Id, "e2e-TestE2E_Status")
+	is.Equal(status.Version, "v-e2e")
+	is.True(status.Time != nil)
+
+	// Dropping the connection publishes the will. The bridge reconnects and is online again.
+	b.broker.DisconnectAll()
+	waitForStatus(func(s mqtt.Status) bool { return s.State == "online" && s.Time.After(*status.Time) })
+	time.Sleep(300 * time.Millisecond) // the disconnect handler reconnects as well, let it finish.
+	var wills int
+	for _, msg := range b.broker.Received() {
+		var s mqtt.Status
+		if msg.Topic == statusTopic && json.Unmarshal(msg.Payload, &s) == nil && s.State == "offline" {
+			is.True(msg.Retain)
+			is.True(s.Time == nil) // the will is built when we connect, so it has no time.
+			wills++
+		}
+	}
+	is.Equal(wills, 1)
+
+	// A clean shutdown doesn't publish the will, so we publish offline ourselves.
+	b.stop()
+	status = waitForStatus(func(s mqtt.Status) bool { return s.State == "offline" })
+	is.True(status.Time != nil)
+}
+
+func TestE2E_Sources(t *testing.T) {
+	is := is2.New(t)
+	us, err := mqtttest.NewBroker()
+	is.NoErr(err)
+	t.Cleanup(us.Close)
+	b := startBridge(t, func(p *Params) {
+		p.MqttSources = []MqttSource{
+			{Name: "eu", Broker: p.MqttBroker, Port: p.MqttPort, Topic: e2eTopic, ClientId: "e2e-eu"},
+			{Name: "us", Broker: us.Host(), Port: us.Port(), Topic: "sensors/+", ClientId: "e2e-us"},
+		}
+	})
+	deadline := time.Now().Add(10 * time.Second)
+	for !us.Subscribed("sensors/+") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	is.True(us.Subscribed("sensors/+"))
+	b.broker.Publish("devices/1/telemetry", []byte("from eu"), 1, false)
+	us.Publish("sensors/2", []byte("from us"), 1, false)
+	is.True(b.waitForMessages(2, 10*time.Second))
+	msgs, err := b.writer.Messages()
+	is.NoErr(err)
+	sources := make(map[string]string)
+	for _, m := range msgs {
+		if m.Topic != "test" {
+			sources[m.Topic] = m.Source
+		}
+	}
+	is.Equal(sources, map[string]string{"devices/1/telemetry": "eu", "sensors/2": "us"})
+}
+
+func TestE2E_BrokerFailover(t *testing.T) {
+	is := is2.New(t)
+	primary, err := mqtttest.NewBroker()
+	is.NoErr(err)
+	t.Cleanup(primary.Close)
+	primary.SetRefuseConnections(true)
+	// b.broker is the fallback. startBridge waits for the subscription there.
+	b := startBridge(t, func(p *Params) {
+		p.MqttBroker = fmt.Sprintf("%s:%d,%s:%d", primary.Host(), primary.Port(), p.MqttBroker, p.MqttPort)
+		p.MqttPreferPrimaryAfter = 200 * time.Millisecond
+	})
+	b.publish(0, 10)
+	is.True(b.waitForMessages(10, 10*time.Second))
+
+	primary.SetRefuseConnections(false)
+	deadline := time.Now().Add(10 * time.Second)
+	for !primary.Subscribed(e2eTopic) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	is.True(primary.Subscribed(e2eTopic)) // moved back to the primary
+	for i := 10; i < 20; i++ {
+		primary.Publish(fmt.Sprintf("devices/%d/telemetry", i), []byte(fmt.Sprintf(`{"seq":%d}`, i)), 1, false)
+	}
+	is.True(b.waitForMessages(20, 10*time.Second))
+	is.Equal(payloads(b.writer.Records()), expectedPayloads(0, 20))
+}
+
+// Moving back to the primary is our choice, so when no broker takes us we keep trying instead of exiting.
+func TestE2E_BrokerSwitchBackFails(t *testing.T) {
+	is := is2.New(t)
+	primary, err := mqtttest.NewBroker()
+	is.NoErr(err)
+	t.Cleanup(primary.Close)
+	primary.SetRefuseConnections(true) // reachable, but doesn't take us.
+	b := startBridge(t, func(p *Params) {
+		p.MqttBroker = fmt.Sprintf("%s:%d,%s:%d", primary.Host(), primary.Port(), p.MqttBroker, p.MqttPort)
+		p.MqttPreferPrimaryAfter = 200 * time.Millisecond
+	})
+	b.broker.SetRefuseConnections(true)
+	deadline := time.Now().Add(10 * time.Second)
+	for len(b.broker.Clients()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	is.Equal(len(b.broker.Clients()), 0) // we tried to switch, and neither broker takes us.
+	time.Sleep(3 * time.Second)          // connect would have given up and exited by now.
+	b.broker.SetRefuseConnections(false)
+	is.True(b.waitForSubscription(e2eTopic, 10*time.Second)) // back on the broker we were on.
+	b.publish(0, 10)
+	is.True(b.waitForMessages(10, 10*time.Second))
+}
+
+func TestE2E_Spill(t *testing.T) {
+	is := is2.New(t)
+	dir := t.TempDir()
+	b := startBridge(t, func(p *Params) {
+		p.ChannelSize = 2
+		p.KafkaMaxInFlight = 5
+		p.MqttBackpressure = mqtt.BackpressureSpill
+		p.MqttSpillDir = dir
+	})
+	b.writer.SetFailing(true)
+	b.publish(0, 50)
+	spooled := func() int64 {
+		info, err := os.Stat(filepath.Join(dir, "mqtt.spool"))
+		if err != nil || info.Size() < 8 {
+			return 0
+		}
+		return info.Size() - 8 // the read offset
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for spooled() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	is.True(spooled() > 0) // the queue is full, so we spill
+	b.writer.SetFailing(false)
+	b.publish(50, 60)
+	is.True(b.waitForMessages(60, 10*time.Second))
+	is.Equal(payloads(b.writer.Records()), expectedPayloads(0, 60)) // nothing lost, order kept.
+	is.Equal(spooled(), int64(0))                                   // drained and truncated
+}
+
+func TestE2E_SlowDown(t *testing.T) {
+	is := is2.New(t)
+	b := startBridge(t, func(p *Params) {
+		p.ChannelSize = 2
+		p.KafkaMaxInFlight = 5
+		p.MqttBackpressure = mqtt.BackpressureSlow
+	})
+	b.writer.SetFailing(true)
+	b.publish(0, 30)
+	is.True(b.writer.WaitFor(5*time.Second, func(_ []gokafka.Message) bool {
+		_, failures := b.writer.Writes()
+		return failures >= 2
+	}))
+	b.writer.SetFailing(false)
+	is.True(b.waitForMessages(30, 10*time.Second))
+	got := payloads(b.writer.Records())
+	sort.Strings(got)
+	want := expectedPayloads(0, 30)
+	sort.Strings(want)
+	is.Equal(got, want) // order isn't kept while we wait for room.
+}
+
+func TestE2E_Processors(t *testing.T) {
+	is := is2.New(t)
+	cfg := filepath.Join(t.TempDir(), "processors.json")
+	is.NoErr(os.WriteFile(cfg, []byte(`{"routes": [
+		{"filter": "devices/raw", "on_error": "dead-letter", "processors": [{"type": "base64-decode"}]},
+		{"filter": "devices/+/telemetry", "processors": [
+			{"type": "json-add", "fields": {"device": "{topic.1}"}},
+			{"type": "even-only"}
+		]}
+	]}`), 0o600))
+	evenOnly := func(processor.StepConfig) (processor.Processor, error) {
+		return processor.ProcessorFunc(func(msg *processor.Message) error {
+			var doc struct{ Seq int }
+			if err := json.Unmarshal(msg.Content, &doc); err != nil {
+				return err
+			}
+			if doc.Seq%2 != 0 {
+				return processor.ErrDrop
+			}
+			return nil
+		}), nil
+	}
+	b := startBridge(t, func(p *Params) {
+		p.ProcessorsFile = cfg
+		p.Processors = map[string]processor.Factory{"even-only": evenOnly}
+		p.KafkaDeadLetterTopic = "mqtt-dead-letter" // the test writer gets them too
+	})
+	b.publish(0, 4)
+	b.broker.Publish("devices/raw", []byte("aGk="), 1, false)
+	b.broker.Publish("devices/raw", []byte("!!"), 1, false)
+	is.True(b.waitForMessages(4, 10*time.Second))
+	msgs, err := b.writer.Messages()
+	is.NoErr(err)
+	var got []string
+	for _, m := range msgs[1:] {
+		got = append(got, m.Topic+" "+string(m.Content)+" "+m.Error)
+	}
+	sort.Strings(got) // dead letters have a pipeline of their own
+	is.Equal(got, []string{
+		`devices/0/telemetry {"device":"0","seq":0} `,
+		`devices/2/telemetry {"device":"2","seq":2} `,
+		`devices/raw !! processor 'base64-decode': illegal base64 data at input byte 0`,
+		`devices/raw hi `,
+	})
+}
+
+func TestE2E_Avro(t *testing.T) {
+	is := is2.New(t)
+	registry := schematest.NewRegistry()
+	t.Cleanup(registry.Close)
+	b := startBridge(t, func(p *Params) {
+		p.KafkaEncoding = schema.FormatAvro
+		p.SchemaRegistryUrl = registry.URL()
+		p.SchemaAutoRegister = true
+	})
+	b.publish(0, 5)
+	var got []string
+	is.True(b.writer.WaitFor(10*time.Second, func(records []gokafka.Message) bool {
+		got = nil
+		for _, r := range records {
+			msg, id, err := schema.Decode(r)
+			is.NoErr(err) // the test message too
+			is.Equal(id, 1)
+			if msg.Topic != "test" {
+				got = append(got, string(msg.Content))
+			}
+		}
+		return len(got) == 5
+	}))
+	is.Equal(got, expectedPayloads(0, 5))
+	is.Equal(registry.Subjects(), []string{"mqtt-value"})
+}
+
+func TestE2E_AvroRoute(t *testing.T) {
+	is := is2.New(t)
+	registry := schematest.NewRegistry()
+	t.Cleanup(registry.Close)
+	avsc := filepath.Join(t.TempDir(), "raw.avsc")
+	is.NoErr(os.WriteFile(avsc, []byte(`"string"`), 0o600))
+	b := startBridge(t, func(p *Params) {
+		p.KafkaEncoding = schema.FormatAvro
+		p.SchemaRegistryUrl = registry.URL()
+		p.SchemaAutoRegister = true
+		p.SchemaRoutes = "devices/raw=" + avsc
+		p.KafkaDeadLetterTopic = "mqtt-dead-letter" // the test writer gets them too
+	})
+	b.broker.Publish("devices/raw", []byte{4, 'h', 'i'}, 1, false)
+	b.broker.Publish("devices/raw", []byte{4, 'h'}, 1, false)
+	var got []string
+	is.True(b.writer.WaitFor(10*time.Second, func(records []gokafka.Message) bool {
+		got = nil
+		for _, r := range records {
+			msg, id, err := schema.Decode(r)
+			is.NoErr(err)
+			if msg.Topic != "test" {
+				got = append(got, fmt.Sprintf("%d %q %s", id, msg.Content, msg.Error))
+			}
+		}
+		return len(got) == 2
+	}))
+	sort.Strings(got) // dead letters have a pipeline of their own
+	is.Equal(got, []string{
+		`1 "\x04h" payload doesn't match the schema for 'devices/raw': cut short`, // in the envelope
+		`2 "\x04hi" `,
+	})
+}
+
+func TestE2E_RateLimit(t *testing.T) {
+	is := is2.New(t)
+	b := startBridge(t, func(p *Params) {
+		p.RateLimits = "devices/+/telemetry=1/h key=route action=sample:2, devices/raw=1/h action=quarantine"
+		p.KafkaQuarantineTopic = "mqtt-quarantine" // the test writer gets them too
+	})
+	b.publish(0, 6)
+	b.broker.Publish("devices/raw", []byte("first"), 1, false)
+	b.broker.Publish("devices/raw", []byte("second"), 1, false)
+	is.True(b.waitForMessages(5, 10*time.Second))
+	time.Sleep(200 * time.Millisecond) // nothing more should turn up
+	got := payloads(b.writer.Records())
+	sort.Strings(got) // quarantined messages have a pipeline of their own
+	// One from the burst and then one in two, while the quarantined messages are all kept.
+	is.Equal(got, []string{"first", "second", `{"seq":0}`, `{"seq":2}`, `{"seq":4}`})
+}
+
+func TestE2E_Mqtt5Dedupe(t *testing.T) {
+	is := is2.New(t)
+	b := startBridge(t, func(p *Params) {
+		p.MqttProtocolVersion = 5
+		p.DedupeWindow = time.Minute
+		p.DedupeKey = "property:msgid"
+	})
+	publish := func(payload, msgid string) {
+		b.broker.PublishMessage(mqtttest.Message{Topic: "devices/1/telemetry", Payload: []byte(payload), Qos: 1,
+			Properties: []mqtttest.UserProperty{{Key: "msgid", Value: msgid}}})
+	}
+	publish("first", "1")
+	publish("again", "1") // a redelivery with a new payload, the hash wouldn't catch it
+	publish("second", "2")
+	b.broker.Publish("devices/1/telemetry", []byte("no id"), 1, false)
+	is.True(b.waitForMessages(3, 10*time.Second))
+	time.Sleep(200 * time.Millisecond) // nothing more should turn up
+	is.Equal(payloads(b.writer.Records()), []string{"first", "second", "no id"})
+}
+
+func TestE2E_Mqtt5Traceparent(t *testing.T) {
+	is := is2.New(t)
+	b := startBridge(t, func(p *Params) {
+		p.MqttProtocolVersion = 5
+		p.TracingEndpoint = "http://127.0.0.1:1" // nothing listens, the export fails quietly
+		p.TracingSampleRatio = 1
+	})
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	b.broker.PublishMessage(mqtttest.Message{Topic: "devices/1/telemetry", Payload: []byte("traced"), Qos: 1,
+		Properties: []mqtttest.UserProperty{{Key: "traceparent", Value: tp}}})
+	b.broker.Publish("devices/2/telemetry", []byte("new trace"), 1, false)
+	is.True(b.waitForMessages(2, 10*time.Second))
+	traces := make(map[string]string)
+	for _, r := range b.writer.Records() {
+		var msg kafka.Message
+		is.NoErr(json.Unmarshal(r.Value, &msg))
+		if msg.Topic == "test" {
+			continue
+		}
+		is.Equal(len(r.Headers), 1)
+		sc, err := tracing.ParseTraceparent(string(r.Headers[0].Value))
+		is.NoErr(err)
+		traces[string(msg.Content)] = sc.TraceID.String()
+	}
+	is.Equal(traces["traced"], "4bf92f3577b34da6a3ce929d0e0e4736") // the sender's trace goes on into Kafka
+	is.True(traces["new trace"] != "4bf92f3577b34da6a3ce929d0e0e4736")
+}
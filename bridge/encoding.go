@@ -0,0 +1,38 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"github.com/celerway/metamorphosis/bridge/kafka"
+	"github.com/celerway/metamorphosis/bridge/schema"
+	"time"
+)
+
+const schemaRegistryTimeout = 30 * time.Second
+
+// encoder returns the Kafka encoder for params.KafkaEncoding. nil is the JSON envelope.
+func (params Params) encoder() (kafka.Encoder, error) {
+	if params.KafkaEncoding == "" || params.KafkaEncoding == "json" {
+		return nil, nil
+	}
+	if params.SchemaRegistryUrl == "" {
+		return nil, errors.New("no schema registry URL")
+	}
+	routes, err := schema.ParseRoutes(params.SchemaRoutes)
+	if err != nil {
+		return nil, err
+	}
+	subject := params.SchemaSubject
+	if subject == "" {
+		subject = params.KafkaTopic + "-value" // the registry's default naming
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), schemaRegistryTimeout)
+	defer cancel()
+	return schema.NewEncoder(ctx, schema.Params{
+		Registry:     schema.NewRegistry(params.SchemaRegistryUrl, params.SchemaRegistryUser, params.SchemaRegistryPassword),
+		Format:       params.KafkaEncoding,
+		Subject:      subject,
+		AutoRegister: params.SchemaAutoRegister,
+		Routes:       routes,
+	})
+}
@@ -0,0 +1,208 @@
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/celerway/metamorphosis/bridge/topic"
+	"github.com/prometheus/client_golang/prometheus"
+	gokafka "github.com/segmentio/kafka-go"
+	"net"
+	"strings"
+	"time"
+)
+
+const produceApiKey = 0
+
+// ParseCompression parses a codec name: none, gzip, snappy, lz4 or zstd.
+func ParseCompression(name string) (gokafka.Compression, error) {
+	var c gokafka.Compression
+	if name == "" {
+		return c, nil
+	}
+	if err := c.UnmarshalText([]byte(strings.ToLower(name))); err != nil {
+		return c, fmt.Errorf("unknown compression '%s' (expected none, gzip, snappy, lz4 or zstd)", name)
+	}
+	return c, nil
+}
+
+// ParseCompressionRoutes parses a spec like "devices/+/telemetry=zstd,logs/#=none".
+func ParseCompressionRoutes(spec string) ([]CompressionRoute, error) {
+	var routes []CompressionRoute
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		filter, name, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid compression route '%s' (expected filter=compression)", part)
+		}
+		if err := topic.ValidateFilter(filter); err != nil {
+			return nil, err
+		}
+		c, err := ParseCompression(name)
+		if err != nil {
+			return nil, fmt.Errorf("route '%s': %w", filter, err)
+		}
+		routes = append(routes, CompressionRoute{Filter: filter, Compression: c})
+	}
+	return routes, nil
+}
+
+// compressionFor returns the compression for an MQTT topic. The first matching route wins.
+func compressionFor(routes []CompressionRoute, def gokafka.Compression, mqttTopic string) gokafka.Compression {
+	for _, r := range routes {
+		if topic.Match(r.Filter, mqttTopic) {
+			return r.Compression
+		}
+	}
+	return def
+}
+
+// compressionName is used for labels and logs. kafka-go calls no compression "uncompressed".
+func compressionName(c gokafka.Compression) string {
+	if c == 0 {
+		return "none"
+	}
+	return c.String()
+}
+
+func (c *batchCounter) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.observe(b[:n])
+	return n, err
+}
+
+// observe follows the requests written to the connection. Requests start with their size and API key,
+// so everything but produce requests is skipped as it goes by. Produce requests are collected and
+// counted once they're complete.
+func (c *batchCounter) observe(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(b) > 0 {
+		switch {
+		case c.skip > 0:
+			n := min(c.skip, len(b))
+			c.skip -= n
+			b = b[n:]
+		case c.need > 0:
+			n := min(c.need, len(b))
+			c.buf = append(c.buf, b[:n]...)
+			c.need -= n
+			b = b[n:]
+			if c.need == 0 {
+				if n, err := recordBatchBytes(c.buf); err != nil {
+					c.unknown(err)
+				} else {
+					c.counter.Add(float64(n))
+				}
+				c.buf = c.buf[:0]
+			}
+		default:
+			n := min(6-len(c.buf), len(b)) // the size and the API key
+			c.buf = append(c.buf, b[:n]...)
+			b = b[n:]
+			if len(c.buf) < 6 {
+				continue
+			}
+			rest := int(int32(binary.BigEndian.Uint32(c.buf))) - 2
+			if binary.BigEndian.Uint16(c.buf[4:]) == produceApiKey && rest > 0 {
+				c.need = rest
+			} else {
+				c.skip = rest
+				c.buf = c.buf[:0]
+			}
+		}
+	}
+}
+
+// recordBatchBytes returns the size of the record batches in a produce request. We know v3 to v8, which
+// is what kafka-go sends: v8 to current brokers, as that's the newest it has.
+func recordBatchBytes(req []byte) (int, error) {
+	r := wireReader{b: req, ok: true}
+	r.skip(6) // size and API key
+	version := r.int16()
+	r.skip(4)         // correlation id
+	r.skip(r.int16()) // client id
+	if version < 3 || version > 8 {
+		return 0, fmt.Errorf("produce request v%d isn't supported", version)
+	}
+	r.skip(r.int16()) // transactional id
+	r.skip(6)         // acks and timeout
+	total := 0
+	for topics := r.int32(); topics > 0 && r.ok; topics-- {
+		r.skip(r.int16()) // topic name
+		for partitions := r.int32(); partitions > 0 && r.ok; partitions-- {
+			r.skip(4) // partition
+			size := r.int32()
+			r.skip(size)
+			if size > 0 {
+				total += size
+			}
+		}
+	}
+	if !r.ok {
+		return 0, fmt.Errorf("produce request v%d is cut short", version)
+	}
+	return total, nil
+}
+
+// wireReader reads big endian integers, and stops at the end of the buffer.
+type wireReader struct {
+	b  []byte
+	ok bool
+}
+
+func (r *wireReader) skip(n int) {
+	if n <= 0 {
+		return // null strings and records have a length of -1
+	}
+	if n > len(r.b) {
+		r.b, r.ok = nil, false
+		return
+	}
+	r.b = r.b[n:]
+}
+
+func (r *wireReader) int16() int {
+	if len(r.b) < 2 {
+		r.b, r.ok = nil, false
+		return 0
+	}
+	v := int16(binary.BigEndian.Uint16(r.b))
+	r.b = r.b[2:]
+	return int(v)
+}
+
+func (r *wireReader) int32() int {
+	if len(r.b) < 4 {
+		r.b, r.ok = nil, false
+		return 0
+	}
+	v := int32(binary.BigEndian.Uint32(r.b))
+	r.b = r.b[4:]
+	return int(v)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// countingTransport is a transport that counts the record batches written to the brokers. unknown is
+// called with produce requests we can't count.
+func countingTransport(counter prometheus.Counter, unknown func(error)) *gokafka.Transport {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: time.Minute}
+	return &gokafka.Transport{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &batchCounter{Conn: conn, counter: counter, unknown: unknown}, nil
+		},
+	}
+}
@@ -0,0 +1,164 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	is2 "github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	gokafka "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/apiversions"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseCompressionRoutes(t *testing.T) {
+	is := is2.New(t)
+	routes, err := ParseCompressionRoutes(" devices/+/telemetry=zstd, logs/#=GZIP,raw=none,")
+	is.NoErr(err)
+	is.Equal(routes, []CompressionRoute{
+		{Filter: "devices/+/telemetry", Compression: gokafka.Zstd},
+		{Filter: "logs/#", Compression: gokafka.Gzip},
+		{Filter: "raw", Compression: 0},
+	})
+	is.Equal(compressionFor(routes, gokafka.Snappy, "devices/1/telemetry"), gokafka.Zstd)
+	is.Equal(compressionFor(routes, gokafka.Snappy, "raw"), gokafka.Compression(0))
+	is.Equal(compressionFor(routes, gokafka.Snappy, "other"), gokafka.Snappy)
+	routes, err = ParseCompressionRoutes("")
+	is.NoErr(err)
+	is.Equal(len(routes), 0)
+	for _, bad := range []string{"logs/#", "logs/#=brotli", "logs/#/x=gzip"} {
+		_, err = ParseCompressionRoutes(bad)
+		is.True(err != nil) // bad spec
+	}
+	c, err := ParseCompression("lz4")
+	is.NoErr(err)
+	is.Equal(compressionName(c), "lz4")
+	is.Equal(compressionName(0), "none")
+}
+
+func TestBatchCounter(t *testing.T) {
+	is := is2.New(t)
+	records := func() protocol.RecordSet {
+		var rs []protocol.Record
+		for i := 0; i < 100; i++ {
+			rs = append(rs, protocol.Record{Value: protocol.NewBytes(bytes.Repeat([]byte("telemetry"), 100))})
+		}
+		return protocol.RecordSet{Version: 2, Attributes: protocol.Gzip, Records: protocol.NewRecordReader(rs...)}
+	}
+	rs := records()
+	var batch bytes.Buffer
+	_, err := rs.WriteTo(&batch)
+	is.NoErr(err)
+	size := batch.Len() - 4    // WriteTo starts with the size
+	is.True(size < 100*900/10) // it's gzipped
+
+	var wire bytes.Buffer
+	is.NoErr(protocol.WriteRequest(&wire, 1, 1, "test", &metadata.Request{TopicNames: []string{"mqtt"}}))
+	is.NoErr(protocol.WriteRequest(&wire, 7, 2, "test", &produce.Request{Acks: -1, Timeout: 1000, Topics: []produce.RequestTopic{
+		{Topic: "mqtt", Partitions: []produce.RequestPartition{{Partition: 0, RecordSet: records()}}},
+	}}))
+
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test"})
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() { _, _ = io.Copy(io.Discard, server) }()
+	var unknown []error
+	conn := &batchCounter{Conn: client, counter: counter, unknown: func(err error) { unknown = append(unknown, err) }}
+	// In small writes, so the requests are split at odd places.
+	for b := wire.Bytes(); len(b) > 0; b = b[min(len(b), 7):] {
+		_, err := conn.Write(b[:min(len(b), 7)])
+		is.NoErr(err)
+	}
+	is.NoErr(conn.Close())
+	// Only the record batch is counted, not the metadata request or the request headers.
+	is.Equal(testutil.ToFloat64(counter), float64(size))
+	is.Equal(len(unknown), 0)
+
+	// A version we don't know isn't counted, and is reported.
+	wire.Reset()
+	is.NoErr(protocol.WriteRequest(&wire, 2, 3, "test", &produce.Request{Acks: -1, Timeout: 1000}))
+	_, err = (&batchCounter{Conn: nopConn{}, counter: counter, unknown: func(err error) { unknown = append(unknown, err) }}).Write(wire.Bytes())
+	is.NoErr(err)
+	is.Equal(testutil.ToFloat64(counter), float64(size))
+	is.Equal(len(unknown), 1)
+	is.Equal(unknown[0].Error(), "produce request v2 isn't supported")
+}
+
+// TestBatchCounter_KafkaGo writes with kafka-go to a broker that speaks the newest protocol versions, so we
+// know the produce requests it sends are ones we can count.
+func TestBatchCounter_KafkaGo(t *testing.T) {
+	is := is2.New(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	defer ln.Close()
+	versions := make(chan int16, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fakeBroker(conn, ln.Addr().(*net.TCPAddr), versions)
+		}
+	}()
+
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test"})
+	var unknown []error
+	w := &gokafka.Writer{
+		Addr:         gokafka.TCP(ln.Addr().String()),
+		Topic:        "mqtt",
+		BatchTimeout: time.Millisecond,
+		Compression:  gokafka.Gzip,
+		Transport:    countingTransport(counter, func(err error) { unknown = append(unknown, err) }),
+	}
+	defer w.Close()
+	is.NoErr(w.WriteMessages(context.Background(), gokafka.Message{Value: bytes.Repeat([]byte("telemetry"), 100)}))
+	is.Equal(<-versions, int16(8)) // kafka-go's newest, which recordBatchBytes knows
+	is.Equal(len(unknown), 0)
+	is.True(testutil.ToFloat64(counter) > 0)
+	is.True(testutil.ToFloat64(counter) < 900) // it's gzipped
+}
+
+// fakeBroker is a single broker cluster with one partition of "mqtt". It takes every produce request,
+// and sends on the version of each.
+func fakeBroker(conn net.Conn, addr *net.TCPAddr, versions chan<- int16) {
+	defer conn.Close()
+	for {
+		version, id, _, req, err := protocol.ReadRequest(conn)
+		if err != nil {
+			return
+		}
+		var res protocol.Message
+		switch req := req.(type) {
+		case *apiversions.Request:
+			res = &apiversions.Response{ApiKeys: []apiversions.ApiKeyResponse{
+				{ApiKey: int16(protocol.Produce), MaxVersion: 9},
+				{ApiKey: int16(protocol.Metadata), MaxVersion: 12},
+				{ApiKey: int16(protocol.ApiVersions), MaxVersion: 3},
+			}}
+		case *metadata.Request:
+			res = &metadata.Response{
+				Brokers: []metadata.ResponseBroker{{Host: addr.IP.String(), Port: int32(addr.Port)}},
+				Topics:  []metadata.ResponseTopic{{Name: "mqtt", Partitions: []metadata.ResponsePartition{{}}}},
+			}
+		case *produce.Request:
+			versions <- version
+			res = &produce.Response{Topics: []produce.ResponseTopic{{Topic: req.Topics[0].Topic, Partitions: []produce.ResponsePartition{{}}}}}
+		default:
+			return
+		}
+		if err := protocol.WriteResponse(conn, version, id, res); err != nil {
+			return
+		}
+	}
+}
+
+type nopConn struct{ net.Conn }
+
+func (nopConn) Write(b []byte) (int, error) { return len(b), nil }
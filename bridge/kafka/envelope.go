@@ -0,0 +1,84 @@
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/celerway/metamorphosis/bridge/topic"
+	gokafka "github.com/segmentio/kafka-go"
+	"strings"
+)
+
+// How the payload is written in the JSON envelope, on topics with inlined JSON. Elsewhere the field is
+// left out and the payload is always base64.
+const (
+	EncodingJson   = "json"   // the payload is the JSON value in "payload"
+	EncodingBase64 = "base64" // the payload wasn't JSON, it's base64 in "content"
+)
+
+// jsonEncoder writes the JSON envelope.
+type jsonEncoder struct {
+	inline []string // topic filters where JSON payloads are inlined
+}
+
+// inlineEnvelope is the envelope on topics with inlined JSON.
+type inlineEnvelope struct {
+	Source   string          `json:"source,omitempty"`
+	Topic    string          `json:"topic"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Content  []byte          `json:"content,omitempty"`
+	Encoding string          `json:"encoding"`
+	Error    string          `json:"error,omitempty"`
+}
+
+func (e jsonEncoder) Encode(m Message) ([]byte, []gokafka.Header, error) {
+	if !e.inlines(m.Topic) {
+		value, err := json.Marshal(m)
+		return value, nil, err
+	}
+	env := inlineEnvelope{Source: m.Source, Topic: m.Topic, Error: m.Error}
+	if json.Valid(m.Content) {
+		env.Payload, env.Encoding = m.Content, EncodingJson
+	} else {
+		env.Content, env.Encoding = m.Content, EncodingBase64
+	}
+	value, err := json.Marshal(env)
+	return value, nil, err
+}
+
+func (e jsonEncoder) inlines(name string) bool {
+	for _, filter := range e.inline {
+		if topic.Match(filter, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// DecodeEnvelope decodes the JSON envelope, with or without an inlined payload.
+func DecodeEnvelope(value []byte) (Message, error) {
+	var env inlineEnvelope
+	if err := json.Unmarshal(value, &env); err != nil {
+		return Message{}, err
+	}
+	m := Message{Source: env.Source, Topic: env.Topic, Content: env.Content, Error: env.Error}
+	if env.Encoding == EncodingJson {
+		m.Content = env.Payload
+	}
+	return m, nil
+}
+
+// ParseInlineJson parses a comma separated list of topic filters.
+func ParseInlineJson(spec string) ([]string, error) {
+	var filters []string
+	for _, filter := range strings.Split(spec, ",") {
+		filter = strings.TrimSpace(filter)
+		if filter == "" {
+			continue
+		}
+		if err := topic.ValidateFilter(filter); err != nil {
+			return nil, fmt.Errorf("inline JSON: %w", err)
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
@@ -0,0 +1,42 @@
+package kafka
+
+import (
+	is2 "github.com/matryer/is"
+	"testing"
+)
+
+func TestJsonEncoder(t *testing.T) {
+	is := is2.New(t)
+	filters, err := ParseInlineJson(" devices/#, logs/+ ,")
+	is.NoErr(err)
+	is.Equal(filters, []string{"devices/#", "logs/+"})
+	_, err = ParseInlineJson("a/#/b")
+	is.True(err != nil)
+	enc := jsonEncoder{inline: filters}
+	encode := func(m Message) string {
+		value, headers, err := enc.Encode(m)
+		is.NoErr(err)
+		is.Equal(len(headers), 0)
+		return string(value)
+	}
+
+	// Elsewhere nothing changes.
+	is.Equal(encode(Message{Topic: "other", Content: []byte(`{"a":1}`)}), `{"topic":"other","content":"eyJhIjoxfQ=="}`)
+	is.Equal(encode(Message{Source: "eu", Topic: "devices/1", Content: []byte(`{"a": [1, 2.50]}`)}),
+		`{"source":"eu","topic":"devices/1","payload":{"a":[1,2.50]},"encoding":"json"}`)
+	is.Equal(encode(Message{Topic: "logs/app", Content: []byte(`"just a string"`)}),
+		`{"topic":"logs/app","payload":"just a string","encoding":"json"}`)
+	is.Equal(encode(Message{Topic: "logs/app", Content: []byte("not json")}),
+		`{"topic":"logs/app","content":"bm90IGpzb24=","encoding":"base64"}`)
+	is.Equal(encode(Message{Topic: "logs/app", Content: []byte(`{"a":1}`), Error: "bad"}),
+		`{"topic":"logs/app","payload":{"a":1},"encoding":"json","error":"bad"}`)
+
+	for _, content := range []string{`{"a":1}`, "not json", ""} {
+		for _, topic := range []string{"other", "devices/1"} {
+			m, err := DecodeEnvelope([]byte(encode(Message{Topic: topic, Content: []byte(content)})))
+			is.NoErr(err)
+			is.Equal(m.Topic, topic)
+			is.Equal(string(m.Content), content)
+		}
+	}
+}
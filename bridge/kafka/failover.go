@@ -0,0 +1,174 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	gokafka "github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const probeTimeout = 5 * time.Second
+
+// ParseBrokers parses a list of bootstrap brokers like "kafka-1:9092,kafka-2". Brokers without a port get defaultPort.
+func ParseBrokers(spec string, defaultPort int) ([]string, error) {
+	var brokers []string
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(part)
+		if err != nil {
+			// Perhaps there's no port. IPv6 addresses need brackets then.
+			host, port, err = net.SplitHostPort(part + ":" + strconv.Itoa(defaultPort))
+			if err != nil {
+				return nil, fmt.Errorf("invalid broker address '%s': %w", part, err)
+			}
+		}
+		if host == "" {
+			return nil, fmt.Errorf("invalid broker address '%s': no host", part)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return nil, fmt.Errorf("invalid broker address '%s': bad port", part)
+		}
+		brokers = append(brokers, net.JoinHostPort(host, port))
+	}
+	return brokers, nil
+}
+
+func (c cluster) String() string {
+	return [...]string{"primary", "secondary"}[c]
+}
+
+func newFailover(after, probeInterval time.Duration, probe func(ctx context.Context) error, logger *log.Entry) *failover {
+	f := &failover{
+		after:         after,
+		probeInterval: probeInterval,
+		probe:         probe,
+		gauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kafka_active_cluster",
+			Help: "The Kafka cluster we write to has the value 1",
+		}, []string{"cluster"}),
+		logger: logger,
+	}
+	f.setGauge()
+	return f
+}
+
+// current returns the cluster to write to. On the secondary it probes the primary, if it's time to.
+func (f *failover) current() cluster {
+	f.mu.Lock()
+	probe := f.active == secondaryCluster && !f.probing && time.Since(f.lastProbe) >= f.probeInterval
+	if probe {
+		f.probing = true
+		f.lastProbe = time.Now()
+	}
+	active := f.active
+	f.mu.Unlock()
+	if !probe {
+		return active
+	}
+	// Probe without holding the lock, so writers on the secondary aren't held up.
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	err := f.probe(ctx)
+	cancel()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.probing = false
+	if err != nil {
+		f.logger.Debugf("Primary Kafka cluster is still unavailable: %s", err)
+		return f.active
+	}
+	f.logger.Warn("Primary Kafka cluster is healthy again, switching back to it")
+	f.switchTo(primaryCluster)
+	return f.active
+}
+
+// result records the outcome of a write to c.
+func (f *failover) result(c cluster, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c != primaryCluster || f.active != primaryCluster {
+		return // failures on the secondary are handled by the buffer's retries. There is nowhere else to go.
+	}
+	if err == nil {
+		f.failingSince = time.Time{}
+		return
+	}
+	if f.failingSince.IsZero() {
+		f.failingSince = time.Now()
+	}
+	if time.Since(f.failingSince) >= f.after {
+		f.logger.Warnf("Writes to the primary Kafka cluster have failed for %v, switching to the secondary: %s",
+			time.Since(f.failingSince).Round(time.Second), err)
+		f.switchTo(secondaryCluster)
+	}
+}
+
+// fallBack switches to the secondary cluster at startup, when the primary can't be reached at all. The
+// primary is probed as usual, so we go back once it's up. It returns false if we're already on the secondary.
+func (f *failover) fallBack(err error) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.active == secondaryCluster {
+		return false
+	}
+	f.logger.Warnf("Primary Kafka cluster is unavailable at startup, starting on the secondary: %s", err)
+	f.switchTo(secondaryCluster)
+	return true
+}
+
+func (f *failover) switchTo(c cluster) {
+	f.active = c
+	f.failingSince = time.Time{}
+	f.lastProbe = time.Now()
+	f.setGauge()
+}
+
+func (f *failover) setGauge() {
+	for _, c := range []cluster{primaryCluster, secondaryCluster} {
+		v := 0.0
+		if c == f.active {
+			v = 1
+		}
+		f.gauge.WithLabelValues(c.String()).Set(v)
+	}
+}
+
+// Cluster returns the name of the active cluster.
+func (f *failover) Cluster() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active.String()
+}
+
+func (w failoverWriter) WriteMessages(ctx context.Context, msgs ...gokafka.Message) error {
+	c := w.f.current()
+	err := w.writers[c].WriteMessages(ctx, msgs...)
+	w.f.result(c, err)
+	if err != nil {
+		return fmt.Errorf("%s cluster: %w", c, err)
+	}
+	return nil
+}
+
+// metadataProbe checks that the cluster answers a metadata request for the topic.
+func metadataProbe(brokers []string, topic string) func(ctx context.Context) error {
+	client := &gokafka.Client{Addr: gokafka.TCP(brokers...), Timeout: probeTimeout}
+	return func(ctx context.Context) error {
+		resp, err := client.Metadata(ctx, &gokafka.MetadataRequest{Topics: []string{topic}})
+		if err != nil {
+			return err
+		}
+		if len(resp.Topics) == 0 {
+			return errors.New("no metadata for topic")
+		}
+		return resp.Topics[0].Error
+	}
+}
@@ -0,0 +1,98 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	is2 "github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseBrokers(t *testing.T) {
+	is := is2.New(t)
+	brokers, err := ParseBrokers(" kafka-1:9093, kafka-2 ,10.0.0.1,[::1]:9094,[::2],", 9092)
+	is.NoErr(err)
+	is.Equal(brokers, []string{"kafka-1:9093", "kafka-2:9092", "10.0.0.1:9092", "[::1]:9094", "[::2]:9092"})
+	brokers, err = ParseBrokers("", 9092)
+	is.NoErr(err)
+	is.Equal(len(brokers), 0)
+	for _, bad := range []string{":9092", "kafka:port", "kafka:70000", "[::1"} {
+		_, err = ParseBrokers(bad, 9092)
+		is.True(err != nil) // bad address
+	}
+}
+
+func TestFailover(t *testing.T) {
+	is := is2.New(t)
+	primary, secondary := &mockWriter{}, &mockWriter{}
+	var primaryUp int32 = 1
+	probes := int32(0)
+	probe := func(ctx context.Context) error {
+		atomic.AddInt32(&probes, 1)
+		if atomic.LoadInt32(&primaryUp) == 1 {
+			return nil
+		}
+		return errors.New("primary is down")
+	}
+	f := newFailover(50*time.Millisecond, 20*time.Millisecond, probe, logrus.WithField("module", "kafka"))
+	w := failoverWriter{writers: [2]KafkaWriter{primary, secondary}, f: f}
+	ctx := context.Background()
+	write := func() error { return w.WriteMessages(ctx, generateTestMessage(jsonEncoder{}, "t")) }
+
+	is.NoErr(write())
+	is.Equal(atomic.LoadUint64(&primary.msgs), uint64(1))
+	is.Equal(testutil.ToFloat64(f.gauge.WithLabelValues("primary")), float64(1))
+
+	// The primary fails. We stay on it until it has failed for 50ms.
+	primary.setState(true)
+	atomic.StoreInt32(&primaryUp, 0)
+	is.True(write() != nil)
+	is.Equal(f.Cluster(), "primary")
+	time.Sleep(60 * time.Millisecond)
+	is.True(write() != nil)
+	is.Equal(f.Cluster(), "secondary")
+	is.Equal(testutil.ToFloat64(f.gauge.WithLabelValues("primary")), float64(0))
+	is.Equal(testutil.ToFloat64(f.gauge.WithLabelValues("secondary")), float64(1))
+	is.NoErr(write()) // the retry goes to the secondary.
+	is.Equal(atomic.LoadUint64(&secondary.msgs), uint64(1))
+
+	// The primary is probed, but isn't back yet.
+	time.Sleep(25 * time.Millisecond)
+	is.NoErr(write())
+	is.Equal(atomic.LoadInt32(&probes), int32(1))
+	is.Equal(f.Cluster(), "secondary")
+
+	// It's back. The next write after the probe interval goes to it.
+	primary.setState(false)
+	atomic.StoreInt32(&primaryUp, 1)
+	time.Sleep(25 * time.Millisecond)
+	is.NoErr(write())
+	is.Equal(f.Cluster(), "primary")
+	is.Equal(atomic.LoadUint64(&primary.msgs), uint64(2))
+	is.Equal(atomic.LoadUint64(&secondary.msgs), uint64(2))
+}
+
+func TestFailover_Startup(t *testing.T) {
+	is := is2.New(t)
+	primary, secondary := &mockWriter{}, &mockWriter{}
+	primary.setState(true)
+	f := newFailover(time.Hour, time.Hour, func(ctx context.Context) error { return errors.New("down") },
+		logrus.WithField("module", "kafka"))
+	pl := makeTestPool(nil, 1, 0)
+	pl.failover = f
+	pl.pipelines[0].writer = failoverWriter{writers: [2]KafkaWriter{primary, secondary}, f: f}
+	cancel, wg := runPool(pl)
+	defer wg.Wait()
+	defer cancel()
+	// The primary is down, so the test message goes to the secondary, and so does everything after it.
+	pl.C <- makeMessage("t", 1)
+	for i := 0; i < 100 && atomic.LoadUint64(&secondary.msgs) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	is.Equal(atomic.LoadUint64(&secondary.msgs), uint64(2))
+	is.Equal(f.Cluster(), "secondary")
+	is.Equal(atomic.LoadUint64(&primary.msgs), uint64(0))
+}
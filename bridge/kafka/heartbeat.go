@@ -0,0 +1,108 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	gokafka "github.com/segmentio/kafka-go"
+	"sync/atomic"
+	"time"
+)
+
+// HeartbeatTopic is the MQTT topic in the envelope of heartbeat messages. MQTT clients can't publish
+// to topics starting with '$', and '#' doesn't match them, so it can't be mixed up with real traffic.
+const HeartbeatTopic = "$metamorphosis/heartbeat"
+
+// runHeartbeats writes a heartbeat every interval until the context is cancelled.
+func (pl *pool) runHeartbeats(ctx context.Context) {
+	ticker := time.NewTicker(pl.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := pl.sendHeartbeat(ctx); err != nil {
+				pl.logger.Warnf("Heartbeat: %s", err)
+			}
+		}
+	}
+}
+
+func (pl *pool) sendHeartbeat(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, heartbeatTimeout)
+	defer cancel()
+	status, err := pl.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("getting status: %w", err)
+	}
+	hb := Heartbeat{
+		Id:       pl.id,
+		Version:  pl.version,
+		Time:     time.Now(),
+		Uptime:   time.Since(pl.started).Seconds(),
+		Interval: pl.heartbeatInterval.Seconds(),
+		Buffered: status.Buffered,
+		Cluster:  status.Cluster,
+	}
+	pl.counters.take(&hb)
+	content, err := json.Marshal(hb)
+	if err != nil {
+		return fmt.Errorf("marshalling heartbeat: %w", err)
+	}
+	value, headers, err := pl.encoder.Encode(Message{Topic: HeartbeatTopic, Content: content})
+	if err != nil {
+		return fmt.Errorf("encoding heartbeat: %w", err)
+	}
+	record := gokafka.Message{Value: value, Headers: headers}
+	err = pl.heartbeatWriter.WriteMessages(ctx, record)
+	if err != nil {
+		pl.counters.putBack(hb) // so the next heartbeat covers this period too.
+		return fmt.Errorf("writing heartbeat: %w", err)
+	}
+	// The heartbeat writer uses the default compression, and its batches are counted with the rest.
+	pl.uncompressed.WithLabelValues(compressionName(pl.compression)).Add(float64(messageSize(record)))
+	pl.logger.Debugf("Heartbeat sent (received: %d, written: %d)", hb.Received, hb.Written)
+	return nil
+}
+
+// The counters are safe to use on a nil pointer, which is what buffers outside a pool have.
+
+func (c *counters) receive() {
+	if c != nil {
+		atomic.AddInt64(&c.received, 1)
+	}
+}
+
+func (c *counters) write(msgs int) {
+	if c != nil {
+		atomic.AddInt64(&c.written, int64(msgs))
+	}
+}
+
+func (c *counters) fail() {
+	if c != nil {
+		atomic.AddInt64(&c.failed, 1)
+	}
+}
+
+func (c *counters) drop() {
+	if c != nil {
+		atomic.AddInt64(&c.dropped, 1)
+	}
+}
+
+// take moves the counters to the heartbeat and resets them.
+func (c *counters) take(hb *Heartbeat) {
+	hb.Received = atomic.SwapInt64(&c.received, 0)
+	hb.Written = atomic.SwapInt64(&c.written, 0)
+	hb.FailedWrites = atomic.SwapInt64(&c.failed, 0)
+	hb.Dropped = atomic.SwapInt64(&c.dropped, 0)
+}
+
+func (c *counters) putBack(hb Heartbeat) {
+	atomic.AddInt64(&c.received, hb.Received)
+	atomic.AddInt64(&c.written, hb.Written)
+	atomic.AddInt64(&c.failed, hb.FailedWrites)
+	atomic.AddInt64(&c.dropped, hb.Dropped)
+}
@@ -0,0 +1,82 @@
+package kafka
+
+import (
+	"encoding/json"
+	is2 "github.com/matryer/is"
+	"testing"
+	"time"
+)
+
+// heartbeats decodes the heartbeats written so far.
+func heartbeats(t *testing.T, writer *mockWriter) []Heartbeat {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	var out []Heartbeat
+	for _, r := range writer.storage {
+		var msg Message
+		if err := json.Unmarshal(r.Value, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Topic != HeartbeatTopic {
+			t.Fatalf("unexpected topic '%s' among the heartbeats", msg.Topic)
+		}
+		var hb Heartbeat
+		if err := json.Unmarshal(msg.Content, &hb); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, hb)
+	}
+	return out
+}
+
+// waitForTotals waits until the heartbeats have accounted for received and written messages.
+func waitForTotals(t *testing.T, writer *mockWriter, received, written int64) []Heartbeat {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		hbs := heartbeats(t, writer)
+		var r, w int64
+		for _, hb := range hbs {
+			r += hb.Received
+			w += hb.Written
+		}
+		if r == received && w == written {
+			return hbs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("heartbeats have %d received and %d written, expected %d and %d", r, w, received, written)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPool_Heartbeat(t *testing.T) {
+	is := is2.New(t)
+	writer, hbWriter := &mockWriter{}, &mockWriter{}
+	pl := makeTestPool(writer, 2, 0)
+	pl.testMessage = false
+	pl.heartbeatInterval = 10 * time.Millisecond
+	pl.heartbeatWriter = hbWriter
+	pl.id, pl.version = "bridge-1", "v1.2.3"
+	cancel, wg := runPool(pl)
+	defer wg.Wait()
+	defer cancel()
+	for i := 0; i < 10; i++ {
+		pl.C <- makeMessage("t", i)
+	}
+	hbs := waitForTotals(t, hbWriter, 10, 10)
+	hb := hbs[len(hbs)-1]
+	is.Equal(hb.Id, "bridge-1")
+	is.Equal(hb.Version, "v1.2.3")
+	is.Equal(hb.Interval, 0.01)
+	is.True(hb.Uptime > 0)
+	is.Equal(seqByTopic(t, writer, false)["test"], []string(nil)) // the test message is turned off
+
+	// A failed heartbeat doesn't lose the counts, the next one has them.
+	hbWriter.setState(true)
+	for i := 10; i < 15; i++ {
+		pl.C <- makeMessage("t", i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	hbWriter.setState(false)
+	waitForTotals(t, hbWriter, 15, 15)
+}
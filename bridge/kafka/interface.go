@@ -8,3 +8,14 @@ import (
 type KafkaWriter interface {
 	WriteMessages(ctx context.Context, msgs ...gokafka.Message) error
 }
+
+// Encoder turns a message into the value and headers of a Kafka record. The default writes the JSON envelope.
+type Encoder interface {
+	Encode(m Message) (value []byte, headers []gokafka.Header, err error)
+}
+
+// topicAdmin is the part of the kafka-go client used to check and create topics.
+type topicAdmin interface {
+	Metadata(ctx context.Context, req *gokafka.MetadataRequest) (*gokafka.MetadataResponse, error)
+	CreateTopics(ctx context.Context, req *gokafka.CreateTopicsRequest) (*gokafka.CreateTopicsResponse, error)
+}
@@ -2,98 +2,253 @@ package kafka
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"github.com/celerway/metamorphosis/bridge/logging"
 	"github.com/celerway/metamorphosis/bridge/observability"
+	"github.com/celerway/metamorphosis/bridge/tracing"
+	"github.com/prometheus/client_golang/prometheus"
 	gokafka "github.com/segmentio/kafka-go"
 	log "github.com/sirupsen/logrus"
-	"strconv"
+	"sync"
 	"time"
 )
 
-func Initialize(p Params) *buffer {
-	logger := log.WithFields(log.Fields{"module": "kafka"})
-	brokerAddr := gokafka.TCP(p.Broker + ":" + strconv.FormatInt(int64(p.Port), 10))
-	writer := &gokafka.Writer{
-		Addr:         brokerAddr,
-		Topic:        p.Topic,
-		MaxAttempts:  10,
-		BatchSize:    1,
-		BatchTimeout: time.Millisecond * 20, // Just a really low timeout so the batch is written more or less right away.
-		RequiredAcks: gokafka.RequireAll,
-		Async:        false,
-		Compression:  0,
-		Logger:       nil,
-		ErrorLogger:  logger,
+// Initialize sets up the pipelines that write to Kafka. Call Run to start them.
+func Initialize(p Params) *pool {
+	logger := logging.Module("kafka")
+	if p.Workers < 1 {
+		p.Workers = 1
 	}
+	var fo *failover
+	if len(p.SecondaryBrokers) > 0 && p.Writer == nil {
+		fo = newFailover(p.FailoverAfter, p.RetryInterval, metadataProbe(p.Brokers, p.Topic), logger)
+	}
+	// If kafka-go sends produce requests we don't know, the compressed bytes aren't counted. Say so, once.
+	var unknownOnce sync.Once
+	unknownRequest := func(err error) {
+		unknownOnce.Do(func() {
+			logger.Warnf("Can't count the compressed bytes written to Kafka, %s. kafka_bytes_compressed will be short.", err)
+		})
+	}
+	newClusterWriter := func(brokers []string, topic string, compression gokafka.Compression, wire prometheus.Counter) KafkaWriter {
+		kw := &gokafka.Writer{
+			Addr:         gokafka.TCP(brokers...),
+			Topic:        topic,
+			MaxAttempts:  10,
+			BatchSize:    p.MaxBatchSize,        // we do our own batching, so each write should be a single request.
+			BatchTimeout: time.Millisecond * 20, // Just a really low timeout so the batch is written more or less right away.
+			RequiredAcks: gokafka.RequireAll,
+			Async:        false,
+			Compression:  compression,
+			Transport:    countingTransport(wire, unknownRequest),
+			Logger:       nil,
+			ErrorLogger:  logger,
+			// Brokers with auto.create.topics.enable create missing topics when we write, if we let them.
+			AllowAutoTopicCreation: true,
+		}
+		if p.Workers > 1 {
+			kw.Balancer = &gokafka.Hash{} // records are keyed, keep each key on one partition.
+		}
+		return kw
+	}
+	newWriter := func(topic string, compression gokafka.Compression, wire prometheus.Counter) KafkaWriter {
+		if p.Writer != nil {
+			return p.Writer
+		}
+		primary := newClusterWriter(p.Brokers, topic, compression, wire)
+		if fo == nil {
+			return primary
+		}
+		return failoverWriter{
+			writers: [2]KafkaWriter{primary, newClusterWriter(p.SecondaryBrokers, topic, compression, wire)},
+			f:       fo,
+		}
+	}
+	// Compression is set per writer, so each compression in use gets its own writer and pipelines.
+	pl := newPool(p, func(compression gokafka.Compression, wire prometheus.Counter) KafkaWriter {
+		return newWriter(p.Topic, compression, wire)
+	})
+	pl.failover = fo
+	topics := []string{p.Topic}
+	if p.HeartbeatInterval > 0 {
+		pl.heartbeatWriter = pl.pipelines[0].writer
+		if p.HeartbeatTopic != "" && p.HeartbeatTopic != p.Topic {
+			pl.heartbeatWriter = newWriter(p.HeartbeatTopic, p.Compression,
+				pl.compressed.WithLabelValues(compressionName(p.Compression)))
+			topics = append(topics, p.HeartbeatTopic)
+		}
+	}
+	// Dead letters and quarantined messages go to topics of their own, each with one more pipeline. So
+	// they're started, flushed and reported on with the others.
+	sidePipeline := func(topic, name string) *buffer {
+		if topic == "" || topic == p.Topic {
+			return nil
+		}
+		writer := newWriter(topic, p.Compression, pl.compressed.WithLabelValues(compressionName(p.Compression)))
+		channelSize := p.ChannelSize
+		if channelSize <= 0 {
+			channelSize = pipelineChannelSize
+		}
+		b := newBuffer(p, writer, make(MessageChan, channelSize), logger.WithField("pipeline", name))
+		b.topic = topic
+		b.compression = p.Compression
+		b.uncompressedBytes = pl.uncompressed.WithLabelValues(compressionName(p.Compression))
+		b.counters = pl.counters
+		pl.pipelines = append(pl.pipelines, b)
+		topics = append(topics, topic)
+		return b
+	}
+	pl.deadLetter = sidePipeline(p.DeadLetterTopic, "dead-letter")
+	pl.quarantine = sidePipeline(p.QuarantineTopic, "quarantine")
+	if p.Writer == nil && p.TopicSettings.Check != TopicCheckOff {
+		pl.preflight = func(ctx context.Context) error {
+			primary := &gokafka.Client{Addr: gokafka.TCP(p.Brokers...), Timeout: probeTimeout}
+			var secondary topicAdmin // a nil *gokafka.Client wouldn't be a nil topicAdmin.
+			if fo != nil {
+				secondary = &gokafka.Client{Addr: gokafka.TCP(p.SecondaryBrokers...), Timeout: probeTimeout}
+			}
+			return preflight(ctx, primary, secondary, fo, topics, p.TopicSettings, logger)
+		}
+	}
+	return pl
+}
+
+// newBuffer creates a single pipeline reading from ch.
+func newBuffer(p Params, writer KafkaWriter, ch MessageChan, logger *log.Entry) *buffer {
 	return &buffer{
 		batchSize:            p.BatchSize,
+		topic:                p.Topic,
 		interval:             p.Interval,
 		failureState:         false,
 		failureRetryInterval: p.RetryInterval,
-		C:                    p.Channel,
+		C:                    ch,
 		buffer:               make([]gokafka.Message, 0, p.BatchSize), // default is to have buffer for a full batch.
 		writer:               writer,
 		maxBatchSize:         p.MaxBatchSize,
+		batchBytes:           p.BatchBytes,
+		maxRequestBytes:      p.MaxRequestBytes,
+		maxInFlight:          p.MaxInFlight,
+		keyed:                p.Workers > 1,
 		kafkaTimeout:         time.Second * 10, // 10s timeout when takling to kafka.,
 		logger:               logger,
 		obsChannel:           p.ObsChannel,
 		testMessageTopic:     p.TestMessageTopic,
+		requests:             make(chan func()),
+		tracer:               p.Tracer,
+		encoder:              encoderFor(p),
 	}
 }
 
+// encoderFor returns p.Encoder, or the JSON envelope if there is none.
+func encoderFor(p Params) Encoder {
+	if p.Encoder == nil {
+		return jsonEncoder{inline: p.InlineJson}
+	}
+	return p.Encoder
+}
+
 // Run starts monitoring the channel and sends messages to the broker.
 func (k *buffer) Run(ctx context.Context) error {
 	err := k.sendTestMessage()
 	if err != nil {
 		return fmt.Errorf("failed to send initial test message: %w", err)
 	}
-	ticker := time.NewTicker(k.interval)
-	k.logger.Infof("Kafka interface started with write interval %v and batch size %d", k.interval, k.batchSize)
+	k.run(ctx)
+	return nil
+}
+
+// run is the main loop of the buffer. When the context is cancelled whatever is left in the
+// channel is picked up before the final flush.
+func (k *buffer) run(ctx context.Context) {
+	ticker := time.NewTicker(tickInterval(k.interval))
+	k.logger.Infof("Kafka interface started with linger %v, batch size %d and batch bytes %d",
+		k.interval, k.batchSize, k.batchBytes)
 loop:
 	for {
+		in := k.C
+		if k.maxInFlight > 0 && len(k.buffer) >= k.maxInFlight {
+			in = nil // full. Stop reading until we've written something, which pushes back on the sender.
+		}
 		select {
 		case <-ctx.Done():
 			k.logger.Info("context cancelled")
 			break loop
 		case <-ticker.C:
-			if time.Since(k.lastSendAttempt) > k.interval {
+			if len(k.buffer) > 0 && time.Since(k.oldest) >= k.interval {
 				k.Send(false)
 			}
-		case m := <-k.C:
-			k.logger.Trace("Message received")
+		case m := <-in:
+			if k.traceSampler.Sample() {
+				k.logger.Trace("Message received")
+			}
 			k.Enqueue(m)
+		case f := <-k.requests:
+			f()
 		}
 	}
 	ticker.Stop()
+drain:
+	for {
+		select {
+		case m := <-k.C:
+			k.Enqueue(m)
+		default:
+			break drain
+		}
+	}
 	k.logger.Info("Final flush of the buffer")
 	k.Send(true)
-	return nil
 }
 
 // Enqueue adds a message to the buffer
 // It'll transform it from the Message type (used by MQTT) to what Kafka expects.
 // if the number of enqueued messages is greater than the batch size, it'll send them.
 func (k *buffer) Enqueue(msg Message) {
-	msgJson, err := json.Marshal(msg)
+	value, headers, err := k.encoder.Encode(msg)
 	if err != nil {
-		// todo: Log the error. There is nothing else we can do here.
+		// There is nothing else we can do with it.
+		k.logger.Errorf("Dropping message on topic '%s': encoding: %s", msg.Topic, err)
+		k.counters.drop()
 		return
 	}
 	m := gokafka.Message{
-		Value: msgJson,
+		Value:   value,
+		Headers: headers,
+	}
+	if k.keyed {
+		m.Key = []byte(msg.key())
+	}
+	if msg.Trace.IsValid() {
+		// The parent of the produce span. It's replaced by the produce span when the message is written.
+		m.Headers = append(m.Headers, gokafka.Header{Key: tracing.TraceparentHeader, Value: []byte(msg.Trace.Traceparent())})
+	}
+	size := messageSize(m)
+	if k.maxRequestBytes > 0 && size > k.maxRequestBytes {
+		// Kafka would reject it, and retrying it forever would block everything behind it.
+		k.logger.Errorf("Dropping message on topic '%s': %d bytes is more than the max request size (%d)",
+			msg.Topic, size, k.maxRequestBytes)
+		k.obsChannel <- observability.KafkaOversize
+		k.counters.drop()
+		return
+	}
+	if len(k.buffer) == 0 {
+		k.oldest = time.Now()
 	}
 	k.buffer = append(k.buffer, m)
-	if len(k.buffer) >= k.batchSize {
+	k.bufferedBytes += size
+	if len(k.buffer) >= k.batchSize || (k.batchBytes > 0 && k.bufferedBytes >= k.batchBytes) {
 		if k.failureState {
 			// Not triggering flush if we're failing.
 			return
 		}
-		k.logger.Debugf("Triggering flush (buffer is %d, batchSize is %d)", len(k.buffer), k.batchSize)
+		k.logger.Debugf("Triggering flush (buffer is %d msgs/%d bytes, batch size is %d msgs/%d bytes)",
+			len(k.buffer), k.bufferedBytes, k.batchSize, k.batchBytes)
 		k.Send(false)
 		return
 	}
-	k.logger.Tracef("current buffer contains %d messages", len(k.buffer))
+	if k.traceSampler.Sample() {
+		k.logger.Tracef("current buffer contains %d messages", len(k.buffer))
+	}
 }
 
 // Send will send all messages in the buffer to the gokafka broker
@@ -116,7 +271,7 @@ func (k *buffer) Send(force bool) {
 	var err error
 	start := time.Now()
 	msgs := len(k.buffer)
-	if msgs <= k.maxBatchSize {
+	if k.batchLen(k.buffer) == msgs {
 		err = k.sendAll()
 	} else {
 		err = k.sendBatched()
@@ -126,8 +281,10 @@ func (k *buffer) Send(force bool) {
 		k.logger.Warnf("Send: %s (buffered msgs: %d time taken: %v, failures: %d)",
 			err, msgs, time.Since(start), k.failures)
 		k.failureState = true
+		k.lastError = err
 		return
 	}
+	k.lastSuccess = time.Now()
 	k.logger.Debugf("Send: Wrote %d messages in %v [cur buffer: %d]", msgs, time.Since(start), len(k.buffer))
 	k.failureState = false
 	k.updateLastSendAttempt()
@@ -139,52 +296,129 @@ func (k *buffer) sendAll() error {
 	ctx, cancel := context.WithTimeout(context.Background(), k.kafkaTimeout)
 	defer cancel()
 
-	err := k.writer.WriteMessages(ctx, k.buffer...)
+	err := k.write(ctx, k.buffer)
 	if err != nil {
 		k.obsChannel <- observability.KafkaError
+		k.counters.fail()
 		return err
 	}
 	k.obsChannel <- observability.KafkaSent
+	k.countWritten(len(k.buffer), k.bufferedBytes)
 	k.buffer = k.buffer[:0]
+	k.bufferedBytes = 0
 	return nil
 }
 
-// sendBatched sends messages in batches of maxBatchSize.
+// sendBatched sends messages in batches of at most maxBatchSize messages and maxRequestBytes bytes.
+// Each batch gets its own timeout. We stop at the first failure, the rest is retried later.
 func (k *buffer) sendBatched() error {
-	l := len(k.buffer)
-	k.logger.Debugf("Sending all (%d) messages in batches", l)
-	batches := l / k.maxBatchSize
-	timeout := k.kafkaTimeout * time.Duration(batches)
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+	k.logger.Debugf("Sending all (%d) messages in batches", len(k.buffer))
 	batch := 0
-	for {
+	for len(k.buffer) > 0 {
 		batch++
-		k.logger.Debug("attempting to send batch:", batch)
-		l := len(k.buffer)
-		if l == 0 {
+		n := k.batchLen(k.buffer)
+		k.logger.Debugf("attempting to send batch %d (%d messages)", batch, n)
+		ctx, cancel := context.WithTimeout(context.Background(), k.kafkaTimeout)
+		err := k.write(ctx, k.buffer[:n])
+		cancel()
+		if err != nil {
+			k.obsChannel <- observability.KafkaError
+			k.counters.fail()
+			return fmt.Errorf("error batch %d: %w", batch, err)
+		}
+		written := 0
+		for _, m := range k.buffer[:n] {
+			written += messageSize(m)
+		}
+		k.bufferedBytes -= written
+		k.countWritten(n, written)
+		k.buffer = k.buffer[n:] // remove the batch from the buffer.
+		k.obsChannel <- observability.KafkaSent
+	}
+	k.buffer = k.buffer[:0]
+	k.bufferedBytes = 0
+	return nil
+}
+
+// batchLen returns how many of msgs fit in one request. It's always at least one.
+func (k *buffer) batchLen(msgs []gokafka.Message) int {
+	n, size := 0, 0
+	for n < len(msgs) && (k.maxBatchSize <= 0 || n < k.maxBatchSize) {
+		size += messageSize(msgs[n])
+		if n > 0 && k.maxRequestBytes > 0 && size > k.maxRequestBytes {
 			break
 		}
-		if l < k.maxBatchSize {
-			err := k.writer.WriteMessages(ctx, k.buffer...)
-			if err != nil {
-				k.obsChannel <- observability.KafkaError
-				return fmt.Errorf("error batch %d", batch)
+		n++
+	}
+	return n
+}
+
+func (k *buffer) countWritten(msgs, bytes int) {
+	k.counters.write(msgs)
+	if k.uncompressedBytes != nil {
+		k.uncompressedBytes.Add(float64(bytes))
+	}
+}
+
+// messageSize is roughly the size of the record on the wire.
+func messageSize(m gokafka.Message) int {
+	size := len(m.Key) + len(m.Value)
+	for _, h := range m.Headers {
+		size += len(h.Key) + len(h.Value)
+	}
+	return size
+}
+
+// tickInterval is how often we check if the oldest message has lingered long enough.
+func tickInterval(linger time.Duration) time.Duration {
+	tick := linger / 4
+	if tick < time.Millisecond {
+		tick = time.Millisecond
+	}
+	if tick > time.Second {
+		tick = time.Second
+	}
+	return tick
+}
+
+// write writes the messages to Kafka, wrapped in produce spans if tracing is enabled.
+func (k *buffer) write(ctx context.Context, msgs []gokafka.Message) error {
+	spans := k.startProduceSpans(msgs)
+	err := k.writer.WriteMessages(ctx, msgs...)
+	for _, span := range spans {
+		span.SetError(err)
+		span.End()
+	}
+	return err
+}
+
+// startProduceSpans starts a span for each traced message and replaces the traceparent header with
+// the context of the produce span, so consumers continue the trace from here. On a retry the
+// new span becomes a child of the one that failed.
+func (k *buffer) startProduceSpans(msgs []gokafka.Message) []*tracing.Span {
+	if k.tracer == nil {
+		return nil
+	}
+	spans := make([]*tracing.Span, 0, len(msgs))
+	for i := range msgs {
+		for j, h := range msgs[i].Headers {
+			if h.Key != tracing.TraceparentHeader {
+				continue
 			}
-			k.buffer = k.buffer[:0] // done. clear the buffer.
-			k.obsChannel <- observability.KafkaSent
-			break
-		} else {
-			err := k.writer.WriteMessages(ctx, k.buffer[:k.maxBatchSize]...)
+			parent, err := tracing.ParseTraceparent(string(h.Value))
 			if err != nil {
-				k.obsChannel <- observability.KafkaError
-				return err
+				break
 			}
-			k.buffer = k.buffer[k.maxBatchSize:] // remove the first k.maxBatchSize messages from the buffer.
-			k.obsChannel <- observability.KafkaSent
+			span := k.tracer.Start(parent, "kafka produce", tracing.KindProducer)
+			span.SetAttribute("messaging.system", "kafka")
+			span.SetAttribute("messaging.destination.name", k.topic)
+			span.SetAttribute("messaging.batch.message_count", len(msgs))
+			msgs[i].Headers[j].Value = []byte(span.Context().Traceparent())
+			spans = append(spans, span)
+			break
 		}
 	}
-	return nil
+	return spans
 }
 
 // sendTestMessage sends a test message with the mqtt topic "test" (can be overridden using ENV).
@@ -192,29 +426,79 @@ func (k *buffer) sendBatched() error {
 func (k *buffer) sendTestMessage() error {
 	ctx, cancel := context.WithTimeout(context.Background(), k.kafkaTimeout)
 	defer cancel()
-	err := k.writer.WriteMessages(ctx, generateTestMessage(k.testMessageTopic))
+	msg := generateTestMessage(k.encoder, k.testMessageTopic)
+	err := k.writer.WriteMessages(ctx, msg)
 	if err != nil {
 		return fmt.Errorf("error sending test message on topic '%s': %w", k.testMessageTopic, err)
 	}
+	if k.uncompressedBytes != nil {
+		k.uncompressedBytes.Add(float64(messageSize(msg)))
+	}
+	return nil
+}
+
+// Status returns a snapshot of the state of the buffer. The buffer must be running.
+func (k *buffer) Status(ctx context.Context) (Status, error) {
+	var status Status
+	err := k.do(ctx, func() {
+		status = Status{
+			Buffered:        len(k.buffer),
+			FailureState:    k.failureState,
+			Failures:        k.failures,
+			LastSuccess:     k.lastSuccess,
+			LastSendAttempt: k.lastSendAttempt,
+		}
+		if k.lastError != nil {
+			status.LastError = k.lastError.Error()
+		}
+	})
+	return status, err
+}
+
+// Flush forces a send of the buffer, even if we're in a failed state and it isn't time to retry yet.
+func (k *buffer) Flush(ctx context.Context) error {
+	var err error
+	doErr := k.do(ctx, func() {
+		k.Send(true)
+		if k.failureState {
+			err = k.lastError
+		}
+	})
+	if doErr != nil {
+		return doErr
+	}
 	return err
 }
 
+// do runs f on the goroutine running the buffer and waits for it to complete.
+func (k *buffer) do(ctx context.Context, f func()) error {
+	done := make(chan struct{})
+	select {
+	case k.requests <- func() { f(); close(done) }:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-done
+	return nil
+}
+
 func (k *buffer) updateLastSendAttempt() {
 	k.lastSendAttempt = time.Now()
 }
 
-func generateTestMessage(topic string) gokafka.Message {
+func generateTestMessage(enc Encoder, topic string) gokafka.Message {
 	msg := Message{
 		Topic:   topic,
 		Content: []byte("Internal test to see if kafka is alive at startup"),
 	}
-	msgJson, err := json.Marshal(msg)
+	value, headers, err := enc.Encode(msg)
 	if err != nil {
 		// something is very wrong. bail out.
 		log.Fatalf("mashalling test message: %s", err)
 	}
 	testMsg := gokafka.Message{
-		Value: msgJson,
+		Value:   value,
+		Headers: headers,
 	}
 	return testMsg
 }
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	log "github.com/celerway/chainsaw"
 	"github.com/celerway/metamorphosis/bridge/observability"
+	"github.com/celerway/metamorphosis/bridge/tracing"
 	is2 "github.com/matryer/is"
 	"github.com/segmentio/kafka-go"
 	logrus "github.com/sirupsen/logrus"
@@ -30,13 +31,17 @@ type mockWriter struct {
 
 func (m *mockWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	deadlock, delay := m.deadlock, m.batchDelay+m.msgDelay*time.Duration(len(msgs))
+	m.mu.Unlock()
 	// if deadlock, block until context is cancelled
-	if m.deadlock {
+	if deadlock {
 		log.Warn("writer is deadlocked")
 		<-ctx.Done()
 	}
-	time.Sleep(m.batchDelay + m.msgDelay*time.Duration(len(msgs)))
+	// Sleep without holding the lock, so concurrent writes overlap like they would against a cluster.
+	time.Sleep(delay)
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.failed {
 		return errors.New("storage is in a failed state")
 	}
@@ -162,6 +167,8 @@ func makeTestBuffer(writer *mockWriter) buffer {
 		logger:               logrus.WithFields(logrus.Fields{"module": "kafka", "instance": "test"}),
 		obsChannel:           obsChannel,
 		testMessageTopic:     "test",
+		requests:             make(chan func()),
+		encoder:              jsonEncoder{},
 	}
 }
 
@@ -483,6 +490,69 @@ func TestBuffer_Batching_RecoveryInterrupted(t *testing.T) {
 
 }
 
+// Fail the storage, check that the status reflects it and that a forced flush gets the messages through.
+func TestBuffer_StatusFlush(t *testing.T) {
+	is := is2.New(t)
+	storage := &mockWriter{}
+	buffer := makeTestBuffer(storage)
+	defer close(buffer.obsChannel)
+	buffer.failureRetryInterval = time.Hour // only a forced flush will retry.
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := buffer.Run(ctx)
+		if err != nil {
+			log.Errorf("Error %s", err)
+		}
+	}()
+	is.NoErr(waitForAtomic(&storage.msgs, 1, time.Second, time.Millisecond)) // the test message
+	storage.setState(true)
+	for i := 0; i < 10; i++ {
+		buffer.C <- makeMessage("test", i)
+	}
+	status, err := buffer.Status(ctx)
+	is.NoErr(err)
+	is.True(status.FailureState)
+	is.Equal(status.Buffered, 10)
+	is.True(status.LastError != "")
+	is.True(buffer.Flush(ctx) != nil) // still failing
+	storage.setState(false)
+	is.NoErr(buffer.Flush(ctx))
+	status, err = buffer.Status(ctx)
+	is.NoErr(err)
+	is.True(!status.FailureState)
+	is.Equal(status.Buffered, 0)
+	is.Equal(atomic.LoadUint64(&storage.msgs), uint64(11))
+	cancel()
+	wg.Wait()
+}
+
+// Traced messages get a traceparent header that continues the trace from the produce span.
+func TestBuffer_TraceHeaders(t *testing.T) {
+	is := is2.New(t)
+	storage := &mockWriter{}
+	buffer := makeTestBuffer(storage)
+	defer close(buffer.obsChannel)
+	tracer, err := tracing.Initialize(tracing.Params{Endpoint: "http://localhost:4318", SampleRatio: 1})
+	is.NoErr(err)
+	buffer.tracer = tracer
+	parent := tracer.Start(tracing.SpanContext{}, "bridge", tracing.KindInternal).Context()
+	traced := makeMessage("test", 1)
+	traced.Trace = parent
+	buffer.Enqueue(traced)
+	buffer.Enqueue(makeMessage("test", 2))
+	buffer.Send(true)
+	is.Equal(len(storage.storage), 2)
+	is.Equal(len(storage.storage[0].Headers), 1)
+	is.Equal(len(storage.storage[1].Headers), 0) // not traced
+	sc, err := tracing.ParseTraceparent(string(storage.storage[0].Headers[0].Value))
+	is.NoErr(err)
+	is.Equal(sc.TraceID, parent.TraceID)
+	is.True(sc.SpanID != parent.SpanID)
+}
+
 func makeMessage(topic string, id int) Message {
 	return Message{
 		Topic:   topic,
@@ -499,3 +569,72 @@ func dumpLogs() {
 	fmt.Println("====== end of dump ======")
 
 }
+
+func TestBuffer_BatchBytes(t *testing.T) {
+	is := is2.New(t)
+	storage := &mockWriter{}
+	buffer := makeTestBuffer(storage)
+	defer close(buffer.obsChannel)
+	buffer.batchSize = 1000
+	buffer.Enqueue(makeMessage("test", 1))
+	size := buffer.bufferedBytes
+	is.True(size > 0)
+	buffer.batchBytes = 3 * size
+	buffer.Enqueue(makeMessage("test", 2))
+	is.Equal(atomic.LoadUint64(&storage.writes), uint64(0))
+	buffer.Enqueue(makeMessage("test", 3)) // hits batchBytes
+	is.Equal(atomic.LoadUint64(&storage.writes), uint64(1))
+	is.Equal(atomic.LoadUint64(&storage.msgs), uint64(3))
+	is.Equal(buffer.bufferedBytes, 0)
+}
+
+func TestBuffer_SplitByRequestBytes(t *testing.T) {
+	is := is2.New(t)
+	storage := &mockWriter{}
+	buffer := makeTestBuffer(storage)
+	defer close(buffer.obsChannel)
+	buffer.batchSize = 1000
+	one := messageSize(gokafkaMessage(t, makeMessage("test", 1)))
+	buffer.maxRequestBytes = one*2 + one/2 // two messages per request.
+	for i := 1; i <= 5; i++ {
+		buffer.Enqueue(makeMessage("test", i))
+	}
+	buffer.Send(true)
+	is.Equal(atomic.LoadUint64(&storage.writes), uint64(3)) // 2 + 2 + 1
+	is.Equal(atomic.LoadUint64(&storage.msgs), uint64(5))
+	is.Equal(len(buffer.buffer), 0)
+	is.Equal(buffer.bufferedBytes, 0)
+	// A message which can't fit in a request is dropped.
+	big := makeMessage("test", 6)
+	big.Content = make([]byte, buffer.maxRequestBytes)
+	buffer.Enqueue(big)
+	is.Equal(len(buffer.buffer), 0)
+}
+
+func TestBuffer_Linger(t *testing.T) {
+	is := is2.New(t)
+	storage := &mockWriter{}
+	buffer := makeTestBuffer(storage)
+	defer close(buffer.obsChannel)
+	buffer.batchSize = 1000
+	buffer.interval = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = buffer.Run(ctx) }()
+	is.NoErr(waitForAtomic(&storage.msgs, 1, time.Second, time.Millisecond)) // test message
+	start := time.Now()
+	buffer.C <- makeMessage("test", 1)
+	is.NoErr(waitForAtomic(&storage.msgs, 2, time.Second, time.Millisecond))
+	waited := time.Since(start)
+	is.True(waited >= 50*time.Millisecond)
+	is.True(waited < 200*time.Millisecond) // the linger is measured from the message, not a coarse tick.
+}
+
+// gokafkaMessage is what Enqueue turns msg into.
+func gokafkaMessage(t *testing.T, msg Message) kafka.Message {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kafka.Message{Value: b}
+}
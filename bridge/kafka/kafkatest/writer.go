@@ -0,0 +1,130 @@
+// Package kafkatest provides a Kafka writer for tests. It records the produced records and can
+// be told to fail or be slow, so outages can be rehearsed without a Kafka cluster.
+package kafkatest
+
+import (
+	"context"
+	"errors"
+	"github.com/celerway/metamorphosis/bridge/kafka"
+	gokafka "github.com/segmentio/kafka-go"
+	"sync"
+	"time"
+)
+
+// ErrUnavailable is returned from WriteMessages while the writer is failing.
+var ErrUnavailable = errors.New("kafkatest: cluster unavailable")
+
+// Writer implements kafka.KafkaWriter.
+type Writer struct {
+	mu       sync.Mutex
+	records  []gokafka.Message
+	writes   int
+	failures int
+	failing  bool
+	latency  time.Duration
+	notify   chan struct{}
+}
+
+func NewWriter() *Writer {
+	return &Writer{notify: make(chan struct{})}
+}
+
+// WriteMessages records the messages, unless the writer is failing. Latency is applied before
+// the failure check, like a slow cluster which then times out.
+func (w *Writer) WriteMessages(ctx context.Context, msgs ...gokafka.Message) error {
+	w.mu.Lock()
+	latency := w.latency
+	w.mu.Unlock()
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	defer w.wakeUp()
+	if w.failing {
+		w.failures++
+		return ErrUnavailable
+	}
+	now := time.Now()
+	for _, msg := range msgs {
+		if msg.Time.IsZero() {
+			msg.Time = now
+		}
+		msg.Offset = int64(len(w.records))
+		w.records = append(w.records, msg)
+	}
+	w.writes++
+	return nil
+}
+
+// wakeUp wakes up everyone in WaitFor. Must be called with the lock held.
+func (w *Writer) wakeUp() {
+	close(w.notify)
+	w.notify = make(chan struct{})
+}
+
+// SetFailing makes every write fail until it's called with false.
+func (w *Writer) SetFailing(failing bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.failing = failing
+}
+
+// SetLatency delays every write.
+func (w *Writer) SetLatency(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.latency = d
+}
+
+// Records returns the records written so far, oldest first.
+func (w *Writer) Records() []gokafka.Message {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]gokafka.Message(nil), w.records...)
+}
+
+// Writes returns the number of successful and failed calls to WriteMessages.
+func (w *Writer) Writes() (int, int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writes, w.failures
+}
+
+// Messages decodes the envelopes written by the bridge. Test messages are included.
+func (w *Writer) Messages() ([]kafka.Message, error) {
+	records := w.Records()
+	msgs := make([]kafka.Message, 0, len(records))
+	for _, r := range records {
+		msg, err := kafka.DecodeEnvelope(r.Value)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// WaitFor blocks until cond returns true for the records written so far, or the timeout expires.
+// cond is checked after every write, failed or not.
+func (w *Writer) WaitFor(timeout time.Duration, cond func(records []gokafka.Message) bool) bool {
+	deadline := time.After(timeout)
+	for {
+		w.mu.Lock()
+		records := append([]gokafka.Message(nil), w.records...)
+		notify := w.notify
+		w.mu.Unlock()
+		if cond(records) {
+			return true
+		}
+		select {
+		case <-notify:
+		case <-deadline:
+			return false
+		}
+	}
+}
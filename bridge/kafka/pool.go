@@ -0,0 +1,267 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"github.com/celerway/metamorphosis/bridge/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	gokafka "github.com/segmentio/kafka-go"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	pipelineChannelSize = 100 // unless Params.ChannelSize is set
+	preflightTimeout    = 30 * time.Second
+	heartbeatTimeout    = 10 * time.Second
+)
+
+func newPool(p Params, newWriter func(gokafka.Compression, prometheus.Counter) KafkaWriter) *pool {
+	logger := logging.Module("kafka")
+	pl := &pool{
+		C:           p.Channel,
+		groups:      make(map[gokafka.Compression][]*buffer),
+		routes:      p.CompressionRoutes,
+		compression: p.Compression,
+		uncompressed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kafka_bytes_uncompressed",
+			Help: "Bytes of Kafka records written, before compression",
+		}, []string{"compression"}),
+		compressed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kafka_bytes_compressed",
+			Help: "Bytes of Kafka record batches written, after compression",
+		}, []string{"compression"}),
+		testMessage:       !p.NoTestMessage,
+		counters:          &counters{},
+		id:                p.Id,
+		version:           p.Version,
+		heartbeatInterval: p.HeartbeatInterval,
+		encoder:           encoderFor(p),
+		logger:            logger,
+	}
+	// The default compression goes first, so pipeline 0 is a default one.
+	channelSize := p.ChannelSize
+	if channelSize <= 0 {
+		channelSize = pipelineChannelSize
+	}
+	compressions := []gokafka.Compression{p.Compression}
+	for _, r := range p.CompressionRoutes {
+		if _, ok := pl.groups[r.Compression]; !ok && r.Compression != p.Compression {
+			pl.groups[r.Compression] = nil
+			compressions = append(compressions, r.Compression)
+		}
+	}
+	for _, c := range compressions {
+		name := compressionName(c)
+		writer := newWriter(c, pl.compressed.WithLabelValues(name))
+		group := make([]*buffer, p.Workers)
+		for i := range group {
+			plLogger := logger
+			if p.Workers > 1 || len(compressions) > 1 {
+				plLogger = logger.WithField("pipeline", len(pl.pipelines))
+			}
+			if len(compressions) > 1 {
+				plLogger = plLogger.WithField("compression", name)
+			}
+			b := newBuffer(p, writer, make(MessageChan, channelSize), plLogger)
+			b.compression = c
+			b.uncompressedBytes = pl.uncompressed.WithLabelValues(name)
+			b.counters = pl.counters
+			group[i] = b
+			pl.pipelines = append(pl.pipelines, b)
+		}
+		pl.groups[c] = group
+	}
+	return pl
+}
+
+// key is what messages are sharded on.
+func (m Message) key() string {
+	if m.Key != "" {
+		return m.Key
+	}
+	return m.Topic
+}
+
+// Run sends the test message and then runs the pipelines until the context is cancelled. On shutdown the
+// pipelines get everything that has been handed out before they do their final flush.
+func (pl *pool) Run(ctx context.Context) error {
+	if pl.preflight != nil {
+		preflightCtx, cancel := context.WithTimeout(ctx, preflightTimeout)
+		err := pl.preflight(preflightCtx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("topic preflight: %w", err)
+		}
+	}
+	if pl.testMessage {
+		err := pl.pipelines[0].sendTestMessage()
+		if err != nil && pl.failover != nil && pl.failover.fallBack(err) {
+			err = pl.pipelines[0].sendTestMessage()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to send initial test message: %w", err)
+		}
+	}
+	pl.started = time.Now()
+	pl.logger.Infof("Starting %d Kafka pipeline(s)", len(pl.pipelines))
+	pipeCtx, pipeCancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	if pl.heartbeatInterval > 0 && pl.heartbeatWriter != nil {
+		heartbeatCtx, heartbeatCancel := context.WithCancel(ctx)
+		defer heartbeatCancel()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pl.runHeartbeats(heartbeatCtx)
+		}()
+	}
+	for _, b := range pl.pipelines {
+		wg.Add(1)
+		go func(b *buffer) {
+			defer wg.Done()
+			b.run(pipeCtx)
+		}(b)
+	}
+	leftovers := pl.dispatch(ctx)
+	pipeCancel()
+	wg.Wait()
+	// The pipelines are done, so it's safe to touch them from here.
+	flush := make(map[*buffer]bool)
+	for _, m := range leftovers {
+		b := pl.pipelineFor(m)
+		b.Enqueue(m)
+		flush[b] = true
+	}
+	for b := range flush {
+		b.Send(true)
+	}
+	return nil
+}
+
+// dispatch hands messages to the pipelines until the context is cancelled. Returns the messages
+// it couldn't hand out: one blocked on a full pipeline and whatever is left in the channel.
+func (pl *pool) dispatch(ctx context.Context) []Message {
+	var leftovers []Message
+	for {
+		select {
+		case <-ctx.Done():
+			return pl.drain(leftovers)
+		case m := <-pl.C:
+			pl.counters.receive()
+			select {
+			case pl.pipelineFor(m).C <- m:
+			case <-ctx.Done():
+				return pl.drain(append(leftovers, m))
+			}
+		}
+	}
+}
+
+// drain picks up what's left on the channel at shutdown. These are written with the leftovers, so they
+// count as received like the rest.
+func (pl *pool) drain(msgs []Message) []Message {
+	for {
+		select {
+		case m := <-pl.C:
+			pl.counters.receive()
+			msgs = append(msgs, m)
+		default:
+			return msgs
+		}
+	}
+}
+
+// pipelineFor picks the group by compression and then the pipeline within it by key. Dead letters and
+// quarantined messages have pipelines of their own.
+func (pl *pool) pipelineFor(m Message) *buffer {
+	if m.Error != "" && pl.deadLetter != nil {
+		return pl.deadLetter
+	}
+	if m.Quarantine && pl.quarantine != nil {
+		return pl.quarantine
+	}
+	pl.routesMu.RLock()
+	routes := pl.routes
+	pl.routesMu.RUnlock()
+	group := pl.groups[compressionFor(routes, pl.compression, m.Topic)]
+	return group[shard(m.key(), len(group))]
+}
+
+// SetCompressionRoutes replaces the compression routes. Only compressions that already have pipelines
+// can be used, others need a restart. Messages already on their way aren't moved.
+func (pl *pool) SetCompressionRoutes(routes []CompressionRoute) error {
+	for _, r := range routes {
+		if _, ok := pl.groups[r.Compression]; !ok {
+			return fmt.Errorf("route '%s': compression %s isn't in use, adding it needs a restart",
+				r.Filter, compressionName(r.Compression))
+		}
+	}
+	pl.routesMu.Lock()
+	pl.routes = routes
+	pl.routesMu.Unlock()
+	return nil
+}
+
+func shard(key string, n int) int {
+	if n == 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// Collectors returns the metrics kept by the pool, for observability to register.
+func (pl *pool) Collectors() []prometheus.Collector {
+	collectors := []prometheus.Collector{pl.uncompressed, pl.compressed}
+	if pl.failover != nil {
+		collectors = append(collectors, pl.failover.gauge)
+	}
+	return collectors
+}
+
+// Status sums up the status of the pipelines.
+func (pl *pool) Status(ctx context.Context) (Status, error) {
+	var total Status
+	for _, b := range pl.pipelines {
+		s, err := b.Status(ctx)
+		if err != nil {
+			return Status{}, err
+		}
+		total.Buffered += s.Buffered
+		total.Failures += s.Failures
+		total.FailureState = total.FailureState || s.FailureState
+		if total.LastError == "" {
+			total.LastError = s.LastError
+		}
+		total.LastSuccess = latest(total.LastSuccess, s.LastSuccess)
+		total.LastSendAttempt = latest(total.LastSendAttempt, s.LastSendAttempt)
+		if len(pl.pipelines) > 1 {
+			total.Pipelines = append(total.Pipelines, s)
+		}
+	}
+	if pl.failover != nil {
+		total.Cluster = pl.failover.Cluster()
+	}
+	return total, nil
+}
+
+// Flush flushes every pipeline. The first error is returned.
+func (pl *pool) Flush(ctx context.Context) error {
+	var firstErr error
+	for i, b := range pl.pipelines {
+		if err := b.Flush(ctx); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("pipeline %d: %w", i, err)
+		}
+	}
+	return firstErr
+}
+
+func latest(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,260 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/celerway/metamorphosis/bridge/observability"
+	is2 "github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	gokafka "github.com/segmentio/kafka-go"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func makeTestPool(writer *mockWriter, workers, maxInFlight int) *pool {
+	obsChannel := make(observability.Channel)
+	go func() { // service the obs channel.
+		for range obsChannel {
+		}
+	}()
+	return newPool(Params{
+		Channel:          make(MessageChan),
+		BatchSize:        50,
+		MaxBatchSize:     500,
+		Interval:         5 * time.Millisecond,
+		RetryInterval:    20 * time.Millisecond,
+		Topic:            "unittest",
+		ObsChannel:       obsChannel,
+		TestMessageTopic: "test",
+		Workers:          workers,
+		MaxInFlight:      maxInFlight,
+	}, func(gokafka.Compression, prometheus.Counter) KafkaWriter { return writer })
+}
+
+func runPool(pl *pool) (context.CancelFunc, *sync.WaitGroup) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = pl.Run(ctx)
+	}()
+	return cancel, wg
+}
+
+// seqByTopic decodes what was written and returns the content, per MQTT topic, in the order it was written.
+// If keyed is set the record key must be the MQTT topic.
+func seqByTopic(t *testing.T, writer *mockWriter, keyed bool) map[string][]string {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	out := make(map[string][]string)
+	for _, r := range writer.storage {
+		var msg Message
+		if err := json.Unmarshal(r.Value, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Topic == "test" {
+			continue
+		}
+		if keyed && string(r.Key) != msg.Topic {
+			t.Errorf("record key %q, expected %q", r.Key, msg.Topic)
+		}
+		out[msg.Topic] = append(out[msg.Topic], string(msg.Content))
+	}
+	return out
+}
+
+func TestPool_OrderPerKey(t *testing.T) {
+	is := is2.New(t)
+	writer := &mockWriter{}
+	writer.setDelay(time.Millisecond, 0)
+	pl := makeTestPool(writer, 4, 0)
+	is.Equal(len(pl.pipelines), 4)
+	cancel, wg := runPool(pl)
+	const topics, perTopic = 20, 100
+	for i := 0; i < perTopic; i++ {
+		for j := 0; j < topics; j++ {
+			pl.C <- makeMessage(fmt.Sprintf("devices/%d", j), i)
+		}
+	}
+	cancel() // shutdown flushes everything.
+	wg.Wait()
+	got := seqByTopic(t, writer, true)
+	is.Equal(len(got), topics)
+	for topic, seq := range got {
+		is.Equal(len(seq), perTopic)
+		for i, content := range seq {
+			if content != fmt.Sprint(i) {
+				t.Fatalf("%s: message %d is %s, out of order", topic, i, content)
+			}
+		}
+	}
+	for _, b := range pl.pipelines {
+		is.True(!b.lastSuccess.IsZero()) // every pipeline should have gotten some of the topics.
+	}
+}
+
+func TestPool_StatusAndFailure(t *testing.T) {
+	is := is2.New(t)
+	writer := &mockWriter{}
+	pl := makeTestPool(writer, 2, 0)
+	cancel, wg := runPool(pl)
+	defer wg.Wait()
+	defer cancel()
+	waitForAtomic(&writer.msgs, 1, 100*time.Millisecond, time.Millisecond) // test message
+	writer.setState(true)
+	for i := 0; i < 10; i++ {
+		pl.C <- makeMessage(fmt.Sprintf("t/%d", i), i)
+	}
+	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second)
+	defer ctxCancel()
+	is.True(pl.Flush(ctx) != nil)
+	status, err := pl.Status(ctx)
+	is.NoErr(err)
+	is.Equal(status.Buffered, 10)
+	is.True(status.FailureState)
+	is.Equal(len(status.Pipelines), 2)
+	writer.setState(false)
+	is.NoErr(pl.Flush(ctx))
+	status, err = pl.Status(ctx)
+	is.NoErr(err)
+	is.Equal(status.Buffered, 0)
+	is.True(!status.FailureState)
+}
+
+func TestPool_MaxInFlight(t *testing.T) {
+	is := is2.New(t)
+	writer := &mockWriter{}
+	pl := makeTestPool(writer, 1, 5)
+	cancel, wg := runPool(pl)
+	waitForAtomic(&writer.msgs, 1, 100*time.Millisecond, time.Millisecond)
+	writer.setState(true)
+	const total = 200
+	sent := make(chan int)
+	go func() {
+		n := 0
+		for i := 0; i < total; i++ {
+			select {
+			case pl.C <- makeMessage("t", i):
+				n++
+			case <-time.After(200 * time.Millisecond):
+				sent <- n
+				return
+			}
+		}
+		sent <- n
+	}()
+	// 5 in the buffer, pipelineChannelSize in the pipeline channel and one blocked in the dispatcher.
+	n := <-sent
+	is.Equal(n, 5+pipelineChannelSize+1)
+	writer.setState(false) // Kafka is back, the rest goes through.
+	for i := n; i < total; i++ {
+		pl.C <- makeMessage("t", i)
+	}
+	cancel()
+	wg.Wait()
+	is.Equal(len(seqByTopic(t, writer, false)["t"]), total)
+}
+
+// BenchmarkPool pushes messages through the pool against a writer which takes 2ms per request,
+// roughly a produce request with acks=all on a healthy cluster. The msg/s metric is what matters.
+func BenchmarkPool(b *testing.B) {
+	for _, workers := range []int{1, 4, 8, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			writer := &mockWriter{}
+			writer.setDelay(2*time.Millisecond, 0)
+			pl := makeTestPool(writer, workers, 0)
+			pl.C = make(MessageChan, 1000)
+			for _, p := range pl.pipelines {
+				p.batchSize = 100
+			}
+			cancel, wg := runPool(pl)
+			topics := make([]string, 1000)
+			for i := range topics {
+				topics[i] = fmt.Sprintf("devices/%d/telemetry", i)
+			}
+			msg := Message{Content: []byte(`{"temperature":21.5,"humidity":40}`)}
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				msg.Topic = topics[i%len(topics)]
+				pl.C <- msg
+			}
+			cancel()
+			wg.Wait()
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "msg/s")
+		})
+	}
+}
+
+func TestPool_Compression(t *testing.T) {
+	is := is2.New(t)
+	writers := map[gokafka.Compression]*mockWriter{}
+	newWriter := func(c gokafka.Compression, _ prometheus.Counter) KafkaWriter {
+		writers[c] = &mockWriter{}
+		return writers[c]
+	}
+	obsChannel := make(observability.Channel)
+	go func() {
+		for range obsChannel {
+		}
+	}()
+	defer close(obsChannel)
+	routes, err := ParseCompressionRoutes("logs/debug=none,logs/#=zstd,bulk/+/data=zstd")
+	is.NoErr(err)
+	pl := newPool(Params{
+		Channel:           make(MessageChan),
+		BatchSize:         50,
+		MaxBatchSize:      500,
+		Interval:          5 * time.Millisecond,
+		RetryInterval:     20 * time.Millisecond,
+		ObsChannel:        obsChannel,
+		TestMessageTopic:  "test",
+		Workers:           2,
+		Compression:       gokafka.Gzip,
+		CompressionRoutes: routes,
+	}, newWriter)
+	is.Equal(len(writers), 3)      // gzip (default), zstd and none
+	is.Equal(len(pl.pipelines), 6) // two per compression
+	is.Equal(pl.pipelines[0].compression, gokafka.Gzip)
+	cancel, wg := runPool(pl)
+	for i, topic := range []string{"logs/debug", "logs/app", "bulk/1/data", "devices/1", "logs/debug"} {
+		pl.C <- makeMessage(topic, i)
+	}
+	cancel()
+	wg.Wait()
+	is.Equal(seqByTopic(t, writers[gokafka.Zstd], false), map[string][]string{"logs/app": {"1"}, "bulk/1/data": {"2"}})
+	is.Equal(seqByTopic(t, writers[0], false), map[string][]string{"logs/debug": {"0", "4"}})
+	is.Equal(seqByTopic(t, writers[gokafka.Gzip], false), map[string][]string{"devices/1": {"3"}})
+	written := 0
+	for _, m := range writers[0].storage {
+		written += messageSize(m)
+	}
+	is.Equal(testutil.ToFloat64(pl.uncompressed.WithLabelValues("none")), float64(written))
+
+	// Routes can be replaced at runtime, but only with compressions that have pipelines.
+	routes, err = ParseCompressionRoutes("devices/#=zstd")
+	is.NoErr(err)
+	is.NoErr(pl.SetCompressionRoutes(routes))
+	is.Equal(pl.pipelineFor(makeMessage("devices/1", 0)).compression, gokafka.Zstd)
+	is.Equal(pl.pipelineFor(makeMessage("logs/debug", 0)).compression, gokafka.Gzip)
+	routes, err = ParseCompressionRoutes("devices/#=lz4")
+	is.NoErr(err)
+	is.True(pl.SetCompressionRoutes(routes) != nil)
+	is.Equal(pl.pipelineFor(makeMessage("devices/1", 0)).compression, gokafka.Zstd) // unchanged
+}
+
+func TestPool_DrainCounts(t *testing.T) {
+	is := is2.New(t)
+	pl := makeTestPool(&mockWriter{}, 1, 0)
+	pl.C = make(MessageChan, 2)
+	pl.C <- makeMessage("t", 1)
+	pl.C <- makeMessage("t", 2)
+	is.Equal(len(pl.drain(nil)), 2)
+	// What's drained at shutdown is written, so it must count as received too.
+	is.Equal(atomic.LoadInt64(&pl.counters.received), int64(2))
+}
@@ -0,0 +1,151 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	gokafka "github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// What the startup topic check does when a topic is missing or can't be described.
+const (
+	TopicCheckFail = "fail" // exit
+	TopicCheckWarn = "warn" // log it and start. Brokers with auto.create.topics.enable create missing topics.
+	TopicCheckOff  = "off"  // don't check, for when we aren't allowed to describe the topics.
+)
+
+// ParseTopicCheck checks the topic check mode. Empty is TopicCheckFail.
+func ParseTopicCheck(mode string) (string, error) {
+	switch strings.ToLower(mode) {
+	case "", TopicCheckFail:
+		return TopicCheckFail, nil
+	case TopicCheckWarn:
+		return TopicCheckWarn, nil
+	case TopicCheckOff:
+		return TopicCheckOff, nil
+	}
+	return "", fmt.Errorf("unknown topic check '%s' (expected fail, warn or off)", mode)
+}
+
+// preflight checks the topics before we start. secondary is nil without failover. With TopicCheckWarn,
+// problems are logged and we start on the primary regardless.
+func preflight(ctx context.Context, primary, secondary topicAdmin, fo *failover, topics []string, settings TopicSettings, logger *log.Entry) error {
+	if settings.Check != TopicCheckWarn {
+		if secondary == nil {
+			return checkTopics(ctx, primary, topics, settings, logger)
+		}
+		return checkClusters(ctx, primary, secondary, fo, topics, settings, logger)
+	}
+	clusters := map[string]topicAdmin{"primary": primary, "secondary": secondary}
+	for _, name := range []string{"primary", "secondary"} {
+		if clusters[name] == nil {
+			continue
+		}
+		if err := checkTopics(ctx, clusters[name], topics, settings, logger); err != nil {
+			logger.Warnf("Topic check on the %s Kafka cluster: %s. Starting anyway.", name, err)
+		}
+	}
+	return nil
+}
+
+// checkTopics makes sure the topics exist on the cluster. Missing topics are created if settings.Create
+// is set, otherwise they're reported by name.
+func checkTopics(ctx context.Context, admin topicAdmin, topics []string, settings TopicSettings, logger *log.Entry) error {
+	missing, err := missingTopics(ctx, admin, topics)
+	if err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		logger.Debugf("Kafka topic(s) %s exist", strings.Join(topics, ", "))
+		return nil
+	}
+	if !settings.Create {
+		return fmt.Errorf("missing Kafka topic(s): %s. Create them or enable topic creation", strings.Join(missing, ", "))
+	}
+	req := &gokafka.CreateTopicsRequest{}
+	for _, t := range missing {
+		tc := gokafka.TopicConfig{
+			Topic:             t,
+			NumPartitions:     settings.Partitions,
+			ReplicationFactor: settings.ReplicationFactor,
+		}
+		if settings.Retention != 0 {
+			tc.ConfigEntries = []gokafka.ConfigEntry{
+				{ConfigName: "retention.ms", ConfigValue: strconv.FormatInt(settings.Retention.Milliseconds(), 10)},
+			}
+		}
+		req.Topics = append(req.Topics, tc)
+	}
+	resp, err := admin.CreateTopics(ctx, req)
+	if err != nil {
+		return fmt.Errorf("creating Kafka topic(s) %s: %w", strings.Join(missing, ", "), err)
+	}
+	var failed []string
+	for _, t := range missing {
+		err := resp.Errors[t]
+		switch {
+		case err == nil:
+			logger.Infof("Created Kafka topic '%s' (partitions: %d, replication factor: %d, retention: %v)",
+				t, settings.Partitions, settings.ReplicationFactor, settings.Retention)
+		case errors.Is(err, gokafka.TopicAlreadyExists):
+			// Someone beat us to it, perhaps another instance of the bridge.
+		default:
+			failed = append(failed, fmt.Sprintf("%s (%s)", t, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not create Kafka topic(s): %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// missingTopics returns the topics that don't exist, sorted. Any other error on a topic, like not being
+// authorized to see it, is returned as an error.
+func missingTopics(ctx context.Context, admin topicAdmin, topics []string) ([]string, error) {
+	resp, err := admin.Metadata(ctx, &gokafka.MetadataRequest{Topics: topics})
+	if err != nil {
+		return nil, fmt.Errorf("fetching metadata for Kafka topic(s) %s: %w", strings.Join(topics, ", "), err)
+	}
+	found := make(map[string]error, len(resp.Topics))
+	for _, t := range resp.Topics {
+		found[t.Name] = t.Error
+	}
+	var missing, broken []string
+	for _, t := range topics {
+		err, ok := found[t]
+		switch {
+		case !ok || errors.Is(err, gokafka.UnknownTopicOrPartition):
+			missing = append(missing, t)
+		case err != nil:
+			broken = append(broken, fmt.Sprintf("%s (%s)", t, err))
+		}
+	}
+	if len(broken) > 0 {
+		return nil, fmt.Errorf("unavailable Kafka topic(s): %s", strings.Join(broken, ", "))
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// checkClusters checks the topics on both clusters. With a primary that works, the secondary isn't needed
+// to start, it's enough to know that it won't work. Without one, we start on the secondary.
+func checkClusters(ctx context.Context, primary, secondary topicAdmin, fo *failover, topics []string, settings TopicSettings, logger *log.Entry) error {
+	primaryErr := checkTopics(ctx, primary, topics, settings, logger)
+	secondaryErr := checkTopics(ctx, secondary, topics, settings, logger)
+	switch {
+	case primaryErr == nil:
+		if secondaryErr != nil {
+			logger.Warnf("Secondary Kafka cluster: %s", secondaryErr)
+		}
+		return nil
+	case secondaryErr != nil:
+		return fmt.Errorf("primary cluster: %s, secondary cluster: %w", primaryErr, secondaryErr)
+	default:
+		fo.fallBack(primaryErr)
+		return nil
+	}
+}
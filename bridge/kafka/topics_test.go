@@ -0,0 +1,127 @@
+package kafka
+
+import (
+	"context"
+	is2 "github.com/matryer/is"
+	gokafka "github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeAdmin is a cluster with the given topics. Topics in errs fail in metadata, and topics in createErrs fail
+// when they're created.
+type fakeAdmin struct {
+	topics     map[string]bool
+	errs       map[string]error
+	createErrs map[string]error
+	created    []gokafka.TopicConfig
+}
+
+func (f *fakeAdmin) Metadata(_ context.Context, req *gokafka.MetadataRequest) (*gokafka.MetadataResponse, error) {
+	resp := &gokafka.MetadataResponse{}
+	for _, t := range req.Topics {
+		switch {
+		case f.errs[t] != nil:
+			resp.Topics = append(resp.Topics, gokafka.Topic{Name: t, Error: f.errs[t]})
+		case f.topics[t]:
+			resp.Topics = append(resp.Topics, gokafka.Topic{Name: t})
+		default:
+			resp.Topics = append(resp.Topics, gokafka.Topic{Name: t, Error: gokafka.UnknownTopicOrPartition})
+		}
+	}
+	return resp, nil
+}
+
+func (f *fakeAdmin) CreateTopics(_ context.Context, req *gokafka.CreateTopicsRequest) (*gokafka.CreateTopicsResponse, error) {
+	resp := &gokafka.CreateTopicsResponse{Errors: map[string]error{}}
+	for _, t := range req.Topics {
+		if f.createErrs[t.Topic] != nil {
+			resp.Errors[t.Topic] = f.createErrs[t.Topic]
+			continue
+		}
+		f.created = append(f.created, t)
+		f.topics[t.Topic] = true
+	}
+	return resp, nil
+}
+
+func TestCheckTopics(t *testing.T) {
+	is := is2.New(t)
+	ctx := context.Background()
+	logger := logrus.WithField("module", "kafka")
+	admin := &fakeAdmin{topics: map[string]bool{"mqtt": true}}
+
+	is.NoErr(checkTopics(ctx, admin, []string{"mqtt"}, TopicSettings{}, logger))
+
+	err := checkTopics(ctx, admin, []string{"mqtt", "status", "other"}, TopicSettings{}, logger)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "missing Kafka topic(s): other, status")) // names the missing topics
+	is.Equal(len(admin.created), 0)
+
+	settings := TopicSettings{Create: true, Partitions: 6, ReplicationFactor: 3, Retention: 48 * time.Hour}
+	is.NoErr(checkTopics(ctx, admin, []string{"mqtt", "status"}, settings, logger))
+	is.Equal(len(admin.created), 1)
+	is.Equal(admin.created[0].Topic, "status")
+	is.Equal(admin.created[0].NumPartitions, 6)
+	is.Equal(admin.created[0].ReplicationFactor, 3)
+	is.Equal(admin.created[0].ConfigEntries, []gokafka.ConfigEntry{{ConfigName: "retention.ms", ConfigValue: "172800000"}})
+	is.NoErr(checkTopics(ctx, admin, []string{"mqtt", "status"}, TopicSettings{}, logger)) // exists now
+
+	admin.errs = map[string]error{"secret": gokafka.TopicAuthorizationFailed}
+	err = checkTopics(ctx, admin, []string{"mqtt", "secret"}, settings, logger)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "unavailable Kafka topic(s): secret")) // not missing, so not created
+	admin.errs = nil
+
+	// Created by someone else between the metadata request and ours.
+	admin.createErrs = map[string]error{"race": gokafka.TopicAlreadyExists, "bad": gokafka.InvalidReplicationFactor}
+	is.NoErr(checkTopics(ctx, admin, []string{"race"}, settings, logger))
+	err = checkTopics(ctx, admin, []string{"bad"}, settings, logger)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "could not create Kafka topic(s): bad"))
+}
+
+func TestCheckClusters(t *testing.T) {
+	is := is2.New(t)
+	ctx := context.Background()
+	logger := logrus.WithField("module", "kafka")
+	up := func() *fakeAdmin { return &fakeAdmin{topics: map[string]bool{"mqtt": true}} }
+	down := &fakeAdmin{topics: map[string]bool{}}
+	newFo := func() *failover {
+		return newFailover(time.Minute, time.Minute, func(context.Context) error { return nil }, logger)
+	}
+
+	fo := newFo()
+	is.NoErr(checkClusters(ctx, up(), down, fo, []string{"mqtt"}, TopicSettings{}, logger)) // the secondary only warns
+	is.Equal(fo.Cluster(), "primary")
+	fo = newFo()
+	is.NoErr(checkClusters(ctx, down, up(), fo, []string{"mqtt"}, TopicSettings{}, logger))
+	is.Equal(fo.Cluster(), "secondary") // we start on the secondary
+	err := checkClusters(ctx, down, down, newFo(), []string{"mqtt"}, TopicSettings{}, logger)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "primary cluster") && strings.Contains(err.Error(), "secondary cluster"))
+}
+
+func TestPreflight(t *testing.T) {
+	is := is2.New(t)
+	ctx := context.Background()
+	logger := logrus.WithField("module", "kafka")
+	missing := &fakeAdmin{topics: map[string]bool{}}
+	denied := &fakeAdmin{topics: map[string]bool{}, errs: map[string]error{"mqtt": gokafka.TopicAuthorizationFailed}}
+	fo := newFailover(time.Minute, time.Minute, func(context.Context) error { return nil }, logger)
+
+	is.True(preflight(ctx, missing, nil, nil, []string{"mqtt"}, TopicSettings{Check: TopicCheckFail}, logger) != nil)
+	// Warnings only, so brokers that create topics on their own, and ACLs without describe, still work.
+	is.NoErr(preflight(ctx, missing, nil, nil, []string{"mqtt"}, TopicSettings{Check: TopicCheckWarn}, logger))
+	is.NoErr(preflight(ctx, denied, missing, fo, []string{"mqtt"}, TopicSettings{Check: TopicCheckWarn}, logger))
+	is.Equal(fo.Cluster(), "primary")
+
+	for _, mode := range []string{"", "FAIL", "warn", "off"} {
+		_, err := ParseTopicCheck(mode)
+		is.NoErr(err)
+	}
+	_, err := ParseTopicCheck("maybe")
+	is.True(err != nil)
+}
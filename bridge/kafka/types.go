@@ -1,9 +1,15 @@
 package kafka
 
 import (
+	"context"
+	"github.com/celerway/metamorphosis/bridge/logging"
 	"github.com/celerway/metamorphosis/bridge/observability"
+	"github.com/celerway/metamorphosis/bridge/tracing"
+	"github.com/prometheus/client_golang/prometheus"
 	gokafka "github.com/segmentio/kafka-go"
 	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
 	"time"
 )
 
@@ -16,6 +22,12 @@ type buffer struct {
 	interval             time.Duration
 	writer               KafkaWriter
 	maxBatchSize         int
+	batchBytes           int // send when this many bytes are buffered. 0 disables.
+	maxRequestBytes      int // batches are split so a request doesn't exceed this. 0 is no limit.
+	bufferedBytes        int
+	oldest               time.Time // when the oldest message in the buffer was enqueued.
+	maxInFlight          int       // max buffered messages before we stop reading from C. 0 is no limit.
+	keyed                bool      // set the record key, so Kafka keeps the order per key.
 	batchSize            int
 	topic                string
 	kafkaTimeout         time.Duration
@@ -23,24 +35,178 @@ type buffer struct {
 	logger               *log.Entry
 	obsChannel           observability.Channel
 	testMessageTopic     string
+	lastError            error
+	lastSuccess          time.Time
+	requests             chan func() // runs on the Run goroutine so callers don't race with it.
+	compression          gokafka.Compression
+	uncompressedBytes    prometheus.Counter // nil in tests
+	counters             *counters          // shared by the pool, for heartbeats. nil in tests.
+	traceSampler         logging.Sampler
+	tracer               *tracing.Tracer
+	encoder              Encoder
+}
+
+// pool shards messages by key over a number of buffers (pipelines). Each has its own batching,
+// in-flight limit and retry state, so a key is always written in order.
+// There is a group of pipelines for each compression in use, as compression is set per writer.
+type pool struct {
+	C            MessageChan // incoming messages, from the bridge
+	pipelines    []*buffer
+	groups       map[gokafka.Compression][]*buffer
+	routes       []CompressionRoute
+	routesMu     sync.RWMutex        // routes can be replaced at runtime
+	compression  gokafka.Compression // used if no route matches
+	uncompressed *prometheus.CounterVec
+	compressed   *prometheus.CounterVec
+	failover     *failover                       // nil without a secondary cluster
+	preflight    func(ctx context.Context) error // checks the topics before we start. nil skips it.
+	testMessage  bool
+	counters     *counters
+	started      time.Time
+	id           string // identifies the bridge in heartbeats
+	version      string
+	// heartbeats are sent every heartbeatInterval, if it's set.
+	heartbeatInterval time.Duration
+	heartbeatWriter   KafkaWriter
+	deadLetter        *buffer // the pipeline for dead letters, nil if they go with everything else.
+	quarantine        *buffer // the pipeline for quarantined messages, nil if they go with everything else.
+	encoder           Encoder
+	logger            *log.Entry
+}
+
+// counters count what has happened since the last heartbeat.
+type counters struct {
+	received int64
+	written  int64
+	failed   int64
+	dropped  int64
+}
+
+// Heartbeat is the content of the heartbeat messages. The counters are since the previous heartbeat.
+type Heartbeat struct {
+	Id           string    `json:"id"`
+	Version      string    `json:"version"`
+	Time         time.Time `json:"time"`
+	Uptime       float64   `json:"uptime_seconds"`
+	Interval     float64   `json:"interval_seconds"` // when to expect the next one
+	Buffered     int       `json:"buffered"`
+	Received     int64     `json:"received"`
+	Written      int64     `json:"written"`
+	FailedWrites int64     `json:"failed_writes"`
+	Dropped      int64     `json:"dropped"` // too large to write
+	Cluster      string    `json:"cluster,omitempty"`
+}
+
+// CompressionRoute sets the compression for messages with an MQTT topic matching Filter.
+type CompressionRoute struct {
+	Filter      string              `json:"filter"`
+	Compression gokafka.Compression `json:"compression"`
+}
+
+// batchCounter counts the record batches in the produce requests written to a Kafka connection. That's
+// the size of the records after compression, without the metadata requests and request headers.
+type batchCounter struct {
+	net.Conn
+	counter prometheus.Counter
+	unknown func(error) // called for produce requests we can't count
+	mu      sync.Mutex
+	buf     []byte // the start of the request being written, or all of it for produce requests.
+	need    int    // bytes left of the produce request in buf
+	skip    int    // bytes left of a request we don't count
+}
+
+type cluster int
+
+const (
+	primaryCluster cluster = iota
+	secondaryCluster
+)
+
+// failover decides which cluster we write to. We switch to the secondary cluster when writes to the
+// primary have failed for longer than after. While on the secondary, the primary is probed every
+// probeInterval, and we switch back as soon as it answers. It's shared by all the writers of a pool,
+// so they all switch together.
+type failover struct {
+	mu            sync.Mutex
+	active        cluster
+	after         time.Duration
+	probeInterval time.Duration
+	failingSince  time.Time // first failure on the primary since the last success. Zero if it's fine.
+	lastProbe     time.Time
+	probing       bool
+	probe         func(ctx context.Context) error // checks that the primary is healthy
+	gauge         *prometheus.GaugeVec
+	logger        *log.Entry
+}
+
+// failoverWriter writes to the cluster picked by failover.
+type failoverWriter struct {
+	writers [2]KafkaWriter // primary, secondary
+	f       *failover
+}
+
+// Status is a snapshot of the state of the buffer.
+type Status struct {
+	Buffered        int       `json:"buffered"`
+	FailureState    bool      `json:"failure_state"`
+	Failures        int       `json:"failures"`
+	LastError       string    `json:"last_error,omitempty"`
+	LastSuccess     time.Time `json:"last_success"`
+	LastSendAttempt time.Time `json:"last_send_attempt"`
+	Cluster         string    `json:"cluster,omitempty"`   // the active cluster, if there is a secondary.
+	Pipelines       []Status  `json:"pipelines,omitempty"` // per pipeline, if there are more than one.
 }
 
 type Message struct {
-	Topic   string `json:"topic"`
-	Content []byte `json:"content"`
+	Source     string              `json:"source,omitempty"` // the MQTT source, when the bridge reads from several brokers
+	Topic      string              `json:"topic"`
+	Content    []byte              `json:"content"`
+	Error      string              `json:"error,omitempty"` // why the bridge couldn't process it. Only set on dead letters.
+	Quarantine bool                `json:"-"`               // goes to the quarantine topic, see Params.QuarantineTopic
+	Key        string              `json:"-"`               // selects the pipeline and the Kafka record key. Defaults to Topic.
+	Trace      tracing.SpanContext `json:"-"`               // injected as a traceparent header, not part of the envelope.
 }
 
 type MessageChan chan Message
 
+// TopicSettings are used to create missing topics at startup.
+type TopicSettings struct {
+	Check             string // what the startup check does with problems: fail (default), warn or off
+	Create            bool
+	Partitions        int           // -1 is the broker default
+	ReplicationFactor int           // -1 is the broker default
+	Retention         time.Duration // 0 is the broker default
+}
+
 type Params struct {
-	Broker           string
-	Port             int
-	Channel          MessageChan
-	BatchSize        int
-	MaxBatchSize     int
-	Interval         time.Duration
-	Topic            string
-	ObsChannel       observability.Channel
-	RetryInterval    time.Duration
-	TestMessageTopic string
+	Brokers           []string // bootstrap brokers, host:port
+	SecondaryBrokers  []string // optional cluster we fail over to
+	FailoverAfter     time.Duration
+	Channel           MessageChan
+	BatchSize         int
+	MaxBatchSize      int
+	Interval          time.Duration // linger: max time a message waits in the buffer
+	BatchBytes        int           // send when this many bytes are buffered. 0 disables.
+	MaxRequestBytes   int           // max size of a produce request. Larger messages are dropped.
+	Topic             string
+	ObsChannel        observability.Channel
+	RetryInterval     time.Duration
+	TestMessageTopic  string
+	Tracer            *tracing.Tracer     // nil disables tracing
+	Writer            KafkaWriter         // overrides the writer for Broker/Port. Used in tests.
+	Workers           int                 // number of parallel pipelines. Messages are sharded by key.
+	MaxInFlight       int                 // max buffered messages per pipeline. 0 is no limit.
+	ChannelSize       int                 // size of the channel of each pipeline. 0 is pipelineChannelSize.
+	Compression       gokafka.Compression // default compression
+	CompressionRoutes []CompressionRoute  // compression per MQTT topic filter, first match wins.
+	TopicSettings     TopicSettings
+	NoTestMessage     bool          // skip the test message at startup
+	HeartbeatInterval time.Duration // 0 disables heartbeats
+	HeartbeatTopic    string        // Kafka topic for heartbeats. Defaults to Topic.
+	DeadLetterTopic   string        // Kafka topic for messages with an Error. Empty sends them to Topic.
+	QuarantineTopic   string        // Kafka topic for messages with Quarantine set. Empty sends them to Topic.
+	Encoder           Encoder       // nil writes the JSON envelope
+	InlineJson        []string      // MQTT topic filters where JSON payloads are inlined in the JSON envelope
+	Id                string        // identifies the bridge in heartbeats
+	Version           string
 }
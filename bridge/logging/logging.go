@@ -0,0 +1,163 @@
+package logging
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Every module (kafka, mqtt, ...) gets its own logrus logger so the level can be set per module.
+// They all share the formatter and output of the standard logger.
+
+var (
+	mu              sync.Mutex
+	modules         = make(map[string]*log.Logger)
+	moduleLevels    = make(map[string]log.Level) // explicit per-module levels. Others follow the standard logger.
+	logPayloads     int32
+	traceSampleRate uint64 = 1
+)
+
+// Configure sets the format (text|json), the default level and the per-module levels.
+// moduleLevels looks like "kafka=debug,mqtt=info".
+func Configure(format string, level log.Level, moduleLevelSpec string) error {
+	switch format {
+	case "", "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format '%s' (text|json)", format)
+	}
+	levels, err := ParseModuleLevels(moduleLevelSpec)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	moduleLevels = levels
+	mu.Unlock()
+	SetLevel(level)
+	return nil
+}
+
+// ParseModuleLevels parses a spec like "kafka=debug,mqtt=info".
+func ParseModuleLevels(spec string) (map[string]log.Level, error) {
+	levels := make(map[string]log.Level)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		module, levelStr, ok := strings.Cut(part, "=")
+		if !ok || module == "" {
+			return nil, fmt.Errorf("invalid module level '%s' (expected module=level)", part)
+		}
+		level, err := log.ParseLevel(levelStr)
+		if err != nil {
+			return nil, fmt.Errorf("module '%s': %w", module, err)
+		}
+		levels[module] = level
+	}
+	return levels, nil
+}
+
+// Module returns the logger for a module. The entry carries the "module" field.
+func Module(name string) *log.Entry {
+	mu.Lock()
+	defer mu.Unlock()
+	logger, ok := modules[name]
+	if !ok {
+		logger = log.New()
+		modules[name] = logger
+		syncLogger(name, logger)
+	}
+	return logger.WithField("module", name)
+}
+
+// SetLevel sets the level of the standard logger and all modules without an explicit level.
+func SetLevel(level log.Level) {
+	log.SetLevel(level)
+	mu.Lock()
+	defer mu.Unlock()
+	for name, logger := range modules {
+		syncLogger(name, logger)
+	}
+}
+
+// SetModuleLevel sets the level for a single module.
+func SetModuleLevel(module string, level log.Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	moduleLevels[module] = level
+	if logger, ok := modules[module]; ok {
+		syncLogger(module, logger)
+	}
+}
+
+// SetModuleLevels replaces all the per-module levels. Modules that aren't in levels follow the standard logger.
+func SetModuleLevels(levels map[string]log.Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	moduleLevels = levels
+	for name, logger := range modules {
+		syncLogger(name, logger)
+	}
+}
+
+// Levels returns the effective level of every module we know about.
+func Levels() map[string]string {
+	mu.Lock()
+	defer mu.Unlock()
+	levels := make(map[string]string, len(modules))
+	for name, logger := range modules {
+		levels[name] = logger.GetLevel().String()
+	}
+	return levels
+}
+
+// syncLogger makes the module logger match the standard logger. Caller must hold mu.
+func syncLogger(name string, logger *log.Logger) {
+	std := log.StandardLogger()
+	logger.SetFormatter(std.Formatter)
+	logger.SetOutput(std.Out)
+	logger.SetReportCaller(std.ReportCaller)
+	if level, ok := moduleLevels[name]; ok {
+		logger.SetLevel(level)
+	} else {
+		logger.SetLevel(std.GetLevel())
+	}
+}
+
+// SetLogPayloads enables or disables logging of message payloads. Payloads can contain
+// anything, so they are never logged unless this is explicitly enabled.
+func SetLogPayloads(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&logPayloads, v)
+}
+
+// LogPayloads returns true if payloads may be logged.
+func LogPayloads() bool {
+	return atomic.LoadInt32(&logPayloads) == 1
+}
+
+// SetTraceSampleRate makes samplers let through one in every n calls. n <= 1 logs everything.
+func SetTraceSampleRate(n int) {
+	if n < 1 {
+		n = 1
+	}
+	atomic.StoreUint64(&traceSampleRate, uint64(n))
+}
+
+// Sampler is used to keep per-message trace logs from flooding the output.
+type Sampler struct {
+	count uint64
+}
+
+// Sample returns true for the first call and then for one in every n calls, n being the trace sample rate.
+func (s *Sampler) Sample() bool {
+	return (atomic.AddUint64(&s.count, 1)-1)%atomic.LoadUint64(&traceSampleRate) == 0
+}
@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	is2 "github.com/matryer/is"
+	log "github.com/sirupsen/logrus"
+	"testing"
+)
+
+func TestModuleLevels(t *testing.T) {
+	is := is2.New(t)
+	var buf bytes.Buffer
+	defer log.SetOutput(log.StandardLogger().Out)
+	log.SetOutput(&buf)
+	is.NoErr(Configure("json", log.InfoLevel, "kafka=debug, mqtt=warn"))
+	kafka := Module("kafka")
+	mqtt := Module("mqtt")
+	other := Module("other")
+	is.Equal(kafka.Logger.GetLevel(), log.DebugLevel)
+	is.Equal(mqtt.Logger.GetLevel(), log.WarnLevel)
+	is.Equal(other.Logger.GetLevel(), log.InfoLevel)
+
+	kafka.Debug("visible")
+	mqtt.Info("hidden")
+	is.Equal(bytes.Count(buf.Bytes(), []byte("\n")), 1)
+	var line map[string]interface{}
+	is.NoErr(json.Unmarshal(buf.Bytes(), &line)) // json format
+	is.Equal(line["module"], "kafka")
+	is.Equal(line["msg"], "visible")
+
+	// Changing the global level leaves explicit module levels alone.
+	SetLevel(log.ErrorLevel)
+	is.Equal(kafka.Logger.GetLevel(), log.DebugLevel)
+	is.Equal(other.Logger.GetLevel(), log.ErrorLevel)
+	SetModuleLevel("other", log.TraceLevel)
+	is.Equal(Levels()["other"], "trace")
+
+	// Replacing the module levels puts the ones left out back on the global level.
+	SetModuleLevels(map[string]log.Level{"mqtt": log.TraceLevel})
+	is.Equal(kafka.Logger.GetLevel(), log.ErrorLevel)
+	is.Equal(mqtt.Logger.GetLevel(), log.TraceLevel)
+	is.Equal(other.Logger.GetLevel(), log.ErrorLevel)
+	is.NoErr(Configure("text", log.InfoLevel, ""))
+}
+
+func TestConfigureErrors(t *testing.T) {
+	is := is2.New(t)
+	is.True(Configure("xml", log.InfoLevel, "") != nil)
+	is.True(Configure("text", log.InfoLevel, "kafka") != nil)
+	is.True(Configure("text", log.InfoLevel, "kafka=loud") != nil)
+}
+
+func TestSampler(t *testing.T) {
+	is := is2.New(t)
+	defer SetTraceSampleRate(1)
+	SetTraceSampleRate(10)
+	s := Sampler{}
+	sampled := 0
+	for i := 0; i < 100; i++ {
+		if s.Sample() {
+			sampled++
+		}
+	}
+	is.Equal(sampled, 10)
+	SetTraceSampleRate(0) // everything
+	is.True(s.Sample())
+	is.True(s.Sample())
+}
@@ -5,67 +5,258 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"github.com/celerway/metamorphosis/bridge/admin"
 	"github.com/celerway/metamorphosis/bridge/kafka"
+	"github.com/celerway/metamorphosis/bridge/logging"
 	"github.com/celerway/metamorphosis/bridge/mqtt"
 	"github.com/celerway/metamorphosis/bridge/observability"
+	"github.com/celerway/metamorphosis/bridge/processor"
+	"github.com/celerway/metamorphosis/bridge/tracing"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 )
 
-const channelSize = 100
+const defaultChannelSize = 100
 
 func Run(ctx context.Context, params Params) {
 	// params.MainWaitGroup.Add(1) // allows the caller to wait for clean exit.
 	var wg sync.WaitGroup // wg for children.
-	var tlsConfig *tls.Config
+	var err error
 	// In order to avoid hanging when we shut down we shutdown things in a certain order. So we use two contexts
 	// to do this.
 	mqttCtx, mqttCancel := context.WithCancel(context.Background())   // Mqtt client. Cleanup first.
 	kafkaCtx, kafkaCancel := context.WithCancel(context.Background()) // Kafka, shutdown after mqtt.
 	obsCtx, obsCancel := context.WithCancel(context.Background())     // obs, needs to be shutdown last to avoid deadlocks.
+	channelSize := params.ChannelSize
+	if channelSize <= 0 {
+		channelSize = defaultChannelSize
+	}
 	obsChan := observability.GetChannel(channelSize)
 	br := bridge{
-		mqttCh:  make(mqtt.MessageChannel, channelSize),
-		kafkaCh: make(kafka.MessageChan, channelSize),
-		logger:  log.WithFields(log.Fields{"module": "bridge"}),
-	}
-	if params.MqttTls {
-		tlsConfig = NewTlsConfig(params.TlsRootCrtFile, params.MqttClientCertFile, params.MqttClientKeyFile, br.logger)
-	}
-	mqttParams := mqtt.Params{
-		TlsConfig:  tlsConfig,
-		Broker:     params.MqttBroker,
-		Port:       params.MqttPort,
-		Topic:      params.MqttTopic,
-		Tls:        params.MqttTls,
-		Clientid:   params.MqttClientId,
-		Channel:    br.mqttCh,
-		ObsChannel: obsChan,
+		mqttCh:       make(mqtt.MessageChannel, channelSize),
+		kafkaCh:      make(kafka.MessageChan, channelSize),
+		obsChannel:   obsChan,
+		logger:       logging.Module("bridge"),
+		traceSampler: &logging.Sampler{},
+	}
+	if params.DedupeWindow > 0 {
+		br.dedupe, err = newDedupe(params.DedupeWindow, params.DedupeMaxEntries, params.DedupeKey)
+		if err != nil {
+			br.logger.Fatalf("Could not set up deduplication: %s", err)
+		}
+		br.logger.Infof("Deduplicating messages within %v (key: '%s')", params.DedupeWindow, params.DedupeKey)
+	}
+	if params.TracingEndpoint != "" {
+		br.tracer, err = tracing.Initialize(tracing.Params{
+			Endpoint:    params.TracingEndpoint,
+			ServiceName: params.TracingService,
+			SampleRatio: params.TracingSampleRatio,
+		})
+		if err != nil {
+			br.logger.Fatalf("Could not initialize tracing: %s", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			br.tracer.Run(obsCtx) // shut down with obs, after Kafka, so the last spans are exported.
+		}()
+	}
+	if params.ProcessorsFile != "" {
+		cfg, err := processor.LoadConfig(params.ProcessorsFile)
+		if err != nil {
+			br.logger.Fatalf("Could not load processors: %s", err)
+		}
+		br.processors, err = processor.New(cfg, params.Processors)
+		if err != nil {
+			br.logger.Fatalf("Could not set up processors: %s", err)
+		}
+		if br.processors.DeadLetters() && params.KafkaDeadLetterTopic == "" {
+			br.logger.Fatalf("Processors dead letter messages, but there is no Kafka dead letter topic")
+		}
+		br.logger.Infof("Processing messages as configured in %s", params.ProcessorsFile)
+	}
+	limits, err := parseRateLimits(params.RateLimits)
+	if err != nil {
+		br.logger.Fatalf("Could not parse rate limits: %s", err)
+	}
+	if len(limits) > 0 {
+		br.rateLimiter = newRateLimiter(limits, params.RateLimitTopK)
+		if br.rateLimiter.quarantines() && params.KafkaQuarantineTopic == "" {
+			br.logger.Fatalf("Rate limits quarantine messages, but there is no Kafka quarantine topic")
+		}
+		br.logger.Infof("Rate limiting %d topic filter(s)", len(limits))
+	}
+	sources, err := params.sources()
+	if err != nil {
+		br.logger.Fatalf("Could not set up MQTT sources: %s", err)
+	}
+	if br.dedupe != nil && strings.HasPrefix(params.DedupeKey, "property:") {
+		for _, source := range sources {
+			if source.ProtocolVersion != 5 {
+				br.logger.Warnf("Dedupe key '%s' needs MQTT 5, messages from MQTT 3.1.1 brokers aren't deduplicated",
+					params.DedupeKey)
+				break
+			}
+		}
+	}
+	mqttMetrics := mqtt.NewMetrics(br.mqttCh)
+	rl := &reloader{logger: br.logger}
+	mqttParams := make([]mqtt.Params, 0, len(sources))
+	for _, source := range sources {
+		var tlsConfig *tls.Config
+		if source.Tls {
+			certs, err := newCertReloader(source.RootCrtFile, source.ClientCertFile, source.ClientKeyFile, br.logger)
+			if err != nil {
+				br.logger.Fatalf("Could not load MQTT TLS files: %s", err)
+			}
+			rl.certs = append(rl.certs, certs)
+			tlsConfig = certs.Config()
+		}
+		wsHeaders, err := mqtt.ParseHeaders(source.WsHeaders)
+		if err != nil {
+			br.logger.Fatalf("Could not parse MQTT websocket headers: %s", err)
+		}
+		mp := mqtt.Params{
+			Source:             source.Name,
+			TlsConfig:          tlsConfig,
+			Broker:             source.Broker,
+			Port:               source.Port,
+			Url:                source.Url,
+			Transport:          source.Transport,
+			WsPath:             source.WsPath,
+			WsHeaders:          wsHeaders,
+			WsProxy:            source.WsProxy,
+			ProtocolVersion:    source.ProtocolVersion,
+			Topic:              source.Topic,
+			Tls:                source.Tls,
+			Clientid:           source.ClientId,
+			Username:           source.Username,
+			Metrics:            mqttMetrics,
+			Backpressure:       params.MqttBackpressure,
+			SpillDir:           params.MqttSpillDir,
+			SpillMaxBytes:      params.MqttSpillMaxBytes,
+			SlowMaxHandlers:    params.MqttSlowMaxHandlers,
+			PreferPrimaryAfter: source.PreferPrimaryAfter,
+			Password:           source.Password,
+			Channel:            br.mqttCh,
+			ObsChannel:         obsChan,
+			Tracer:             br.tracer,
+			StatusTopic:        params.MqttStatusTopic,
+			StatusInterval:     params.MqttStatusInterval,
+			Version:            params.Version,
+		}
+		mqttParams = append(mqttParams, mp)
+	}
+	kafkaBrokers, err := kafka.ParseBrokers(params.KafkaBroker, params.KafkaPort)
+	if err != nil {
+		br.logger.Fatalf("Could not parse Kafka brokers: %s", err)
+	}
+	kafkaSecondaryBrokers, err := kafka.ParseBrokers(params.KafkaSecondaryBrokers, params.KafkaPort)
+	if err != nil {
+		br.logger.Fatalf("Could not parse secondary Kafka brokers: %s", err)
+	}
+	compression, err := kafka.ParseCompression(params.KafkaCompression)
+	if err != nil {
+		br.logger.Fatalf("Could not set up Kafka compression: %s", err)
+	}
+	topicCheck, err := kafka.ParseTopicCheck(params.KafkaTopicCheck)
+	if err != nil {
+		br.logger.Fatalf("Kafka topic check: %s", err)
+	}
+	compressionRoutes, err := kafka.ParseCompressionRoutes(params.KafkaCompressionRoutes)
+	if err != nil {
+		br.logger.Fatalf("Could not set up Kafka compression: %s", err)
+	}
+	encoder, err := params.encoder()
+	if err != nil {
+		br.logger.Fatalf("Could not set up %s encoding: %s", params.KafkaEncoding, err)
+	}
+	if v, ok := encoder.(payloadValidator); ok {
+		br.validator = v
+	}
+	inlineJson, err := kafka.ParseInlineJson(params.KafkaInlineJson)
+	if err != nil {
+		br.logger.Fatalf("Could not set up Kafka encoding: %s", err)
+	}
+	if len(inlineJson) > 0 && encoder != nil {
+		br.logger.Fatalf("Inlined JSON payloads need the JSON envelope, not %s", params.KafkaEncoding)
 	}
 	kafkaParams := kafka.Params{
-		Broker:           params.KafkaBroker,
-		Port:             params.KafkaPort,
-		Channel:          br.kafkaCh,
-		Topic:            params.KafkaTopic,
-		ObsChannel:       obsChan,
-		RetryInterval:    params.KafkaRetryInterval,
-		Interval:         params.KafkaInterval,
-		BatchSize:        params.KafkaBatchSize,
-		MaxBatchSize:     params.KafkaMaxBatchSize,
-		TestMessageTopic: params.TestMessageTopic,
+		Brokers:           kafkaBrokers,
+		SecondaryBrokers:  kafkaSecondaryBrokers,
+		FailoverAfter:     params.KafkaFailoverAfter,
+		Channel:           br.kafkaCh,
+		Topic:             params.KafkaTopic,
+		ObsChannel:        obsChan,
+		RetryInterval:     params.KafkaRetryInterval,
+		Interval:          params.KafkaInterval,
+		BatchSize:         params.KafkaBatchSize,
+		MaxBatchSize:      params.KafkaMaxBatchSize,
+		BatchBytes:        params.KafkaBatchBytes,
+		MaxRequestBytes:   params.KafkaMaxRequestBytes,
+		TestMessageTopic:  params.TestMessageTopic,
+		NoTestMessage:     params.NoTestMessage,
+		HeartbeatInterval: params.HeartbeatInterval,
+		HeartbeatTopic:    params.HeartbeatTopic,
+		DeadLetterTopic:   params.KafkaDeadLetterTopic,
+		QuarantineTopic:   params.KafkaQuarantineTopic,
+		Encoder:           encoder,
+		InlineJson:        inlineJson,
+		Id:                params.MqttClientId,
+		Version:           params.Version,
+		Tracer:            br.tracer,
+		Writer:            params.KafkaWriter,
+		Workers:           params.KafkaWorkers,
+		MaxInFlight:       params.KafkaMaxInFlight,
+		ChannelSize:       params.ChannelSize,
+		Compression:       compression,
+		CompressionRoutes: compressionRoutes,
+		TopicSettings: kafka.TopicSettings{
+			Check:             topicCheck,
+			Create:            params.KafkaCreateTopics,
+			Partitions:        params.KafkaTopicPartitions,
+			ReplicationFactor: params.KafkaTopicReplication,
+			Retention:         params.KafkaTopicRetention,
+		},
+	}
+	kafkaWorker := kafka.Initialize(kafkaParams)
+	kafkaStatus := func(ctx context.Context) (interface{}, error) {
+		return kafkaWorker.Status(ctx)
+	}
+	collectors := append(kafkaWorker.Collectors(), mqttMetrics.Collectors()...)
+	if br.processors != nil {
+		collectors = append(collectors, br.processors.Collectors()...)
+	}
+	if br.rateLimiter != nil {
+		collectors = append(collectors, br.rateLimiter.Collectors()...)
 	}
 	obsParams := observability.Params{
-		Channel:    obsChan,
-		HealthPort: params.HealthPort,
+		Channel:      obsChan,
+		HealthPort:   params.HealthPort,
+		ListenAddr:   params.HealthAddr,
+		TlsCertFile:  params.HealthTlsCertFile,
+		TlsKeyFile:   params.HealthTlsKeyFile,
+		AuthUser:     params.HealthAuthUser,
+		AuthPassword: params.HealthAuthPassword,
+		AuthToken:    params.HealthAuthToken,
+		Collectors:   collectors,
 	}
 	// Start the goroutines that do the work.
-	obs := observability.Initialize(obsParams) // Fire up obs.
+	obs, err := observability.Initialize(obsParams) // Fire up obs.
+	if err != nil {
+		br.logger.Fatalf("Could not initialize observability: %s", err)
+	}
+	if err := obs.Listen(); err != nil {
+		br.logger.Fatalf("Could not start observability: %s", err)
+	}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		obs.Run(obsCtx)
+		_ = obs.Run(obsCtx) // errors after start-up are logged, and the status messages are still read.
 	}()
 
 	wg.Add(1)
@@ -73,33 +264,78 @@ func Run(ctx context.Context, params Params) {
 		defer wg.Done()
 		br.mainloop()
 	}()
-	kafkaWorker := kafka.Initialize(kafkaParams)
+	kafkaDone := make(chan struct{})
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		defer close(kafkaDone)
 		err := kafkaWorker.Run(kafkaCtx)
 		if err != nil {
 			log.Fatalf("Could not initialize kafka worker: %s", err)
 		}
 	}()
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		mqtt.Run(mqttCtx, mqttParams) // Then connect to MQTT
-	}()
+	mqttClients := make(mqttSources, 0, len(mqttParams))
+	mqttWg := sync.WaitGroup{} // the MQTT clients, which must be done before their channel is closed.
+	for _, mp := range mqttParams {
+		mp.KafkaStatus = kafkaStatus
+		mqttClient := mqtt.Initialize(mp)
+		mqttClients = append(mqttClients, mqttClient)
+		rl.sources = append(rl.sources, &reloadSource{name: mp.Source, client: mqttClient, topic: mp.Topic})
+		mqttWg.Add(1)
+		go func() {
+			defer mqttWg.Done()
+			mqttClient.Run(mqttCtx) // Then connect to MQTT
+		}()
+	}
+	if params.AdminPort > 0 {
+		adminApi, err := admin.Initialize(admin.Params{
+			Port:  params.AdminPort,
+			Token: params.AdminToken,
+			Kafka: kafkaWorker,
+			Mqtt:  mqttClients,
+		})
+		if err != nil {
+			br.logger.Fatalf("Could not initialize admin API: %s", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := adminApi.Run(obsCtx)
+			if err != nil {
+				br.logger.Errorf("Admin API: %s", err)
+			}
+		}()
+	}
+	rl.kafka = kafkaWorker
+	for _, certs := range rl.certs {
+		wg.Add(1)
+		go func(certs *certReloader) {
+			defer wg.Done()
+			certs.Run(obsCtx, params.TlsReloadInterval)
+		}(certs)
+	}
 	obs.Ready()
 
 	// Spin off a goroutine that will wait for SIGNALs and cancel the context.
 	// If we wanna do something on a regular basis (log stats or whatnot)
 	// this is a good place.
 
-	<-ctx.Done()
+wait:
+	for {
+		select {
+		case <-ctx.Done():
+			break wait
+		case settings := <-params.Reload:
+			rl.apply(settings)
+		}
+	}
 	br.logger.Warn("Context cancelled. Initiating shutdown.")
 	mqttCancel()
-	time.Sleep(time.Second)
+	mqttWg.Wait()               // the clients return once their message handlers are done.
 	close(br.mqttCh)            // Closing the channel will cause the mainloop to exit.
 	time.Sleep(3 * time.Second) // This should be enough to make sure Kafka is flushed out.
 	kafkaCancel()
+	<-kafkaDone // the final flush reports to obs, so it must be done before obs closes its channel.
 	obsCancel() // shuts down the HTTP server for obs.
 	obs.Cleanup()
 	wg.Wait() // Block and for us to shut down completely.
@@ -130,7 +366,31 @@ func NewTlsConfig(caFile, clientCertFile, clientKeyFile string, logger *log.Entr
 	}
 }
 
+// String returns the settings as JSON, for the startup log. Secrets are left out, and passwords in URLs removed.
 func (br Params) String() string {
+	br.MqttUrl, br.MqttWsProxy = redactUrls(br.MqttUrl), redactUrls(br.MqttWsProxy)
+	br.MqttSources = append([]MqttSource(nil), br.MqttSources...)
+	for i := range br.MqttSources {
+		br.MqttSources[i].Url = redactUrls(br.MqttSources[i].Url)
+		br.MqttSources[i].WsProxy = redactUrls(br.MqttSources[i].WsProxy)
+	}
 	jsonBytes, _ := json.MarshalIndent(br, "", "  ")
 	return string(jsonBytes)
 }
+
+// redactUrls removes the passwords from a comma separated list of URLs. Ones we can't parse are left out.
+func redactUrls(list string) string {
+	if list == "" {
+		return list
+	}
+	parts := strings.Split(list, ",")
+	for i, part := range parts {
+		u, err := url.Parse(strings.TrimSpace(part))
+		if err != nil {
+			parts[i] = "(invalid URL)"
+			continue
+		}
+		parts[i] = u.Redacted()
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,181 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const primaryProbeTimeout = 5 * time.Second
+
+// switchQuiesce is how long we wait for messages in progress before we switch back to the first broker.
+const switchQuiesce = 5 * time.Second
+
+// handleConnectAttempt is called by paho before it tries a broker. It tries them in order and stops at
+// the first one that accepts us, so the last attempt is the broker we end up connected to.
+// paho doesn't set the server name for TLS over TCP, so we do, or the certificate can't be checked against it.
+func (client *client) handleConnectAttempt(broker *url.URL, tlsConfig *tls.Config) *tls.Config {
+	client.mu.Lock()
+	client.url = broker.String()
+	client.mu.Unlock()
+	client.logger.Debugf("Trying MQTT broker %s", broker.Redacted())
+	if tlsConfig != nil && tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = broker.Hostname()
+	}
+	return tlsConfig
+}
+
+// setConnected records that we're connected to the broker of the last attempt.
+func (client *client) setConnected() {
+	client.mu.Lock()
+	current := client.url
+	client.connectedAt = time.Now()
+	client.mu.Unlock()
+	if client.connected == nil {
+		return
+	}
+	for _, u := range client.urls {
+		value := 0.0
+		if u == current {
+			value = 1
+		}
+		client.connected.WithLabelValues(redact(u)).Set(value)
+	}
+}
+
+// broker returns the broker we're connected to, without any password.
+func (client *client) broker() string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return redact(client.url)
+}
+
+// brokers returns all the brokers, for logging.
+func (client *client) brokers() string {
+	out := make([]string, len(client.urls))
+	for i, u := range client.urls {
+		out[i] = redact(u)
+	}
+	return strings.Join(out, ", ")
+}
+
+// onFallback returns how long we've been connected to a broker other than the first one.
+func (client *client) onFallback() (time.Duration, bool) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.url == client.urls[0] || !client.paho.IsConnected() {
+		return 0, false
+	}
+	return time.Since(client.connectedAt), true
+}
+
+// runPreferPrimary moves us back to the first broker once we've been on another one for preferAfter
+// and the first one answers again. It blocks until the context is cancelled.
+func (client *client) runPreferPrimary(ctx context.Context) {
+	if client.preferAfter <= 0 || len(client.urls) < 2 {
+		return
+	}
+	interval := client.preferAfter / 4
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			since, ok := client.onFallback()
+			if !ok || since < client.preferAfter || !reachable(client.urls[0]) || client.isClosing() {
+				continue
+			}
+			client.logger.Warnf("Connected to %s for %v and %s is reachable again. Reconnecting.",
+				client.broker(), since.Round(time.Second), redact(client.urls[0]))
+			client.switchBack(ctx)
+		}
+	}
+}
+
+// switchBack reconnects, so we end up on the first broker that takes us. paho tries them in order, so if
+// the first one doesn't accept us we're back on the one we were on. We stop taking messages and let the
+// ones in progress be acked first, so nothing is lost in between. Unlike connect, we never give up and
+// exit: this is a switch we chose to make.
+func (client *client) switchBack(ctx context.Context) {
+	client.unsubscribe()
+	if !client.waitIdle(switchQuiesce) {
+		client.logger.Warnf("Messages are still being handled after %v, they may be delivered again", switchQuiesce)
+	}
+	client.paho.Disconnect(250)
+	for {
+		err := client.tryConnect(1)
+		if err == nil {
+			return
+		}
+		client.logger.Errorf("Could not reconnect to any MQTT broker: %s. Retrying.", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+		if client.isClosing() {
+			return
+		}
+	}
+}
+
+// waitIdle waits for the message handlers in progress to finish. It returns false if they didn't in time.
+func (client *client) waitIdle(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt32(&client.busy) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// reachable returns true if we can open a TCP connection to the broker.
+func reachable(brokerUrl string) bool {
+	u, err := url.Parse(brokerUrl)
+	if err != nil {
+		return false
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), defaultPort(u.Scheme))
+	}
+	conn, err := net.DialTimeout("tcp", host, primaryProbeTimeout)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+func defaultPort(scheme string) string {
+	switch scheme {
+	case "ws":
+		return "80"
+	case "wss":
+		return "443"
+	}
+	if isTls(scheme + "://") {
+		return "8883"
+	}
+	return "1883"
+}
+
+func redact(brokerUrl string) string {
+	u, err := url.Parse(brokerUrl)
+	if err != nil {
+		return brokerUrl
+	}
+	return u.Redacted()
+}
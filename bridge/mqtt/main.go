@@ -3,41 +3,135 @@ package mqtt
 import (
 	"context"
 	"fmt"
+	"github.com/celerway/metamorphosis/bridge/logging"
 	"github.com/celerway/metamorphosis/bridge/observability"
+	"github.com/celerway/metamorphosis/bridge/tracing"
 	paho "github.com/eclipse/paho.mqtt.golang"
-	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
 	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 func Run(ctx context.Context, params Params) {
-	client := client{
-		broker:     params.Broker,
-		port:       params.Port,
-		topic:      params.Topic,
-		clientId:   params.Clientid,
-		tls:        params.Tls,
-		ch:         params.Channel,
-		obsChannel: params.ObsChannel,
-		logger:     log.WithFields(log.Fields{"module": "mqtt"}),
+	Initialize(params).Run(ctx)
+}
+
+// Initialize sets up the MQTT client. Call Run to connect and start processing messages.
+func Initialize(params Params) *client {
+	client := &client{
+		source:      params.Source,
+		topics:      []string{params.Topic},
+		clientId:    params.Clientid,
+		tls:         params.Tls,
+		ch:          params.Channel,
+		done:        make(chan struct{}),
+		obsChannel:  params.ObsChannel,
+		preferAfter: params.PreferPrimaryAfter,
+		tracer:      params.Tracer,
+		logger:      logging.Module("mqtt"),
+		// status
+		statusTopic:    params.StatusTopic,
+		statusInterval: params.StatusInterval,
+		version:        params.Version,
+		kafkaStatus:    params.KafkaStatus,
+		started:        time.Now(),
+	}
+	if params.Source != "" {
+		client.logger = client.logger.WithField("source", params.Source)
 	}
 	client.logger.Debugf("Starting MQTT Worker.")
-	client.logger.Debugf("Broker: %s:%d (tls: %v)", params.Broker, params.Port, params.Tls)
-
+	metrics := params.Metrics
+	if metrics == nil {
+		metrics = NewMetrics(params.Channel) // not registered anywhere
+	}
+	if params.Source != "" {
+		client.received = metrics.received.WithLabelValues(params.Source)
+	}
+	client.connected = metrics.connected.MustCurryWith(prometheus.Labels{"source": params.Source})
+	client.blocked = metrics.blocked.WithLabelValues(params.Source)
+	client.spilled = metrics.spilled.WithLabelValues(params.Source)
+	client.spooled = metrics.spooled.WithLabelValues(params.Source)
+	client.dropped = metrics.dropped.WithLabelValues(params.Source)
+	client.shed = metrics.shed.WithLabelValues(params.Source)
+	if err := checkBackpressure(params.Backpressure); err != nil {
+		client.logger.Fatalf("MQTT: %s", err)
+	}
+	if err := checkProtocolVersion(params.ProtocolVersion); err != nil {
+		client.logger.Fatalf("MQTT: %s", err)
+	}
+	if params.Backpressure == BackpressureSlow {
+		max := params.SlowMaxHandlers
+		if max <= 0 {
+			max = defaultSlowMaxHandlers
+		}
+		client.slots = make(chan struct{}, max)
+	}
+	if params.Backpressure == BackpressureSpill {
+		sp, err := openSpool(spoolPath(params.SpillDir, params.Source), params.SpillMaxBytes)
+		if err != nil {
+			client.logger.Fatalf("MQTT: %s", err)
+		}
+		client.spool = sp
+		if size := client.spool.size(); size > 0 {
+			client.logger.Infof("Replaying %d bytes of spilled messages from %s", size, client.spool.path)
+		}
+		client.spooled.Set(float64(client.spool.size()))
+	}
+	urls, err := BrokerUrls(params)
+	if err != nil {
+		client.logger.Fatalf("MQTT broker: %s", err)
+	}
 	opts := paho.NewClientOptions()
-	if params.Tls {
+	useWs := false
+	for _, u := range urls {
+		opts.AddBroker(u)
+		client.tls = client.tls || isTls(u)
+		useWs = useWs || strings.HasPrefix(u, "ws")
+	}
+	// paho tries the brokers in order and tells us which one it's trying, so we use its form of the URLs.
+	for _, u := range opts.Servers {
+		client.urls = append(client.urls, u.String())
+	}
+	client.url = client.urls[0]
+	client.logger.Debugf("Brokers: %s", client.brokers())
+	opts.SetConnectionAttemptHandler(client.handleConnectAttempt)
+	if client.tls {
 		opts.SetTLSConfig(params.TlsConfig)
-		opts.AddBroker(fmt.Sprintf("ssl://%s:%d", params.Broker, params.Port))
-		client.tls = true
-	} else {
-		opts.AddBroker(fmt.Sprintf("mqtt://%s:%d", params.Broker, params.Port))
+	}
+	if useWs {
+		proxy, err := proxyFunc(params.WsProxy)
+		if err != nil {
+			client.logger.Fatalf("MQTT websocket proxy: %s", err)
+		}
+		opts.SetWebsocketOptions(&paho.WebsocketOptions{Proxy: proxy})
+		if params.WsHeaders != nil {
+			opts.SetHTTPHeaders(params.WsHeaders)
+		}
 	}
 	// opts.ResumeSubs = true
+	opts.SetOrderMatters(params.Backpressure != BackpressureSlow)
 	opts.SetClientID(client.clientId)
+	if params.Username != "" {
+		opts.SetUsername(params.Username)
+		opts.SetPassword(params.Password)
+	}
 	opts.SetConnectionLostHandler(client.handleDisconnect)
 	opts.SetOnConnectHandler(client.handleConnect)
-	pahoClient := paho.NewClient(opts)
-	client.paho = pahoClient
+	if client.statusTopic != "" {
+		opts.SetBinaryWill(client.statusTopic, client.will(), 1, true)
+	}
+	if params.ProtocolVersion == 5 {
+		client.paho = newV5Client(opts)
+	} else {
+		client.paho = paho.NewClient(opts)
+	}
+	return client
+}
+
+// Run connects to the broker and blocks until the context is cancelled.
+func (client *client) Run(ctx context.Context) {
 	client.connect() // blocks and aborts on failure.
 	client.logger.Info("Starting MQTT client worker")
 	client.mainloop(ctx)
@@ -50,21 +144,54 @@ func Run(ctx context.Context, params Params) {
 func (client *client) mainloop(ctx context.Context) {
 	// Here we start blocking the goroutine and wait for shutdown.
 	// If we need to keep track of something we can wrap this in a loop
+	spoolDone := make(chan struct{})
+	if client.spool != nil {
+		go func() {
+			defer close(spoolDone)
+			client.runSpool(ctx)
+		}()
+	} else {
+		close(spoolDone)
+	}
+	go client.runPreferPrimary(ctx)
+	client.runStatus(ctx)
 	<-ctx.Done()
 	client.logger.Info("MQTT client context is cancelled. Shutting down.")
+	client.mu.Lock()
+	client.closing = true
+	close(client.done)
+	client.mu.Unlock()
 	client.unsubscribe()
+	client.publishStatus(client.statusMessage(stateOffline)) // the will isn't published when we disconnect cleanly.
 	client.paho.Disconnect(100)
+	client.handlers.Wait() // the channel is closed once we return, so no one can be left sending on it.
+	<-spoolDone
+	if client.spool != nil {
+		if size := client.spool.size(); size > 0 {
+			client.logger.Warnf("Leaving %d bytes of spilled messages in %s for the next run", size, client.spool.path)
+		}
+		_ = client.spool.close()
+	}
 	client.logger.Info("MQTT client exiting")
 }
 
 // connect to the broker. Blocks until the connection is established and the subscription is done.
+// Exits if that fails.
 func (client *client) connect() {
 	const connectionAttempts = 10
+	if err := client.tryConnect(connectionAttempts); err != nil {
+		client.logger.Errorf("Max number of connection attempt reached. Giving up and aborting.")
+		os.Exit(1)
+	}
+}
+
+// tryConnect connects to the broker and subscribes, and gives up after connectionAttempts.
+func (client *client) tryConnect(connectionAttempts int) error {
 	fullyConnected := false
 	attempts := 0
 	for !fullyConnected && attempts < connectionAttempts {
-		client.logger.Infof("MQTT client connection attempt %d: connect to broker %s:%d (tls: %t).",
-			attempts, client.broker, client.port, client.tls)
+		client.logger.Infof("MQTT client connection attempt %d: connect to broker %s (tls: %t).",
+			attempts, client.brokers(), client.tls)
 		if !client.paho.IsConnected() {
 			client.logger.Info("MQTT client is not connected. Connecting.")
 			token := client.paho.Connect()
@@ -80,59 +207,265 @@ func (client *client) connect() {
 		// connection should be up here. Issuing a MQTT subscribe now.
 		err := client.subscribe() //  blocks. Also sets up handlers.
 		if err != nil {
-			client.logger.Errorf("Could not subscribe to topic '%s': %s", client.topic, err)
+			client.logger.Errorf("Could not subscribe to topics %v: %s", client.Subscriptions(), err)
 			time.Sleep(200 * time.Millisecond)
 			attempts++
 			continue
 		}
 		fullyConnected = true
 	}
-	if !fullyConnected && attempts >= connectionAttempts {
-		client.logger.Errorf("Max number of connection attempt reached. Giving up and aborting.")
-		os.Exit(1)
+	if !fullyConnected {
+		return fmt.Errorf("no connection after %d attempts", attempts)
+	}
+	client.logger.Infof("Worker '%v' connected to MQTT %s", client.clientId, client.broker())
+	if !client.isClosing() {
+		client.publishStatus(client.statusMessage(stateOnline))
 	}
-	client.logger.Infof("Worker '%v' connected to MQTT %s:%d", client.clientId, client.broker, client.port)
+	return nil
+}
+
+func (client *client) isClosing() bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.closing
 }
 func (client *client) handleConnect(_ paho.Client) {
-	client.logger.Info("Connection to MQTT broker established")
+	client.setConnected()
+	client.logger.Infof("Connection to MQTT broker %s established", client.broker())
 }
 
 func (client *client) handleDisconnect(_ paho.Client, err error) {
 	client.logger.Errorf("handleDisconnect invoked with error: %s", err)
 	time.Sleep(100 * time.Millisecond) // Add some time so the broker isn't rushed by reconnects.
+	if client.isClosing() {
+		client.logger.Info("Shutting down, not reconnecting.")
+		return
+	}
 	client.logger.Info("Reconnecting to broker.")
 	client.connect()
 }
 
 func (client *client) unsubscribe() {
-	token := client.paho.Unsubscribe(client.topic)
+	topics := client.Subscriptions()
+	if len(topics) == 0 {
+		return
+	}
+	token := client.paho.Unsubscribe(topics...)
 	if token.Wait() && token.Error() != nil {
-		client.logger.Errorf("Could not unsubscribe from %s:  %s", client.topic, token.Error())
+		client.logger.Errorf("Could not unsubscribe from %v:  %s", topics, token.Error())
 	} else {
-		client.logger.Infof("Unsubscribed from topic '%s'", client.topic)
+		client.logger.Infof("Unsubscribed from topics %v", topics)
 	}
 }
+
+// subscribe issues a subscription for all the topics. If we're paused it does nothing.
 func (client *client) subscribe() error {
-	client.logger.Tracef("Issuing subscribe to topic '%s'", client.topic)
-	token := client.paho.Subscribe(client.topic, 1, client.messageHandler)
+	client.mu.Lock()
+	paused := client.paused
+	client.mu.Unlock()
+	if paused {
+		client.logger.Info("MQTT consumption is paused. Not subscribing.")
+		return nil
+	}
+	for _, topic := range client.Subscriptions() {
+		err := client.subscribeTopic(topic)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (client *client) subscribeTopic(topic string) error {
+	client.logger.Tracef("Issuing subscribe to topic '%s'", topic)
+	token := client.paho.Subscribe(topic, 1, client.messageHandler)
 	res := token.Wait()
 	// sToken, ok := token.(paho.SubscribeToken)
 	client.logger.Tracef("token.Wait is now: %v", res)
 	if token.Error() != nil {
-		client.logger.Errorf("Could not subscribe to '%s':  %s", client.topic, token.Error())
+		client.logger.Errorf("Could not subscribe to '%s':  %s", topic, token.Error())
 		return fmt.Errorf("subscribe error: %w", token.Error())
 	}
 
-	client.logger.Infof("successfully subcribed to '%s", client.topic)
+	client.logger.Infof("successfully subcribed to '%s", topic)
+	return nil
+}
+
+// Subscriptions returns the topics we're subscribed to (or will subscribe to when resumed).
+func (client *client) Subscriptions() []string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	topics := make([]string, len(client.topics))
+	copy(topics, client.topics)
+	return topics
+}
+
+// Paused returns true if consumption has been paused.
+func (client *client) Paused() bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.paused
+}
+
+// Subscribe adds a subscription at runtime.
+func (client *client) Subscribe(topic string) error {
+	client.mu.Lock()
+	for _, t := range client.topics {
+		if t == topic {
+			client.mu.Unlock()
+			return fmt.Errorf("already subscribed to '%s'", topic)
+		}
+	}
+	client.topics = append(client.topics, topic)
+	paused := client.paused
+	client.mu.Unlock()
+	if paused {
+		return nil
+	}
+	if err := client.subscribeTopic(topic); err != nil {
+		client.mu.Lock()
+		client.removeTopic(topic)
+		client.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// removeTopic removes a topic from the list. Call with the lock held.
+func (client *client) removeTopic(topic string) bool {
+	for i, t := range client.topics {
+		if t == topic {
+			client.topics = append(client.topics[:i], client.topics[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Unsubscribe removes a subscription at runtime.
+func (client *client) Unsubscribe(topic string) error {
+	client.mu.Lock()
+	found := client.removeTopic(topic)
+	paused := client.paused
+	client.mu.Unlock()
+	if !found {
+		return fmt.Errorf("not subscribed to '%s'", topic)
+	}
+	if paused {
+		return nil
+	}
+	token := client.paho.Unsubscribe(topic)
+	if token.Wait() && token.Error() != nil {
+		return fmt.Errorf("unsubscribe error: %w", token.Error())
+	}
+	client.logger.Infof("Unsubscribed from topic '%s'", topic)
 	return nil
 }
 
+// Pause stops consumption by unsubscribing from all topics. The broker will hold on to messages
+// for persistent sessions, otherwise messages published while paused are lost.
+// We're marked as paused before unsubscribing, so a reconnect in between doesn't subscribe again.
+func (client *client) Pause() error {
+	client.mu.Lock()
+	if client.paused {
+		client.mu.Unlock()
+		return nil
+	}
+	client.paused = true
+	topics := make([]string, len(client.topics))
+	copy(topics, client.topics)
+	client.mu.Unlock()
+	if len(topics) > 0 {
+		token := client.paho.Unsubscribe(topics...)
+		if token.Wait() && token.Error() != nil {
+			client.mu.Lock()
+			client.paused = false
+			client.mu.Unlock()
+			return fmt.Errorf("unsubscribe error: %w", token.Error())
+		}
+	}
+	client.logger.Warn("MQTT consumption paused")
+	return nil
+}
+
+// Resume re-subscribes to all topics.
+func (client *client) Resume() error {
+	client.mu.Lock()
+	if !client.paused {
+		client.mu.Unlock()
+		return nil
+	}
+	client.paused = false
+	client.mu.Unlock()
+	client.logger.Warn("MQTT consumption resumed")
+	return client.subscribe()
+}
+
 func (client *client) messageHandler(_ paho.Client, msg paho.Message) {
-	client.logger.Tracef("Got message on topic %s. Message: %s", msg.Topic(), string(msg.Payload()))
+	client.mu.Lock()
+	closing := client.closing
+	if !closing {
+		client.handlers.Add(1)
+		atomic.AddInt32(&client.busy, 1)
+	}
+	client.mu.Unlock()
+	if closing {
+		client.logger.Debugf("Shutting down, dropping message on topic %s", msg.Topic())
+		client.dropped.Inc()
+		return
+	}
+	defer client.handlers.Done()
+	defer atomic.AddInt32(&client.busy, -1)
+	if client.slots != nil {
+		if !client.takeSlot(msg) {
+			return
+		}
+		defer func() { <-client.slots }()
+	}
+	if client.traceSampler.Sample() {
+		if logging.LogPayloads() {
+			client.logger.Tracef("Got message on topic %s. Message: %s", msg.Topic(), string(msg.Payload()))
+		} else {
+			client.logger.Tracef("Got message on topic %s (%d bytes)", msg.Topic(), len(msg.Payload()))
+		}
+	}
+	var props []UserProperty
+	if m, ok := msg.(*v5Message); ok {
+		props = m.UserProperties()
+	}
+	span := client.tracer.Start(traceParent(props), "mqtt receive", tracing.KindConsumer)
+	span.SetAttribute("messaging.system", "mqtt")
+	span.SetAttribute("messaging.source.name", msg.Topic())
+	span.SetAttribute("messaging.message.payload_size_bytes", len(msg.Payload()))
+	if client.source != "" {
+		span.SetAttribute("metamorphosis.source", client.source)
+	}
 	chMsg := ChannelMessage{
-		Topic:   msg.Topic(),
-		Content: msg.Payload(),
+		Source:     client.source,
+		Topic:      msg.Topic(),
+		Content:    msg.Payload(),
+		Trace:      span.Context(),
+		Properties: props,
 	}
-	client.ch <- chMsg
+	client.enqueue(chMsg)
+	span.End()
 	client.obsChannel <- observability.MattReceived
+	if client.received != nil {
+		client.received.Inc()
+	}
+}
+
+// traceParent returns the context in a traceparent user property, so the receive span continues the
+// sender's trace. Without one (or with MQTT 3.1.1), or with one we can't parse, the message starts a new trace.
+func traceParent(props []UserProperty) tracing.SpanContext {
+	for _, p := range props {
+		if p.Key != tracing.TraceparentHeader {
+			continue
+		}
+		if sc, err := tracing.ParseTraceparent(p.Value); err == nil {
+			return sc
+		}
+		break
+	}
+	return tracing.SpanContext{}
 }
@@ -0,0 +1,48 @@
+package mqtt
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NewMetrics creates the metrics for the MQTT clients feeding ch. They're shared by all sources.
+func NewMetrics(ch MessageChannel) *Metrics {
+	return &Metrics{
+		queued: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mqtt_queue_length",
+			Help: "Number of received MQTT messages waiting to be passed on to Kafka",
+		}, func() float64 { return float64(len(ch)) }),
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mqtt_source_received",
+			Help: "Number of received MQTT messages, per source",
+		}, []string{"source"}),
+		connected: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mqtt_broker_connected",
+			Help: "MQTT broker we're connected to (1), per source",
+		}, []string{"source", "broker"}),
+		blocked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mqtt_blocked_seconds",
+			Help: "Time spent waiting for room in the queue",
+		}, []string{"source"}),
+		spilled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mqtt_spilled",
+			Help: "Number of MQTT messages spilled to disk because the queue was full",
+		}, []string{"source"}),
+		spooled: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mqtt_spool_bytes",
+			Help: "Bytes of spilled messages waiting on disk",
+		}, []string{"source"}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mqtt_shutdown_dropped",
+			Help: "Number of MQTT messages dropped at shutdown because there was no room for them",
+		}, []string{"source"}),
+		shed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mqtt_slow_dropped",
+			Help: "Number of QoS 0 MQTT messages dropped with slow backpressure because too many were waiting",
+		}, []string{"source"}),
+	}
+}
+
+// Collectors returns the metrics, to be registered with observability.
+func (m *Metrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.queued, m.received, m.connected, m.blocked, m.spilled, m.spooled, m.dropped, m.shed}
+}
@@ -0,0 +1,617 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/celerway/metamorphosis/bridge/topic"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultV5WriteTimeout is used when the options don't set a write timeout, so a stuck connection can't
+// block us forever.
+const defaultV5WriteTimeout = 30 * time.Second
+
+var (
+	errV5NotConnected  = errors.New("mqtt5: not connected")
+	errV5Disconnected  = errors.New("mqtt5: disconnected")
+	errV5PingTimeout   = errors.New("mqtt5: no answer to ping")
+	errV5Qos2Publish   = errors.New("mqtt5: publishing with QoS 2 is not supported")
+	errV5PayloadFormat = errors.New("mqtt5: unknown payload type")
+)
+
+// mqttClient is what we use of a client: paho for MQTT 3.1.1, or v5Client for MQTT 5.
+type mqttClient interface {
+	IsConnected() bool
+	Connect() paho.Token
+	Disconnect(quiesce uint)
+	Publish(topic string, qos byte, retained bool, payload interface{}) paho.Token
+	Subscribe(topic string, qos byte, callback paho.MessageHandler) paho.Token
+	Unsubscribe(topics ...string) paho.Token
+}
+
+// v5Client is a small MQTT 5 client, used instead of paho, which only speaks MQTT 3.1.1, so we can read
+// user properties. It takes paho's options and behaves like paho where we rely on it: it tries the brokers
+// in order, calls the same handlers and acks a message once its handler returns. Unlike paho it doesn't
+// reconnect on its own, handleDisconnect does that, and it doesn't publish with QoS 2.
+// The handlers are given a nil paho.Client.
+type v5Client struct {
+	opts      *paho.ClientOptions
+	connectMu sync.Mutex // one Connect at a time
+	mu        sync.Mutex // protects session and routes
+	session   *v5Session // nil when we're not connected
+	routes    map[string]paho.MessageHandler
+}
+
+// v5Session is a connection to a broker. A new one is made for every connection, so what's left of an
+// old one can't get in the way of the next.
+type v5Session struct {
+	client    *v5Client
+	conn      net.Conn
+	r         *bufio.Reader // also read CONNACK, so it may have buffered what came after it
+	keepAlive time.Duration
+	writeMu   sync.Mutex
+	mu        sync.Mutex // protects nextId, pending and qos2
+	nextId    uint16
+	pending   map[uint16]*v5Token // waiting for PUBACK, SUBACK or UNSUBACK
+	qos2      map[uint16]bool     // QoS 2 messages we've received and not had PUBREL for
+	messages  chan *v5Message     // messages for the handlers, when order matters. nil otherwise.
+	pinging   int32               // set while we wait for PINGRESP
+	done      chan struct{}       // closed when the connection is closed
+	closeOnce sync.Once
+}
+
+func newV5Client(opts *paho.ClientOptions) *v5Client {
+	return &v5Client{opts: opts, routes: make(map[string]paho.MessageHandler)}
+}
+
+func (c *v5Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session != nil
+}
+
+// Connect tries the brokers in order and stops at the first one that accepts us.
+func (c *v5Client) Connect() paho.Token {
+	t := newV5Token()
+	go func() {
+		t.complete(c.connect())
+	}()
+	return t
+}
+
+func (c *v5Client) connect() error {
+	c.connectMu.Lock()
+	defer c.connectMu.Unlock()
+	if c.IsConnected() {
+		return nil
+	}
+	err := errors.New("mqtt5: no brokers")
+	for _, server := range c.opts.Servers {
+		var s *v5Session
+		s, err = c.dial(server)
+		if err != nil {
+			continue
+		}
+		c.mu.Lock()
+		c.session = s
+		c.mu.Unlock()
+		s.start()
+		if c.opts.OnConnect != nil {
+			go c.opts.OnConnect(nil)
+		}
+		return nil
+	}
+	return err
+}
+
+// dial connects to a broker and waits for CONNACK.
+func (c *v5Client) dial(server *url.URL) (*v5Session, error) {
+	tlsConfig := c.opts.TLSConfig
+	if c.opts.OnConnectAttempt != nil {
+		tlsConfig = c.opts.OnConnectAttempt(server, tlsConfig)
+	}
+	conn, err := c.open(server, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	var will *v5Will
+	if c.opts.WillEnabled {
+		will = &v5Will{topic: c.opts.WillTopic, payload: c.opts.WillPayload, qos: c.opts.WillQos, retain: c.opts.WillRetained}
+	}
+	_ = conn.SetDeadline(time.Now().Add(c.opts.ConnectTimeout))
+	packet := encodeV5Connect(c.opts.ClientID, c.opts.Username, c.opts.Password, will,
+		uint16(c.opts.KeepAlive), c.opts.CleanSession)
+	if _, err := conn.Write(packet); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	header, body, err := readV5Packet(r)
+	if err == nil && header>>4 != v5Connack {
+		err = fmt.Errorf("mqtt5: expected CONNACK, got packet type %d", header>>4)
+	}
+	var props v5Properties
+	if err == nil {
+		p := v5Parser{buf: body}
+		p.byte() // session present
+		code := p.byte()
+		props = p.properties()
+		switch {
+		case p.err != nil:
+			err = p.err
+		case code >= 0x80:
+			err = v5ReasonError(code, props.reason)
+		}
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	s := &v5Session{
+		client:    c,
+		conn:      conn,
+		r:         r,
+		keepAlive: time.Duration(c.opts.KeepAlive) * time.Second,
+		pending:   make(map[uint16]*v5Token),
+		qos2:      make(map[uint16]bool),
+		done:      make(chan struct{}),
+	}
+	if props.serverKeepAlive >= 0 {
+		s.keepAlive = time.Duration(props.serverKeepAlive) * time.Second
+	}
+	if c.opts.Order {
+		s.messages = make(chan *v5Message, 100)
+	}
+	return s, nil
+}
+
+// open makes the network connection, the way paho does.
+func (c *v5Client) open(server *url.URL, tlsConfig *tls.Config) (net.Conn, error) {
+	timeout := c.opts.ConnectTimeout
+	switch server.Scheme {
+	case "ws":
+		return paho.NewWebsocket(server.String(), nil, timeout, c.opts.HTTPHeaders, c.opts.WebsocketOptions)
+	case "wss":
+		return paho.NewWebsocket(server.String(), tlsConfig, timeout, c.opts.HTTPHeaders, c.opts.WebsocketOptions)
+	case "mqtt", "tcp":
+		return net.DialTimeout("tcp", server.Host, timeout)
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+		return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", server.Host, tlsConfig)
+	}
+	return nil, fmt.Errorf("mqtt5: unknown protocol '%s'", server.Scheme)
+}
+
+// Disconnect waits up to quiesce milliseconds for outstanding acks, sends DISCONNECT and closes the
+// connection. The connection lost handler isn't called.
+func (c *v5Client) Disconnect(quiesce uint) {
+	c.mu.Lock()
+	s := c.session
+	c.session = nil
+	c.mu.Unlock()
+	if s == nil {
+		return
+	}
+	deadline := time.Now().Add(time.Duration(quiesce) * time.Millisecond)
+	for s.outstanding() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_ = s.write(encodeV5Packet(v5Disconnect, 0, nil))
+	s.close(errV5Disconnected)
+}
+
+// Publish sends a message with QoS 0 or 1. The payload is a []byte or a string.
+func (c *v5Client) Publish(topicName string, qos byte, retained bool, payload interface{}) paho.Token {
+	t := newV5Token()
+	var data []byte
+	switch p := payload.(type) {
+	case []byte:
+		data = p
+	case string:
+		data = []byte(p)
+	default:
+		t.complete(errV5PayloadFormat)
+		return t
+	}
+	if qos > 1 {
+		t.complete(errV5Qos2Publish)
+		return t
+	}
+	s := c.current()
+	if s == nil {
+		t.complete(errV5NotConnected)
+		return t
+	}
+	if qos == 0 {
+		t.complete(s.write(encodeV5Publish(topicName, data, 0, retained, 0, nil)))
+		return t
+	}
+	id, err := s.register(t)
+	if err == nil {
+		err = s.write(encodeV5Publish(topicName, data, qos, retained, id, nil))
+	}
+	if err != nil {
+		s.unregister(id)
+		t.complete(err)
+	}
+	return t
+}
+
+// Subscribe subscribes to a topic filter. Messages that match it are passed to callback.
+func (c *v5Client) Subscribe(filter string, qos byte, callback paho.MessageHandler) paho.Token {
+	c.mu.Lock()
+	c.routes[filter] = callback
+	c.mu.Unlock()
+	return c.request(func(id uint16) []byte { return encodeV5Subscribe(id, []string{filter}, qos) })
+}
+
+func (c *v5Client) Unsubscribe(filters ...string) paho.Token {
+	c.mu.Lock()
+	for _, filter := range filters {
+		delete(c.routes, filter)
+	}
+	c.mu.Unlock()
+	return c.request(func(id uint16) []byte { return encodeV5Unsubscribe(id, filters) })
+}
+
+// request sends a packet that's answered with an ack for its packet id.
+func (c *v5Client) request(packet func(id uint16) []byte) paho.Token {
+	t := newV5Token()
+	s := c.current()
+	if s == nil {
+		t.complete(errV5NotConnected)
+		return t
+	}
+	id, err := s.register(t)
+	if err == nil {
+		err = s.write(packet(id))
+	}
+	if err != nil {
+		s.unregister(id)
+		t.complete(err)
+	}
+	return t
+}
+
+func (c *v5Client) current() *v5Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session
+}
+
+// handlers returns the handlers for the filters that match a topic, like paho's router.
+func (c *v5Client) handlers(name string) []paho.MessageHandler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var handlers []paho.MessageHandler
+	for filter, h := range c.routes {
+		if topic.Match(sharedFilter(filter), name) {
+			handlers = append(handlers, h)
+		}
+	}
+	return handlers
+}
+
+// sharedFilter returns the filter of a shared subscription, "$share/<group>/<filter>", which is what the
+// topics have to match.
+func sharedFilter(filter string) string {
+	if !strings.HasPrefix(filter, "$share/") {
+		return filter
+	}
+	parts := strings.SplitN(filter, "/", 3)
+	if len(parts) < 3 {
+		return filter
+	}
+	return parts[2]
+}
+
+func (s *v5Session) start() {
+	go s.read()
+	go s.ping()
+	if s.messages != nil {
+		go s.dispatch()
+	}
+}
+
+func (s *v5Session) write(packet []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	timeout := s.client.opts.WriteTimeout
+	if timeout <= 0 {
+		timeout = defaultV5WriteTimeout
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := s.conn.Write(packet)
+	return err
+}
+
+// register gives a token a packet id, so it can be completed by the ack for it.
+func (s *v5Session) register(t *v5Token) (uint16, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == nil {
+		return 0, errV5Disconnected
+	}
+	for i := 0; i < 65535; i++ {
+		s.nextId++
+		if s.nextId == 0 {
+			s.nextId = 1
+		}
+		if s.pending[s.nextId] == nil {
+			s.pending[s.nextId] = t
+			return s.nextId, nil
+		}
+	}
+	return 0, errors.New("mqtt5: no free packet ids")
+}
+
+func (s *v5Session) unregister(id uint16) *v5Token {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.pending[id]
+	delete(s.pending, id)
+	return t
+}
+
+func (s *v5Session) outstanding() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// close closes the connection and fails what's waiting for an ack. It returns true the first time.
+func (s *v5Session) close(err error) bool {
+	first := false
+	s.closeOnce.Do(func() {
+		first = true
+		close(s.done)
+		_ = s.conn.Close()
+		s.mu.Lock()
+		pending := s.pending
+		s.pending = nil
+		s.mu.Unlock()
+		for _, t := range pending {
+			t.complete(err)
+		}
+	})
+	return first
+}
+
+// lost closes a connection we didn't choose to close, and tells the client unless it disconnected.
+func (s *v5Session) lost(err error) {
+	if !s.close(err) {
+		return
+	}
+	c := s.client
+	c.mu.Lock()
+	current := c.session == s
+	if current {
+		c.session = nil
+	}
+	c.mu.Unlock()
+	if current && c.opts.OnConnectionLost != nil {
+		go c.opts.OnConnectionLost(nil, err)
+	}
+}
+
+func (s *v5Session) read() {
+	for {
+		header, body, err := readV5Packet(s.r)
+		if err == nil {
+			atomic.StoreInt32(&s.pinging, 0) // anything will do to show the broker is there
+			err = s.handle(header, body)
+		}
+		if err != nil {
+			s.lost(err)
+			return
+		}
+	}
+}
+
+func (s *v5Session) handle(header byte, body []byte) error {
+	kind := header >> 4
+	switch kind {
+	case v5Publish:
+		pub, err := parseV5Publish(header, body)
+		if err != nil {
+			return err
+		}
+		return s.received(pub)
+	case v5Puback, v5Suback, v5Unsuback:
+		id, reasons, props, err := parseV5Ack(kind, body)
+		if err != nil {
+			return err
+		}
+		if t := s.unregister(id); t != nil {
+			var failed error
+			for _, code := range reasons {
+				if code >= 0x80 {
+					failed = v5ReasonError(code, props.reason)
+				}
+			}
+			t.complete(failed)
+		}
+	case v5Pubrel:
+		id, _, _, err := parseV5Ack(kind, body)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		delete(s.qos2, id)
+		s.mu.Unlock()
+		return s.write(encodeV5Ack(v5Pubcomp, id))
+	case v5Pingresp:
+	case v5Disconnect:
+		p := v5Parser{buf: body}
+		var code byte
+		var props v5Properties
+		if !p.empty() {
+			code = p.byte()
+			props = p.properties()
+		}
+		return fmt.Errorf("broker disconnected: %w", v5ReasonError(code, props.reason))
+	default:
+		return fmt.Errorf("mqtt5: unexpected packet type %d", kind)
+	}
+	return nil
+}
+
+// received passes a message on to the handlers. When order matters, one goroutine runs them in the order
+// the messages arrive. Otherwise they run in a goroutine each, like paho.
+func (s *v5Session) received(pub v5PublishPacket) error {
+	if pub.qos == 2 {
+		s.mu.Lock()
+		duplicate := s.qos2[pub.id]
+		s.qos2[pub.id] = true
+		s.mu.Unlock()
+		if duplicate {
+			return nil // we already have it, PUBREC is sent when its handlers are done
+		}
+	}
+	m := &v5Message{pub: pub, session: s}
+	if s.messages == nil {
+		go s.deliver(m)
+		return nil
+	}
+	select {
+	case s.messages <- m:
+	case <-s.done:
+	}
+	return nil
+}
+
+func (s *v5Session) dispatch() {
+	for {
+		select {
+		case m := <-s.messages:
+			s.deliver(m)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *v5Session) deliver(m *v5Message) {
+	for _, h := range s.client.handlers(m.Topic()) {
+		h(nil, m)
+	}
+	m.Ack()
+}
+
+// ping sends PINGREQ every keep alive interval, and closes the connection if nothing comes back in time.
+func (s *v5Session) ping() {
+	if s.keepAlive <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		atomic.StoreInt32(&s.pinging, 1)
+		if err := s.write(encodeV5Packet(v5Pingreq, 0, nil)); err != nil {
+			s.lost(err)
+			return
+		}
+		timer := time.NewTimer(s.client.opts.PingTimeout)
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if atomic.LoadInt32(&s.pinging) == 1 {
+			s.lost(errV5PingTimeout)
+			return
+		}
+	}
+}
+
+// v5Message is a received message. It's a paho.Message, with the user properties as well.
+type v5Message struct {
+	pub     v5PublishPacket
+	session *v5Session
+	once    sync.Once
+}
+
+func (m *v5Message) Duplicate() bool   { return m.pub.dup }
+func (m *v5Message) Qos() byte         { return m.pub.qos }
+func (m *v5Message) Retained() bool    { return m.pub.retained }
+func (m *v5Message) Topic() string     { return m.pub.topic }
+func (m *v5Message) MessageID() uint16 { return m.pub.id }
+func (m *v5Message) Payload() []byte   { return m.pub.payload }
+
+// UserProperties returns the MQTT 5 user properties, in the order they were sent.
+func (m *v5Message) UserProperties() []UserProperty {
+	return m.pub.props.user
+}
+
+// Ack sends PUBACK for QoS 1 and PUBREC for QoS 2. It's done once the handlers have returned.
+func (m *v5Message) Ack() {
+	m.once.Do(func() {
+		switch m.pub.qos {
+		case 1:
+			_ = m.session.write(encodeV5Ack(v5Puback, m.pub.id))
+		case 2:
+			_ = m.session.write(encodeV5Ack(v5Pubrec, m.pub.id))
+		}
+	})
+}
+
+// v5Token implements paho.Token.
+type v5Token struct {
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+func newV5Token() *v5Token {
+	return &v5Token{done: make(chan struct{})}
+}
+
+func (t *v5Token) complete(err error) {
+	t.once.Do(func() {
+		t.err = err
+		close(t.done)
+	})
+}
+
+func (t *v5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *v5Token) WaitTimeout(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *v5Token) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *v5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
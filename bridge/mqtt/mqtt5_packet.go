@@ -0,0 +1,402 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MQTT 5 control packet types.
+const (
+	v5Connect     = 1
+	v5Connack     = 2
+	v5Publish     = 3
+	v5Puback      = 4
+	v5Pubrec      = 5
+	v5Pubrel      = 6
+	v5Pubcomp     = 7
+	v5Subscribe   = 8
+	v5Suback      = 9
+	v5Unsubscribe = 10
+	v5Unsuback    = 11
+	v5Pingreq     = 12
+	v5Pingresp    = 13
+	v5Disconnect  = 14
+	v5Auth        = 15
+)
+
+// MQTT 5 properties we read or write. The rest are skipped.
+const (
+	propServerKeepAlive = 0x13
+	propReasonString    = 0x1f
+	propUserProperty    = 0x26
+)
+
+var errMalformed = errors.New("mqtt5: malformed packet")
+
+// v5Properties are the properties we care about in a packet.
+type v5Properties struct {
+	user            []UserProperty
+	reason          string
+	serverKeepAlive int // -1 if not set
+}
+
+// readV5Packet reads the fixed header and the rest of a packet.
+func readV5Packet(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := 0
+	for shift := 0; ; shift += 7 {
+		if shift > 21 {
+			return 0, nil, errMalformed
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func encodeV5Packet(kind, flags byte, body []byte) []byte {
+	packet := appendVarint([]byte{kind<<4 | flags}, len(body))
+	return append(packet, body...)
+}
+
+func appendVarint(b []byte, n int) []byte {
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func appendV5String(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func appendV5Bytes(b []byte, data []byte) []byte {
+	b = append(b, byte(len(data)>>8), byte(len(data)))
+	return append(b, data...)
+}
+
+// appendUserProperties writes a property block with the user properties.
+func appendUserProperties(b []byte, props []UserProperty) []byte {
+	var block []byte
+	for _, p := range props {
+		block = append(block, propUserProperty)
+		block = appendV5String(block, p.Key)
+		block = appendV5String(block, p.Value)
+	}
+	b = appendVarint(b, len(block))
+	return append(b, block...)
+}
+
+type v5Will struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+}
+
+func encodeV5Connect(clientId, username, password string, will *v5Will, keepAlive uint16, cleanStart bool) []byte {
+	body := appendV5String(nil, "MQTT")
+	body = append(body, 5)
+	var flags byte
+	if cleanStart {
+		flags |= 0x02
+	}
+	if will != nil {
+		flags |= 0x04 | will.qos<<3
+		if will.retain {
+			flags |= 0x20
+		}
+	}
+	if password != "" {
+		flags |= 0x40
+	}
+	if username != "" {
+		flags |= 0x80
+	}
+	body = append(body, flags, byte(keepAlive>>8), byte(keepAlive))
+	body = appendVarint(body, 0) // no properties
+	body = appendV5String(body, clientId)
+	if will != nil {
+		body = appendVarint(body, 0) // no will properties
+		body = appendV5String(body, will.topic)
+		body = appendV5Bytes(body, will.payload)
+	}
+	if username != "" {
+		body = appendV5String(body, username)
+	}
+	if password != "" {
+		body = appendV5Bytes(body, []byte(password))
+	}
+	return encodeV5Packet(v5Connect, 0, body)
+}
+
+func encodeV5Publish(topicName string, payload []byte, qos byte, retain bool, id uint16, props []UserProperty) []byte {
+	flags := qos << 1
+	if retain {
+		flags |= 0x01
+	}
+	body := appendV5String(nil, topicName)
+	if qos > 0 {
+		body = append(body, byte(id>>8), byte(id))
+	}
+	body = appendUserProperties(body, props)
+	return encodeV5Packet(v5Publish, flags, append(body, payload...))
+}
+
+// encodeV5Ack encodes PUBACK, PUBREC, PUBREL and PUBCOMP with success, which only needs the packet id.
+func encodeV5Ack(kind byte, id uint16) []byte {
+	var flags byte
+	if kind == v5Pubrel {
+		flags = 0x02
+	}
+	return encodeV5Packet(kind, flags, []byte{byte(id >> 8), byte(id)})
+}
+
+func encodeV5Subscribe(id uint16, filters []string, qos byte) []byte {
+	body := []byte{byte(id >> 8), byte(id)}
+	body = appendVarint(body, 0)
+	for _, f := range filters {
+		body = appendV5String(body, f)
+		body = append(body, qos&0x03)
+	}
+	return encodeV5Packet(v5Subscribe, 0x02, body)
+}
+
+func encodeV5Unsubscribe(id uint16, filters []string) []byte {
+	body := []byte{byte(id >> 8), byte(id)}
+	body = appendVarint(body, 0)
+	for _, f := range filters {
+		body = appendV5String(body, f)
+	}
+	return encodeV5Packet(v5Unsubscribe, 0x02, body)
+}
+
+// v5Parser reads fields from a packet body. The first error sticks, so fields can be read without
+// checking every one of them.
+type v5Parser struct {
+	buf []byte
+	err error
+}
+
+func (p *v5Parser) next(n int) []byte {
+	if p.err != nil || n < 0 || len(p.buf) < n {
+		p.err = errMalformed
+		return make([]byte, maxInt(n, 0))
+	}
+	b := p.buf[:n]
+	p.buf = p.buf[n:]
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (p *v5Parser) byte() byte {
+	return p.next(1)[0]
+}
+
+func (p *v5Parser) uint16() uint16 {
+	return binary.BigEndian.Uint16(p.next(2))
+}
+
+func (p *v5Parser) uint32() uint32 {
+	return binary.BigEndian.Uint32(p.next(4))
+}
+
+func (p *v5Parser) varint() int {
+	n := 0
+	for shift := 0; ; shift += 7 {
+		if shift > 21 {
+			p.err = errMalformed
+			return 0
+		}
+		b := p.byte()
+		if p.err != nil {
+			return 0
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return n
+		}
+	}
+}
+
+func (p *v5Parser) string() string {
+	return string(p.next(int(p.uint16())))
+}
+
+func (p *v5Parser) rest() []byte {
+	b := p.buf
+	p.buf = nil
+	return b
+}
+
+func (p *v5Parser) empty() bool {
+	return len(p.buf) == 0
+}
+
+// properties reads a property block. Properties we don't use are skipped, which needs their type.
+func (p *v5Parser) properties() v5Properties {
+	props := v5Properties{serverKeepAlive: -1}
+	block := v5Parser{buf: p.next(p.varint())}
+	for p.err == nil && block.err == nil && !block.empty() {
+		id := block.varint()
+		switch id {
+		case propUserProperty:
+			props.user = append(props.user, UserProperty{Key: block.string(), Value: block.string()})
+		case propReasonString:
+			props.reason = block.string()
+		case propServerKeepAlive:
+			props.serverKeepAlive = int(block.uint16())
+		case 0x01, 0x17, 0x19, 0x24, 0x25, 0x28, 0x29, 0x2a: // byte
+			block.byte()
+		case 0x21, 0x22, 0x23: // two byte integer
+			block.uint16()
+		case 0x02, 0x11, 0x18, 0x27: // four byte integer
+			block.uint32()
+		case 0x0b: // variable byte integer
+			block.varint()
+		case 0x03, 0x08, 0x12, 0x15, 0x1a, 0x1c: // string
+			block.string()
+		case 0x09, 0x16: // binary data
+			block.next(int(block.uint16()))
+		default:
+			block.err = fmt.Errorf("mqtt5: unknown property 0x%02x", id)
+		}
+	}
+	if p.err == nil {
+		p.err = block.err
+	}
+	return props
+}
+
+// v5PublishPacket is an incoming PUBLISH.
+type v5PublishPacket struct {
+	topic    string
+	payload  []byte
+	qos      byte
+	retained bool
+	dup      bool
+	id       uint16
+	props    v5Properties
+}
+
+func parseV5Publish(header byte, body []byte) (v5PublishPacket, error) {
+	pub := v5PublishPacket{
+		qos:      header >> 1 & 0x03,
+		retained: header&0x01 != 0,
+		dup:      header&0x08 != 0,
+	}
+	if pub.qos > 2 {
+		return pub, errMalformed
+	}
+	p := v5Parser{buf: body}
+	pub.topic = p.string()
+	if pub.qos > 0 {
+		pub.id = p.uint16()
+	}
+	pub.props = p.properties()
+	pub.payload = p.rest()
+	return pub, p.err
+}
+
+// parseV5Ack parses a packet that starts with a packet id and, in some, a reason code and properties:
+// PUBACK, PUBREC, PUBREL, PUBCOMP. SUBACK and UNSUBACK have a reason code for each filter.
+func parseV5Ack(kind byte, body []byte) (id uint16, reasons []byte, props v5Properties, err error) {
+	p := v5Parser{buf: body}
+	id = p.uint16()
+	props.serverKeepAlive = -1
+	switch kind {
+	case v5Suback, v5Unsuback:
+		props = p.properties()
+		reasons = p.rest()
+	default:
+		if !p.empty() {
+			reasons = []byte{p.byte()}
+		}
+		if !p.empty() {
+			props = p.properties()
+		}
+	}
+	return id, reasons, props, p.err
+}
+
+// v5ReasonError describes a reason code of 0x80 or more, which is a failure.
+func v5ReasonError(code byte, reason string) error {
+	text, ok := v5Reasons[code]
+	if !ok {
+		text = "unknown reason"
+	}
+	if reason != "" {
+		text += ": " + reason
+	}
+	return fmt.Errorf("mqtt5: %s (0x%02x)", text, code)
+}
+
+var v5Reasons = map[byte]string{
+	0x00: "normal disconnection",
+	0x04: "disconnect with will message",
+	0x80: "unspecified error",
+	0x81: "malformed packet",
+	0x82: "protocol error",
+	0x83: "implementation specific error",
+	0x84: "unsupported protocol version",
+	0x85: "client identifier not valid",
+	0x86: "bad user name or password",
+	0x87: "not authorized",
+	0x88: "server unavailable",
+	0x89: "server busy",
+	0x8a: "banned",
+	0x8b: "server shutting down",
+	0x8c: "bad authentication method",
+	0x8d: "keep alive timeout",
+	0x8e: "session taken over",
+	0x8f: "topic filter invalid",
+	0x90: "topic name invalid",
+	0x91: "packet identifier in use",
+	0x92: "packet identifier not found",
+	0x93: "receive maximum exceeded",
+	0x94: "topic alias invalid",
+	0x95: "packet too large",
+	0x96: "message rate too high",
+	0x97: "quota exceeded",
+	0x98: "administrative action",
+	0x99: "payload format invalid",
+	0x9a: "retain not supported",
+	0x9b: "QoS not supported",
+	0x9c: "use another server",
+	0x9d: "server moved",
+	0x9e: "shared subscriptions not supported",
+	0x9f: "connection rate exceeded",
+	0xa0: "maximum connect time",
+	0xa1: "subscription identifiers not supported",
+	0xa2: "wildcard subscriptions not supported",
+}
@@ -0,0 +1,172 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"github.com/celerway/metamorphosis/bridge/logging"
+	"github.com/celerway/metamorphosis/bridge/mqtt/mqtttest"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	is2 "github.com/matryer/is"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestV5Client(t *testing.T) {
+	is := is2.New(t)
+	broker, err := mqtttest.NewBroker()
+	is.NoErr(err)
+	defer broker.Close()
+
+	var mu sync.Mutex
+	var attempts []string
+	lost := make(chan error, 1)
+	opts := paho.NewClientOptions().AddBroker("tcp://127.0.0.1:1").AddBroker("tcp://" + broker.Addr())
+	opts.SetClientID("v5").SetConnectTimeout(time.Second)
+	opts.SetBinaryWill("status", []byte("offline"), 1, true)
+	opts.SetConnectionAttemptHandler(func(u *url.URL, cfg *tls.Config) *tls.Config {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts = append(attempts, u.Host)
+		return cfg
+	})
+	opts.SetConnectionLostHandler(func(_ paho.Client, err error) { lost <- err })
+	c := newV5Client(opts)
+
+	token := c.Connect()
+	is.True(token.WaitTimeout(5 * time.Second))
+	is.NoErr(token.Error())
+	is.True(c.IsConnected())
+	mu.Lock()
+	is.Equal(attempts, []string{"127.0.0.1:1", broker.Addr()}) // brokers are tried in order
+	mu.Unlock()
+	is.Equal(broker.Clients(), []string{"v5"})
+
+	received := make(chan paho.Message, 10)
+	token = c.Subscribe("devices/+", 1, func(_ paho.Client, msg paho.Message) { received <- msg })
+	is.True(token.WaitTimeout(5 * time.Second))
+	is.NoErr(token.Error())
+	is.True(broker.Subscribed("devices/+"))
+
+	props := []mqtttest.UserProperty{{Key: "msgid", Value: "1"}, {Key: "msgid", Value: "2"}}
+	broker.PublishMessage(mqtttest.Message{Topic: "devices/a", Payload: []byte("hello"), Qos: 1, Properties: props})
+	broker.Publish("other", []byte("not for us"), 1, false)
+	select {
+	case msg := <-received:
+		is.Equal(msg.Topic(), "devices/a")
+		is.Equal(string(msg.Payload()), "hello")
+		is.Equal(msg.Qos(), byte(1))
+		is.Equal(msg.(*v5Message).UserProperties(), []UserProperty{{Key: "msgid", Value: "1"}, {Key: "msgid", Value: "2"}})
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message")
+	}
+
+	token = c.Publish("up", 1, false, "from v5")
+	is.True(token.WaitTimeout(5 * time.Second))
+	is.NoErr(token.Error())
+	is.Equal(broker.Received()[0].Topic, "up")
+	is.Equal(string(broker.Received()[0].Payload), "from v5")
+	is.True(c.Publish("up", 2, false, "x").Error() != nil) // QoS 2 isn't supported
+
+	token = c.Unsubscribe("devices/+")
+	is.True(token.WaitTimeout(5 * time.Second))
+	is.NoErr(token.Error())
+	is.True(!broker.Subscribed("devices/+"))
+
+	// A lost connection is reported, pending tokens fail and the will is published.
+	broker.DisconnectAll()
+	select {
+	case err := <-lost:
+		is.True(err != nil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("lost connection not reported")
+	}
+	is.True(!c.IsConnected())
+	is.True(c.Subscribe("devices/+", 1, nil).Error() != nil)
+	will, ok := broker.Retained("status")
+	is.True(ok)
+	is.Equal(string(will.Payload), "offline")
+
+	// Disconnecting doesn't call the lost handler.
+	token = c.Connect()
+	is.True(token.WaitTimeout(5 * time.Second))
+	is.NoErr(token.Error())
+	c.Disconnect(100)
+	is.True(!c.IsConnected())
+	select {
+	case err := <-lost:
+		t.Fatalf("lost handler called on disconnect: %s", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestV5Client_Refused(t *testing.T) {
+	is := is2.New(t)
+	broker, err := mqtttest.NewBroker()
+	is.NoErr(err)
+	defer broker.Close()
+	broker.SetRefuseConnections(true)
+	c := newV5Client(paho.NewClientOptions().AddBroker("tcp://" + broker.Addr()))
+	token := c.Connect()
+	is.True(token.WaitTimeout(5 * time.Second))
+	is.True(token.Error() != nil)
+	is.Equal(token.Error().Error(), "mqtt5: server unavailable (0x88)")
+	is.True(!c.IsConnected())
+}
+
+func TestSubscribe_Failed(t *testing.T) {
+	is := is2.New(t)
+	broker, err := mqtttest.NewBroker()
+	is.NoErr(err)
+	defer broker.Close()
+	c := &client{paho: newV5Client(paho.NewClientOptions().AddBroker("tcp://" + broker.Addr())), logger: logging.Module("mqtt")}
+	is.True(c.Subscribe("devices/#") != nil) // not connected
+	is.Equal(c.Subscriptions(), []string{})  // so it's not kept, to be subscribed on reconnect
+	token := c.paho.Connect()
+	is.True(token.WaitTimeout(5 * time.Second))
+	is.NoErr(token.Error())
+	defer c.paho.Disconnect(100)
+	is.NoErr(c.Subscribe("devices/#")) // and can be tried again
+	is.Equal(c.Subscriptions(), []string{"devices/#"})
+}
+
+func TestParseV5Publish(t *testing.T) {
+	is := is2.New(t)
+	body := appendV5String(nil, "a/b")
+	body = append(body, 0, 7) // packet id
+	var props []byte
+	props = append(props, 0x01, 1)                              // payload format indicator
+	props = append(props, 0x02, 0, 0, 0, 60)                    // message expiry interval
+	props = appendV5String(append(props, 0x03), "text/plain")   // content type
+	props = appendV5Bytes(append(props, 0x09), []byte{1, 2, 3}) // correlation data
+	props = append(props, 0x0b, 0x80, 0x01)                     // subscription identifier 128
+	props = appendV5String(appendV5String(append(props, 0x26), "k"), "v")
+	body = appendVarint(body, len(props))
+	body = append(append(body, props...), "payload"...)
+
+	pub, err := parseV5Publish(v5Publish<<4|0x02|0x01, body)
+	is.NoErr(err)
+	is.Equal(pub.topic, "a/b")
+	is.Equal(pub.id, uint16(7))
+	is.Equal(pub.qos, byte(1))
+	is.True(pub.retained)
+	is.Equal(pub.props.user, []UserProperty{{Key: "k", Value: "v"}})
+	is.Equal(string(pub.payload), "payload")
+
+	// Truncated, and an unknown property.
+	_, err = parseV5Publish(v5Publish<<4|0x02, body[:10])
+	is.True(err != nil)
+	bad := append(appendV5String(nil, "a"), 0, 1, 2, 0x7f, 0)
+	_, err = parseV5Publish(v5Publish<<4|0x02, bad)
+	is.True(err != nil)
+}
+
+func TestTraceParent(t *testing.T) {
+	is := is2.New(t)
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc := traceParent([]UserProperty{{Key: "msgid", Value: "1"}, {Key: "traceparent", Value: tp}})
+	is.True(sc.IsValid())
+	is.Equal(sc.Traceparent(), tp)
+	is.True(!traceParent(nil).IsValid())
+	is.True(!traceParent([]UserProperty{{Key: "traceparent", Value: "garbage"}}).IsValid()) // a new trace
+}
@@ -0,0 +1,635 @@
+// Package mqtttest provides a small in-process MQTT 3.1.1 and 5 broker for tests.
+//
+// It supports what the bridge and paho use: CONNECT (with wills), PUBLISH at QoS 0-2, retained messages,
+// SUBSCRIBE/UNSUBSCRIBE with wildcards and PING. With MQTT 5, user properties are passed on to the
+// subscribers and the other properties are ignored. There are no persistent sessions and outgoing QoS 1/2
+// messages are never retransmitted. On top of that it can inject faults: latency, dropped messages,
+// refused connections and disconnects.
+package mqtttest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/celerway/metamorphosis/bridge/topic"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Broker is an in-process MQTT broker listening on localhost.
+type Broker struct {
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[*conn]struct{}
+	retained map[string]Message
+	received []Message
+	latency  time.Duration
+	dropRate float64
+	refuse   bool
+	rnd      *rand.Rand
+	wg       sync.WaitGroup
+}
+
+// Message is a message published to the broker.
+type Message struct {
+	Topic    string
+	Payload  []byte
+	Qos      byte
+	Retain   bool
+	ClientId string // empty if published through Broker.Publish
+	// Properties are the MQTT 5 user properties. They're only sent to MQTT 5 subscribers.
+	Properties []UserProperty
+}
+
+// UserProperty is an MQTT 5 user property.
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// NewBroker starts a broker on a random port on localhost.
+func NewBroker() (*Broker, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+	b := &Broker{
+		listener: l,
+		conns:    make(map[*conn]struct{}),
+		retained: make(map[string]Message),
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	b.wg.Add(1)
+	go b.accept()
+	return b, nil
+}
+
+// Addr returns the host:port the broker listens on.
+func (b *Broker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+// Host returns the host the broker listens on.
+func (b *Broker) Host() string {
+	host, _, _ := net.SplitHostPort(b.Addr())
+	return host
+}
+
+// Port returns the port the broker listens on.
+func (b *Broker) Port() int {
+	_, port, _ := net.SplitHostPort(b.Addr())
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// Close stops the broker and disconnects all clients.
+func (b *Broker) Close() {
+	_ = b.listener.Close()
+	b.DisconnectAll()
+	b.wg.Wait()
+}
+
+// Publish delivers a message to all matching subscribers, as if a client published it.
+func (b *Broker) Publish(topicName string, payload []byte, qos byte, retain bool) {
+	b.route(Message{Topic: topicName, Payload: payload, Qos: qos, Retain: retain})
+}
+
+// PublishMessage is Publish with all the fields of a message, like its user properties.
+func (b *Broker) PublishMessage(msg Message) {
+	msg.ClientId = ""
+	b.route(msg)
+}
+
+// Received returns the messages published by clients (including wills), oldest first.
+func (b *Broker) Received() []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Message(nil), b.received...)
+}
+
+// Retained returns the retained message for a topic.
+func (b *Broker) Retained(topicName string) (Message, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msg, ok := b.retained[topicName]
+	return msg, ok
+}
+
+// Clients returns the ids of the connected clients.
+func (b *Broker) Clients() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ids := make([]string, 0, len(b.conns))
+	for c := range b.conns {
+		if id, ok := c.id(); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Subscribed returns true if any client is subscribed with exactly this filter.
+func (b *Broker) Subscribed(filter string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		if _, ok := c.subscription(filter); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SetLatency delays every delivery to subscribers by d.
+func (b *Broker) SetLatency(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.latency = d
+}
+
+// SetDropRate makes the broker silently drop this fraction (0-1) of deliveries to subscribers.
+func (b *Broker) SetDropRate(rate float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dropRate = rate
+}
+
+// SetRefuseConnections makes the broker answer new connections with "server unavailable".
+func (b *Broker) SetRefuseConnections(refuse bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refuse = refuse
+}
+
+// DisconnectAll drops every client connection without a DISCONNECT, like a network failure would.
+// Wills are published.
+func (b *Broker) DisconnectAll() {
+	b.mu.Lock()
+	conns := make([]*conn, 0, len(b.conns))
+	for c := range b.conns {
+		conns = append(conns, c)
+	}
+	b.mu.Unlock()
+	for _, c := range conns {
+		c.close()
+	}
+}
+
+// takeOver disconnects any other connection with the same client id, as the spec requires.
+func (b *Broker) takeOver(c *conn, clientId string) {
+	b.mu.Lock()
+	var old []*conn
+	for other := range b.conns {
+		if id, ok := other.id(); other != c && ok && id == clientId {
+			old = append(old, other)
+		}
+	}
+	b.mu.Unlock()
+	for _, other := range old {
+		other.close()
+	}
+}
+
+func (b *Broker) accept() {
+	defer b.wg.Done()
+	for {
+		nc, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := newConn(b, nc)
+		b.mu.Lock()
+		b.conns[c] = struct{}{}
+		b.mu.Unlock()
+		b.wg.Add(2)
+		go func() {
+			defer b.wg.Done()
+			c.writeLoop()
+		}()
+		go func() {
+			defer b.wg.Done()
+			c.readLoop()
+			b.mu.Lock()
+			delete(b.conns, c)
+			b.mu.Unlock()
+		}()
+	}
+}
+
+// route records a message, handles retain and hands it to the subscribers.
+func (b *Broker) route(msg Message) {
+	b.mu.Lock()
+	if msg.ClientId != "" {
+		b.received = append(b.received, msg)
+	}
+	if msg.Retain {
+		if len(msg.Payload) == 0 {
+			delete(b.retained, msg.Topic)
+		} else {
+			b.retained[msg.Topic] = msg
+		}
+	}
+	conns := make([]*conn, 0, len(b.conns))
+	for c := range b.conns {
+		conns = append(conns, c)
+	}
+	b.mu.Unlock()
+	for _, c := range conns {
+		if qos, ok := c.matches(msg.Topic); ok {
+			b.deliver(c, msg, qos, false)
+		}
+	}
+}
+
+// deliver queues a message for a subscriber, applying the faults.
+func (b *Broker) deliver(c *conn, msg Message, subQos byte, retained bool) {
+	b.mu.Lock()
+	drop := b.dropRate > 0 && b.rnd.Float64() < b.dropRate
+	at := time.Now().Add(b.latency)
+	b.mu.Unlock()
+	if drop {
+		return
+	}
+	qos := msg.Qos
+	if subQos < qos {
+		qos = subQos
+	}
+	packet := encodePublish(msg.Topic, msg.Payload, qos, retained, c.nextPacketId(qos), c.v5(), msg.Properties)
+	c.queue(outgoing{at: at, packet: packet})
+}
+
+type outgoing struct {
+	at     time.Time
+	packet []byte
+}
+
+type subscription struct {
+	filter string
+	qos    byte
+}
+
+// conn is a single client connection.
+type conn struct {
+	broker      *Broker
+	nc          net.Conn
+	out         chan outgoing
+	done        chan struct{}
+	closeOnce   sync.Once
+	mu          sync.Mutex
+	clientId    string
+	version     byte // protocol level: 4 is MQTT 3.1.1, 5 is MQTT 5
+	isConnected bool
+	subs        []subscription
+	will        *Message
+	packetId    uint16
+}
+
+func newConn(b *Broker, nc net.Conn) *conn {
+	return &conn{
+		broker: b,
+		nc:     nc,
+		out:    make(chan outgoing, 1000),
+		done:   make(chan struct{}),
+	}
+}
+
+func (c *conn) connected() bool {
+	_, ok := c.id()
+	return ok
+}
+
+// id returns the client id and whether the client has connected.
+func (c *conn) id() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clientId, c.isConnected
+}
+
+func (c *conn) v5() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version == 5
+}
+
+func (c *conn) subscription(filter string) (subscription, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.subs {
+		if s.filter == filter {
+			return s, true
+		}
+	}
+	return subscription{}, false
+}
+
+// matches returns the highest QoS of the subscriptions matching the topic.
+func (c *conn) matches(topicName string) (byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var qos byte
+	found := false
+	for _, s := range c.subs {
+		if topic.Match(s.filter, topicName) {
+			if !found || s.qos > qos {
+				qos = s.qos
+			}
+			found = true
+		}
+	}
+	return qos, found
+}
+
+func (c *conn) nextPacketId(qos byte) uint16 {
+	if qos == 0 {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.packetId++
+	if c.packetId == 0 {
+		c.packetId = 1
+	}
+	return c.packetId
+}
+
+func (c *conn) queue(o outgoing) {
+	select {
+	case c.out <- o:
+	case <-c.done:
+	}
+}
+
+// close drops the connection. The will is published unless the client disconnected cleanly.
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		_ = c.nc.Close()
+		c.mu.Lock()
+		will := c.will
+		c.will = nil
+		c.isConnected = false
+		c.mu.Unlock()
+		if will != nil {
+			c.broker.route(*will)
+		}
+	})
+}
+
+func (c *conn) writeLoop() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case o := <-c.out:
+			if wait := time.Until(o.at); wait > 0 {
+				select {
+				case <-c.done:
+					return
+				case <-time.After(wait):
+				}
+			}
+			if _, err := c.nc.Write(o.packet); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+func (c *conn) readLoop() {
+	defer c.close()
+	r := bufio.NewReader(c.nc)
+	for {
+		header, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		if err := c.handle(header, body); err != nil {
+			return
+		}
+	}
+}
+
+func (c *conn) handle(header byte, body []byte) error {
+	kind := header >> 4
+	if kind != packetConnect && !c.connected() {
+		return errors.New("first packet must be CONNECT")
+	}
+	switch kind {
+	case packetConnect:
+		return c.handleConnect(body)
+	case packetPublish:
+		return c.handlePublish(header, body)
+	case packetPubrec: // our outgoing QoS 2 message, continue the handshake.
+		if len(body) < 2 {
+			return errMalformed
+		}
+		c.queue(outgoing{packet: encodeAck(packetPubrel<<4|0x02, body[:2])}) // MQTT 5 may add a reason code
+	case packetPubrel:
+		if len(body) < 2 {
+			return errMalformed
+		}
+		c.queue(outgoing{packet: encodeAck(packetPubcomp<<4, body[:2])})
+	case packetPuback, packetPubcomp: // we don't retransmit, so there's nothing to do.
+	case packetSubscribe:
+		return c.handleSubscribe(body)
+	case packetUnsubscribe:
+		return c.handleUnsubscribe(body)
+	case packetPingreq:
+		c.queue(outgoing{packet: []byte{packetPingresp << 4, 0}})
+	case packetDisconnect:
+		c.mu.Lock()
+		if len(body) == 0 || body[0] != 0x04 { // MQTT 5 can ask for the will to be published anyway
+			c.will = nil // clean disconnect, the will is discarded.
+		}
+		c.mu.Unlock()
+		return io.EOF
+	default:
+		return fmt.Errorf("unexpected packet type %d", kind)
+	}
+	return nil
+}
+
+func (c *conn) handleConnect(body []byte) error {
+	p := parser{buf: body}
+	_ = p.string() // protocol name
+	version := p.byte()
+	flags := p.byte()
+	_ = p.uint16() // keepalive
+	if version == 5 {
+		_ = p.properties()
+	}
+	clientId := p.string()
+	var will *Message
+	if flags&0x04 != 0 {
+		if version == 5 {
+			_ = p.properties() // will properties
+		}
+		will = &Message{
+			Topic:    p.string(),
+			Payload:  p.bytes(),
+			Qos:      (flags >> 3) & 0x03,
+			Retain:   flags&0x20 != 0,
+			ClientId: clientId,
+		}
+	}
+	if p.err != nil {
+		return p.err
+	}
+	c.broker.mu.Lock()
+	refuse := c.broker.refuse
+	c.broker.mu.Unlock()
+	if refuse {
+		// Written here rather than queued, so it's sent before the connection is closed.
+		if version == 5 {
+			_, _ = c.nc.Write([]byte{packetConnack << 4, 3, 0, 0x88, 0}) // 0x88: server unavailable
+		} else {
+			_, _ = c.nc.Write([]byte{packetConnack << 4, 2, 0, 3}) // 3: server unavailable
+		}
+		return errors.New("refusing connection")
+	}
+	c.broker.takeOver(c, clientId)
+	c.mu.Lock()
+	c.clientId = clientId
+	c.version = version
+	c.will = will
+	c.isConnected = true
+	c.mu.Unlock()
+	if version == 5 {
+		c.queue(outgoing{packet: []byte{packetConnack << 4, 3, 0, 0, 0}})
+	} else {
+		c.queue(outgoing{packet: []byte{packetConnack << 4, 2, 0, 0}})
+	}
+	return nil
+}
+
+func (c *conn) handlePublish(header byte, body []byte) error {
+	qos := (header >> 1) & 0x03
+	p := parser{buf: body}
+	topicName := p.string()
+	var id []byte
+	if qos > 0 {
+		id = p.next(2)
+	}
+	var props []UserProperty
+	if c.v5() {
+		props = p.properties()
+	}
+	if p.err != nil {
+		return p.err
+	}
+	clientId, _ := c.id()
+	c.broker.route(Message{
+		Topic:      topicName,
+		Payload:    append([]byte(nil), p.rest()...),
+		Qos:        qos,
+		Retain:     header&0x01 != 0,
+		ClientId:   clientId,
+		Properties: props,
+	})
+	switch qos {
+	case 1:
+		c.queue(outgoing{packet: encodeAck(packetPuback<<4, id)})
+	case 2:
+		c.queue(outgoing{packet: encodeAck(packetPubrec<<4, id)})
+	}
+	return nil
+}
+
+func (c *conn) handleSubscribe(body []byte) error {
+	p := parser{buf: body}
+	id := p.next(2)
+	v5 := c.v5()
+	if v5 {
+		_ = p.properties()
+	}
+	var added []subscription
+	codes := make([]byte, 0)
+	for len(p.buf) > 0 && p.err == nil {
+		filter := p.string()
+		qos := p.byte() & 0x03
+		if qos > 2 {
+			qos = 2
+		}
+		if topic.ValidateFilter(filter) != nil {
+			codes = append(codes, 0x80)
+			continue
+		}
+		added = append(added, subscription{filter: filter, qos: qos})
+		codes = append(codes, qos)
+	}
+	if p.err != nil {
+		return p.err
+	}
+	c.mu.Lock()
+	for _, s := range added {
+		replaced := false
+		for i := range c.subs {
+			if c.subs[i].filter == s.filter {
+				c.subs[i] = s
+				replaced = true
+			}
+		}
+		if !replaced {
+			c.subs = append(c.subs, s)
+		}
+	}
+	c.mu.Unlock()
+	if v5 {
+		id = append(id, 0) // no properties
+	}
+	c.queue(outgoing{packet: encodePacket(packetSuback, 0, append(id, codes...))})
+	// Retained messages are sent after the SUBACK.
+	c.broker.mu.Lock()
+	var retained []Message
+	for _, msg := range c.broker.retained {
+		retained = append(retained, msg)
+	}
+	c.broker.mu.Unlock()
+	for _, msg := range retained {
+		for _, s := range added {
+			if topic.Match(s.filter, msg.Topic) {
+				c.broker.deliver(c, msg, s.qos, true)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (c *conn) handleUnsubscribe(body []byte) error {
+	p := parser{buf: body}
+	id := p.next(2)
+	v5 := c.v5()
+	if v5 {
+		_ = p.properties()
+	}
+	var filters []string
+	for len(p.buf) > 0 && p.err == nil {
+		filters = append(filters, p.string())
+	}
+	if p.err != nil {
+		return p.err
+	}
+	c.mu.Lock()
+	for _, f := range filters {
+		for i := range c.subs {
+			if c.subs[i].filter == f {
+				c.subs = append(c.subs[:i], c.subs[i+1:]...)
+				break
+			}
+		}
+	}
+	c.mu.Unlock()
+	if v5 {
+		// A reason code for each filter, always success. There are no properties.
+		c.queue(outgoing{packet: encodePacket(packetUnsuback, 0, append(append(id, 0), make([]byte, len(filters))...))})
+		return nil
+	}
+	c.queue(outgoing{packet: encodeAck(packetUnsuback<<4, id)})
+	return nil
+}
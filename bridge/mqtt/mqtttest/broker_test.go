@@ -0,0 +1,125 @@
+package mqtttest
+
+import (
+	"fmt"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	is2 "github.com/matryer/is"
+	"testing"
+	"time"
+)
+
+func makeTestBroker(t *testing.T) *Broker {
+	b, err := NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.Close)
+	return b
+}
+
+func connectClient(t *testing.T, b *Broker, id string, configure func(*paho.ClientOptions)) paho.Client {
+	opts := paho.NewClientOptions().AddBroker(fmt.Sprintf("tcp://%s", b.Addr())).SetClientID(id)
+	opts.SetAutoReconnect(false)
+	if configure != nil {
+		configure(opts)
+	}
+	c := paho.NewClient(opts)
+	token := c.Connect()
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connect: %v", token.Error())
+	}
+	t.Cleanup(func() { c.Disconnect(10) })
+	return c
+}
+
+func subscribe(t *testing.T, c paho.Client, filter string, qos byte) chan paho.Message {
+	ch := make(chan paho.Message, 100)
+	token := c.Subscribe(filter, qos, func(_ paho.Client, msg paho.Message) { ch <- msg })
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("subscribe: %v", token.Error())
+	}
+	return ch
+}
+
+func receive(ch chan paho.Message, timeout time.Duration) (paho.Message, bool) {
+	select {
+	case msg := <-ch:
+		return msg, true
+	case <-time.After(timeout):
+		return nil, false
+	}
+}
+
+func TestBroker_PubSub(t *testing.T) {
+	is := is2.New(t)
+	b := makeTestBroker(t)
+	sub := connectClient(t, b, "sub", nil)
+	pub := connectClient(t, b, "pub", nil)
+	ch := subscribe(t, sub, "devices/+/telemetry", 2)
+	is.True(b.Subscribed("devices/+/telemetry"))
+	for qos := byte(0); qos <= 2; qos++ {
+		token := pub.Publish("devices/1/telemetry", qos, false, []byte{qos})
+		is.True(token.WaitTimeout(5 * time.Second))
+		is.NoErr(token.Error())
+		msg, ok := receive(ch, 5*time.Second)
+		is.True(ok)
+		is.Equal(msg.Payload(), []byte{qos})
+		is.Equal(msg.Qos(), qos)
+	}
+	pub.Publish("devices/1/status", 1, false, "nope").Wait() // QoS 1, so it has been routed when Wait returns.
+	b.Publish("devices/2/telemetry", []byte("injected"), 0, false)
+	msg, ok := receive(ch, 5*time.Second)
+	is.True(ok)
+	is.Equal(string(msg.Payload()), "injected") // the status message didn't match.
+	is.Equal(len(b.Received()), 4)
+	is.Equal(b.Received()[0].ClientId, "pub")
+}
+
+func TestBroker_RetainAndWill(t *testing.T) {
+	is := is2.New(t)
+	b := makeTestBroker(t)
+	connectClient(t, b, "dying", func(opts *paho.ClientOptions) {
+		opts.SetWill("status/dying", "offline", 1, true)
+	})
+	b.Publish("status/other", []byte("online"), 0, true)
+	b.DisconnectAll()
+	msg, ok := b.Retained("status/dying")
+	is.True(ok)
+	is.Equal(string(msg.Payload), "offline")
+	sub := connectClient(t, b, "sub", nil)
+	ch := subscribe(t, sub, "status/#", 1)
+	got := map[string]string{}
+	for i := 0; i < 2; i++ {
+		msg, ok := receive(ch, 5*time.Second)
+		is.True(ok)
+		is.True(msg.Retained())
+		got[msg.Topic()] = string(msg.Payload())
+	}
+	is.Equal(got, map[string]string{"status/dying": "offline", "status/other": "online"})
+}
+
+func TestBroker_Faults(t *testing.T) {
+	is := is2.New(t)
+	b := makeTestBroker(t)
+	sub := connectClient(t, b, "sub", nil)
+	ch := subscribe(t, sub, "#", 0)
+	b.SetDropRate(1)
+	b.Publish("a", []byte("dropped"), 0, false)
+	_, ok := receive(ch, 200*time.Millisecond)
+	is.True(!ok)
+	b.SetDropRate(0)
+	b.SetLatency(300 * time.Millisecond)
+	start := time.Now()
+	b.Publish("a", []byte("late"), 0, false)
+	msg, ok := receive(ch, 5*time.Second)
+	is.True(ok)
+	is.Equal(string(msg.Payload()), "late")
+	is.True(time.Since(start) >= 300*time.Millisecond)
+
+	b.SetRefuseConnections(true)
+	c := paho.NewClient(paho.NewClientOptions().AddBroker("tcp://" + b.Addr()).SetClientID("refused"))
+	token := c.Connect()
+	is.True(token.WaitTimeout(5 * time.Second))
+	is.True(token.Error() != nil)
+	is.Equal(b.Clients(), []string{"sub"})
+}
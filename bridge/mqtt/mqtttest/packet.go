@@ -0,0 +1,206 @@
+package mqtttest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// MQTT 3.1.1 and 5 control packet types.
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetPubrec      = 5
+	packetPubrel      = 6
+	packetPubcomp     = 7
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+)
+
+// propUserProperty is the MQTT 5 user property. It's the only property we look at.
+const propUserProperty = 0x26
+
+var errMalformed = errors.New("malformed packet")
+
+// readPacket reads the fixed header and the rest of a packet.
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := 0
+	for shift := 0; ; shift += 7 {
+		if shift > 21 {
+			return 0, nil, errMalformed
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func encodePacket(kind, flags byte, body []byte) []byte {
+	packet := []byte{kind<<4 | flags}
+	length := len(body)
+	for {
+		b := byte(length & 0x7f)
+		length >>= 7
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// encodeAck encodes the acks that only carry a packet id. header includes the flags.
+func encodeAck(header byte, id []byte) []byte {
+	return append([]byte{header, 2}, id...)
+}
+
+// encodePublish encodes a PUBLISH. With MQTT 5 (v5) it has the user properties.
+func encodePublish(topicName string, payload []byte, qos byte, retain bool, id uint16, v5 bool, props []UserProperty) []byte {
+	flags := qos << 1
+	if retain {
+		flags |= 0x01
+	}
+	body := appendString(nil, topicName)
+	if qos > 0 {
+		body = append(body, byte(id>>8), byte(id))
+	}
+	if v5 {
+		body = appendProperties(body, props)
+	}
+	return encodePacket(packetPublish, flags, append(body, payload...))
+}
+
+// appendProperties appends an MQTT 5 property block with the user properties.
+func appendProperties(b []byte, props []UserProperty) []byte {
+	var block []byte
+	for _, prop := range props {
+		block = append(block, propUserProperty)
+		block = appendString(block, prop.Key)
+		block = appendString(block, prop.Value)
+	}
+	return append(appendVarint(b, len(block)), block...)
+}
+
+func appendVarint(b []byte, n int) []byte {
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func appendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// parser reads fields from a packet body. The first error sticks, so fields can be read without
+// checking every one of them.
+type parser struct {
+	buf []byte
+	err error
+}
+
+func (p *parser) next(n int) []byte {
+	if p.err != nil || len(p.buf) < n {
+		p.err = errMalformed
+		return make([]byte, n)
+	}
+	b := p.buf[:n]
+	p.buf = p.buf[n:]
+	return b
+}
+
+func (p *parser) byte() byte {
+	return p.next(1)[0]
+}
+
+func (p *parser) uint16() uint16 {
+	return binary.BigEndian.Uint16(p.next(2))
+}
+
+func (p *parser) bytes() []byte {
+	return append([]byte(nil), p.next(int(p.uint16()))...)
+}
+
+func (p *parser) string() string {
+	return string(p.next(int(p.uint16())))
+}
+
+func (p *parser) varint() int {
+	n := 0
+	for shift := 0; shift <= 21; shift += 7 {
+		b := p.byte()
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return n
+		}
+	}
+	p.err = errMalformed
+	return 0
+}
+
+// properties reads an MQTT 5 property block and returns the user properties. The others are skipped.
+func (p *parser) properties() []UserProperty {
+	var props []UserProperty
+	block := parser{buf: p.next(p.varint())}
+	for p.err == nil && block.err == nil && len(block.buf) > 0 {
+		switch id := block.varint(); id {
+		case propUserProperty:
+			props = append(props, UserProperty{Key: block.string(), Value: block.string()})
+		case 0x01, 0x17, 0x19, 0x24, 0x25, 0x28, 0x29, 0x2a:
+			block.byte()
+		case 0x13, 0x21, 0x22, 0x23:
+			block.uint16()
+		case 0x02, 0x11, 0x18, 0x27:
+			block.next(4)
+		case 0x0b:
+			block.varint()
+		case 0x03, 0x08, 0x09, 0x12, 0x15, 0x16, 0x1a, 0x1c, 0x1f:
+			block.bytes()
+		default:
+			block.err = errMalformed
+		}
+	}
+	if p.err == nil {
+		p.err = block.err
+	}
+	return props
+}
+
+func (p *parser) rest() []byte {
+	b := p.buf
+	p.buf = nil
+	return b
+}
@@ -0,0 +1,178 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"path/filepath"
+	"time"
+)
+
+// What we do when the queue to Kafka is full.
+const (
+	// BackpressureBlock waits for room in paho's callback. Nothing else is read from the broker meanwhile,
+	// keepalives included, so a long wait gets us disconnected.
+	BackpressureBlock = "block"
+	// BackpressureSlow handles each message on its own goroutine and acks it once it's queued. For QoS 1 and 2
+	// the broker stops sending when its in-flight window is full, and keepalives still work. QoS 0 messages have
+	// no window, so they're dropped once SlowMaxHandlers are waiting. Order isn't kept while we wait.
+	BackpressureSlow = "slow"
+	// BackpressureSpill writes messages to disk while the queue is full and feeds them back in order.
+	BackpressureSpill = "spill"
+)
+
+// defaultSlowMaxHandlers is how many messages can be waiting for room at once with slow backpressure.
+const defaultSlowMaxHandlers = 1000
+
+// blockedWarning is how long we wait for room in the queue before we log it.
+const blockedWarning = time.Second
+
+func checkBackpressure(strategy string) error {
+	switch strategy {
+	case "", BackpressureBlock, BackpressureSlow, BackpressureSpill:
+		return nil
+	}
+	return fmt.Errorf("unknown backpressure strategy '%s' (expected block, slow or spill)", strategy)
+}
+
+func checkProtocolVersion(version int) error {
+	switch version {
+	case 0, 4, 5:
+		return nil
+	}
+	return fmt.Errorf("unsupported protocol version %d (expected 4 for MQTT 3.1.1 or 5)", version)
+}
+
+// spoolPath returns the spool file for a source.
+func spoolPath(dir, source string) string {
+	if source == "" {
+		source = "mqtt"
+	}
+	return filepath.Join(dir, source+".spool")
+}
+
+// enqueue passes a message on to the bridge.
+func (client *client) enqueue(msg ChannelMessage) {
+	if client.spool != nil {
+		// Once we've spilled, everything goes through the spool until it's drained, to keep the order.
+		if client.spool.empty() {
+			select {
+			case client.ch <- msg:
+				return
+			default:
+			}
+		}
+		err := client.spool.append(msg)
+		if errors.Is(err, errSpoolFull) {
+			// Wait for room in the spool rather than the queue, so the order is kept.
+			client.logger.Warnf("Spool is full (%d bytes), waiting for room", client.spool.size())
+			start := time.Now()
+			for errors.Is(err, errSpoolFull) {
+				select {
+				case <-client.spool.room:
+					err = client.spool.append(msg)
+				case <-client.done:
+					client.drop(msg)
+					return
+				}
+			}
+			client.blocked.Add(time.Since(start).Seconds())
+		}
+		if err == nil {
+			client.spilled.Inc()
+			client.spooled.Set(float64(client.spool.size()))
+			return
+		}
+		// It's going to be out of order, but that's better than losing it.
+		client.logger.Errorf("Could not spill message on '%s': %s", msg.Topic, err)
+	}
+	select {
+	case client.ch <- msg:
+		return
+	default:
+	}
+	start := time.Now()
+	select {
+	case client.ch <- msg:
+	case <-client.done:
+		client.shutdown(msg)
+		return
+	}
+	waited := time.Since(start)
+	client.blocked.Add(waited.Seconds())
+	if waited >= blockedWarning {
+		client.logger.Warnf("Waited %v for room in the queue to Kafka", waited.Round(time.Millisecond))
+	}
+}
+
+// shutdown takes care of a message there's no room for while we shut down. It's spilled if we can,
+// otherwise it's dropped.
+func (client *client) shutdown(msg ChannelMessage) {
+	if client.spool != nil {
+		if err := client.spool.append(msg); err == nil {
+			client.spilled.Inc()
+			client.spooled.Set(float64(client.spool.size()))
+			return
+		}
+	}
+	client.drop(msg)
+}
+
+func (client *client) drop(msg ChannelMessage) {
+	client.logger.Debugf("Shutting down, dropping message on topic %s", msg.Topic)
+	client.dropped.Inc()
+}
+
+// takeSlot reserves a slot for a message handler with slow backpressure. paho starts a goroutine for every
+// message, so this is what limits them. QoS 1 and 2 messages wait for a slot, as the broker's in-flight window
+// keeps their number down. QoS 0 messages have no such limit and are dropped when the slots are taken.
+// It returns false if the message is dropped.
+func (client *client) takeSlot(msg paho.Message) bool {
+	select {
+	case client.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if msg.Qos() == 0 {
+		client.logger.Debugf("Too many messages waiting for room, dropping QoS 0 message on topic %s", msg.Topic())
+		client.shed.Inc()
+		return false
+	}
+	select {
+	case client.slots <- struct{}{}:
+		return true
+	case <-client.done:
+		client.drop(ChannelMessage{Topic: msg.Topic()})
+		return false
+	}
+}
+
+// runSpool feeds spilled messages back into the queue until the context is cancelled. Whatever is left
+// stays on disk for the next run.
+func (client *client) runSpool(ctx context.Context) {
+	for {
+		msg, ok, err := client.spool.peek()
+		if err != nil {
+			client.logger.Error(err)
+			continue
+		}
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-client.spool.notify:
+				continue
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case client.ch <- msg:
+		}
+		if err := client.spool.pop(); err != nil {
+			client.logger.Error(err)
+		}
+		client.spooled.Set(float64(client.spool.size()))
+	}
+}
@@ -0,0 +1,112 @@
+package mqtt
+
+import (
+	"github.com/celerway/metamorphosis/bridge/logging"
+	is2 "github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+	"time"
+)
+
+func TestEnqueue_Shutdown(t *testing.T) {
+	is := is2.New(t)
+	ch := make(MessageChannel) // no one reads it, like a stalled Kafka
+	metrics := NewMetrics(ch)
+	newClient := func(sp *spool) *client {
+		return &client{
+			ch:      ch,
+			done:    make(chan struct{}),
+			spool:   sp,
+			logger:  logging.Module("mqtt"),
+			blocked: metrics.blocked.WithLabelValues("test"),
+			spilled: metrics.spilled.WithLabelValues("test"),
+			spooled: metrics.spooled.WithLabelValues("test"),
+			dropped: metrics.dropped.WithLabelValues("test"),
+		}
+	}
+	// Handlers waiting for room give up when we shut down, rather than send on a channel about to be closed.
+	c := newClient(nil)
+	returned := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		go func() {
+			c.enqueue(ChannelMessage{Topic: "t"})
+			returned <- struct{}{}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(c.done)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-returned:
+		case <-time.After(time.Second):
+			t.Fatal("enqueue didn't return on shutdown")
+		}
+	}
+	is.Equal(testutil.ToFloat64(c.dropped), 3.0)
+
+	// With a spool, they're spilled instead. One waits for room in the full spool, and is dropped.
+	sp, err := openSpool(spoolPath(t.TempDir(), "test"), 60)
+	is.NoErr(err)
+	defer sp.close()
+	c = newClient(sp)
+	c.enqueue(ChannelMessage{Topic: "a", Content: []byte("1")})
+	is.Equal(testutil.ToFloat64(c.spilled), 1.0)
+	go func() {
+		c.enqueue(ChannelMessage{Topic: "b", Content: []byte("2")})
+		returned <- struct{}{}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(c.done)
+	<-returned
+	is.Equal(testutil.ToFloat64(c.spilled), 1.0)
+	is.Equal(testutil.ToFloat64(c.dropped), 4.0)
+}
+
+type fakeMessage struct {
+	topic string
+	qos   byte
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return m.qos }
+func (m fakeMessage) Retained() bool    { return false }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return nil }
+func (m fakeMessage) Ack()              {}
+
+func TestTakeSlot(t *testing.T) {
+	is := is2.New(t)
+	metrics := NewMetrics(make(MessageChannel))
+	c := &client{
+		slots:   make(chan struct{}, 2),
+		done:    make(chan struct{}),
+		logger:  logging.Module("mqtt"),
+		shed:    metrics.shed.WithLabelValues("test"),
+		dropped: metrics.dropped.WithLabelValues("test"),
+	}
+	is.True(c.takeSlot(fakeMessage{topic: "t", qos: 0}))
+	is.True(c.takeSlot(fakeMessage{topic: "t", qos: 1}))
+	// All taken: QoS 0 is dropped right away, as there's no window to stop the broker sending more.
+	is.True(!c.takeSlot(fakeMessage{topic: "t", qos: 0}))
+	is.Equal(testutil.ToFloat64(c.shed), 1.0)
+	// QoS 1 waits for a slot.
+	got := make(chan bool)
+	go func() {
+		got <- c.takeSlot(fakeMessage{topic: "t", qos: 1})
+	}()
+	select {
+	case <-got:
+		t.Fatal("QoS 1 message didn't wait for a slot")
+	case <-time.After(20 * time.Millisecond):
+	}
+	<-c.slots
+	is.True(<-got)
+	// Until we shut down.
+	go func() {
+		got <- c.takeSlot(fakeMessage{topic: "t", qos: 2})
+	}()
+	close(c.done)
+	is.True(!<-got)
+	is.Equal(testutil.ToFloat64(c.dropped), 1.0)
+}
@@ -0,0 +1,213 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var errSpoolFull = errors.New("spool is full")
+
+const (
+	// spoolHeaderSize is the read offset at the start of the file, so a restart doesn't replay what
+	// was already delivered.
+	spoolHeaderSize = 8
+	// spoolCompactBytes is how much has to be read before we compact the file. We also wait until
+	// at least half of the file has been read, so the copying adds up to little.
+	spoolCompactBytes = 1 << 20
+)
+
+// openSpool opens (or creates) the spool file. Messages left from a previous run are kept and replayed.
+func openSpool(path string, maxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("spool: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("spool: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("spool: %w", err)
+	}
+	s := &spool{
+		f:         f,
+		path:      path,
+		w:         info.Size(),
+		maxBytes:  maxBytes,
+		compactAt: spoolCompactBytes,
+		notify:    make(chan struct{}, 1),
+		room:      make(chan struct{}, 1),
+	}
+	if maxBytes > 0 && maxBytes/2 < s.compactAt {
+		s.compactAt = maxBytes / 2
+	}
+	if s.w < spoolHeaderSize {
+		if err := s.reset(); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		return s, nil
+	}
+	var header [spoolHeaderSize]byte
+	if _, err := f.ReadAt(header[:], 0); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("spool: %w", err)
+	}
+	s.r = int64(binary.BigEndian.Uint64(header[:]))
+	if s.r < spoolHeaderSize || s.r > s.w {
+		s.r = spoolHeaderSize // we don't know where we were, so replay all of it.
+	}
+	return s, nil
+}
+
+// append writes a message to the end of the spool. maxBytes limits what's waiting to be read, not the file.
+// An empty spool takes any message, so one larger than maxBytes doesn't wait forever.
+func (s *spool) append(msg ChannelMessage) error {
+	body, err := json.Marshal(spooledMessage{Source: msg.Source, Topic: msg.Topic, Content: msg.Content, Properties: msg.Properties})
+	if err != nil {
+		return fmt.Errorf("spool: %w", err)
+	}
+	record := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(record, uint32(len(body)))
+	copy(record[4:], body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxBytes > 0 && s.w > s.r && s.w-s.r+int64(len(record)) > s.maxBytes {
+		return errSpoolFull
+	}
+	if _, err := s.f.WriteAt(record, s.w); err != nil {
+		return fmt.Errorf("spool: %w", err)
+	}
+	s.w += int64(len(record))
+	signal(s.notify)
+	return nil
+}
+
+// peek returns the oldest message without removing it. ok is false if the spool is empty.
+// A record cut short, by a crash while it was written, is dropped.
+func (s *spool) peek() (msg ChannelMessage, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.r >= s.w {
+		return msg, false, nil
+	}
+	var header [4]byte
+	if _, err := s.f.ReadAt(header[:], s.r); err != nil {
+		return msg, false, s.readError(err)
+	}
+	// Check the length against the file before we trust it, so a corrupt one doesn't allocate gigabytes.
+	size := int64(binary.BigEndian.Uint32(header[:]))
+	if 4+size > s.w-s.r {
+		return msg, false, s.readError(io.ErrUnexpectedEOF)
+	}
+	body := make([]byte, size)
+	if _, err := s.f.ReadAt(body, s.r+4); err != nil {
+		return msg, false, s.readError(err)
+	}
+	var sm spooledMessage
+	if err := json.Unmarshal(body, &sm); err != nil {
+		return msg, false, s.readError(err)
+	}
+	s.next = s.r + 4 + int64(len(body))
+	return ChannelMessage{Source: sm.Source, Topic: sm.Topic, Content: sm.Content, Properties: sm.Properties}, true, nil
+}
+
+// readError resets the spool if the rest of it can't be read, so we don't get stuck on it.
+func (s *spool) readError(err error) error {
+	_ = s.reset()
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("spool: dropping incomplete record at the end of %s", s.path)
+	}
+	return fmt.Errorf("spool: dropping unreadable records in %s: %w", s.path, err)
+}
+
+// pop removes the message returned by peek, and saves the read offset. The file is truncated once it's
+// empty, and compacted once enough of it has been read.
+func (s *spool) pop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer signal(s.room)
+	s.r = s.next
+	if s.r >= s.w {
+		return s.reset()
+	}
+	read := s.r - spoolHeaderSize
+	if read >= s.compactAt && read >= s.w-s.r {
+		return s.compact()
+	}
+	return s.saveOffset()
+}
+
+// compact moves what's left to the start of the file. It's truncated before the read offset is saved, so a
+// crash in between replays the messages rather than losing them.
+func (s *spool) compact() error {
+	left := s.w - s.r
+	buf := make([]byte, 64*1024)
+	for done := int64(0); done < left; {
+		n := int64(len(buf))
+		if left-done < n {
+			n = left - done
+		}
+		if _, err := s.f.ReadAt(buf[:n], s.r+done); err != nil {
+			return fmt.Errorf("spool: %w", err)
+		}
+		if _, err := s.f.WriteAt(buf[:n], spoolHeaderSize+done); err != nil {
+			return fmt.Errorf("spool: %w", err)
+		}
+		done += n
+	}
+	if err := s.f.Truncate(spoolHeaderSize + left); err != nil {
+		return fmt.Errorf("spool: %w", err)
+	}
+	s.r, s.next, s.w = spoolHeaderSize, spoolHeaderSize, spoolHeaderSize+left
+	return s.saveOffset()
+}
+
+func (s *spool) saveOffset() error {
+	var header [spoolHeaderSize]byte
+	binary.BigEndian.PutUint64(header[:], uint64(s.r))
+	if _, err := s.f.WriteAt(header[:], 0); err != nil {
+		return fmt.Errorf("spool: %w", err)
+	}
+	return nil
+}
+
+func (s *spool) reset() error {
+	s.r, s.w, s.next = spoolHeaderSize, spoolHeaderSize, spoolHeaderSize
+	if err := s.f.Truncate(spoolHeaderSize); err != nil {
+		return fmt.Errorf("spool: %w", err)
+	}
+	return s.saveOffset()
+}
+
+// signal wakes up whoever waits on ch, if anyone does.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// empty returns true if there is nothing in the spool.
+func (s *spool) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.r >= s.w
+}
+
+// size returns the bytes waiting in the spool.
+func (s *spool) size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w - s.r
+}
+
+func (s *spool) close() error {
+	return s.f.Close()
+}
@@ -0,0 +1,106 @@
+package mqtt
+
+import (
+	is2 "github.com/matryer/is"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	is := is2.New(t)
+	path := spoolPath(t.TempDir(), "eu")
+	is.Equal(filepath.Base(path), "eu.spool")
+	s, err := openSpool(path, 0)
+	is.NoErr(err)
+	is.True(s.empty())
+	is.NoErr(s.append(ChannelMessage{Source: "eu", Topic: "a", Content: []byte("1")}))
+	is.NoErr(s.append(ChannelMessage{Topic: "b", Content: []byte("2")}))
+	msg, ok, err := s.peek()
+	is.NoErr(err)
+	is.True(ok)
+	is.Equal(msg.Source, "eu")
+	is.Equal(msg.Topic, "a")
+	is.Equal(string(msg.Content), "1")
+	is.NoErr(s.pop())
+	is.NoErr(s.close())
+
+	// What's left is replayed when the spool is opened again.
+	s, err = openSpool(path, 0)
+	is.NoErr(err)
+	msg, ok, err = s.peek()
+	is.NoErr(err)
+	is.True(ok)
+	is.Equal(msg.Topic, "b") // the read offset is kept, so what was delivered isn't replayed.
+	is.NoErr(s.pop())
+	is.True(s.empty())
+	info, err := os.Stat(path)
+	is.NoErr(err)
+	is.Equal(info.Size(), int64(spoolHeaderSize)) // truncated once drained
+	is.NoErr(s.close())
+
+	// A record cut short is dropped.
+	is.NoErr(os.WriteFile(path, []byte{0, 0, 0, 0, 0, 0, 0, spoolHeaderSize, 0, 0, 0, 9, '{'}, 0o640))
+	s, err = openSpool(path, 0)
+	is.NoErr(err)
+	_, ok, err = s.peek()
+	is.True(err != nil)
+	is.True(!ok)
+	is.True(s.empty())
+	is.NoErr(s.close())
+
+	// So is a length larger than the file, without allocating it.
+	is.NoErr(os.WriteFile(path, []byte{0, 0, 0, 0, 0, 0, 0, spoolHeaderSize, 0xff, 0xff, 0xff, 0xff, '{', '}'}, 0o640))
+	s, err = openSpool(path, 0)
+	is.NoErr(err)
+	_, ok, err = s.peek()
+	is.True(err != nil)
+	is.True(!ok)
+	is.True(s.empty())
+	is.NoErr(s.close())
+
+	s, err = openSpool(path, 40)
+	is.NoErr(err)
+	is.NoErr(s.append(ChannelMessage{Topic: "a", Content: []byte("1")}))
+	is.Equal(s.append(ChannelMessage{Topic: "a", Content: []byte("1")}), errSpoolFull)
+	_, _, _ = s.peek()
+	is.NoErr(s.pop())
+	is.NoErr(s.append(ChannelMessage{Topic: "a", Content: make([]byte, 100)})) // too large, but the spool is empty
+	is.NoErr(s.close())
+}
+
+func TestSpool_Compact(t *testing.T) {
+	is := is2.New(t)
+	path := spoolPath(t.TempDir(), "")
+	s, err := openSpool(path, 200)
+	is.NoErr(err)
+	// Under constant load the spool never drains, but the cap is on what's waiting, and the file is compacted.
+	next := 0
+	for i := 0; i < 1000; i++ {
+		is.NoErr(s.append(ChannelMessage{Topic: "t", Content: []byte(strconv.Itoa(i))}))
+		if i < 3 {
+			continue // keep a few waiting
+		}
+		msg, ok, err := s.peek()
+		is.NoErr(err)
+		is.True(ok)
+		is.Equal(string(msg.Content), strconv.Itoa(next))
+		next++
+		is.NoErr(s.pop())
+		info, err := os.Stat(path)
+		is.NoErr(err)
+		is.True(info.Size() <= spoolHeaderSize+400)
+	}
+	is.True(s.size() > 0 && s.size() < 200)
+	is.NoErr(s.close())
+
+	// The next run starts where we left off.
+	s, err = openSpool(path, 200)
+	is.NoErr(err)
+	msg, ok, err := s.peek()
+	is.NoErr(err)
+	is.True(ok)
+	is.Equal(string(msg.Content), strconv.Itoa(next))
+	is.NoErr(s.close())
+}
@@ -0,0 +1,96 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+const (
+	stateOnline   = "online"
+	stateOffline  = "offline"
+	statusTimeout = 5 * time.Second
+)
+
+// statusMessage builds the status we publish.
+func (client *client) statusMessage(state string) Status {
+	now := time.Now()
+	status := Status{
+		State:   state,
+		Id:      client.clientId,
+		Source:  client.source,
+		Version: client.version,
+		Time:    &now,
+	}
+	if state == stateOnline {
+		status.Broker = client.broker()
+		status.Uptime = time.Since(client.started).Seconds()
+		status.Paused = client.Paused()
+	}
+	return status
+}
+
+// addKafkaStatus adds the state of the Kafka side. Only the periodic status has it, as Kafka might
+// still be starting up when we connect.
+func (client *client) addKafkaStatus(status *Status) {
+	if client.kafkaStatus == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), statusTimeout)
+	defer cancel()
+	kafka, err := client.kafkaStatus(ctx)
+	if err != nil {
+		status.KafkaError = err.Error()
+		return
+	}
+	status.Kafka = kafka
+}
+
+// will is the last will and testament. The broker publishes it if we go away without disconnecting.
+func (client *client) will() []byte {
+	payload, _ := json.Marshal(Status{State: stateOffline, Id: client.clientId, Source: client.source, Version: client.version})
+	return payload
+}
+
+// publishStatus publishes a retained status message, if a status topic is set.
+func (client *client) publishStatus(status Status) {
+	if client.statusTopic == "" {
+		return
+	}
+	payload, err := json.Marshal(status)
+	if err != nil {
+		client.logger.Errorf("Could not marshal status: %s", err)
+		return
+	}
+	token := client.paho.Publish(client.statusTopic, 1, true, payload)
+	if !token.WaitTimeout(statusTimeout) {
+		client.logger.Warnf("Timed out publishing status to '%s'", client.statusTopic)
+		return
+	}
+	if token.Error() != nil {
+		client.logger.Warnf("Could not publish status to '%s': %s", client.statusTopic, token.Error())
+		return
+	}
+	client.logger.Debugf("Published status '%s' to '%s'", status.State, client.statusTopic)
+}
+
+// runStatus publishes the status every statusInterval until the context is cancelled.
+func (client *client) runStatus(ctx context.Context) {
+	if client.statusTopic == "" || client.statusInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(client.statusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if client.paho.IsConnected() {
+				status := client.statusMessage(stateOnline)
+				client.addKafkaStatus(&status)
+				client.publishStatus(status)
+			}
+		}
+	}
+}
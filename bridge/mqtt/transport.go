@@ -0,0 +1,136 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// BrokerUrls returns the URLs we connect to, in order of preference. Params.Url is a comma separated list of
+// full URLs and is used as is, otherwise they're built from the brokers (host or host:port, comma separated),
+// port, TLS and transport settings.
+func BrokerUrls(p Params) ([]string, error) {
+	var urls []string
+	if p.Url != "" {
+		for _, raw := range strings.Split(p.Url, ",") {
+			raw = strings.TrimSpace(raw)
+			if raw == "" {
+				continue
+			}
+			if err := checkUrl(raw); err != nil {
+				return nil, err
+			}
+			urls = append(urls, raw)
+		}
+	} else {
+		for _, broker := range strings.Split(p.Broker, ",") {
+			broker = strings.TrimSpace(broker)
+			if broker == "" {
+				continue
+			}
+			u, err := brokerUrl(p, broker)
+			if err != nil {
+				return nil, err
+			}
+			urls = append(urls, u)
+		}
+	}
+	if len(urls) == 0 {
+		return nil, errors.New("no broker given")
+	}
+	return urls, nil
+}
+
+func checkUrl(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("broker url '%s': %w", raw, err)
+	}
+	switch u.Scheme {
+	case "mqtt", "tcp", "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "ws", "wss":
+	default:
+		return fmt.Errorf("broker url '%s': unsupported scheme '%s'", u.Redacted(), u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("broker url '%s': no host", u.Redacted())
+	}
+	return nil
+}
+
+// brokerUrl builds the URL for a broker, "host" or "host:port".
+func brokerUrl(p Params, broker string) (string, error) {
+	host := net.JoinHostPort(broker, strconv.Itoa(p.Port))
+	if h, port, err := net.SplitHostPort(broker); err == nil {
+		if _, err := strconv.Atoi(port); h == "" || err != nil {
+			return "", fmt.Errorf("invalid broker '%s'", broker)
+		}
+		host = broker
+	}
+	switch p.Transport {
+	case "", "tcp":
+		if p.Tls {
+			return "ssl://" + host, nil
+		}
+		return "mqtt://" + host, nil
+	case "ws":
+		u := url.URL{Scheme: "ws", Host: host, Path: p.WsPath}
+		if p.Tls {
+			u.Scheme = "wss"
+		}
+		if u.Path == "" {
+			u.Path = "/mqtt"
+		}
+		return u.String(), nil
+	default:
+		return "", fmt.Errorf("unknown transport '%s' (expected tcp or ws)", p.Transport)
+	}
+}
+
+// isTls returns true if the broker URL uses TLS.
+func isTls(brokerUrl string) bool {
+	scheme, _, _ := strings.Cut(brokerUrl, "://")
+	switch scheme {
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "wss":
+		return true
+	}
+	return false
+}
+
+// ParseHeaders parses extra HTTP headers for the websocket handshake, like "Authorization: Bearer abc, X-Tenant: a".
+func ParseHeaders(spec string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid header '%s' (expected 'Name: value')", part)
+		}
+		headers.Add(name, strings.TrimSpace(value))
+	}
+	return headers, nil
+}
+
+// proxyFunc returns the proxy for websocket connections. An empty string uses the environment
+// (HTTPS_PROXY, HTTP_PROXY and NO_PROXY), "direct" doesn't use a proxy.
+func proxyFunc(proxy string) (paho.ProxyFunction, error) {
+	switch proxy {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case "direct":
+		return func(*http.Request) (*url.URL, error) { return nil, nil }, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy url '%s'", proxy)
+	}
+	return http.ProxyURL(u), nil
+}
@@ -1,39 +1,164 @@
 package mqtt
 
 import (
+	"context"
 	"crypto/tls"
+	"github.com/celerway/metamorphosis/bridge/logging"
 	"github.com/celerway/metamorphosis/bridge/observability"
-	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/celerway/metamorphosis/bridge/tracing"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"sync"
+	"time"
 )
 
 type Params struct {
-	Broker     string
+	Source     string // name of the source, when reading from several brokers. Added to the messages.
+	Broker     string // comma separated, in order of preference
 	Port       int
+	Url        string // full broker URLs, e.g. wss://mqtt.example.com/mqtt. Overrides Broker, Port, Tls and Transport.
+	Transport  string // tcp (default) or ws
+	WsPath     string // path for the ws transport. Defaults to /mqtt.
+	WsHeaders  http.Header
+	WsProxy    string // proxy URL for websockets. Empty uses the environment, "direct" disables it.
 	Clientid   string
+	Username   string
+	Password   string
 	Tls        bool
 	TlsConfig  *tls.Config
 	Channel    MessageChannel
 	Topic      string
 	ObsChannel observability.Channel
+	Metrics    *Metrics        // shared by all sources. Optional.
+	Tracer     *tracing.Tracer // nil disables tracing
+	// Backpressure is what we do when Channel is full: block (default), slow or spill.
+	Backpressure  string
+	SpillDir      string // where spilled messages are kept
+	SpillMaxBytes int64  // 0 is no limit
+	// ProtocolVersion is the MQTT version: 4 (3.1.1, the default) or 5. Only MQTT 5 has user properties.
+	ProtocolVersion int
+	// SlowMaxHandlers limits the message handlers in progress with slow backpressure. 0 is defaultSlowMaxHandlers.
+	SlowMaxHandlers int
+	// With several brokers, we move back to the first one once we've been on another for PreferPrimaryAfter.
+	PreferPrimaryAfter time.Duration
+	// Status is published, retained, to StatusTopic. Empty disables it.
+	StatusTopic    string
+	StatusInterval time.Duration // 0 only publishes when we connect and disconnect.
+	Version        string
+	KafkaStatus    func(ctx context.Context) (interface{}, error) // included in the status, if set.
+}
+
+// Status is what we publish to the status topic. The offline status is also the last will.
+type Status struct {
+	State      string      `json:"state"` // online or offline
+	Id         string      `json:"id"`
+	Source     string      `json:"source,omitempty"`
+	Broker     string      `json:"broker,omitempty"`
+	Version    string      `json:"version,omitempty"`
+	Time       *time.Time  `json:"time,omitempty"` // not set in the will, we don't know when that is sent.
+	Uptime     float64     `json:"uptime_seconds,omitempty"`
+	Paused     bool        `json:"paused,omitempty"`
+	Kafka      interface{} `json:"kafka,omitempty"`
+	KafkaError string      `json:"kafka_error,omitempty"`
 }
 
 type ChannelMessage struct {
+	Source  string // the source it was received from, empty with a single source
 	Topic   string
 	Content []byte
+	Trace   tracing.SpanContext // the receive span
+	// Properties are the MQTT 5 user properties, in the order they were sent. nil with MQTT 3.1.1.
+	Properties []UserProperty
+}
+
+// Property returns the value of the first user property with the key.
+func (m ChannelMessage) Property(key string) (string, bool) {
+	for _, p := range m.Properties {
+		if p.Key == key {
+			return p.Value, true
+		}
+	}
+	return "", false
+}
+
+// UserProperty is an MQTT 5 user property. A message can have several with the same key.
+type UserProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
 }
 
 type MessageChannel chan ChannelMessage
 
+// Metrics are labelled with the source.
+type Metrics struct {
+	queued    prometheus.GaugeFunc
+	received  *prometheus.CounterVec
+	connected *prometheus.GaugeVec
+	blocked   *prometheus.CounterVec
+	spilled   *prometheus.CounterVec
+	spooled   *prometheus.GaugeVec
+	dropped   *prometheus.CounterVec
+	shed      *prometheus.CounterVec
+}
+
+// spool is a file of messages we couldn't queue. It starts with the read offset (8 bytes), followed by
+// the records: a 4 byte length and a JSON spooledMessage.
+type spool struct {
+	mu        sync.Mutex
+	f         *os.File
+	path      string
+	r, w      int64         // read and write offsets
+	next      int64         // the offset after the record returned by peek
+	maxBytes  int64         // what can be waiting to be read
+	compactAt int64         // bytes read before we compact the file
+	notify    chan struct{} // signalled when a message is appended
+	room      chan struct{} // signalled when a message is removed
+}
+
+type spooledMessage struct {
+	Source     string         `json:"source,omitempty"`
+	Topic      string         `json:"topic"`
+	Content    []byte         `json:"content"`
+	Properties []UserProperty `json:"properties,omitempty"`
+}
+
 type client struct {
-	paho       paho.Client
-	tlsConfig  *tls.Config
-	broker     string
-	port       int
-	clientId   string
-	tls        bool
-	ch         MessageChannel
-	topic      string
-	obsChannel observability.Channel
-	logger     *log.Entry
+	paho         mqttClient // paho, or v5Client for MQTT 5
+	source       string
+	tlsConfig    *tls.Config
+	urls         []string // in order of preference
+	url          string   // the broker we're connected to, or trying to connect to
+	connectedAt  time.Time
+	connected    *prometheus.GaugeVec
+	preferAfter  time.Duration
+	clientId     string
+	tls          bool
+	ch           MessageChannel
+	obsChannel   observability.Channel
+	received     prometheus.Counter // nil unless there are several sources
+	blocked      prometheus.Counter
+	spilled      prometheus.Counter
+	spooled      prometheus.Gauge
+	dropped      prometheus.Counter
+	shed         prometheus.Counter
+	slots        chan struct{}  // with slow backpressure, one for each handler in progress. nil otherwise.
+	spool        *spool         // nil unless we spill to disk
+	done         chan struct{}  // closed on shutdown, so handlers waiting for room in the queue give up.
+	handlers     sync.WaitGroup // message handlers in progress. We wait for them before we return.
+	busy         int32          // message handlers in progress, for when we can't block on handlers.
+	logger       *log.Entry
+	mu           sync.Mutex // protects topics and paused, which can be changed at runtime.
+	topics       []string
+	paused       bool
+	closing      bool // set on shutdown, so we don't reconnect or take more messages.
+	traceSampler logging.Sampler
+	tracer       *tracing.Tracer
+	// status
+	statusTopic    string
+	statusInterval time.Duration
+	version        string
+	kafkaStatus    func(ctx context.Context) (interface{}, error)
+	started        time.Time
 }
@@ -2,17 +2,25 @@ package observability
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/celerway/metamorphosis/bridge/logging"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func (obs observability) Run(ctx context.Context) {
+// Run processes status messages and serves the HTTP endpoints until the context is cancelled.
+// Status messages are consumed until then even if the server fails, so the rest of the bridge never
+// blocks on them. An error from the server is logged right away and returned once we're done.
+func (obs *observability) Run(ctx context.Context) error {
 	obs.logger.Debug("Observability worker is running")
 	wg := sync.WaitGroup{}
 	wg.Add(1)
@@ -28,90 +36,198 @@ func (obs observability) Run(ctx context.Context) {
 			obs.handleChannelMessage(msg)
 		}
 	}()
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		obs.runHttpServer(ctx) // will return when context is cancelled.
-		obs.Cleanup()
-	}()
+	err := obs.Listen()
+	if err == nil {
+		err = obs.runHttpServer(ctx) // will return when context is cancelled, or the server fails.
+	}
+	if err != nil {
+		obs.logger.Errorf("%s. The endpoints are down until we restart.", err)
+	}
 	wg.Wait()
+	obs.Cleanup()
 	log.Info("Observability worker is done")
+	return err
 }
 
-func Initialize(params Params) *observability {
-	reg := prometheus.NewRegistry()
+// Listen opens the listen address and loads the TLS certificate, if there is one. Run calls it if it
+// hasn't been called, but calling it first makes start-up errors easy to handle.
+func (obs *observability) Listen() error {
+	if obs.listener != nil {
+		return nil
+	}
+	var tlsConfig *tls.Config
+	if obs.tlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(obs.tlsCertFile, obs.tlsKeyFile)
+		if err != nil {
+			return fmt.Errorf("observability service: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	ln, err := net.Listen("tcp", obs.listenAddr)
+	if err != nil {
+		return fmt.Errorf("observability service: %w", err)
+	}
+	obs.listener, obs.tlsConfig = ln, tlsConfig
+	return nil
+}
 
+func Initialize(params Params) (*observability, error) {
+	reg := prometheus.NewRegistry()
+	listenAddr := params.ListenAddr
+	if listenAddr == "" {
+		listenAddr = fmt.Sprintf(":%d", params.HealthPort)
+	}
+	if (params.TlsCertFile == "") != (params.TlsKeyFile == "") {
+		return nil, errors.New("observability: both TLS certificate and key must be set")
+	}
 	obs := observability{
-		channel:    params.Channel,
-		logger:     log.WithFields(log.Fields{"module": "observability"}),
-		healthPort: params.HealthPort,
-		promReg:    reg,
+		channel:      params.Channel,
+		logger:       logging.Module("observability"),
+		listenAddr:   listenAddr,
+		tlsCertFile:  params.TlsCertFile,
+		tlsKeyFile:   params.TlsKeyFile,
+		authUser:     params.AuthUser,
+		authPassword: params.AuthPassword,
+		authToken:    params.AuthToken,
+		promReg:      reg,
+		extra:        params.Collectors,
 	}
 
-	obs.mqttReceived = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+	obs.mqttReceived = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "mqtt_received",
 		Help: "Number of received MQTT messages",
 	})
-	obs.mqttErrors = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+	obs.mqttErrors = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "mqtt_errors",
 		Help: "Number of erroneous MQTT messages",
 	})
-	obs.kafkaSent = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+	obs.kafkaSent = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "kafka_sent",
 		Help: "Number of batches sent to kafka",
 	})
-	obs.kafkaErrors = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+	obs.kafkaErrors = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "kafka_errors",
 		Help: "No of errors encountered with Kafka",
 	})
-	obs.kafkaState = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+	obs.kafkaState = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "kafka_state",
 		Help: "Kafka status (0 is OK)",
 	})
-	return &obs // Return the struct so the bridge can adjust the health status.
+	obs.dedupeDrops = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dedupe_dropped",
+		Help: "Number of duplicate MQTT messages dropped by the bridge",
+	})
+	obs.oversize = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kafka_oversize_dropped",
+		Help: "Number of messages dropped because they exceed the max Kafka request size",
+	})
+	for _, c := range obs.collectors() {
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("observability: registering metrics: %w", err)
+		}
+	}
+	return &obs, nil // Return the struct so the bridge can adjust the health status.
 }
 
-// runHttpServer starts the http server that serves the healthz and metrics endpoints.
-// It blocks until the context is cancelled.
-func (obs *observability) runHttpServer(ctx context.Context) {
-	// We don't care about waitGroups and stuff here. We can be aborted at any time.
-	// router := mux.NewRouter().StrictSlash(true)
+// collectors returns all the metrics we register.
+func (obs *observability) collectors() []prometheus.Collector {
+	return append([]prometheus.Collector{
+		obs.mqttReceived,
+		obs.mqttErrors,
+		obs.kafkaSent,
+		obs.kafkaErrors,
+		obs.kafkaState,
+		obs.dedupeDrops,
+		obs.oversize,
+	}, obs.extra...)
+}
 
-	http.Handle("/metrics", promhttp.HandlerFor(obs.promReg, promhttp.HandlerOpts{}))
-	http.HandleFunc("/healthz", obs.HealthzHandler)
-	listenPort := fmt.Sprintf(":%d", obs.healthPort)
-	obs.logger.Infof("Observability service attempting to listen to port %s", listenPort)
+// runHttpServer starts the http server that serves the healthz and metrics endpoints.
+// It blocks until the context is cancelled or the server fails.
+func (obs *observability) runHttpServer(ctx context.Context) error {
+	// Each instance gets its own mux so several bridges can live in the same process.
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", obs.authenticate(promhttp.HandlerFor(obs.promReg, promhttp.HandlerOpts{})))
+	mux.HandleFunc("/healthz", obs.HealthzHandler) // left open so k8s probes work without credentials.
+	obs.logger.Infof("Observability service listening on %s (tls: %t)", obs.listener.Addr(), obs.tlsConfig != nil)
 	srv := &http.Server{
-		Addr: listenPort,
+		Handler:   mux,
+		TLSConfig: obs.tlsConfig,
 	}
+	errCh := make(chan error, 1)
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			obs.logger.Fatal(err)
+		var err error
+		if obs.tlsConfig != nil {
+			err = srv.ServeTLS(obs.listener, "", "") // the certificate is in TLSConfig
+		} else {
+			err = srv.Serve(obs.listener)
+		}
+		if err != http.ErrServerClosed {
+			errCh <- err
 		}
 	}()
-	<-ctx.Done()
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("observability service: %w", err)
+	case <-ctx.Done():
+	}
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 	err := srv.Shutdown(shutdownCtx)
+	wg.Wait()
 	if err != nil {
-		obs.logger.Fatalf("Observability service shutdown error: %s", err)
+		return fmt.Errorf("observability service shutdown: %w", err)
 	}
-	cancel() // cancel the shutdownCtx
-	wg.Wait()
+	return nil
+}
+
+// authenticate wraps the handler with basic or bearer auth, if configured.
+func (obs *observability) authenticate(next http.Handler) http.Handler {
+	if obs.authToken == "" && obs.authUser == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if obs.authorized(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if obs.authUser != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metamorphosis"`)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte("unauthorized"))
+	})
+}
+
+func (obs *observability) authorized(r *http.Request) bool {
+	if obs.authToken != "" {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, []byte("Bearer "+obs.authToken)) == 1 {
+			return true
+		}
+	}
+	if obs.authUser != "" {
+		user, password, ok := r.BasicAuth()
+		if ok && subtle.ConstantTimeCompare([]byte(user), []byte(obs.authUser)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(obs.authPassword)) == 1 {
+			return true
+		}
+	}
+	return false
 }
 
 func (obs *observability) Cleanup() {
 	obs.logger.Info("De-registering prometheus counters")
-	obs.promReg.Unregister(obs.mqttReceived) // During testing we run multiple bridges in the same binary.
-	obs.promReg.Unregister(obs.mqttErrors)   // So we must make sure that these don't collide.
-	obs.promReg.Unregister(obs.kafkaSent)
-	obs.promReg.Unregister(obs.kafkaState)
-
+	// During testing we run multiple bridges in the same binary, so we must make sure that these don't collide.
+	for _, c := range obs.collectors() {
+		obs.promReg.Unregister(c)
+	}
 }
 
-func (obs observability) handleChannelMessage(msg StatusMessage) {
+func (obs *observability) handleChannelMessage(msg StatusMessage) {
 	obs.logger.Tracef("Observability received %s", msg)
 
 	switch msg {
@@ -125,6 +241,10 @@ func (obs observability) handleChannelMessage(msg StatusMessage) {
 	case KafkaError:
 		obs.kafkaErrors.Inc()
 		obs.kafkaState.Set(1)
+	case DedupeDropped:
+		obs.dedupeDrops.Inc()
+	case KafkaOversize:
+		obs.oversize.Inc()
 	default:
 		obs.logger.Errorf("Observability: Unknown message recived")
 	}
@@ -135,7 +255,7 @@ func GetChannel(size int) Channel {
 }
 
 func (obs *observability) HealthzHandler(w http.ResponseWriter, _ *http.Request) {
-	if obs.ready {
+	if atomic.LoadInt32(&obs.ready) == 1 {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 	} else {
@@ -145,5 +265,5 @@ func (obs *observability) HealthzHandler(w http.ResponseWriter, _ *http.Request)
 }
 
 func (obs *observability) Ready() {
-	obs.ready = true
+	atomic.StoreInt32(&obs.ready, 1)
 }
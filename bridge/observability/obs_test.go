@@ -7,6 +7,7 @@ import (
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 	"io"
+	"net"
 	"net/http"
 	"sync"
 	"testing"
@@ -24,14 +25,17 @@ func Test_observability_Run(t *testing.T) {
 		Channel:    ch,
 		HealthPort: obsPort,
 	}
-	obs := Initialize(params)
+	obs, err := Initialize(params)
+	is.NoErr(err)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		obs.Run(ctx)
+		if err := obs.Run(ctx); err != nil {
+			t.Errorf("obs.Run: %s", err)
+		}
 	}()
 	time.Sleep(10 * time.Millisecond)
 	metrics, err := getMetrics(obsPort)
@@ -65,6 +69,72 @@ func Test_observability_Run(t *testing.T) {
 	wg.Wait()
 }
 
+// Two instances in the same process, with auth on one of them. Used to panic on duplicate registration.
+func Test_observability_MultipleInstances(t *testing.T) {
+	is := is2.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first, err := Initialize(Params{Channel: make(Channel), ListenAddr: "127.0.0.1:2001"})
+	is.NoErr(err)
+	second, err := Initialize(Params{Channel: make(Channel), ListenAddr: "127.0.0.1:2002", AuthToken: "sekrit"})
+	is.NoErr(err)
+	wg := sync.WaitGroup{}
+	for _, obs := range []*observability{first, second} {
+		obs := obs
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := obs.Run(ctx); err != nil {
+				t.Errorf("obs.Run: %s", err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	_, err = getMetrics(2001)
+	is.NoErr(err)
+	resp, err := http.Get("http://127.0.0.1:2002/metrics")
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusUnauthorized)
+	req, err := http.NewRequest("GET", "http://127.0.0.1:2002/metrics", nil)
+	is.NoErr(err)
+	req.Header.Set("Authorization", "Bearer sekrit")
+	resp, err = http.DefaultClient.Do(req)
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	resp, err = http.Get("http://127.0.0.1:2002/healthz") // no auth needed for health checks.
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, 423)
+	cancel()
+	wg.Wait()
+}
+
+// Listening on an address that is taken returns an error instead of exiting. Status messages are still
+// read until we're cancelled, so senders don't block.
+func Test_observability_ListenError(t *testing.T) {
+	is := is2.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	defer l.Close()
+	ch := make(Channel)
+	obs, err := Initialize(Params{Channel: ch, ListenAddr: l.Addr().String()})
+	is.NoErr(err)
+	is.True(obs.Listen() != nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- obs.Run(ctx)
+	}()
+	for i := 0; i < 10; i++ {
+		select {
+		case ch <- MattReceived:
+		case <-time.After(time.Second):
+			t.Fatal("status messages aren't read after the server failed")
+		}
+	}
+	cancel()
+	is.True(<-errCh != nil)
+}
+
 // getMetrics fetches the metrics from the /metrics endpoint and returns a map of metric name to value.
 func getMetrics(port int) (metricsMap, error) {
 	req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/metrics", port), nil)
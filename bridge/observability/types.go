@@ -1,8 +1,10 @@
 package observability
 
 import (
+	"crypto/tls"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	"net"
 )
 
 type Channel chan StatusMessage
@@ -14,15 +16,24 @@ const (
 	MqttError
 	KafkaSent
 	KafkaError
+	DedupeDropped
+	KafkaOversize
 )
 
 func (d StatusMessage) String() string {
-	return [...]string{"MattReceived", "MqttError", "KafkaSent", "KafkaError"}[d]
+	return [...]string{"MattReceived", "MqttError", "KafkaSent", "KafkaError", "DedupeDropped", "KafkaOversize"}[d]
 }
 
 type Params struct {
-	Channel    Channel
-	HealthPort int
+	Channel      Channel
+	HealthPort   int
+	ListenAddr   string // full listen address (host:port). Overrides HealthPort if set.
+	TlsCertFile  string // serve https if set
+	TlsKeyFile   string
+	AuthUser     string // basic auth for /metrics
+	AuthPassword string
+	AuthToken    string                 // bearer token for /metrics
+	Collectors   []prometheus.Collector // metrics kept by other packages, registered with ours.
 }
 
 type observability struct {
@@ -32,8 +43,18 @@ type observability struct {
 	kafkaSent    prometheus.Counter
 	kafkaErrors  prometheus.Counter
 	kafkaState   prometheus.Gauge
+	dedupeDrops  prometheus.Counter
+	oversize     prometheus.Counter
 	logger       *log.Entry
-	ready        bool
-	healthPort   int
+	ready        int32 // set once we're up. Read by the HTTP handlers, so it's accessed atomically.
+	listenAddr   string
+	tlsCertFile  string
+	tlsKeyFile   string
+	tlsConfig    *tls.Config  // set by Listen
+	listener     net.Listener // set by Listen
+	authUser     string
+	authPassword string
+	authToken    string
 	promReg      *prometheus.Registry
+	extra        []prometheus.Collector
 }
@@ -0,0 +1,296 @@
+package processor
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxBytes limits decompressed payloads, so a small message can't blow up into gigabytes.
+const defaultMaxBytes = 16 << 20
+
+var builtins = map[string]Factory{
+	"json-extract":  newJsonExtract,
+	"json-rename":   newJsonRename,
+	"json-add":      newJsonAdd,
+	"gunzip":        newDecompress,
+	"inflate":       newDecompress,
+	"hex-decode":    newHexDecode,
+	"base64-decode": newBase64Decode,
+}
+
+// json-extract replaces the payload with a field. A string field becomes the payload as it is, so it can
+// be decoded by the next processor, anything else is written as JSON.
+func newJsonExtract(cfg StepConfig) (Processor, error) {
+	if cfg.Field == "" {
+		return nil, errors.New("json-extract needs a field")
+	}
+	path := strings.Split(cfg.Field, ".")
+	return ProcessorFunc(func(msg *Message) error {
+		doc, err := decodeObject(msg.Content)
+		if err != nil {
+			return err
+		}
+		value, ok := lookup(doc, path)
+		if !ok {
+			return fmt.Errorf("no field '%s' in payload", cfg.Field)
+		}
+		if s, ok := value.(string); ok {
+			msg.Content = []byte(s)
+			return nil
+		}
+		msg.Content, err = json.Marshal(value)
+		return err
+	}), nil
+}
+
+// json-rename moves fields, given as old: new. Both can be nested (a.b). Missing fields are skipped.
+// The fields are moved at once, so a: b, b: a swaps them and a: b, b: c doesn't move a on to c.
+func newJsonRename(cfg StepConfig) (Processor, error) {
+	if len(cfg.Fields) == 0 {
+		return nil, errors.New("json-rename needs fields")
+	}
+	type rename struct {
+		from, to []string
+	}
+	// Sorted, so nested targets (b and b.c) are set in the same order every time.
+	targets := make(map[string]string, len(cfg.Fields))
+	renames := make([]rename, 0, len(cfg.Fields))
+	for _, from := range sortedKeys(cfg.Fields) {
+		s, ok := cfg.Fields[from].(string)
+		if !ok || s == "" || from == "" {
+			return nil, fmt.Errorf("json-rename: field '%s' must be renamed to a name", from)
+		}
+		if other, ok := targets[s]; ok {
+			return nil, fmt.Errorf("json-rename: fields '%s' and '%s' are both renamed to '%s'", other, from, s)
+		}
+		targets[s] = from
+		renames = append(renames, rename{from: strings.Split(from, "."), to: strings.Split(s, ".")})
+	}
+	return ProcessorFunc(func(msg *Message) error {
+		doc, err := decodeObject(msg.Content)
+		if err != nil {
+			return err
+		}
+		values := make([]interface{}, len(renames))
+		found := make([]bool, len(renames))
+		for i, r := range renames {
+			values[i], found[i] = lookup(doc, r.from)
+		}
+		for i, r := range renames {
+			if found[i] {
+				remove(doc, r.from)
+			}
+		}
+		for i, r := range renames {
+			if !found[i] {
+				continue
+			}
+			if err := set(doc, r.to, values[i]); err != nil {
+				return err
+			}
+		}
+		msg.Content, err = json.Marshal(doc)
+		return err
+	}), nil
+}
+
+// json-add sets fields. String values may refer to the topic: {topic} is the whole topic, {topic.N} is
+// level N (0 is the first, -1 the last) and {source} is the MQTT source.
+func newJsonAdd(cfg StepConfig) (Processor, error) {
+	if len(cfg.Fields) == 0 {
+		return nil, errors.New("json-add needs fields")
+	}
+	return ProcessorFunc(func(msg *Message) error {
+		doc, err := decodeObject(msg.Content)
+		if err != nil {
+			return err
+		}
+		for _, name := range sortedKeys(cfg.Fields) { // so a field and one inside it are set in the same order every time
+			value := cfg.Fields[name]
+			if s, ok := value.(string); ok {
+				if value, err = expand(s, msg); err != nil {
+					return err
+				}
+			}
+			if err := set(doc, strings.Split(name, "."), value); err != nil {
+				return err
+			}
+		}
+		msg.Content, err = json.Marshal(doc)
+		return err
+	}), nil
+}
+
+var placeholder = regexp.MustCompile(`\{(topic|source)(?:\.(-?\d+))?\}`)
+
+func expand(s string, msg *Message) (string, error) {
+	var err error
+	expanded := placeholder.ReplaceAllStringFunc(s, func(p string) string {
+		m := placeholder.FindStringSubmatch(p)
+		if m[1] == "source" {
+			return msg.Source
+		}
+		if m[2] == "" {
+			return msg.Topic
+		}
+		levels := strings.Split(msg.Topic, "/")
+		n, _ := strconv.Atoi(m[2])
+		if n < 0 {
+			n += len(levels)
+		}
+		if n < 0 || n >= len(levels) {
+			err = fmt.Errorf("topic '%s' has no level %s", msg.Topic, m[2])
+			return ""
+		}
+		return levels[n]
+	})
+	return expanded, err
+}
+
+// gunzip and inflate decompress the payload. inflate takes zlib (what HTTP calls deflate) as well as
+// raw deflate.
+func newDecompress(cfg StepConfig) (Processor, error) {
+	maxBytes := cfg.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxBytes
+	}
+	open := func(b []byte) (io.Reader, error) {
+		return gzip.NewReader(bytes.NewReader(b))
+	}
+	if cfg.Type == "inflate" {
+		open = func(b []byte) (io.Reader, error) {
+			if isZlib(b) {
+				return zlib.NewReader(bytes.NewReader(b))
+			}
+			return flate.NewReader(bytes.NewReader(b)), nil
+		}
+	}
+	return ProcessorFunc(func(msg *Message) error {
+		r, err := open(msg.Content)
+		if err != nil {
+			return err
+		}
+		out, err := ioutil.ReadAll(io.LimitReader(r, maxBytes+1))
+		if err != nil {
+			return err
+		}
+		if int64(len(out)) > maxBytes {
+			return fmt.Errorf("decompressed payload is larger than %d bytes", maxBytes)
+		}
+		msg.Content = out
+		return nil
+	}), nil
+}
+
+// isZlib checks for a zlib header: deflate with a valid header checksum.
+func isZlib(b []byte) bool {
+	return len(b) >= 2 && b[0]&0x0f == 8 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0
+}
+
+func newHexDecode(StepConfig) (Processor, error) {
+	return ProcessorFunc(func(msg *Message) error {
+		out, err := hex.DecodeString(string(bytes.TrimSpace(msg.Content)))
+		if err != nil {
+			return err
+		}
+		msg.Content = out
+		return nil
+	}), nil
+}
+
+func newBase64Decode(cfg StepConfig) (Processor, error) {
+	encodings := map[string]*base64.Encoding{
+		"":        base64.StdEncoding,
+		"std":     base64.StdEncoding,
+		"url":     base64.URLEncoding,
+		"raw-std": base64.RawStdEncoding,
+		"raw-url": base64.RawURLEncoding,
+	}
+	enc, ok := encodings[cfg.Encoding]
+	if !ok {
+		return nil, fmt.Errorf("unknown base64 encoding '%s' (std|url|raw-std|raw-url)", cfg.Encoding)
+	}
+	return ProcessorFunc(func(msg *Message) error {
+		out, err := enc.DecodeString(string(bytes.TrimSpace(msg.Content)))
+		if err != nil {
+			return err
+		}
+		msg.Content = out
+		return nil
+	}), nil
+}
+
+// decodeObject decodes a JSON object, keeping numbers as they are.
+func decodeObject(b []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("payload isn't a JSON object: %w", err)
+	}
+	if doc == nil {
+		return nil, errors.New("payload isn't a JSON object")
+	}
+	return doc, nil
+}
+
+func lookup(doc map[string]interface{}, path []string) (interface{}, bool) {
+	var value interface{} = doc
+	for _, field := range path {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = obj[field]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// set sets a field, creating the objects on the way.
+func set(doc map[string]interface{}, path []string, value interface{}) error {
+	obj := doc
+	for _, field := range path[:len(path)-1] {
+		next, ok := obj[field]
+		if !ok {
+			child := make(map[string]interface{})
+			obj[field], obj = child, child
+			continue
+		}
+		if obj, ok = next.(map[string]interface{}); !ok {
+			return fmt.Errorf("can't set '%s': '%s' isn't an object", strings.Join(path, "."), field)
+		}
+	}
+	obj[path[len(path)-1]] = value
+	return nil
+}
+
+func remove(doc map[string]interface{}, path []string) {
+	parent, ok := lookup(doc, path[:len(path)-1])
+	if obj, isObj := parent.(map[string]interface{}); ok && isObj {
+		delete(obj, path[len(path)-1])
+	}
+}
+
+func sortedKeys(fields map[string]interface{}) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
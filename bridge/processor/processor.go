@@ -0,0 +1,179 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/celerway/metamorphosis/bridge/topic"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+)
+
+// Processors transform payloads between MQTT and Kafka. Each route has a chain of them, and every
+// message goes through the chain of the first route matching its topic.
+
+// LoadConfig reads a JSON config file.
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// UnmarshalJSON keeps the raw step around, so custom processors can have options of their own.
+func (s *StepConfig) UnmarshalJSON(b []byte) error {
+	type plain StepConfig
+	if err := json.Unmarshal(b, (*plain)(s)); err != nil {
+		return err
+	}
+	s.Raw = append(json.RawMessage(nil), b...)
+	return nil
+}
+
+// New builds the chains. custom adds processor types, and may override the built-in ones.
+func New(cfg Config, custom map[string]Factory) (*Chain, error) {
+	factories := make(map[string]Factory, len(builtins)+len(custom))
+	for name, f := range builtins {
+		factories[name] = f
+	}
+	for name, f := range custom {
+		factories[name] = f
+	}
+	c := &Chain{metrics: newMetrics()}
+	for _, rc := range cfg.Routes {
+		if err := topic.ValidateFilter(rc.Filter); err != nil {
+			return nil, err
+		}
+		if len(rc.Processors) == 0 {
+			return nil, fmt.Errorf("route '%s' has no processors", rc.Filter)
+		}
+		r := route{filter: rc.Filter}
+		for _, sc := range rc.Processors {
+			s, err := c.newStep(rc, sc, factories)
+			if err != nil {
+				return nil, fmt.Errorf("route '%s': %w", rc.Filter, err)
+			}
+			r.steps = append(r.steps, s)
+		}
+		c.routes = append(c.routes, r)
+	}
+	return c, nil
+}
+
+func (c *Chain) newStep(rc RouteConfig, sc StepConfig, factories map[string]Factory) (step, error) {
+	f, ok := factories[sc.Type]
+	if !ok {
+		return step{}, fmt.Errorf("unknown processor type '%s'", sc.Type)
+	}
+	s := step{name: sc.Name, onError: sc.OnError}
+	if s.name == "" {
+		s.name = sc.Type
+	}
+	if s.onError == "" {
+		s.onError = rc.OnError
+	}
+	if s.onError == "" {
+		s.onError = OnErrorDrop
+	}
+	switch s.onError {
+	case OnErrorDrop, OnErrorPass, OnErrorDeadLetter:
+	default:
+		return step{}, fmt.Errorf("processor '%s': unknown on_error '%s' (drop|pass|dead-letter)", s.name, s.onError)
+	}
+	p, err := f(sc)
+	if err != nil {
+		return step{}, fmt.Errorf("processor '%s': %w", s.name, err)
+	}
+	s.processor = p
+	s.processed = c.metrics.processed.WithLabelValues(rc.Filter, s.name)
+	s.dropped = c.metrics.dropped.WithLabelValues(rc.Filter, s.name)
+	s.failed = c.metrics.failed.WithLabelValues(rc.Filter, s.name, s.onError)
+	return s, nil
+}
+
+// DeadLetters returns true if any step sends failed messages to the dead letter topic.
+func (c *Chain) DeadLetters() bool {
+	for _, r := range c.routes {
+		for _, s := range r.steps {
+			if s.onError == OnErrorDeadLetter {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Process runs the message through the chain of its route. With DeadLetter the original message is
+// returned, along with the error.
+func (c *Chain) Process(msg Message) (Message, Action, error) {
+	r := c.routeFor(msg.Topic)
+	if r == nil {
+		return msg, Forward, nil
+	}
+	original := msg
+	for _, s := range r.steps {
+		before := msg
+		// Processors may modify the content in place, so they get a copy of it.
+		msg.Content = append([]byte(nil), msg.Content...)
+		err := s.processor.Process(&msg)
+		switch {
+		case err == nil:
+			s.processed.Inc()
+			continue
+		case errors.Is(err, ErrDrop):
+			s.dropped.Inc()
+			return msg, Drop, nil
+		}
+		s.failed.Inc()
+		err = fmt.Errorf("processor '%s': %w", s.name, err)
+		switch s.onError {
+		case OnErrorPass:
+			msg = before
+		case OnErrorDeadLetter:
+			return original, DeadLetter, err
+		default:
+			return msg, Drop, err
+		}
+	}
+	return msg, Forward, nil
+}
+
+func (c *Chain) routeFor(name string) *route {
+	for i := range c.routes {
+		if topic.Match(c.routes[i].filter, name) {
+			return &c.routes[i]
+		}
+	}
+	return nil
+}
+
+func (f ProcessorFunc) Process(msg *Message) error {
+	return f(msg)
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		processed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "processor_processed",
+			Help: "Messages a processor has handled without errors",
+		}, []string{"route", "processor"}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "processor_dropped",
+			Help: "Messages a processor has chosen to drop",
+		}, []string{"route", "processor"}),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "processor_failed",
+			Help: "Messages a processor failed on, by what was done with them",
+		}, []string{"route", "processor", "on_error"}),
+	}
+}
+
+// Collectors returns the metrics, for observability to register.
+func (c *Chain) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{c.metrics.processed, c.metrics.dropped, c.metrics.failed}
+}
@@ -0,0 +1,178 @@
+package processor
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	is2 "github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuiltins(t *testing.T) {
+	is := is2.New(t)
+	run := func(cfg StepConfig, msg Message) (string, error) {
+		t.Helper()
+		p, err := builtins[cfg.Type](cfg)
+		is.NoErr(err)
+		err = p.Process(&msg)
+		return string(msg.Content), err
+	}
+	msg := func(content string) Message {
+		return Message{Source: "eu", Topic: "sites/oslo/sensor-1", Content: []byte(content)}
+	}
+
+	out, err := run(StepConfig{Type: "json-extract", Field: "data.raw"}, msg(`{"data":{"raw":"aGk="}}`))
+	is.NoErr(err)
+	is.Equal(out, "aGk=") // strings as they are
+	out, err = run(StepConfig{Type: "json-extract", Field: "data"}, msg(`{"data":{"n":1.50}}`))
+	is.NoErr(err)
+	is.Equal(out, `{"n":1.50}`) // anything else as JSON, numbers untouched
+	_, err = run(StepConfig{Type: "json-extract", Field: "missing"}, msg(`{"data":1}`))
+	is.True(err != nil)
+	_, err = run(StepConfig{Type: "json-extract", Field: "data"}, msg(`[1,2]`))
+	is.True(err != nil) // not an object
+
+	out, err = run(StepConfig{Type: "json-rename", Fields: map[string]interface{}{"t": "temperature", "meta.id": "id", "gone": "x"}},
+		msg(`{"t":21.5,"meta":{"id":"a"}}`))
+	is.NoErr(err)
+	is.Equal(out, `{"id":"a","meta":{},"temperature":21.5}`)
+	for i := 0; i < 20; i++ { // the same result whatever order the map gives us
+		out, err = run(StepConfig{Type: "json-rename", Fields: map[string]interface{}{"a": "b", "b": "a", "c": "d", "d": "e"}},
+			msg(`{"a":1,"b":2,"c":3,"d":4}`))
+		is.NoErr(err)
+		is.Equal(out, `{"a":2,"b":1,"d":3,"e":4}`) // swapped, and c isn't moved on to e
+	}
+	_, err = builtins["json-rename"](StepConfig{Fields: map[string]interface{}{"a": "x", "b": "x"}})
+	is.True(err != nil) // two fields to one name
+
+	out, err = run(StepConfig{Type: "json-add", Fields: map[string]interface{}{
+		"site": "{topic.1}", "device": "{topic.-1}", "from": "{source}:{topic}", "meta.v": 2.0,
+	}}, msg(`{"t":1}`))
+	is.NoErr(err)
+	is.Equal(out, `{"device":"sensor-1","from":"eu:sites/oslo/sensor-1","meta":{"v":2},"site":"oslo","t":1}`)
+	_, err = run(StepConfig{Type: "json-add", Fields: map[string]interface{}{"x": "{topic.5}"}}, msg(`{}`))
+	is.True(err != nil) // no such level
+
+	for i := 0; i < 20; i++ { // the object is set first, then the field in it
+		out, err = run(StepConfig{Type: "json-add", Fields: map[string]interface{}{
+			"meta": map[string]interface{}{}, "meta.v": 2.0, "a": "x", "b": "y", "c": "z",
+		}}, msg(`{}`))
+		is.NoErr(err)
+		is.Equal(out, `{"a":"x","b":"y","c":"z","meta":{"v":2}}`)
+	}
+
+	var gz, zl, fl bytes.Buffer
+	compress := func(w io.WriteCloser) {
+		_, _ = w.Write([]byte("hello hello hello"))
+		is.NoErr(w.Close())
+	}
+	compress(gzip.NewWriter(&gz))
+	compress(zlib.NewWriter(&zl))
+	fw, _ := flate.NewWriter(&fl, flate.BestCompression)
+	compress(fw)
+	out, err = run(StepConfig{Type: "gunzip"}, msg(gz.String()))
+	is.NoErr(err)
+	is.Equal(out, "hello hello hello")
+	out, err = run(StepConfig{Type: "inflate"}, msg(zl.String()))
+	is.NoErr(err)
+	is.Equal(out, "hello hello hello")
+	out, err = run(StepConfig{Type: "inflate"}, msg(fl.String()))
+	is.NoErr(err)
+	is.Equal(out, "hello hello hello")
+	_, err = run(StepConfig{Type: "gunzip", MaxBytes: 10}, msg(gz.String()))
+	is.True(err != nil) // too large
+	_, err = run(StepConfig{Type: "gunzip"}, msg("plain"))
+	is.True(err != nil)
+
+	out, err = run(StepConfig{Type: "hex-decode"}, msg("6869\n"))
+	is.NoErr(err)
+	is.Equal(out, "hi")
+	_, err = run(StepConfig{Type: "hex-decode"}, msg("zz"))
+	is.True(err != nil)
+	out, err = run(StepConfig{Type: "base64-decode", Encoding: "raw-url"}, msg("aGk_"))
+	is.NoErr(err)
+	is.Equal(out, "hi?")
+	_, err = builtins["base64-decode"](StepConfig{Encoding: "base32"})
+	is.True(err != nil)
+}
+
+func TestChain(t *testing.T) {
+	is := is2.New(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "processors.json")
+	is.NoErr(os.WriteFile(path, []byte(`{"routes": [
+		{"filter": "raw/#", "on_error": "dead-letter", "processors": [
+			{"type": "base64-decode"},
+			{"type": "json-add", "name": "add-site", "fields": {"site": "{topic.1}"}, "on_error": "pass"},
+			{"type": "only-big", "min": 3}
+		]},
+		{"filter": "#", "processors": [{"type": "hex-decode"}]}
+	]}`), 0o600))
+	cfg, err := LoadConfig(path)
+	is.NoErr(err)
+	onlyBig := func(cfg StepConfig) (Processor, error) {
+		var opts struct{ Min int }
+		if err := json.Unmarshal(cfg.Raw, &opts); err != nil {
+			return nil, err
+		}
+		return ProcessorFunc(func(msg *Message) error {
+			if len(msg.Content) < opts.Min {
+				return ErrDrop
+			}
+			return nil
+		}), nil
+	}
+	c, err := New(cfg, map[string]Factory{"only-big": onlyBig})
+	is.NoErr(err)
+	is.True(c.DeadLetters())
+
+	out, action, err := c.Process(Message{Topic: "raw/oslo", Content: []byte("eyJhIjoxfQ==")}) // {"a":1}
+	is.NoErr(err)
+	is.Equal(action, Forward)
+	is.Equal(string(out.Content), `{"a":1,"site":"oslo"}`)
+
+	out, action, err = c.Process(Message{Topic: "raw/oslo", Content: []byte("aGk=")}) // "hi", not JSON
+	is.NoErr(err)
+	is.Equal(action, Drop) // json-add passed it on, only-big dropped it
+	is.Equal(string(out.Content), "hi")
+
+	out, action, err = c.Process(Message{Topic: "raw/oslo", Content: []byte("!!")})
+	is.True(err != nil)
+	is.Equal(action, DeadLetter)
+	is.Equal(string(out.Content), "!!") // the original
+
+	out, action, err = c.Process(Message{Topic: "other", Content: []byte("zz")})
+	is.True(err != nil)
+	is.Equal(action, Drop)
+
+	out, action, _ = c.Process(Message{Topic: "$SYS/x", Content: []byte("zz")})
+	is.Equal(action, Forward) // no route
+	is.Equal(string(out.Content), "zz")
+
+	is.Equal(testutil.ToFloat64(c.metrics.processed.WithLabelValues("raw/#", "base64-decode")), 2.0)
+	is.Equal(testutil.ToFloat64(c.metrics.failed.WithLabelValues("raw/#", "add-site", "pass")), 1.0)
+	is.Equal(testutil.ToFloat64(c.metrics.dropped.WithLabelValues("raw/#", "only-big")), 1.0)
+	is.Equal(testutil.ToFloat64(c.metrics.failed.WithLabelValues("raw/#", "base64-decode", "dead-letter")), 1.0)
+	is.Equal(testutil.ToFloat64(c.metrics.failed.WithLabelValues("#", "hex-decode", "drop")), 1.0)
+
+	for _, bad := range []Config{
+		{Routes: []RouteConfig{{Filter: "a/#/b", Processors: []StepConfig{{Type: "gunzip"}}}}},
+		{Routes: []RouteConfig{{Filter: "a"}}},
+		{Routes: []RouteConfig{{Filter: "a", Processors: []StepConfig{{Type: "nope"}}}}},
+		{Routes: []RouteConfig{{Filter: "a", Processors: []StepConfig{{Type: "gunzip", OnError: "retry"}}}}},
+		{Routes: []RouteConfig{{Filter: "a", Processors: []StepConfig{{Type: "json-extract"}}}}},
+	} {
+		_, err := New(bad, nil)
+		is.True(err != nil)
+	}
+	_, err = New(Config{Routes: []RouteConfig{{Filter: "a", Processors: []StepConfig{{Type: "gunzip"}}}}},
+		map[string]Factory{"gunzip": func(StepConfig) (Processor, error) { return nil, errors.New("no") }})
+	is.True(err != nil) // custom factories override the built-ins
+}
@@ -0,0 +1,98 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrDrop is returned by a processor that wants the message dropped, e.g. a filter. It's counted as
+// dropped, not as an error.
+var ErrDrop = errors.New("dropped by processor")
+
+// Message is what the processors work on. They may change any of it.
+type Message struct {
+	Source  string // the MQTT source, empty with a single source
+	Topic   string // the MQTT topic
+	Content []byte
+}
+
+// Processor transforms a message in place. Returning an error stops the chain and the message is
+// handled as the step's on_error says.
+type Processor interface {
+	Process(msg *Message) error
+}
+
+// ProcessorFunc lets a plain function be a Processor.
+type ProcessorFunc func(msg *Message) error
+
+// Factory creates a processor from its config. Custom processors are added by passing factories to New.
+type Factory func(cfg StepConfig) (Processor, error)
+
+// Action is what should happen to a message after the chain.
+type Action int
+
+const (
+	Forward    Action = iota // write it to Kafka
+	Drop                     // forget about it
+	DeadLetter               // write the original message to the dead letter topic
+)
+
+// What to do when a processor fails.
+const (
+	OnErrorDrop       = "drop"
+	OnErrorPass       = "pass" // skip the step and carry on with the message as it was
+	OnErrorDeadLetter = "dead-letter"
+)
+
+// Config is the processor config file.
+type Config struct {
+	Routes []RouteConfig `json:"routes"`
+}
+
+// RouteConfig is a chain of processors for the MQTT topics matching Filter. The first matching route wins,
+// messages without a route are left alone.
+type RouteConfig struct {
+	Filter     string       `json:"filter"`
+	OnError    string       `json:"on_error"` // default for the steps, drop if empty
+	Processors []StepConfig `json:"processors"`
+}
+
+// StepConfig configures a processor. The options used depend on the type.
+type StepConfig struct {
+	Type     string                 `json:"type"`
+	Name     string                 `json:"name"`      // used in metrics and logs. Defaults to the type.
+	OnError  string                 `json:"on_error"`  // defaults to the route's
+	Field    string                 `json:"field"`     // json-extract
+	Fields   map[string]interface{} `json:"fields"`    // json-rename (old: new) and json-add (name: value)
+	Encoding string                 `json:"encoding"`  // base64-decode: std, url, raw-std or raw-url
+	MaxBytes int64                  `json:"max_bytes"` // gunzip and inflate: max decompressed size
+	Raw      json.RawMessage        `json:"-"`         // the whole step, for custom processors
+}
+
+// Chain runs messages through the processors of their route.
+type Chain struct {
+	routes  []route
+	metrics *Metrics
+}
+
+type route struct {
+	filter string
+	steps  []step
+}
+
+type step struct {
+	name      string
+	onError   string
+	processor Processor
+	processed prometheus.Counter
+	dropped   prometheus.Counter
+	failed    prometheus.Counter
+}
+
+// Metrics are labelled with the route filter and the processor name.
+type Metrics struct {
+	processed *prometheus.CounterVec
+	dropped   *prometheus.CounterVec
+	failed    *prometheus.CounterVec
+}
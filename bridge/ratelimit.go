@@ -0,0 +1,315 @@
+package bridge
+
+import (
+	"fmt"
+	"github.com/celerway/metamorphosis/bridge/mqtt"
+	"github.com/celerway/metamorphosis/bridge/topic"
+	"github.com/prometheus/client_golang/prometheus"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rate limits protect the bridge (and the Kafka quota) from a device publishing in a tight loop. Each
+// limit is a token bucket per key, where the key is the route, the topic or a level of the topic. The
+// number of buckets is bounded: full buckets are forgotten, and if there are still too many we forget
+// some at random. Throttled messages are counted per key, but only the worst offenders are exported.
+
+const (
+	defaultRateLimitMaxKeys = 100000
+	defaultRateLimitTopK    = 10
+	rateLimitSweepInterval  = time.Minute
+)
+
+// What to do with messages over the limit.
+const (
+	rateActionDrop       = "drop"
+	rateActionSample     = "sample"
+	rateActionQuarantine = "quarantine"
+)
+
+type rateDecision int
+
+const (
+	rateAllow rateDecision = iota
+	rateDrop
+	rateQuarantine
+)
+
+// parseRateLimits parses "filter=rate [burst=n] [key=route|topic|level:n] [action=drop|sample:n|quarantine], ...".
+// The rate is a number of messages per second, or per minute or hour with /m and /h, like 600/m.
+func parseRateLimits(spec string) ([]*rateLimit, error) {
+	var limits []*rateLimit
+	for _, entry := range strings.Split(spec, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		filter, rate, ok := strings.Cut(fields[0], "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit '%s' (expected filter=rate)", strings.TrimSpace(entry))
+		}
+		if err := topic.ValidateFilter(filter); err != nil {
+			return nil, err
+		}
+		l := &rateLimit{filter: filter, keySpec: "route", action: rateActionDrop, buckets: make(map[string]*bucket)}
+		var err error
+		if l.rate, err = parseRate(rate); err != nil {
+			return nil, fmt.Errorf("rate limit '%s': %w", filter, err)
+		}
+		l.burst = l.rate
+		for _, option := range fields[1:] {
+			if err := l.setOption(option); err != nil {
+				return nil, fmt.Errorf("rate limit '%s': %w", filter, err)
+			}
+		}
+		if l.burst < 1 {
+			l.burst = 1 // less and nothing would ever get through
+		}
+		limits = append(limits, l)
+	}
+	return limits, nil
+}
+
+func parseRate(s string) (float64, error) {
+	n, unit, _ := strings.Cut(s, "/")
+	per := map[string]float64{"": 1, "s": 1, "m": 60, "h": 3600}[unit]
+	rate, err := strconv.ParseFloat(n, 64)
+	if err != nil || per == 0 || rate <= 0 {
+		return 0, fmt.Errorf("invalid rate '%s' (like 10, 10/s, 600/m or 3600/h)", s)
+	}
+	return rate / per, nil
+}
+
+func (l *rateLimit) setOption(option string) error {
+	name, value, _ := strings.Cut(option, "=")
+	switch name {
+	case "burst":
+		burst, err := strconv.ParseFloat(value, 64)
+		if err != nil || burst <= 0 {
+			return fmt.Errorf("invalid burst '%s'", value)
+		}
+		l.burst = burst
+	case "key":
+		kind, arg, _ := strings.Cut(value, ":")
+		switch kind {
+		case "route", "topic":
+		case "level":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid key '%s' (level:<n>, 0 is the first level)", value)
+			}
+			l.level = n
+		default:
+			return fmt.Errorf("unknown key '%s' (route|topic|level:<n>)", value)
+		}
+		l.keySpec = kind
+	case "action":
+		action, arg, _ := strings.Cut(value, ":")
+		switch action {
+		case rateActionDrop, rateActionQuarantine:
+		case rateActionSample:
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid action '%s' (sample:<n> lets one in n through)", value)
+			}
+			l.sample = n
+		default:
+			return fmt.Errorf("unknown action '%s' (drop|sample:<n>|quarantine)", value)
+		}
+		l.action = action
+	default:
+		return fmt.Errorf("unknown option '%s' (burst, key or action)", option)
+	}
+	return nil
+}
+
+func newRateLimiter(limits []*rateLimit, topK int) *rateLimiter {
+	if topK <= 0 {
+		topK = defaultRateLimitTopK
+	}
+	r := &rateLimiter{
+		limits:  limits,
+		maxKeys: defaultRateLimitMaxKeys,
+		topK:    topK,
+		now:     time.Now,
+		limited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rate_limited",
+			Help: "Messages over a rate limit, by route and what was done with them",
+		}, []string{"route", "action"}),
+		offenderDesc: prometheus.NewDesc("rate_limit_offender_messages",
+			"Messages over the rate limit from the worst offenders, approximately. Only the top keys per route are kept.",
+			[]string{"route", "key"}, nil),
+	}
+	for _, l := range limits {
+		l.offenders = offenders{capacity: 10 * topK, counts: make(map[string]int)}
+	}
+	r.lastSweep = r.now()
+	return r
+}
+
+// quarantines returns true if any limit sends messages to the quarantine topic.
+func (r *rateLimiter) quarantines() bool {
+	for _, l := range r.limits {
+		if l.action == rateActionQuarantine {
+			return true
+		}
+	}
+	return false
+}
+
+// check takes a token for the message, and decides what to do if there isn't one. Messages without a
+// limit are allowed. The first matching limit is used.
+func (r *rateLimiter) check(msg mqtt.ChannelMessage) rateDecision {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var l *rateLimit
+	for _, candidate := range r.limits {
+		if topic.Match(candidate.filter, msg.Topic) {
+			l = candidate
+			break
+		}
+	}
+	if l == nil {
+		return rateAllow
+	}
+	now := r.now()
+	if now.Sub(r.lastSweep) >= rateLimitSweepInterval {
+		r.sweep(now)
+	}
+	key := l.key(msg.Topic)
+	b, ok := l.buckets[key]
+	if !ok {
+		if r.keys() >= r.maxKeys {
+			r.sweep(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return rateAllow
+	}
+	l.offenders.add(key)
+	switch l.action {
+	case rateActionSample:
+		b.excess++
+		if b.excess%l.sample == 0 {
+			r.limited.WithLabelValues(l.filter, "sampled").Inc()
+			return rateAllow
+		}
+		r.limited.WithLabelValues(l.filter, "dropped").Inc()
+		return rateDrop
+	case rateActionQuarantine:
+		r.limited.WithLabelValues(l.filter, "quarantined").Inc()
+		return rateQuarantine
+	default:
+		r.limited.WithLabelValues(l.filter, "dropped").Inc()
+		return rateDrop
+	}
+}
+
+// key returns the bucket key of a topic.
+func (l *rateLimit) key(name string) string {
+	switch l.keySpec {
+	case "topic":
+		return name
+	case "level":
+		return topic.Level(name, l.level)
+	default:
+		return l.filter
+	}
+}
+
+func (r *rateLimiter) keys() int {
+	n := 0
+	for _, l := range r.limits {
+		n += len(l.buckets)
+	}
+	return n
+}
+
+// sweep forgets the buckets that have filled up, as a new bucket would be the same. If that isn't
+// enough, we forget buckets at random (map order) until we're at 90% of maxKeys, which lets their keys
+// start over with a full burst. The headroom keeps a flood of new keys from sweeping on every message.
+func (r *rateLimiter) sweep(now time.Time) {
+	r.lastSweep = now
+	for _, l := range r.limits {
+		for key, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, key)
+			}
+		}
+	}
+	for _, l := range r.limits {
+		for key := range l.buckets {
+			if r.keys() < r.maxKeys*9/10 {
+				return
+			}
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// add counts a throttled message. The counts are kept with the Space-Saving algorithm: when the table is
+// full, the key with the lowest count is replaced, and the new key takes over its count. The heavy hitters
+// are always in the table, with their counts overestimated by at most the count they took over.
+func (o *offenders) add(key string) {
+	if _, ok := o.counts[key]; ok || len(o.counts) < o.capacity {
+		o.counts[key]++
+		return
+	}
+	minKey, min := "", 0
+	for k, c := range o.counts {
+		if minKey == "" || c < min {
+			minKey, min = k, c
+		}
+	}
+	delete(o.counts, minKey)
+	o.counts[key] = min + 1
+}
+
+// top returns the n keys with the highest counts.
+func (o *offenders) top(n int) []string {
+	keys := make([]string, 0, len(o.counts))
+	for k := range o.counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if o.counts[keys[i]] != o.counts[keys[j]] {
+			return o.counts[keys[i]] > o.counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// Describe and Collect make the rate limiter a prometheus collector for the offenders.
+func (r *rateLimiter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- r.offenderDesc
+}
+
+func (r *rateLimiter) Collect(ch chan<- prometheus.Metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, l := range r.limits {
+		for _, key := range l.offenders.top(r.topK) {
+			ch <- prometheus.MustNewConstMetric(r.offenderDesc, prometheus.GaugeValue,
+				float64(l.offenders.counts[key]), l.filter, key)
+		}
+	}
+}
+
+// Collectors returns the rate limit metrics, for observability to register.
+func (r *rateLimiter) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{r.limited, r}
+}
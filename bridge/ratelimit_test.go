@@ -0,0 +1,136 @@
+package bridge
+
+import (
+	"fmt"
+	"github.com/celerway/metamorphosis/bridge/mqtt"
+	is2 "github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	is := is2.New(t)
+	limits, err := parseRateLimits(" devices/+/telemetry=600/m burst=20 key=level:1 action=sample:10, alarms/#=0.5 action=quarantine,")
+	is.NoErr(err)
+	is.Equal(len(limits), 2)
+	is.Equal(limits[0].filter, "devices/+/telemetry")
+	is.Equal(limits[0].rate, 10.0)
+	is.Equal(limits[0].burst, 20.0)
+	is.Equal(limits[0].keySpec, "level")
+	is.Equal(limits[0].level, 1)
+	is.Equal(limits[0].action, rateActionSample)
+	is.Equal(limits[0].sample, 10)
+	is.Equal(limits[1].keySpec, "route")
+	is.Equal(limits[1].action, rateActionQuarantine)
+	is.Equal(limits[1].burst, 1.0) // the burst follows the rate, but at least one
+	limits, err = parseRateLimits("")
+	is.NoErr(err)
+	is.Equal(len(limits), 0)
+	for _, bad := range []string{
+		"devices/#", "devices/#=fast", "devices/#=10/d", "devices/#=-1", "a/#/b=10",
+		"a=10 burst=0", "a=10 key=level", "a=10 key=device", "a=10 action=sample", "a=10 action=log", "a=10 speed=1",
+	} {
+		_, err = parseRateLimits(bad)
+		is.True(err != nil) // bad should fail
+	}
+}
+
+func testRateLimiter(t *testing.T, spec string) (*rateLimiter, *time.Time) {
+	limits, err := parseRateLimits(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRateLimiter(limits, 0)
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { return now }
+	r.lastSweep = now
+	return r, &now
+}
+
+func TestRateLimiter_TokenBucket(t *testing.T) {
+	is := is2.New(t)
+	r, now := testRateLimiter(t, "devices/+/telemetry=2 burst=3 key=level:1")
+	dev1 := mqtt.ChannelMessage{Topic: "devices/1/telemetry"}
+	dev2 := mqtt.ChannelMessage{Topic: "devices/2/telemetry"}
+	for i := 0; i < 3; i++ {
+		is.Equal(r.check(dev1), rateAllow) // the burst
+	}
+	is.Equal(r.check(dev1), rateDrop)
+	is.Equal(r.check(dev2), rateAllow) // every device has a bucket of its own
+	is.Equal(r.check(mqtt.ChannelMessage{Topic: "other"}), rateAllow)
+	*now = now.Add(500 * time.Millisecond) // one token at 2/s
+	is.Equal(r.check(dev1), rateAllow)
+	is.Equal(r.check(dev1), rateDrop)
+	*now = now.Add(time.Hour) // refills up to the burst only
+	for i := 0; i < 3; i++ {
+		is.Equal(r.check(dev1), rateAllow)
+	}
+	is.Equal(r.check(dev1), rateDrop)
+	is.Equal(testutil.ToFloat64(r.limited.WithLabelValues("devices/+/telemetry", "dropped")), 3.0)
+}
+
+func TestRateLimiter_Actions(t *testing.T) {
+	is := is2.New(t)
+	r, _ := testRateLimiter(t, "sampled/#=1 key=topic action=sample:3, quarantined/#=1 action=quarantine")
+	is.True(r.quarantines())
+	sampled := mqtt.ChannelMessage{Topic: "sampled/a"}
+	var got []rateDecision
+	for i := 0; i < 7; i++ {
+		got = append(got, r.check(sampled))
+	}
+	// One from the burst, then one in three of the rest.
+	is.Equal(got, []rateDecision{rateAllow, rateDrop, rateDrop, rateAllow, rateDrop, rateDrop, rateAllow})
+	is.Equal(r.check(mqtt.ChannelMessage{Topic: "quarantined/a"}), rateAllow)
+	is.Equal(r.check(mqtt.ChannelMessage{Topic: "quarantined/b"}), rateQuarantine) // same route, same bucket
+	is.Equal(testutil.ToFloat64(r.limited.WithLabelValues("sampled/#", "sampled")), 2.0)
+	is.Equal(testutil.ToFloat64(r.limited.WithLabelValues("sampled/#", "dropped")), 4.0)
+	is.Equal(testutil.ToFloat64(r.limited.WithLabelValues("quarantined/#", "quarantined")), 1.0)
+}
+
+func TestRateLimiter_Bounded(t *testing.T) {
+	is := is2.New(t)
+	r, now := testRateLimiter(t, "devices/#=1 key=topic")
+	r.maxKeys = 100
+	for i := 0; i < 1000; i++ {
+		r.check(mqtt.ChannelMessage{Topic: fmt.Sprintf("devices/%d", i)})
+		is.True(r.keys() <= r.maxKeys)
+	}
+	// Full buckets are the same as no bucket, so the sweep forgets them.
+	*now = now.Add(rateLimitSweepInterval)
+	r.check(mqtt.ChannelMessage{Topic: "devices/new"})
+	is.Equal(r.keys(), 1)
+}
+
+func TestRateLimiter_Offenders(t *testing.T) {
+	is := is2.New(t)
+	r, _ := testRateLimiter(t, "devices/#=1 key=level:1")
+	r.topK = 2
+	// Device i sends i+1 messages, so it goes over the limit i times.
+	for i := 0; i < 20; i++ {
+		for j := 0; j <= i; j++ {
+			r.check(mqtt.ChannelMessage{Topic: fmt.Sprintf("devices/%d/telemetry", i)})
+		}
+	}
+	is.Equal(r.limits[0].offenders.top(2), []string{"19", "18"})
+	expected := `
+# HELP rate_limit_offender_messages Messages over the rate limit from the worst offenders, approximately. Only the top keys per route are kept.
+# TYPE rate_limit_offender_messages gauge
+rate_limit_offender_messages{key="18",route="devices/#"} 18
+rate_limit_offender_messages{key="19",route="devices/#"} 19
+`
+	is.NoErr(testutil.CollectAndCompare(prometheus.Collector(r), strings.NewReader(expected), "rate_limit_offender_messages"))
+}
+
+func TestOffenders_SpaceSaving(t *testing.T) {
+	is := is2.New(t)
+	o := offenders{capacity: 2, counts: make(map[string]int)}
+	for _, key := range []string{"a", "a", "a", "b", "c", "c"} {
+		o.add(key)
+	}
+	// c took over the count of b, so it's overestimated, but a heavy hitter is never lost.
+	is.Equal(o.counts, map[string]int{"a": 3, "c": 3})
+	is.Equal(o.top(1), []string{"a"})
+}
@@ -0,0 +1,75 @@
+package bridge
+
+import (
+	"github.com/celerway/metamorphosis/bridge/kafka"
+	"github.com/celerway/metamorphosis/bridge/logging"
+	log "github.com/sirupsen/logrus"
+)
+
+// apply applies new settings. Nothing is restarted, so buffered messages stay where they are. A setting
+// that can't be applied is logged and the current one is kept.
+func (r *reloader) apply(settings Reloadable) {
+	r.logger.Info("Reloading settings")
+	r.applyLogLevels(settings.LogLevel, settings.LogModuleLevels)
+	for _, s := range r.sources {
+		topic, ok := settings.MqttTopics[s.name]
+		if ok {
+			r.applyTopic(s, topic)
+		}
+	}
+	if r.kafka != nil {
+		routes, err := kafka.ParseCompressionRoutes(settings.KafkaCompressionRoutes)
+		if err == nil {
+			err = r.kafka.SetCompressionRoutes(routes)
+		}
+		if err != nil {
+			r.logger.Errorf("Could not reload Kafka compression routes: %s", err)
+		} else {
+			r.logger.Infof("Kafka compression routes: '%s'", settings.KafkaCompressionRoutes)
+		}
+	}
+	for _, c := range r.certs {
+		c.Reload(true)
+	}
+}
+
+func (r *reloader) applyLogLevels(level, moduleLevels string) {
+	if level != "" {
+		l, err := log.ParseLevel(level)
+		if err != nil {
+			r.logger.Errorf("Could not reload log level: %s", err)
+		} else {
+			logging.SetLevel(l)
+		}
+	}
+	levels, err := logging.ParseModuleLevels(moduleLevels)
+	if err != nil {
+		r.logger.Errorf("Could not reload module log levels: %s", err)
+		return
+	}
+	logging.SetModuleLevels(levels)
+}
+
+// applyTopic swaps the configured subscription of a source. Subscriptions added through the admin API are kept.
+func (r *reloader) applyTopic(s *reloadSource, topic string) {
+	if topic == s.topic {
+		return
+	}
+	logger := r.logger
+	if s.name != "" {
+		logger = logger.WithField("source", s.name)
+	}
+	if topic != "" && !contains(s.client.Subscriptions(), topic) {
+		if err := s.client.Subscribe(topic); err != nil {
+			logger.Errorf("Could not subscribe to '%s': %s", topic, err)
+			return
+		}
+	}
+	if s.topic != "" && contains(s.client.Subscriptions(), s.topic) {
+		if err := s.client.Unsubscribe(s.topic); err != nil {
+			logger.Errorf("Could not unsubscribe from '%s': %s", s.topic, err)
+		}
+	}
+	logger.Infof("MQTT subscription changed from '%s' to '%s'", s.topic, topic)
+	s.topic = topic
+}
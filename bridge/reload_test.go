@@ -0,0 +1,128 @@
+package bridge
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/celerway/metamorphosis/bridge/logging"
+	is2 "github.com/matryer/is"
+	log "github.com/sirupsen/logrus"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloaderApply(t *testing.T) {
+	is := is2.New(t)
+	client := &fakeSource{topics: []string{"old/#", "admin/#"}}
+	rl := &reloader{
+		sources: []*reloadSource{{name: "eu", client: client, topic: "old/#"}},
+		logger:  logging.Module("test"),
+	}
+	level := log.GetLevel()
+	defer log.SetLevel(level)
+	rl.apply(Reloadable{LogLevel: "warn", MqttTopics: map[string]string{"eu": "new/#", "us": "other/#"}})
+	is.Equal(log.GetLevel(), log.WarnLevel)
+	is.Equal(client.topics, []string{"admin/#", "new/#"}) // the admin subscription is kept
+	is.Equal(rl.sources[0].topic, "new/#")
+	rl.apply(Reloadable{LogLevel: "nonsense", MqttTopics: map[string]string{}})
+	is.Equal(log.GetLevel(), log.WarnLevel)               // kept
+	is.Equal(client.topics, []string{"admin/#", "new/#"}) // no topic for the source, nothing changes
+}
+
+func TestCertReloader(t *testing.T) {
+	is := is2.New(t)
+	dir := t.TempDir()
+	ca, caKey := writeTestCert(t, dir, "ca", nil, nil)
+	writeTestCert(t, dir, "client", ca, caKey)
+	caFile, certFile, keyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	_, err := newCertReloader(caFile, certFile, filepath.Join(dir, "missing.key"), logging.Module("test"))
+	is.True(err != nil)
+	r, err := newCertReloader(caFile, certFile, keyFile, logging.Module("test"))
+	is.NoErr(err)
+	cfg := r.Config()
+	first, err := cfg.GetClientCertificate(nil)
+	is.NoErr(err)
+
+	// Unchanged files aren't loaded again.
+	r.Reload(false)
+	second, _ := cfg.GetClientCertificate(nil)
+	is.True(first == second)
+
+	// A rotated certificate is picked up.
+	writeTestCert(t, dir, "client", ca, caKey)
+	later := time.Now().Add(time.Minute)
+	is.NoErr(os.Chtimes(certFile, later, later))
+	r.Reload(false)
+	third, _ := cfg.GetClientCertificate(nil)
+	is.True(third != second)
+
+	// A broken file is ignored and the current certificate kept.
+	is.NoErr(os.WriteFile(keyFile, []byte("garbage"), 0o600))
+	r.Reload(true)
+	fourth, _ := cfg.GetClientCertificate(nil)
+	is.True(fourth == third)
+
+	// The server is verified against the CA.
+	server, _ := writeTestCert(t, dir, "server", ca, caKey)
+	is.NoErr(cfg.VerifyConnection(tls.ConnectionState{ServerName: "localhost", PeerCertificates: []*x509.Certificate{server}}))
+	is.True(cfg.VerifyConnection(tls.ConnectionState{ServerName: "example.com", PeerCertificates: []*x509.Certificate{server}}) != nil)
+	is.True(cfg.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{server}}) != nil) // no name to check
+	other, _ := writeTestCert(t, dir, "other", nil, nil)
+	is.True(cfg.VerifyConnection(tls.ConnectionState{ServerName: "other", PeerCertificates: []*x509.Certificate{other}}) != nil)
+}
+
+// writeTestCert writes <name>.crt and <name>.key to dir. Without a parent the certificate is a self-signed CA.
+func writeTestCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), crt, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return mustParse(t, der), key
+}
+
+func mustParse(t *testing.T, der []byte) *x509.Certificate {
+	t.Helper()
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
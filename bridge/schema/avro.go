@@ -0,0 +1,261 @@
+package schema
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Payloads on a route are checked against their schema before they're written. We only need to know if
+// the bytes decode, so the schema is parsed into just enough to walk them.
+
+// maxPayloadDepth limits nesting, so a recursive schema can't take us deeper than this.
+const maxPayloadDepth = 1000
+
+var errAvroShort = errors.New("cut short")
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true, "float": true, "double": true, "bytes": true, "string": true,
+}
+
+// parseAvro parses an Avro schema (.avsc).
+func parseAvro(schema string) (*avroType, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(schema), &v); err != nil {
+		return nil, fmt.Errorf("avro schema: %w", err)
+	}
+	t, err := parseAvroType(v, "", make(map[string]*avroType))
+	if err != nil {
+		return nil, fmt.Errorf("avro schema: %w", err)
+	}
+	return t, nil
+}
+
+// parseAvroType parses a type. ns is the enclosing namespace, named the named types seen so far, by full name.
+func parseAvroType(v interface{}, ns string, named map[string]*avroType) (*avroType, error) {
+	switch v := v.(type) {
+	case string:
+		if avroPrimitives[v] {
+			return &avroType{kind: v}, nil
+		}
+		if t, ok := named[v]; ok {
+			return t, nil
+		}
+		if t, ok := named[ns+"."+v]; ok && ns != "" {
+			return t, nil
+		}
+		return nil, fmt.Errorf("unknown type '%s'", v)
+	case []interface{}:
+		t := &avroType{kind: "union"}
+		for _, b := range v {
+			branch, err := parseAvroType(b, ns, named)
+			if err != nil {
+				return nil, err
+			}
+			t.branches = append(t.branches, branch)
+		}
+		return t, nil
+	case map[string]interface{}:
+		return parseAvroComplex(v, ns, named)
+	}
+	return nil, fmt.Errorf("invalid type %v", v)
+}
+
+func parseAvroComplex(v map[string]interface{}, ns string, named map[string]*avroType) (*avroType, error) {
+	kind, _ := v["type"].(string)
+	t := &avroType{kind: kind}
+	switch kind {
+	case "record", "error", "enum", "fixed":
+		full, err := avroName(v, ns)
+		if err != nil {
+			return nil, err
+		}
+		named[full] = t // before the fields, as they can refer to the record
+		if i := strings.LastIndex(full, "."); i >= 0 {
+			ns = full[:i]
+		}
+	}
+	switch kind {
+	case "record", "error":
+		t.kind = "record"
+		fields, _ := v["fields"].([]interface{})
+		for _, f := range fields {
+			field, ok := f.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("invalid record field")
+			}
+			ft, err := parseAvroType(field["type"], ns, named)
+			if err != nil {
+				return nil, fmt.Errorf("field '%v': %w", field["name"], err)
+			}
+			t.fields = append(t.fields, ft)
+		}
+	case "enum":
+		symbols, _ := v["symbols"].([]interface{})
+		t.size = len(symbols)
+	case "fixed":
+		size, ok := v["size"].(float64)
+		if !ok || size < 0 {
+			return nil, errors.New("fixed without a size")
+		}
+		t.size = int(size)
+	case "array", "map":
+		key := "items"
+		if kind == "map" {
+			key = "values"
+		}
+		items, err := parseAvroType(v[key], ns, named)
+		if err != nil {
+			return nil, err
+		}
+		t.items = items
+	default:
+		// A primitive or a reference with attributes, like a logical type.
+		return parseAvroType(v["type"], ns, named)
+	}
+	return t, nil
+}
+
+// avroName returns the full name of a named type.
+func avroName(v map[string]interface{}, ns string) (string, error) {
+	name, _ := v["name"].(string)
+	if name == "" {
+		return "", fmt.Errorf("%v without a name", v["type"])
+	}
+	if strings.Contains(name, ".") {
+		return name, nil
+	}
+	if space, ok := v["namespace"].(string); ok {
+		ns = space
+	}
+	if ns == "" {
+		return name, nil
+	}
+	return ns + "." + name, nil
+}
+
+// validate checks that b is exactly one value of the type.
+func (t *avroType) validate(b []byte) error {
+	rest, err := t.skip(b, 0)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return fmt.Errorf("%d bytes after the value", len(rest))
+	}
+	return nil
+}
+
+// skip returns what's left of b after a value of the type.
+func (t *avroType) skip(b []byte, depth int) ([]byte, error) {
+	if depth > maxPayloadDepth {
+		return nil, errors.New("nested too deep")
+	}
+	switch t.kind {
+	case "null":
+		return b, nil
+	case "boolean":
+		if len(b) < 1 || b[0] > 1 {
+			return nil, errors.New("invalid boolean")
+		}
+		return b[1:], nil
+	case "int", "long":
+		n, size := binary.Varint(b)
+		if size <= 0 || (t.kind == "int" && int64(int32(n)) != n) {
+			return nil, fmt.Errorf("invalid %s", t.kind)
+		}
+		return b[size:], nil
+	case "float":
+		return avroFixed(b, 4)
+	case "double":
+		return avroFixed(b, 8)
+	case "bytes", "string":
+		data, rest, err := avroBytes(b)
+		if err == nil && t.kind == "string" && !utf8.Valid(data) {
+			err = errors.New("string isn't UTF-8")
+		}
+		return rest, err
+	case "fixed":
+		return avroFixed(b, t.size)
+	case "enum":
+		n, size := binary.Varint(b)
+		if size <= 0 || n < 0 || n >= int64(t.size) {
+			return nil, errors.New("invalid enum symbol")
+		}
+		return b[size:], nil
+	case "union":
+		n, size := binary.Varint(b)
+		if size <= 0 || n < 0 || n >= int64(len(t.branches)) {
+			return nil, errors.New("invalid union branch")
+		}
+		return t.branches[n].skip(b[size:], depth+1)
+	case "record":
+		var err error
+		for _, f := range t.fields {
+			if b, err = f.skip(b, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case "array", "map":
+		return t.skipBlocks(b, depth)
+	}
+	return nil, fmt.Errorf("unknown type '%s'", t.kind)
+}
+
+// skipBlocks skips the blocks of an array or a map, which end with an empty block.
+func (t *avroType) skipBlocks(b []byte, depth int) ([]byte, error) {
+	for {
+		count, size := binary.Varint(b)
+		if size <= 0 {
+			return nil, errAvroShort
+		}
+		b = b[size:]
+		if count == 0 {
+			return b, nil
+		}
+		if count < 0 {
+			// A negative count is followed by the size of the block in bytes.
+			count = -count
+			if _, size = binary.Varint(b); size <= 0 {
+				return nil, errAvroShort
+			}
+			b = b[size:]
+		}
+		// Every item takes a byte or more, unless it's something like null. We don't allow huge blocks of
+		// those, so a few bytes can't keep us busy.
+		if count > int64(len(b)) {
+			return nil, errAvroShort
+		}
+		for i := int64(0); i < count; i++ {
+			var err error
+			if t.kind == "map" {
+				if _, b, err = avroBytes(b); err != nil {
+					return nil, err
+				}
+			}
+			if b, err = t.items.skip(b, depth+1); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func avroFixed(b []byte, n int) ([]byte, error) {
+	if len(b) < n {
+		return nil, errAvroShort
+	}
+	return b[n:], nil
+}
+
+// avroBytes reads bytes or a string: the length as a zigzag varint, then the data.
+func avroBytes(b []byte) ([]byte, []byte, error) {
+	n, size := binary.Varint(b)
+	if size <= 0 || n < 0 || int64(len(b)-size) < n {
+		return nil, nil, errAvroShort
+	}
+	return b[size : size+int(n)], b[size+int(n):], nil
+}
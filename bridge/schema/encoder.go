@@ -0,0 +1,214 @@
+package schema
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/celerway/metamorphosis/bridge/kafka"
+	"github.com/celerway/metamorphosis/bridge/topic"
+	gokafka "github.com/segmentio/kafka-go"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// ParseRoutes parses payload schema routes, "filter=file,filter=file".
+func ParseRoutes(spec string) ([]Route, error) {
+	var routes []Route
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		filter, file, ok := strings.Cut(part, "=")
+		if !ok || file == "" {
+			return nil, fmt.Errorf("invalid schema route '%s' (expected filter=file)", part)
+		}
+		if err := topic.ValidateFilter(filter); err != nil {
+			return nil, err
+		}
+		routes = append(routes, Route{Filter: filter, File: file})
+	}
+	return routes, nil
+}
+
+// NewEncoder registers (or looks up) the schemas and returns an encoder using their ids.
+func NewEncoder(ctx context.Context, p Params) (*Encoder, error) {
+	envelope, err := envelopeSchema(p.Format)
+	if err != nil {
+		return nil, err
+	}
+	if p.Registry == nil {
+		return nil, errors.New("no schema registry")
+	}
+	if p.Subject == "" {
+		return nil, errors.New("no subject for the envelope schema")
+	}
+	resolve := p.Registry.Lookup
+	if p.AutoRegister {
+		resolve = p.Registry.Register
+	}
+	e := &Encoder{format: p.Format}
+	if e.envelopeId, err = resolve(ctx, p.Subject, envelope); err != nil {
+		return nil, fmt.Errorf("envelope schema (subject %s): %w", p.Subject, err)
+	}
+	for _, r := range p.Routes {
+		b, err := ioutil.ReadFile(r.File)
+		if err != nil {
+			return nil, fmt.Errorf("route '%s': %w", r.Filter, err)
+		}
+		s := Schema{Type: envelope.Type, Schema: string(b)}
+		subject := r.Subject
+		if subject == "" {
+			subject = strings.TrimSuffix(filepath.Base(r.File), filepath.Ext(r.File))
+		}
+		validate, err := payloadValidator(p.Format, s.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("route '%s': %w", r.Filter, err)
+		}
+		id, err := resolve(ctx, subject, s)
+		if err != nil {
+			return nil, fmt.Errorf("route '%s' (subject %s): %w", r.Filter, subject, err)
+		}
+		e.routes = append(e.routes, route{filter: r.Filter, id: id, validate: validate})
+	}
+	return e, nil
+}
+
+// payloadValidator returns a function that checks payloads against a route's schema.
+func payloadValidator(format, schema string) (func([]byte) error, error) {
+	if format == FormatProtobuf {
+		m, err := parseProtobuf(schema)
+		if err != nil {
+			return nil, err
+		}
+		return m.validate, nil
+	}
+	t, err := parseAvro(schema)
+	if err != nil {
+		return nil, err
+	}
+	return t.validate, nil
+}
+
+// Validate checks the payload of a message on a route against the route's schema. The bridge calls it
+// before the message is handed to Kafka, so a mismatch can go to the dead letter topic.
+func (e *Encoder) Validate(m kafka.Message) error {
+	if r := e.route(m.Topic); r != nil {
+		return r.check(m.Content)
+	}
+	return nil
+}
+
+func (r *route) check(payload []byte) error {
+	if err := r.validate(payload); err != nil {
+		return fmt.Errorf("payload doesn't match the schema for '%s': %w", r.filter, err)
+	}
+	return nil
+}
+
+// route returns the route for an MQTT topic, nil if it has none.
+func (e *Encoder) route(mqttTopic string) *route {
+	for i := range e.routes {
+		if topic.Match(e.routes[i].filter, mqttTopic) {
+			return &e.routes[i]
+		}
+	}
+	return nil
+}
+
+// Encode implements kafka.Encoder. Messages on a route with a payload schema are written as they are,
+// everything else (and dead letters, which are the payload we couldn't handle) in the envelope. A payload
+// that doesn't match its schema is a dead letter too. The bridge has usually caught those already, but
+// quarantined messages, for one, aren't checked before they get here.
+func (e *Encoder) Encode(m kafka.Message) ([]byte, []gokafka.Header, error) {
+	headers := []gokafka.Header{{Key: EncodingHeader, Value: []byte(e.format)}}
+	if r := e.route(m.Topic); r != nil && m.Error == "" {
+		if err := r.check(m.Content); err != nil {
+			m.Error = err.Error()
+		} else {
+			headers = append(headers, gokafka.Header{Key: TopicHeader, Value: []byte(m.Topic)})
+			if m.Source != "" {
+				headers = append(headers, gokafka.Header{Key: SourceHeader, Value: []byte(m.Source)})
+			}
+			return append(e.header(r.id), m.Content...), headers, nil
+		}
+	}
+	b := e.header(e.envelopeId)
+	if e.format == FormatProtobuf {
+		return appendProtobuf(b, m), headers, nil
+	}
+	return appendAvro(b, m), headers, nil
+}
+
+// header is the start of the wire format. We always use the first message of a Protobuf schema, which
+// has the message indexes [0], written as a single 0.
+func (e *Encoder) header(id int) []byte {
+	b := make([]byte, 5, 64)
+	binary.BigEndian.PutUint32(b[1:], uint32(id))
+	if e.format == FormatProtobuf {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// Decode decodes a record written by an Encoder, along with the id of its schema. Records with a payload
+// schema get the payload as Content, the rest is the envelope.
+func Decode(record gokafka.Message) (kafka.Message, int, error) {
+	var format, mqttTopic, source string
+	var payload bool
+	for _, h := range record.Headers {
+		switch h.Key {
+		case EncodingHeader:
+			format = string(h.Value)
+		case TopicHeader:
+			mqttTopic, payload = string(h.Value), true
+		case SourceHeader:
+			source = string(h.Value)
+		}
+	}
+	b := record.Value
+	if len(b) < 5 || b[0] != 0 {
+		return kafka.Message{}, 0, errors.New("not in the schema registry wire format")
+	}
+	id := int(binary.BigEndian.Uint32(b[1:5]))
+	b = b[5:]
+	if format == FormatProtobuf {
+		var err error
+		if b, err = skipMessageIndexes(b); err != nil {
+			return kafka.Message{}, id, err
+		}
+	}
+	if payload {
+		return kafka.Message{Source: source, Topic: mqttTopic, Content: b}, id, nil
+	}
+	var m kafka.Message
+	var err error
+	switch format {
+	case FormatAvro:
+		m, err = decodeAvro(b)
+	case FormatProtobuf:
+		m, err = decodeProtobuf(b)
+	default:
+		err = fmt.Errorf("unknown encoding '%s'", format)
+	}
+	return m, id, err
+}
+
+// skipMessageIndexes skips the Protobuf message indexes: a count and that many indexes, all zigzag varints.
+// A count of 0 is short for [0].
+func skipMessageIndexes(b []byte) ([]byte, error) {
+	count, n := binary.Varint(b)
+	if n <= 0 || count < 0 {
+		return nil, errors.New("bad protobuf message indexes")
+	}
+	b = b[n:]
+	for i := int64(0); i < count; i++ {
+		if _, n = binary.Varint(b); n <= 0 {
+			return nil, errors.New("bad protobuf message indexes")
+		}
+		b = b[n:]
+	}
+	return b, nil
+}
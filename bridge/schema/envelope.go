@@ -0,0 +1,116 @@
+package schema
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/celerway/metamorphosis/bridge/kafka"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The envelope has the fields of kafka.Message. The schemas are fixed, so we encode them by hand.
+
+const avroEnvelope = `{"type":"record","name":"Envelope","namespace":"com.celerway.metamorphosis","fields":[` +
+	`{"name":"source","type":"string","default":""},` +
+	`{"name":"topic","type":"string"},` +
+	`{"name":"content","type":"bytes"},` +
+	`{"name":"error","type":"string","default":""}]}`
+
+const protobufEnvelope = `syntax = "proto3";
+package metamorphosis;
+
+message Envelope {
+  string source = 1;
+  string topic = 2;
+  bytes content = 3;
+  string error = 4;
+}
+`
+
+// envelopeSchema returns the envelope schema in the format.
+func envelopeSchema(format string) (Schema, error) {
+	switch format {
+	case FormatAvro:
+		return Schema{Schema: avroEnvelope}, nil
+	case FormatProtobuf:
+		return Schema{Type: "PROTOBUF", Schema: protobufEnvelope}, nil
+	default:
+		return Schema{}, fmt.Errorf("unknown encoding '%s' (json|avro|protobuf)", format)
+	}
+}
+
+// Avro encodes strings and bytes as a zigzag varint length followed by the data, and a record as its
+// fields in order.
+func appendAvro(b []byte, m kafka.Message) []byte {
+	for _, field := range [][]byte{[]byte(m.Source), []byte(m.Topic), m.Content, []byte(m.Error)} {
+		var n [binary.MaxVarintLen64]byte
+		b = append(b, n[:binary.PutVarint(n[:], int64(len(field)))]...)
+		b = append(b, field...)
+	}
+	return b
+}
+
+func decodeAvro(b []byte) (kafka.Message, error) {
+	var fields [4][]byte
+	for i := range fields {
+		n, size := binary.Varint(b)
+		if size <= 0 || n < 0 || int64(len(b)-size) < n {
+			return kafka.Message{}, errors.New("avro envelope is cut short")
+		}
+		fields[i] = b[size : size+int(n)]
+		b = b[size+int(n):]
+	}
+	return kafka.Message{
+		Source:  string(fields[0]),
+		Topic:   string(fields[1]),
+		Content: append([]byte(nil), fields[2]...),
+		Error:   string(fields[3]),
+	}, nil
+}
+
+// Protobuf leaves out fields with the default value.
+func appendProtobuf(b []byte, m kafka.Message) []byte {
+	for i, field := range [][]byte{[]byte(m.Source), []byte(m.Topic), m.Content, []byte(m.Error)} {
+		if len(field) > 0 {
+			b = protowire.AppendTag(b, protowire.Number(i+1), protowire.BytesType)
+			b = protowire.AppendBytes(b, field)
+		}
+	}
+	return b
+}
+
+func decodeProtobuf(b []byte) (kafka.Message, error) {
+	var m kafka.Message
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return m, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.BytesType || num > 4 {
+			// Unknown fields are skipped, so the schema can grow.
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return m, protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return m, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			m.Source = string(v)
+		case 2:
+			m.Topic = string(v)
+		case 3:
+			m.Content = append([]byte(nil), v...)
+		case 4:
+			m.Error = string(v)
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,427 @@
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A .proto file is parsed for its messages and their fields, which is what it takes to check the wire
+// format. Options, services and the like are skipped. Types from imported files aren't known, so fields
+// of those types are taken as they come.
+
+var protoScalars = map[string]protowire.Type{
+	"double": protowire.Fixed64Type, "fixed64": protowire.Fixed64Type, "sfixed64": protowire.Fixed64Type,
+	"float": protowire.Fixed32Type, "fixed32": protowire.Fixed32Type, "sfixed32": protowire.Fixed32Type,
+	"int32": protowire.VarintType, "int64": protowire.VarintType, "uint32": protowire.VarintType,
+	"uint64": protowire.VarintType, "sint32": protowire.VarintType, "sint64": protowire.VarintType,
+	"bool": protowire.VarintType, "string": protowire.BytesType, "bytes": protowire.BytesType,
+}
+
+// parseProtobuf parses a .proto file and returns its first message, which is the one we write.
+func parseProtobuf(schema string) (*protoMessage, error) {
+	tokens, err := protoTokens(schema)
+	if err != nil {
+		return nil, fmt.Errorf("protobuf schema: %w", err)
+	}
+	p := &protoParser{tokens: tokens, messages: make(map[string]*protoMessage), enums: make(map[string]bool)}
+	if err := p.parseFile(); err != nil {
+		return nil, fmt.Errorf("protobuf schema: %w", err)
+	}
+	if p.first == nil {
+		return nil, errors.New("protobuf schema: no message")
+	}
+	p.resolve()
+	return p.first, nil
+}
+
+// protoTokens splits a .proto file into identifiers, numbers, strings and symbols, without the comments.
+func protoTokens(s string) ([]string, error) {
+	var tokens []string
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		switch {
+		case unicode.IsSpace(r):
+			s = s[size:]
+		case strings.HasPrefix(s, "//"):
+			if i := strings.IndexByte(s, '\n'); i >= 0 {
+				s = s[i+1:]
+			} else {
+				s = ""
+			}
+		case strings.HasPrefix(s, "/*"):
+			i := strings.Index(s[2:], "*/")
+			if i < 0 {
+				return nil, errors.New("unterminated comment")
+			}
+			s = s[i+4:]
+		case r == '"' || r == '\'':
+			i := 1
+			for i < len(s) && s[i] != byte(r) {
+				if s[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(s) {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, s[:i+1])
+			s = s[i+1:]
+		case r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r):
+			i := strings.IndexFunc(s, func(r rune) bool {
+				return !(r == '_' || r == '.' || r == '-' || r == '+' || unicode.IsLetter(r) || unicode.IsDigit(r))
+			})
+			if i < 0 {
+				i = len(s)
+			}
+			tokens = append(tokens, s[:i])
+			s = s[i:]
+		default:
+			tokens = append(tokens, s[:size])
+			s = s[size:]
+		}
+	}
+	return tokens, nil
+}
+
+type protoParser struct {
+	tokens   []string
+	pos      int
+	pkg      string
+	proto3   bool
+	first    *protoMessage
+	messages map[string]*protoMessage // by full name, without a leading dot
+	enums    map[string]bool
+}
+
+func (p *protoParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t
+}
+
+func (p *protoParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *protoParser) expect(token string) error {
+	if t := p.next(); t != token {
+		return fmt.Errorf("expected '%s', got '%s'", token, t)
+	}
+	return nil
+}
+
+// skipStatement skips to the end of a statement, or past the block it starts.
+func (p *protoParser) skipStatement() error {
+	depth := 0
+	for {
+		switch p.next() {
+		case "":
+			return errors.New("unexpected end of file")
+		case ";":
+			if depth == 0 {
+				return nil
+			}
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth == 0 {
+				return nil
+			}
+		}
+	}
+}
+
+func (p *protoParser) parseFile() error {
+	for p.peek() != "" {
+		switch p.next() {
+		case "syntax":
+			if err := p.expect("="); err != nil {
+				return err
+			}
+			p.proto3 = strings.Trim(p.next(), `"'`) == "proto3"
+			if err := p.expect(";"); err != nil {
+				return err
+			}
+		case "package":
+			p.pkg = p.next()
+			if err := p.expect(";"); err != nil {
+				return err
+			}
+		case "message":
+			m, err := p.parseMessage(p.pkg)
+			if err != nil {
+				return err
+			}
+			if p.first == nil {
+				p.first = m
+			}
+		case "enum":
+			if err := p.parseEnum(p.pkg); err != nil {
+				return err
+			}
+		case ";":
+		default: // import, option, service, extend
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// protoName is the full name of name in scope.
+func protoName(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+func (p *protoParser) parseEnum(scope string) error {
+	p.enums[protoName(scope, p.next())] = true
+	return p.skipStatement()
+}
+
+// parseMessage parses a message after the "message" keyword.
+func (p *protoParser) parseMessage(scope string) (*protoMessage, error) {
+	m := &protoMessage{name: protoName(scope, p.next()), fields: make(map[protowire.Number]*protoField)}
+	p.messages[m.name] = m
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	for {
+		switch t := p.next(); t {
+		case "":
+			return nil, errors.New("unexpected end of file")
+		case "}":
+			return m, nil
+		case ";":
+		case "message":
+			if _, err := p.parseMessage(m.name); err != nil {
+				return nil, err
+			}
+		case "enum":
+			if err := p.parseEnum(m.name); err != nil {
+				return nil, err
+			}
+		case "oneof":
+			p.next() // name
+			if err := p.expect("{"); err != nil {
+				return nil, err
+			}
+			for p.peek() != "}" && p.peek() != "" {
+				if p.peek() == "option" {
+					if err := p.skipStatement(); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				if _, err := p.parseField(m, p.next(), false); err != nil {
+					return nil, err
+				}
+			}
+			p.next()
+		case "option", "reserved", "extensions", "extend":
+			if err := p.skipStatement(); err != nil {
+				return nil, err
+			}
+		case "repeated":
+			if _, err := p.parseField(m, p.next(), true); err != nil {
+				return nil, err
+			}
+		case "optional", "required":
+			if _, err := p.parseField(m, p.next(), false); err != nil {
+				return nil, err
+			}
+		case "map":
+			if err := p.parseMap(m); err != nil {
+				return nil, err
+			}
+		default:
+			if _, err := p.parseField(m, t, false); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// parseField parses "name = number [options];" after the type.
+func (p *protoParser) parseField(m *protoMessage, typ string, repeated bool) (*protoField, error) {
+	p.next() // name
+	if err := p.expect("="); err != nil {
+		return nil, err
+	}
+	num, err := strconv.ParseInt(p.next(), 0, 32)
+	if err != nil || !protowire.Number(num).IsValid() {
+		return nil, fmt.Errorf("invalid field number in message %s", m.name)
+	}
+	f := &protoField{typeName: typ, scope: m.name, repeated: repeated}
+	m.fields[protowire.Number(num)] = f
+	if p.peek() == "[" {
+		for t := p.next(); t != "]"; t = p.next() {
+			if t == "" {
+				return nil, errors.New("unexpected end of file")
+			}
+		}
+	}
+	return f, p.expect(";")
+}
+
+// parseMap parses a map field, which is a repeated message with the key as field 1 and the value as field 2.
+func (p *protoParser) parseMap(m *protoMessage) error {
+	if err := p.expect("<"); err != nil {
+		return err
+	}
+	key := p.next()
+	if err := p.expect(","); err != nil {
+		return err
+	}
+	value := p.next()
+	if err := p.expect(">"); err != nil {
+		return err
+	}
+	f, err := p.parseField(m, "map", true)
+	if err != nil {
+		return err
+	}
+	f.entry = &protoMessage{fields: map[protowire.Number]*protoField{
+		1: {typeName: key, scope: m.name},
+		2: {typeName: value, scope: m.name},
+	}}
+	return nil
+}
+
+// resolve finds the types of the fields. Names are looked up from the innermost scope out, like protoc does.
+func (p *protoParser) resolve() {
+	var fields []*protoField
+	for _, m := range p.messages {
+		for _, f := range m.fields {
+			fields = append(fields, f)
+			if f.entry != nil {
+				for _, ef := range f.entry.fields {
+					fields = append(fields, ef)
+				}
+			}
+		}
+	}
+	for _, f := range fields {
+		if f.entry != nil {
+			f.wire, f.message = protowire.BytesType, f.entry
+			continue
+		}
+		if wire, ok := protoScalars[f.typeName]; ok {
+			f.wire, f.utf8 = wire, f.typeName == "string" && p.proto3
+			continue
+		}
+		f.wire = -1 // from an import: we don't know
+		for scope := f.scope; ; {
+			name := protoName(scope, f.typeName)
+			if strings.HasPrefix(f.typeName, ".") {
+				name = f.typeName[1:]
+			}
+			if m, ok := p.messages[name]; ok {
+				f.wire, f.message = protowire.BytesType, m
+				break
+			}
+			if p.enums[name] {
+				f.wire = protowire.VarintType
+				break
+			}
+			if scope == "" || strings.HasPrefix(f.typeName, ".") {
+				break
+			}
+			if i := strings.LastIndex(scope, "."); i >= 0 {
+				scope = scope[:i]
+			} else {
+				scope = ""
+			}
+		}
+	}
+}
+
+// validate checks that b is a message of this type: every field decodes, and the known ones have the
+// wire type of their type. Unknown fields are allowed, as the schema can grow.
+func (m *protoMessage) validate(b []byte) error {
+	return m.check(b, 0)
+}
+
+func (m *protoMessage) check(b []byte, depth int) error {
+	if depth > maxPayloadDepth {
+		return errors.New("nested too deep")
+	}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		value := b
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return fmt.Errorf("field %d: %w", num, protowire.ParseError(n))
+		}
+		value, b = value[:n], b[n:]
+		f, ok := m.fields[num]
+		if !ok || f.wire < 0 {
+			continue
+		}
+		if err := f.check(typ, value, depth); err != nil {
+			return fmt.Errorf("field %d: %w", num, err)
+		}
+	}
+	return nil
+}
+
+func (f *protoField) check(typ protowire.Type, value []byte, depth int) error {
+	if typ != f.wire {
+		// Repeated numbers may be packed into one length delimited field.
+		if f.repeated && typ == protowire.BytesType && f.wire != protowire.BytesType {
+			return f.checkPacked(value)
+		}
+		return fmt.Errorf("wire type %d, expected %d", typ, f.wire)
+	}
+	if typ != protowire.BytesType {
+		return nil
+	}
+	data, _ := protowire.ConsumeBytes(value)
+	if f.message != nil {
+		return f.message.check(data, depth+1)
+	}
+	if f.utf8 && !utf8.Valid(data) {
+		return errors.New("string isn't UTF-8")
+	}
+	return nil
+}
+
+func (f *protoField) checkPacked(value []byte) error {
+	data, _ := protowire.ConsumeBytes(value)
+	for len(data) > 0 {
+		var n int
+		switch f.wire {
+		case protowire.VarintType:
+			_, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed32Type:
+			_, n = protowire.ConsumeFixed32(data)
+		case protowire.Fixed64Type:
+			_, n = protowire.ConsumeFixed64(data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
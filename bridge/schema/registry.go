@@ -0,0 +1,74 @@
+package schema
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const registryTimeout = 10 * time.Second
+
+// NewRegistry creates a client for the registry at baseUrl. user and password are used for basic auth, if set.
+func NewRegistry(baseUrl, user, password string) *Registry {
+	return &Registry{
+		url:      strings.TrimSuffix(baseUrl, "/"),
+		user:     user,
+		password: password,
+		client:   &http.Client{Timeout: registryTimeout},
+	}
+}
+
+// Register registers the schema under the subject, or returns its id if it's already there.
+func (r *Registry) Register(ctx context.Context, subject string, s Schema) (int, error) {
+	return r.post(ctx, "/subjects/"+url.PathEscape(subject)+"/versions", s)
+}
+
+// Lookup returns the id of a schema that is registered under the subject.
+func (r *Registry) Lookup(ctx context.Context, subject string, s Schema) (int, error) {
+	return r.post(ctx, "/subjects/"+url.PathEscape(subject), s)
+}
+
+func (r *Registry) post(ctx context.Context, path string, s Schema) (int, error) {
+	body, err := json.Marshal(s)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json, application/json")
+	if r.user != "" {
+		req.SetBasicAuth(r.user, r.password)
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("schema registry: %w", err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, fmt.Errorf("schema registry: reading response: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		var e registryError
+		if json.Unmarshal(b, &e) == nil && e.Message != "" {
+			return 0, fmt.Errorf("schema registry: %s (%d)", e.Message, e.Code)
+		}
+		return 0, fmt.Errorf("schema registry: %s", res.Status)
+	}
+	var reply struct {
+		Id int `json:"id"`
+	}
+	if err := json.Unmarshal(b, &reply); err != nil {
+		return 0, fmt.Errorf("schema registry: decoding response: %w", err)
+	}
+	return reply.Id, nil
+}
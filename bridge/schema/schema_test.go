@@ -0,0 +1,236 @@
+package schema
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/celerway/metamorphosis/bridge/kafka"
+	"github.com/celerway/metamorphosis/bridge/schema/schematest"
+	is2 "github.com/matryer/is"
+	gokafka "github.com/segmentio/kafka-go"
+	"google.golang.org/protobuf/encoding/protowire"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	is := is2.New(t)
+	mock := schematest.NewRegistry()
+	defer mock.Close()
+	mock.RequireAuth("user", "secret")
+	ctx := context.Background()
+	s := Schema{Schema: avroEnvelope}
+
+	_, err := NewRegistry(mock.URL(), "user", "wrong").Register(ctx, "mqtt-value", s)
+	is.True(err != nil)
+	r := NewRegistry(mock.URL()+"/", "user", "secret")
+	_, err = r.Lookup(ctx, "mqtt-value", s)
+	is.True(err != nil) // not registered yet
+	id, err := r.Register(ctx, "mqtt-value", s)
+	is.NoErr(err)
+	again, err := r.Register(ctx, "other-value", s)
+	is.NoErr(err)
+	is.Equal(again, id) // same schema, same id
+	found, err := r.Lookup(ctx, "mqtt-value", s)
+	is.NoErr(err)
+	is.Equal(found, id)
+	_, err = r.Lookup(ctx, "mqtt-value", Schema{Type: "PROTOBUF", Schema: protobufEnvelope})
+	is.True(err != nil)
+	is.Equal(mock.Subjects(), []string{"mqtt-value", "other-value"})
+	registered, typ, ok := mock.Schema(id)
+	is.True(ok)
+	is.Equal(registered, avroEnvelope)
+	is.Equal(typ, "")
+}
+
+func TestEncoder(t *testing.T) {
+	is := is2.New(t)
+	mock := schematest.NewRegistry()
+	defer mock.Close()
+	ctx := context.Background()
+	dir := t.TempDir()
+	avsc := filepath.Join(dir, "telemetry.avsc")
+	is.NoErr(os.WriteFile(avsc, []byte(`{"type":"record","name":"Telemetry","fields":[{"name":"t","type":"double"}]}`), 0o600))
+	routes, err := ParseRoutes(" devices/+/telemetry=" + avsc + ",")
+	is.NoErr(err)
+	registry := NewRegistry(mock.URL(), "", "")
+
+	_, err = NewEncoder(ctx, Params{Registry: registry, Format: FormatAvro, Subject: "mqtt-value"})
+	is.True(err != nil) // looking up a schema that isn't registered
+	avro, err := NewEncoder(ctx, Params{Registry: registry, Format: FormatAvro, Subject: "mqtt-value", AutoRegister: true, Routes: routes})
+	is.NoErr(err)
+	is.Equal(mock.Subjects(), []string{"mqtt-value", "telemetry"})
+	proto, err := NewEncoder(ctx, Params{Registry: registry, Format: FormatProtobuf, Subject: "mqtt-proto-value", AutoRegister: true})
+	is.NoErr(err)
+
+	msg := kafka.Message{Source: "eu", Topic: "devices/1/status", Content: []byte{1, 2, 3}}
+	for _, enc := range []*Encoder{avro, proto} {
+		value, headers, err := enc.Encode(msg)
+		is.NoErr(err)
+		is.Equal(value[0], byte(0))                                        // magic byte
+		is.Equal(int(binary.BigEndian.Uint32(value[1:5])), enc.envelopeId) // schema id
+		decoded, id, err := Decode(gokafka.Message{Value: value, Headers: headers})
+		is.NoErr(err)
+		is.Equal(id, enc.envelopeId)
+		is.Equal(decoded, msg)
+	}
+	is.True(avro.envelopeId != proto.envelopeId)
+
+	// Known Avro bytes: the lengths are zigzag encoded, so 2 is 4.
+	value, _, _ := avro.Encode(kafka.Message{Topic: "a/b", Content: []byte("hi")})
+	is.Equal(value[5:], []byte{0, 6, 'a', '/', 'b', 4, 'h', 'i', 0})
+	// Protobuf has the message index and leaves out empty fields.
+	value, _, _ = proto.Encode(kafka.Message{Topic: "a/b", Content: []byte("hi")})
+	is.Equal(value[5:], []byte{0, 0x12, 3, 'a', '/', 'b', 0x1a, 2, 'h', 'i'})
+
+	// Payloads on a route are written as they are, with the topic in a header.
+	telemetry := kafka.Message{Source: "eu", Topic: "devices/1/telemetry", Content: []byte{0, 0, 0, 0, 0, 0, 0xf0, 0x3f}}
+	is.NoErr(avro.Validate(telemetry))
+	value, headers, err := avro.Encode(telemetry)
+	is.NoErr(err)
+	is.Equal(value[5:], telemetry.Content)
+	decoded, id, err := Decode(gokafka.Message{Value: value, Headers: headers})
+	is.NoErr(err)
+	is.Equal(decoded, telemetry)
+	is.Equal(id, avro.routes[0].id)
+	// Unless it's a dead letter.
+	telemetry.Error = "bad"
+	value, _, _ = avro.Encode(telemetry)
+	is.Equal(int(binary.BigEndian.Uint32(value[1:5])), avro.envelopeId)
+	// A payload that doesn't match the schema is one too, with the reason.
+	telemetry = kafka.Message{Source: "eu", Topic: "devices/1/telemetry", Content: []byte{9, 9}}
+	is.True(avro.Validate(telemetry) != nil)
+	value, headers, err = avro.Encode(telemetry)
+	is.NoErr(err)
+	decoded, id, err = Decode(gokafka.Message{Value: value, Headers: headers})
+	is.NoErr(err)
+	is.Equal(id, avro.envelopeId)
+	is.Equal(decoded.Content, telemetry.Content)
+	is.Equal(decoded.Error, "payload doesn't match the schema for 'devices/+/telemetry': cut short")
+	is.NoErr(avro.Validate(kafka.Message{Topic: "devices/1/status", Content: []byte{9}})) // not on a route
+
+	_, _, err = Decode(gokafka.Message{Value: []byte(`{"topic":"a"}`)})
+	is.True(err != nil)
+	for _, bad := range []string{"devices/#", "a/#/b=x.avsc"} {
+		_, err = ParseRoutes(bad)
+		is.True(err != nil)
+	}
+	_, err = NewEncoder(ctx, Params{Registry: registry, Format: "xml", Subject: "x"})
+	is.True(err != nil)
+}
+
+func TestValidateAvro(t *testing.T) {
+	is := is2.New(t)
+	reading, err := parseAvro(`{"type": "record", "name": "Reading", "namespace": "iot", "fields": [
+		{"name": "id", "type": "string"},
+		{"name": "ok", "type": "boolean"},
+		{"name": "n", "type": {"type": "int", "logicalType": "date"}},
+		{"name": "unit", "type": {"type": "enum", "name": "Unit", "symbols": ["C", "F"]}},
+		{"name": "tags", "type": {"type": "map", "values": "string"}},
+		{"name": "next", "type": ["null", "Reading"]},
+		{"name": "mac", "type": {"type": "fixed", "name": "Mac", "size": 6}},
+		{"name": "values", "type": {"type": "array", "items": "iot.Unit"}}
+	]}`)
+	is.NoErr(err)
+	valid := []byte{
+		4, 'a', '1', // id, the lengths are zigzag encoded
+		1,          // ok
+		0x80, 0x01, // n is 64
+		2,                    // unit F
+		2, 2, 'k', 2, 'v', 0, // tags: a block of one, then the end
+		2, 2, 'b', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, // next: a Reading without a next
+		1, 2, 3, 4, 5, 6, // mac
+		3, 4, 0, 2, 0, // values: a block of -2 items in 2 bytes, then the end
+	}
+	is.NoErr(reading.validate(valid))
+	with := func(i int, b ...byte) []byte {
+		return append(append(append([]byte{}, valid[:i]...), b...), valid[i+len(b):]...)
+	}
+	for _, b := range [][]byte{
+		{},
+		append(valid, 0),    // trailing bytes
+		valid[:10],          // cut short
+		with(3, 2),          // boolean
+		with(6, 4),          // enum symbol
+		with(1, 0xff, 0xfe), // not UTF-8
+		with(13, 4),         // union branch
+		{4, 'a', '1', 1, 0x80, 0x01, 2, 0x80, 0x80, 0x80, 0x80, 0x10}, // a block longer than the payload
+	} {
+		is.True(reading.validate(b) != nil)
+	}
+	for _, bad := range []string{`{"type": "record", "name": "R", "fields": [{"name": "a", "type": "Other"}]}`, `{"type": "fixed", "name": "F"}`, `nope`} {
+		_, err := parseAvro(bad)
+		is.True(err != nil)
+	}
+}
+
+func TestValidateProtobuf(t *testing.T) {
+	is := is2.New(t)
+	reading, err := parseProtobuf(`
+		syntax = "proto3";
+		package iot;
+		import "google/protobuf/timestamp.proto";
+		option go_package = "example.com/iot"; // a comment
+
+		/* The first message is the one we check. */
+		message Reading {
+			string id = 1;
+			double value = 2 [json_name = "v"];
+			repeated int32 samples = 3;
+			Unit unit = 4;
+			map<string, Tag> tags = 5;
+			oneof where { Location location = 6; string site = 7; }
+			google.protobuf.Timestamp at = 8;
+			reserved 9, 10;
+			message Location { float lat = 1; float lon = 2; }
+		}
+		message Tag { string value = 1; }
+		enum Unit { CELSIUS = 0; FAHRENHEIT = 1; }
+		service Readings { rpc Get (Reading) returns (Reading); }
+	`)
+	is.NoErr(err)
+	is.Equal(reading.name, "iot.Reading")
+	var valid []byte
+	valid = protowire.AppendTag(valid, 1, protowire.BytesType)
+	valid = protowire.AppendString(valid, "a1")
+	valid = protowire.AppendTag(valid, 2, protowire.Fixed64Type)
+	valid = protowire.AppendFixed64(valid, 42)
+	valid = protowire.AppendTag(valid, 3, protowire.BytesType) // packed
+	valid = protowire.AppendBytes(valid, []byte{1, 2, 3})
+	valid = protowire.AppendTag(valid, 3, protowire.VarintType) // and not
+	valid = protowire.AppendVarint(valid, 4)
+	valid = protowire.AppendTag(valid, 4, protowire.VarintType)
+	valid = protowire.AppendVarint(valid, 1)
+	var entry []byte
+	entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+	entry = protowire.AppendString(entry, "k")
+	entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+	entry = protowire.AppendBytes(entry, protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), "v"))
+	valid = protowire.AppendTag(valid, 5, protowire.BytesType)
+	valid = protowire.AppendBytes(valid, entry)
+	location := protowire.AppendFixed32(protowire.AppendTag(nil, 1, protowire.Fixed32Type), 1)
+	valid = protowire.AppendTag(valid, 6, protowire.BytesType)
+	valid = protowire.AppendBytes(valid, location)
+	valid = protowire.AppendTag(valid, 8, protowire.BytesType) // imported, not checked
+	valid = protowire.AppendBytes(valid, []byte{0xff})
+	valid = protowire.AppendTag(valid, 99, protowire.VarintType) // unknown
+	valid = protowire.AppendVarint(valid, 1)
+	is.NoErr(reading.validate(valid))
+	is.NoErr(reading.validate(nil)) // everything is optional
+
+	for _, b := range [][]byte{
+		valid[:len(valid)-1], // cut short
+		protowire.AppendVarint(protowire.AppendTag(nil, 1, protowire.VarintType), 1),                      // id isn't a varint
+		protowire.AppendBytes(protowire.AppendTag(nil, 1, protowire.BytesType), []byte{0xff}),             // nor UTF-8
+		protowire.AppendBytes(protowire.AppendTag(nil, 6, protowire.BytesType), []byte{0x0d, 1}),          // location.lat cut short
+		protowire.AppendBytes(protowire.AppendTag(nil, 5, protowire.BytesType), []byte{0x12, 2, 0x08, 1}), // tags value isn't a Tag
+		protowire.AppendBytes(protowire.AppendTag(nil, 3, protowire.BytesType), []byte{0x80}),             // packed, cut short
+		{0x80}, // a broken tag
+	} {
+		is.True(reading.validate(b) != nil)
+	}
+	for _, bad := range []string{`syntax = "proto3";`, `message A { string a = x; }`, `message A { string a = 1;`, `/* message A {}`} {
+		_, err := parseProtobuf(bad)
+		is.True(err != nil)
+	}
+}
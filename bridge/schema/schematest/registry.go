@@ -0,0 +1,158 @@
+package schematest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry is an in-memory schema registry with the parts of the Confluent API the bridge uses:
+// registering and looking up schemas under a subject, and fetching a schema by id. A schema gets the
+// same id under every subject, like in the real thing.
+type Registry struct {
+	server   *httptest.Server
+	mu       sync.Mutex
+	ids      map[schema]int
+	schemas  map[int]schema
+	subjects map[string][]int // ids by subject, in version order
+	user     string
+	password string
+}
+
+type schema struct {
+	Type   string `json:"schemaType,omitempty"`
+	Schema string `json:"schema"`
+}
+
+func NewRegistry() *Registry {
+	r := &Registry{
+		ids:      make(map[schema]int),
+		schemas:  make(map[int]schema),
+		subjects: make(map[string][]int),
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.handle))
+	return r
+}
+
+func (r *Registry) URL() string {
+	return r.server.URL
+}
+
+func (r *Registry) Close() {
+	r.server.Close()
+}
+
+// RequireAuth makes the registry require basic auth.
+func (r *Registry) RequireAuth(user, password string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.user, r.password = user, password
+}
+
+// Subjects returns the subjects with registered schemas.
+func (r *Registry) Subjects() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []string
+	for s := range r.subjects {
+		out = append(out, s)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Schema returns the schema with the id, and its type ("" is Avro).
+func (r *Registry) Schema(id int) (string, string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.schemas[id]
+	return s.Schema, s.Type, ok
+}
+
+func (r *Registry) handle(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.user != "" {
+		if user, password, ok := req.BasicAuth(); !ok || user != r.user || password != r.password {
+			reply(w, http.StatusUnauthorized, map[string]interface{}{"error_code": 401, "message": "Unauthorized"})
+			return
+		}
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch {
+	case req.Method == http.MethodPost && len(parts) == 3 && parts[0] == "subjects" && parts[2] == "versions":
+		s, ok := decode(w, req)
+		if !ok {
+			return
+		}
+		id, found := r.ids[s]
+		if !found {
+			id = len(r.ids) + 1
+			r.ids[s], r.schemas[id] = id, s
+		}
+		if !contains(r.subjects[parts[1]], id) {
+			r.subjects[parts[1]] = append(r.subjects[parts[1]], id)
+		}
+		reply(w, http.StatusOK, map[string]interface{}{"id": id})
+	case req.Method == http.MethodPost && len(parts) == 2 && parts[0] == "subjects":
+		s, ok := decode(w, req)
+		if !ok {
+			return
+		}
+		versions, found := r.subjects[parts[1]]
+		if !found {
+			reply(w, http.StatusNotFound, map[string]interface{}{"error_code": 40401, "message": "Subject not found"})
+			return
+		}
+		for i, id := range versions {
+			if r.schemas[id] == s {
+				reply(w, http.StatusOK, map[string]interface{}{
+					"subject": parts[1], "id": id, "version": i + 1, "schema": s.Schema,
+				})
+				return
+			}
+		}
+		reply(w, http.StatusNotFound, map[string]interface{}{"error_code": 40403, "message": "Schema not found"})
+	case req.Method == http.MethodGet && len(parts) == 3 && parts[0] == "schemas" && parts[1] == "ids":
+		id, _ := strconv.Atoi(parts[2])
+		s, found := r.schemas[id]
+		if !found {
+			reply(w, http.StatusNotFound, map[string]interface{}{"error_code": 40403, "message": "Schema not found"})
+			return
+		}
+		reply(w, http.StatusOK, s)
+	default:
+		reply(w, http.StatusNotFound, map[string]interface{}{"error_code": 404, "message": "Not found"})
+	}
+}
+
+func decode(w http.ResponseWriter, req *http.Request) (schema, bool) {
+	var s schema
+	if err := json.NewDecoder(req.Body).Decode(&s); err != nil || s.Schema == "" {
+		reply(w, http.StatusUnprocessableEntity, map[string]interface{}{"error_code": 42201, "message": "Invalid schema"})
+		return s, false
+	}
+	if s.Type == "AVRO" {
+		s.Type = ""
+	}
+	return s, true
+}
+
+func reply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func contains(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
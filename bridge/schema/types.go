@@ -0,0 +1,97 @@
+package schema
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+	"net/http"
+)
+
+// Formats, as used in KAFKA_ENCODING.
+const (
+	FormatAvro     = "avro"
+	FormatProtobuf = "protobuf"
+)
+
+// Record headers. The encoding header tells consumers how to decode the value. Records with a payload
+// schema carry the MQTT topic and source in headers, as the value is just the payload.
+const (
+	EncodingHeader = "metamorphosis-encoding"
+	TopicHeader    = "mqtt-topic"
+	SourceHeader   = "mqtt-source"
+)
+
+// Schema is a schema as the registry sees it. Type is empty for Avro, the registry's default.
+type Schema struct {
+	Type   string `json:"schemaType,omitempty"`
+	Schema string `json:"schema"`
+}
+
+// Registry is a client for a Confluent compatible schema registry.
+type Registry struct {
+	url      string
+	user     string
+	password string
+	client   *http.Client
+}
+
+// Params configure an Encoder.
+type Params struct {
+	Registry     *Registry
+	Format       string  // avro or protobuf
+	Subject      string  // subject of the envelope schema, e.g. "mqtt-value"
+	AutoRegister bool    // register the schemas. If false they must already be registered.
+	Routes       []Route // payload schemas per MQTT topic filter
+}
+
+// Route says that payloads on topics matching Filter are already encoded with the schema in File. They're
+// checked against the schema and written as they are, with the id of that schema, instead of in the
+// envelope. Payloads that don't match are dead letters.
+type Route struct {
+	Filter  string
+	File    string
+	Subject string // defaults to the file name without the extension
+}
+
+// Encoder writes records in the Confluent wire format: a zero byte, the schema id (4 bytes, big endian)
+// and, for Protobuf, the message indexes, followed by the encoded data.
+type Encoder struct {
+	format     string
+	envelopeId int
+	routes     []route // read only, so the encoder can be shared by the pipelines.
+}
+
+type route struct {
+	filter   string
+	id       int
+	validate func([]byte) error
+}
+
+// avroType is a parsed Avro schema, with just what it takes to walk data written with it.
+type avroType struct {
+	kind     string      // a primitive, or record, enum, fixed, array, map or union
+	fields   []*avroType // record fields, in order
+	items    *avroType   // array items or map values
+	branches []*avroType // union
+	size     int         // fixed size or the number of enum symbols
+}
+
+// protoMessage is a parsed Protobuf message.
+type protoMessage struct {
+	name   string
+	fields map[protowire.Number]*protoField
+}
+
+type protoField struct {
+	typeName string
+	scope    string // the message the field is in, where its type name is looked up from
+	repeated bool
+	entry    *protoMessage  // the entry of a map field
+	wire     protowire.Type // -1 if the type is unknown, like one from an import
+	message  *protoMessage  // if the type is a message
+	utf8     bool           // proto3 strings must be UTF-8
+}
+
+// registryError is the error body of the registry API.
+type registryError struct {
+	Code    int    `json:"error_code"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,134 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// sources returns the MQTT sources. Without any, the top level settings make up a single source without a name.
+func (p Params) sources() ([]MqttSource, error) {
+	if len(p.MqttSources) == 0 {
+		return []MqttSource{{
+			Broker:             p.MqttBroker,
+			Port:               p.MqttPort,
+			PreferPrimaryAfter: p.MqttPreferPrimaryAfter,
+			Url:                p.MqttUrl,
+			Transport:          p.MqttTransport,
+			WsPath:             p.MqttWsPath,
+			WsHeaders:          p.MqttWsHeaders,
+			WsProxy:            p.MqttWsProxy,
+			ProtocolVersion:    p.MqttProtocolVersion,
+			Tls:                p.MqttTls,
+			RootCrtFile:        p.TlsRootCrtFile,
+			ClientCertFile:     p.MqttClientCertFile,
+			ClientKeyFile:      p.MqttClientKeyFile,
+			Username:           p.MqttUsername,
+			Password:           p.MqttPassword,
+			Topic:              p.MqttTopic,
+			ClientId:           p.MqttClientId,
+		}}, nil
+	}
+	seen := make(map[string]bool, len(p.MqttSources))
+	for _, s := range p.MqttSources {
+		if s.Name == "" {
+			return nil, errors.New("MQTT source without a name")
+		}
+		if seen[s.Name] {
+			return nil, fmt.Errorf("duplicate MQTT source '%s'", s.Name)
+		}
+		seen[s.Name] = true
+	}
+	return p.MqttSources, nil
+}
+
+// Pause pauses all the sources.
+func (ms mqttSources) Pause() error {
+	for _, s := range ms {
+		if err := s.Pause(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Resume resumes all the sources.
+func (ms mqttSources) Resume() error {
+	for _, s := range ms {
+		if err := s.Resume(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Paused returns true if any of the sources is paused.
+func (ms mqttSources) Paused() bool {
+	for _, s := range ms {
+		if s.Paused() {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscriptions returns the topics any of the sources subscribe to, sorted.
+func (ms mqttSources) Subscriptions() []string {
+	seen := make(map[string]bool)
+	topics := []string{}
+	for _, s := range ms {
+		for _, t := range s.Subscriptions() {
+			if !seen[t] {
+				seen[t] = true
+				topics = append(topics, t)
+			}
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Subscribe adds the subscription to the sources that don't have it.
+func (ms mqttSources) Subscribe(topic string) error {
+	added := false
+	for _, s := range ms {
+		if contains(s.Subscriptions(), topic) {
+			continue
+		}
+		if err := s.Subscribe(topic); err != nil {
+			return err
+		}
+		added = true
+	}
+	if !added {
+		return fmt.Errorf("already subscribed to '%s'", topic)
+	}
+	return nil
+}
+
+// Unsubscribe removes the subscription from the sources that have it.
+func (ms mqttSources) Unsubscribe(topic string) error {
+	removed := false
+	for _, s := range ms {
+		if !contains(s.Subscriptions(), topic) {
+			continue
+		}
+		if err := s.Unsubscribe(topic); err != nil {
+			return err
+		}
+		removed = true
+	}
+	if !removed {
+		return fmt.Errorf("not subscribed to '%s'", topic)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
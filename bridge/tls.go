@@ -0,0 +1,137 @@
+package bridge
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// newCertReloader loads the CA and the client certificate. Call Run to pick up changes to the files.
+func newCertReloader(caFile, certFile, keyFile string, logger *log.Entry) (*certReloader, error) {
+	r := &certReloader{caFile: caFile, certFile: certFile, keyFile: keyFile, logger: logger}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load reads the files. On error the ones we have are kept.
+func (r *certReloader) load() error {
+	modTime, err := r.modTime()
+	if err != nil {
+		return err
+	}
+	ca, err := ioutil.ReadFile(r.caFile)
+	if err != nil {
+		return fmt.Errorf("reading CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("no certificates in CA file %s", r.caFile)
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("tls.LoadX509KeyPair(%s,%s): %w", r.certFile, r.keyFile, err)
+	}
+	r.mu.Lock()
+	r.pool, r.cert, r.loaded = pool, &cert, modTime
+	r.mu.Unlock()
+	return nil
+}
+
+// modTime returns the time of the most recently modified file.
+func (r *certReloader) modTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.caFile, r.certFile, r.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Reload loads the files again if any of them has changed. force loads them regardless.
+func (r *certReloader) Reload(force bool) {
+	modTime, err := r.modTime()
+	if err != nil {
+		r.logger.Errorf("Checking TLS files: %s. Keeping the current certificates.", err)
+		return
+	}
+	r.mu.Lock()
+	changed := !modTime.Equal(r.loaded)
+	r.mu.Unlock()
+	if !changed && !force {
+		return
+	}
+	if err := r.load(); err != nil {
+		r.logger.Errorf("Reloading TLS files: %s. Keeping the current certificates.", err)
+		return
+	}
+	r.logger.Infof("Reloaded TLS client certificate %s and CA %s. They're used from the next connection.",
+		r.certFile, r.caFile)
+}
+
+// Run checks the files every interval until the context is cancelled.
+func (r *certReloader) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Reload(false)
+		}
+	}
+}
+
+// Config returns a TLS config that always uses the current certificates. The server certificate is
+// verified by us, against the current CA, as the standard verification only knows a fixed set of roots.
+func (r *certReloader) Config() *tls.Config {
+	return &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			return r.cert, nil
+		},
+		InsecureSkipVerify: true, // verified in VerifyConnection
+		VerifyConnection:   r.verify,
+	}
+}
+
+// verify does what the standard verification does, with the current CA. Without a server name there's
+// nothing to check the certificate against, so we refuse the connection rather than accept any host.
+func (r *certReloader) verify(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("tls: no server certificate")
+	}
+	if cs.ServerName == "" {
+		return errors.New("tls: no server name to verify the certificate against")
+	}
+	r.mu.Lock()
+	pool := r.pool
+	r.mu.Unlock()
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
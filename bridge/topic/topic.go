@@ -0,0 +1,61 @@
+package topic
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MQTT topic filters, as described in section 4.7 of the MQTT 3.1.1 spec.
+// '+' matches a single level, '#' matches any number of levels and must be last.
+
+// ValidateFilter checks that a filter is well-formed.
+func ValidateFilter(filter string) error {
+	if filter == "" {
+		return errors.New("topic filter can't be empty")
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return fmt.Errorf("topic filter '%s': '#' must be a level of its own, and the last one", filter)
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return fmt.Errorf("topic filter '%s': '+' must be a level of its own", filter)
+		}
+	}
+	return nil
+}
+
+// Match returns true if the topic name matches the filter.
+// Topics starting with '$' are not matched by filters starting with a wildcard.
+func Match(filter, name string) bool {
+	if strings.HasPrefix(name, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	for {
+		fLevel, fRest, fMore := strings.Cut(filter, "/")
+		if fLevel == "#" {
+			return true // matches the parent level too, "a/#" matches "a".
+		}
+		nLevel, nRest, nMore := strings.Cut(name, "/")
+		if fLevel != "+" && fLevel != nLevel {
+			return false
+		}
+		if !fMore || !nMore {
+			if fMore { // the name is done, only "#" can match what is left.
+				return fRest == "#"
+			}
+			return !nMore
+		}
+		filter, name = fRest, nRest
+	}
+}
+
+// Level returns level n (0-based) of the topic, or "" if the topic doesn't have that many levels.
+func Level(name string, n int) string {
+	levels := strings.Split(name, "/")
+	if n < 0 || n >= len(levels) {
+		return ""
+	}
+	return levels[n]
+}
@@ -0,0 +1,52 @@
+package topic
+
+import (
+	is2 "github.com/matryer/is"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	is := is2.New(t)
+	cases := []struct {
+		filter, name string
+		match        bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/b/c", "a/b", false},
+		{"a/b", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+		{"a/+", "a/b/c", false},
+		{"+/+", "a/b", true},
+		{"+", "a", true},
+		{"+", "/a", false},
+		{"+/a", "/a", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "b/c", false},
+		{"#", "a/b/c", true},
+		{"#", "$SYS/broker", false},
+		{"+/broker", "$SYS/broker", false},
+		{"$SYS/#", "$SYS/broker", true},
+		{"a/b/", "a/b/", true},
+		{"a/b/", "a/b", false},
+		{"a/+/#", "a/b", true},
+	}
+	for _, c := range cases {
+		if Match(c.filter, c.name) != c.match {
+			t.Errorf("Match(%q, %q) should be %v", c.filter, c.name, c.match)
+		}
+	}
+	is.Equal(Level("a/b/c", 1), "b")
+	is.Equal(Level("a/b/c", 3), "")
+}
+
+func TestValidateFilter(t *testing.T) {
+	is := is2.New(t)
+	for _, f := range []string{"a", "a/b", "+", "#", "a/+/b", "a/#", "+/+/#", "/"} {
+		is.NoErr(ValidateFilter(f))
+	}
+	for _, f := range []string{"", "a#", "a/#/b", "a+/b", "a/b+", "#/a"} {
+		is.True(ValidateFilter(f) != nil)
+	}
+}
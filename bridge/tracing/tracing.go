@@ -0,0 +1,286 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/celerway/metamorphosis/bridge/logging"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A small OpenTelemetry compatible tracer. We only need a handful of spans per message, so instead of
+// pulling in the OTel SDK we create the spans ourselves and ship them as OTLP/HTTP JSON to a collector.
+
+const (
+	defaultBatchSize     = 512
+	defaultFlushInterval = 5 * time.Second
+	defaultQueueSize     = 8192
+	exportTimeout        = 10 * time.Second
+)
+
+// Initialize creates the tracer. Call Run to start exporting spans.
+func Initialize(params Params) (*Tracer, error) {
+	if params.Endpoint == "" {
+		return nil, errors.New("tracing: endpoint can't be empty")
+	}
+	if !strings.HasPrefix(params.Endpoint, "http://") && !strings.HasPrefix(params.Endpoint, "https://") {
+		return nil, fmt.Errorf("tracing: endpoint '%s' must be a http(s) url", params.Endpoint)
+	}
+	t := &Tracer{
+		serviceName:   params.ServiceName,
+		endpoint:      strings.TrimSuffix(params.Endpoint, "/") + "/v1/traces",
+		sampleRatio:   params.SampleRatio,
+		batchSize:     params.BatchSize,
+		flushInterval: params.FlushInterval,
+		httpClient:    &http.Client{Timeout: exportTimeout},
+		logger:        logging.Module("tracing"),
+	}
+	if t.serviceName == "" {
+		t.serviceName = "metamorphosis"
+	}
+	if t.batchSize <= 0 {
+		t.batchSize = defaultBatchSize
+	}
+	if t.flushInterval <= 0 {
+		t.flushInterval = defaultFlushInterval
+	}
+	queueSize := params.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	t.queue = make(chan *Span, queueSize)
+	return t, nil
+}
+
+// Run exports spans until the context is cancelled. Remaining spans are flushed before it returns.
+func (t *Tracer) Run(ctx context.Context) {
+	t.logger.Infof("Exporting traces to %s (sample ratio %v)", t.endpoint, t.sampleRatio)
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, t.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			t.logger.Warnf("Exporting %d spans: %s", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case s := <-t.queue:
+					batch = append(batch, s)
+					if len(batch) >= t.batchSize {
+						flush()
+					}
+				default:
+					flush()
+					if d := atomic.LoadUint64(&t.dropped); d > 0 {
+						t.logger.Warnf("Dropped %d spans because the export queue was full", d)
+					}
+					return
+				}
+			}
+		case <-ticker.C:
+			flush()
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= t.batchSize {
+				flush()
+			}
+		}
+	}
+}
+
+// Start starts a span. If the parent is valid the span joins its trace, otherwise a new trace is started.
+func (t *Tracer) Start(parent SpanContext, name string, kind SpanKind) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+	}
+	if parent.IsValid() {
+		s.context = SpanContext{TraceID: parent.TraceID, SpanID: newSpanID(), Sampled: parent.Sampled}
+		s.parent = parent.SpanID
+	} else {
+		traceID := newTraceID()
+		s.context = SpanContext{TraceID: traceID, SpanID: newSpanID(), Sampled: sampled(traceID, t.sampleRatio)}
+	}
+	return s
+}
+
+// Context returns the span context, to be passed on to child spans.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetAttribute adds an attribute to the span. Values should be strings, bools, ints or floats.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil || !s.context.Sampled {
+		return
+	}
+	s.attributes = append(s.attributes, attribute{key: key, value: value})
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil {
+		return
+	}
+	s.err = err
+}
+
+// End ends the span and queues it for export. If the queue is full the span is dropped; we never
+// want tracing to slow down the bridge.
+func (s *Span) End() {
+	if s == nil || !s.context.Sampled {
+		return
+	}
+	s.end = time.Now()
+	select {
+	case s.tracer.queue <- s:
+	default:
+		atomic.AddUint64(&s.tracer.dropped, 1)
+	}
+}
+
+func (t *Tracer) export(spans []*Span) error {
+	body, err := json.Marshal(t.toOtlp(spans))
+	if err != nil {
+		return fmt.Errorf("marshalling spans: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// The OTLP JSON encoding. See opentelemetry-proto, trace/v1/trace.proto.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 0 unset, 1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // int64 is a string in the JSON encoding
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func (t *Tracer) toOtlp(spans []*Span) otlpRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           s.context.TraceID.String(),
+			SpanID:            s.context.SpanID.String(),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parent.IsValid() {
+			o.ParentSpanID = s.parent.String()
+		}
+		for _, a := range s.attributes {
+			o.Attributes = append(o.Attributes, toOtlpAttribute(a.key, a.value))
+		}
+		if s.err != nil {
+			o.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+		out = append(out, o)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{toOtlpAttribute("service.name", t.serviceName)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "metamorphosis"}, Spans: out}},
+	}}}
+}
+
+func toOtlpAttribute(key string, value interface{}) otlpAttribute {
+	var v otlpValue
+	switch x := value.(type) {
+	case string:
+		v.StringValue = &x
+	case bool:
+		v.BoolValue = &x
+	case int:
+		s := strconv.Itoa(x)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(x, 10)
+		v.IntValue = &s
+	case float64:
+		v.DoubleValue = &x
+	default:
+		s := fmt.Sprint(x)
+		v.StringValue = &s
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
@@ -0,0 +1,125 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	is2 "github.com/matryer/is"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTraceparent(t *testing.T) {
+	is := is2.New(t)
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(tp)
+	is.NoErr(err)
+	is.True(sc.Sampled)
+	is.Equal(sc.TraceID.String(), "4bf92f3577b34da6a3ce929d0e0e4736")
+	is.Equal(sc.SpanID.String(), "00f067aa0ba902b7")
+	is.Equal(sc.Traceparent(), tp)
+
+	invalid := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",             // no flags
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",          // zero trace id
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",          // zero span id
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",          // invalid version
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",          // not hex
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-whatever", // version 00 can't have more fields
+	}
+	for _, s := range invalid {
+		_, err := ParseTraceparent(s)
+		is.True(err != nil)
+	}
+	// Future versions may add fields.
+	_, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-whatever")
+	is.NoErr(err)
+}
+
+func TestSampling(t *testing.T) {
+	is := is2.New(t)
+	sampledCount := 0
+	for i := 0; i < 10000; i++ {
+		if sampled(newTraceID(), 0.1) {
+			sampledCount++
+		}
+	}
+	is.True(sampledCount > 800 && sampledCount < 1200)
+	is.True(sampled(newTraceID(), 1))
+	is.True(!sampled(newTraceID(), 0))
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	span := tracer.Start(SpanContext{}, "test", KindInternal)
+	span.SetAttribute("a", "b")
+	span.SetError(errors.New("oops"))
+	span.End()
+	is2.New(t).True(!span.Context().IsValid())
+}
+
+// A fake collector receives the spans. Check that they form a trace.
+func TestExport(t *testing.T) {
+	is := is2.New(t)
+	var mu sync.Mutex
+	var received []otlpSpan
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				received = append(received, ss.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+	tracer, err := Initialize(Params{Endpoint: collector.URL, SampleRatio: 1, FlushInterval: time.Hour})
+	is.NoErr(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		tracer.Run(ctx)
+	}()
+	root := tracer.Start(SpanContext{}, "mqtt receive", KindConsumer)
+	root.SetAttribute("messaging.system", "mqtt")
+	child := tracer.Start(root.Context(), "kafka produce", KindProducer)
+	child.SetError(errors.New("kafka is down"))
+	child.End()
+	root.End()
+	cancel() // flushes the spans
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	is.Equal(len(received), 2)
+	is.Equal(received[0].Name, "kafka produce")
+	is.Equal(received[0].TraceID, root.Context().TraceID.String())
+	is.Equal(received[0].ParentSpanID, root.Context().SpanID.String())
+	is.Equal(received[0].Status.Code, 2)
+	is.Equal(received[1].Name, "mqtt receive")
+	is.Equal(received[1].ParentSpanID, "")
+	is.Equal(received[1].Attributes[0].Key, "messaging.system")
+	is.Equal(*received[1].Attributes[0].Value.StringValue, "mqtt")
+}
+
+func TestInitializeErrors(t *testing.T) {
+	is := is2.New(t)
+	_, err := Initialize(Params{})
+	is.True(err != nil)
+	_, err = Initialize(Params{Endpoint: "localhost:4318"})
+	is.True(err != nil)
+}
@@ -0,0 +1,68 @@
+package tracing
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+// SpanContext is what we propagate between the stages of the bridge and into the Kafka headers.
+// The zero value is an invalid context, which means "no parent".
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+type SpanKind int
+
+// Values match the OTLP protocol.
+const (
+	KindInternal SpanKind = 1
+	KindProducer SpanKind = 4
+	KindConsumer SpanKind = 5
+)
+
+type Params struct {
+	Endpoint      string  // OTLP/HTTP endpoint, like http://localhost:4318. Traces are posted to /v1/traces.
+	ServiceName   string  // defaults to metamorphosis
+	SampleRatio   float64 // ratio of new traces that are sampled. Incoming sampled traces are always kept.
+	BatchSize     int
+	FlushInterval time.Duration
+	QueueSize     int
+}
+
+// Tracer creates spans and exports them. A nil Tracer is valid and does nothing, so callers don't
+// have to check if tracing is enabled.
+type Tracer struct {
+	serviceName   string
+	endpoint      string
+	sampleRatio   float64
+	batchSize     int
+	flushInterval time.Duration
+	queue         chan *Span
+	httpClient    *http.Client
+	logger        *log.Entry
+	dropped       uint64
+}
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// Span is a single operation. A nil Span is valid and does nothing.
+type Span struct {
+	tracer     *Tracer
+	name       string
+	kind       SpanKind
+	context    SpanContext
+	parent     SpanID
+	start      time.Time
+	end        time.Time
+	attributes []attribute
+	err        error
+}
@@ -1,35 +1,218 @@
 package bridge
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/celerway/metamorphosis/bridge/admin"
 	"github.com/celerway/metamorphosis/bridge/kafka"
+	"github.com/celerway/metamorphosis/bridge/logging"
 	"github.com/celerway/metamorphosis/bridge/mqtt"
+	"github.com/celerway/metamorphosis/bridge/observability"
+	"github.com/celerway/metamorphosis/bridge/processor"
+	"github.com/celerway/metamorphosis/bridge/tracing"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	"sync"
 	"time"
 )
 
 type Params struct {
-	MqttBroker         string
-	MqttTls            bool
-	MqttPort           int
-	TlsRootCrtFile     string
-	MqttClientCertFile string
-	MqttClientKeyFile  string
-	MqttTopic          string
-	KafkaBroker        string
-	KafkaPort          int
-	KafkaTopic         string
-	KafkaWorkers       int
-	HealthPort         int
-	KafkaRetryInterval time.Duration
-	MqttClientId       string
-	KafkaBatchSize     int
-	KafkaMaxBatchSize  int
-	KafkaInterval      time.Duration
-	TestMessageTopic   string
+	MqttSources            []MqttSource  // brokers to read from. If empty, the Mqtt* fields below are the only source.
+	MqttBroker             string        // comma separated, in order of preference
+	MqttPreferPrimaryAfter time.Duration // move back to the first broker after this long on another. 0 disables.
+	MqttTls                bool
+	MqttPort               int
+	MqttUrl                string // full broker URLs, overrides MqttBroker, MqttPort and MqttTransport
+	MqttTransport          string // tcp or ws
+	MqttWsPath             string // path for the ws transport
+	MqttWsHeaders          string `json:"-"` // extra headers for the websocket handshake, "Name: value, Name: value"
+	MqttWsProxy            string // proxy for websockets, empty uses the environment, "direct" disables it
+	MqttProtocolVersion    int    // 4 (MQTT 3.1.1) or 5. Only MQTT 5 has user properties.
+	TlsRootCrtFile         string
+	MqttClientCertFile     string
+	MqttClientKeyFile      string
+	MqttUsername           string
+	MqttPassword           string `json:"-"`
+	MqttTopic              string
+	MqttBackpressure       string        // what to do when the queue to Kafka is full: block, slow or spill
+	MqttSpillDir           string        // where spilled messages are kept
+	MqttSpillMaxBytes      int64         // 0 is no limit
+	MqttSlowMaxHandlers    int           // messages waiting for room at once with slow backpressure. 0 is the default.
+	ChannelSize            int           // size of the queues between MQTT and Kafka. Defaults to 100.
+	MqttStatusTopic        string        // retained status and last will. Empty disables it.
+	MqttStatusInterval     time.Duration // how often the status is published, 0 only on connect/disconnect
+	KafkaBroker            string        // bootstrap brokers, "host:port,host:port". KafkaPort is used if the port is left out.
+	KafkaPort              int
+	KafkaSecondaryBrokers  string        // optional cluster to fail over to
+	KafkaFailoverAfter     time.Duration // how long writes to the primary must fail before we fail over
+	KafkaTopicCheck        string        // what to do if the topics can't be found at startup: fail, warn or off
+	KafkaCreateTopics      bool          // create missing topics at startup
+	KafkaTopicPartitions   int           // for created topics, -1 is the broker default
+	KafkaTopicReplication  int           // for created topics, -1 is the broker default
+	KafkaTopicRetention    time.Duration // for created topics, 0 is the broker default
+	KafkaTopic             string
+	KafkaWorkers           int // parallel Kafka pipelines, sharded by MQTT topic
+	KafkaMaxInFlight       int // max buffered messages per pipeline, 0 is no limit
+	HealthPort             int
+	HealthAddr             string // overrides HealthPort if set
+	HealthTlsCertFile      string
+	HealthTlsKeyFile       string
+	HealthAuthUser         string
+	HealthAuthPassword     string `json:"-"`
+	HealthAuthToken        string `json:"-"`
+	KafkaRetryInterval     time.Duration
+	MqttClientId           string
+	KafkaBatchSize         int
+	KafkaMaxBatchSize      int
+	KafkaInterval          time.Duration // linger: max time a message waits before it's sent
+	KafkaBatchBytes        int           // send when this many bytes are buffered, 0 disables
+	KafkaMaxRequestBytes   int           // batches are split to stay below this
+	KafkaCompression       string        // none, gzip, snappy, lz4 or zstd
+	KafkaCompressionRoutes string        // compression per MQTT topic filter, e.g. "logs/#=zstd"
+	TestMessageTopic       string
+	NoTestMessage          bool          // skip the test message at startup
+	HeartbeatInterval      time.Duration // 0 disables heartbeats
+	HeartbeatTopic         string        // Kafka topic for heartbeats. Defaults to KafkaTopic.
+	Version                string        // reported in heartbeats
+	DedupeWindow           time.Duration // 0 disables deduplication
+	DedupeKey              string
+	DedupeMaxEntries       int
+	AdminPort              int    // 0 disables the admin API
+	AdminToken             string `json:"-"` // keep it out of the startup log
+	TracingEndpoint        string // OTLP/HTTP endpoint. Empty disables tracing.
+	TracingSampleRatio     float64
+	TracingService         string
+	KafkaWriter            kafka.KafkaWriter            `json:"-"` // replaces the Kafka connection. Used in tests.
+	TlsReloadInterval      time.Duration                // how often the TLS files are checked for changes. 0 only on reload.
+	Reload                 <-chan Reloadable            `json:"-"` // new settings, e.g. on SIGHUP
+	ProcessorsFile         string                       // JSON config of the processor chains. Empty disables processing.
+	Processors             map[string]processor.Factory `json:"-"` // custom processor types
+	KafkaDeadLetterTopic   string                       // for messages that failed processing
+	KafkaEncoding          string                       // json (default), avro or protobuf
+	KafkaInlineJson        string                       // MQTT topic filters where JSON payloads are inlined in the envelope
+	RateLimits             string                       // token buckets per MQTT topic filter, see parseRateLimits
+	RateLimitTopK          int                          // offenders exported per rate limit. Defaults to 10.
+	KafkaQuarantineTopic   string                       // for messages over a rate limit with the quarantine action
+	SchemaRegistryUrl      string
+	SchemaRegistryUser     string
+	SchemaRegistryPassword string `json:"-"`
+	SchemaSubject          string // subject of the envelope schema. Defaults to "<KafkaTopic>-value".
+	SchemaAutoRegister     bool   // register the schemas, instead of only looking them up
+	SchemaRoutes           string // payload schemas per MQTT topic filter, "filter=file,filter=file"
 }
 
-type bridge struct {
-	mqttCh  mqtt.MessageChannel
-	kafkaCh kafka.MessageChan
+// Reloadable are the settings that can be changed while the bridge runs. They replace the current ones.
+type Reloadable struct {
+	LogLevel               string
+	LogModuleLevels        string
+	MqttTopics             map[string]string // subscription by source name. "" is the source without a name.
+	KafkaCompressionRoutes string
+}
+
+// MqttSource is an MQTT broker the bridge reads from. The name is added to the messages and used as a metric label.
+type MqttSource struct {
+	Name               string
+	Broker             string
+	Port               int
+	PreferPrimaryAfter time.Duration
+	Url                string
+	Transport          string
+	WsPath             string
+	WsHeaders          string `json:"-"` // might carry tokens
+	WsProxy            string
+	ProtocolVersion    int
+	Tls                bool
+	RootCrtFile        string
+	ClientCertFile     string
+	ClientKeyFile      string
+	Username           string
+	Password           string `json:"-"`
+	Topic              string
+	ClientId           string
+}
+
+// certReloader keeps the TLS files up to date.
+type certReloader struct {
+	caFile, certFile, keyFile string
+	logger                    *log.Entry
+	mu                        sync.Mutex
+	pool                      *x509.CertPool
+	cert                      *tls.Certificate
+	loaded                    time.Time // modification time of the files we have
+}
+
+// reloader applies Reloadable settings.
+type reloader struct {
+	sources []*reloadSource
+	kafka   routeSetter
+	certs   []*certReloader
 	logger  *log.Entry
 }
+
+// routeSetter is implemented by the Kafka pool.
+type routeSetter interface {
+	SetCompressionRoutes(routes []kafka.CompressionRoute) error
+}
+
+type reloadSource struct {
+	name   string
+	client admin.MqttController
+	topic  string // the configured subscription
+}
+
+// mqttSources lets the admin API control all the sources at once.
+type mqttSources []admin.MqttController
+
+// rateLimit is a token bucket per key for the topics matching filter.
+type rateLimit struct {
+	filter    string
+	rate      float64 // tokens per second
+	burst     float64 // size of the buckets
+	keySpec   string  // route, topic or level
+	level     int     // with keySpec level
+	action    string  // what to do with messages over the limit
+	sample    int     // with the sample action: let one in sample through
+	buckets   map[string]*bucket
+	offenders offenders
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time // when tokens was updated
+	excess int       // messages over the limit, for sampling
+}
+
+// offenders counts throttled messages per key, in a table of bounded size.
+type offenders struct {
+	capacity int
+	counts   map[string]int
+}
+
+type rateLimiter struct {
+	mu           sync.Mutex // check runs on the main loop, Collect on the metrics handler.
+	limits       []*rateLimit
+	maxKeys      int // buckets, over all limits
+	topK         int // offenders exported per limit
+	lastSweep    time.Time
+	now          func() time.Time
+	limited      *prometheus.CounterVec
+	offenderDesc *prometheus.Desc
+}
+
+// payloadValidator checks payloads against their schema, see schema.Encoder.
+type payloadValidator interface {
+	Validate(m kafka.Message) error
+}
+
+type bridge struct {
+	mqttCh       mqtt.MessageChannel
+	kafkaCh      kafka.MessageChan
+	obsChannel   observability.Channel
+	dedupe       *dedupe          // nil if deduplication is disabled
+	processors   *processor.Chain // nil if there are no processors
+	rateLimiter  *rateLimiter     // nil if there are no rate limits
+	validator    payloadValidator // nil if payloads aren't checked against a schema
+	logger       *log.Entry
+	traceSampler *logging.Sampler
+	tracer       *tracing.Tracer
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	_ "embed"
 	"flag"
+	"fmt"
 	"github.com/celerway/metamorphosis/bridge"
+	"github.com/celerway/metamorphosis/bridge/logging"
 	"github.com/joho/godotenv"
 	log "github.com/sirupsen/logrus"
 	"os"
@@ -18,36 +20,140 @@ import (
 //go:embed .version
 var embeddedVersion string
 
+// usage is printed for unknown subcommands.
+const usage = `Usage: metamorphosis [command] [flags]
+
+Commands:
+  run     Run the bridge (default)
+  tail    Print the messages in a Kafka topic
+  publish Publish synthetic MQTT traffic, optionally verifying it arrives in Kafka
+
+Run 'metamorphosis <command> -h' for the flags of each command.
+`
+
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		cmd, args := os.Args[1], os.Args[2:]
+		switch cmd {
+		case "run":
+			os.Args = append(os.Args[:1], args...) // the bridge uses the global flag set.
+		case "tail":
+			os.Exit(tailCmd(args))
+		case "publish":
+			os.Exit(publishCmd(args))
+		default:
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+	}
+	runBridge()
+}
+
+// runBridge runs the bridge until we get SIGINT.
+func runBridge() {
 	var ( // default settings:
-		logLevel             string
-		mqttBroker           string
-		mqttPort             int = 8883
-		mqttTopic            string
-		mqttTls              bool   = true
-		mqttClientId         string = "metamorphosis"
-		caRootCertFile       string
-		mqttCaClientCertFile string
-		mqttCaClientKeyFile  string
-		kafkaBroker          string
-		kafkaPort            int = 9092
-		kafkaTopic           string
-		healthPort           int    = 8080
-		kafkaRetryInterval   int    = 3
-		kafkaInterval        int    = 5
-		kafkaBatchSize       int    = 1000
-		kafkaMaxBatchSize    int    = 8000
-		testMessageTopic     string = "test"
+		logLevel               string
+		logFormat              string = "text"
+		logModuleLevels        string
+		logTraceSample         int = 1
+		logPayloads            bool
+		mqttBroker             string
+		mqttPort               int = 8883
+		mqttUrl                string
+		mqttTransport          string = "tcp"
+		mqttWsPath             string = "/mqtt"
+		mqttWsHeaders          string
+		mqttWsProxy            string
+		mqttProtocolVersion    int = 4
+		mqttTopic              string
+		mqttSources            string
+		mqttBackpressure       string = "block"
+		mqttSpillDir           string
+		mqttSpillMaxBytes      int = 1 << 30
+		mqttSlowMaxHandlers    int = 1000
+		channelSize            int = 100
+		mqttPreferPrimaryAfter time.Duration
+		mqttUsername           string
+		mqttPassword           string
+		mqttStatusTopic        string
+		mqttStatusInterval     time.Duration = time.Minute
+		mqttTls                bool          = true
+		mqttClientId           string        = "metamorphosis"
+		caRootCertFile         string
+		mqttCaClientCertFile   string
+		mqttCaClientKeyFile    string
+		kafkaBroker            string
+		kafkaPort              int = 9092
+		kafkaTopic             string
+		kafkaSecondaryBrokers  string
+		kafkaFailoverAfter     time.Duration = time.Minute
+		kafkaTopicCheck        string        = "fail"
+		kafkaCreateTopics      bool
+		kafkaTopicPartitions   int = -1
+		kafkaTopicReplication  int = -1
+		kafkaTopicRetention    time.Duration
+		healthPort             int           = 8080
+		kafkaRetryInterval     int           = 3
+		kafkaInterval          time.Duration = 5 * time.Second
+		kafkaBatchBytes        int
+		kafkaMaxRequestBytes   int = 1048576
+		kafkaBatchSize         int = 1000
+		kafkaMaxBatchSize      int = 8000
+		kafkaWorkers           int = 1
+		kafkaMaxInFlight       int
+		kafkaCompression       string = "none"
+		kafkaCompressionRoutes string
+		testMessageTopic       string = "test"
+		testMessage            bool   = true
+		heartbeatInterval      time.Duration
+		heartbeatTopic         string
+		dedupeWindow           time.Duration
+		dedupeKey              string = "hash"
+		dedupeMaxEntries       int    = 100000
+		healthAddr             string
+		healthTlsCert          string
+		healthTlsKey           string
+		healthAuthUser         string
+		healthAuthPassword     string
+		healthAuthToken        string
+		adminPort              int
+		adminToken             string
+		tracingEndpoint        string
+		tracingSampleRatio     float64       = 1
+		tracingService         string        = "metamorphosis"
+		tlsReloadInterval      time.Duration = time.Minute
+		processorsFile         string
+		kafkaDeadLetterTopic   string
+		kafkaEncoding          string = "json"
+		kafkaInlineJson        string
+		schemaRegistryUrl      string
+		schemaRegistryUser     string
+		schemaRegistryPassword string
+		schemaSubject          string
+		schemaAutoRegister     bool = true
+		schemaRoutes           string
+		rateLimits             string
+		rateLimitTopK          int = 10
+		kafkaQuarantineTopic   string
 	)
 
-	err := godotenv.Load()
+	envFile := LookupEnvOrString("ENV_FILE", ".env")
+	err := godotenv.Load(envFile)
 	log.Infof("Metamorphosis %s starting up.", embeddedVersion)
 	if err != nil {
-		log.Infof("Error loading .env file, assuming production: %s", err.Error())
+		log.Infof("Error loading %s file, assuming production: %s", envFile, err.Error())
 	}
 
 	flag.StringVar(&logLevel, "log-level",
 		LookupEnvOrString("LOG_LEVEL", logLevel), "Log level (trace|debug|info|warn|error")
+	flag.StringVar(&logFormat, "log-format",
+		LookupEnvOrString("LOG_FORMAT", logFormat), "Log format (text|json)")
+	flag.StringVar(&logModuleLevels, "log-module-levels",
+		LookupEnvOrString("LOG_MODULE_LEVELS", logModuleLevels), "Per-module log levels, e.g. kafka=debug,mqtt=info")
+	flag.IntVar(&logTraceSample, "log-trace-sample",
+		LookupEnvOrInt("LOG_TRACE_SAMPLE", logTraceSample), "Only log one in N of the per-message trace logs")
+	flag.BoolVar(&logPayloads, "log-payloads",
+		LookupEnvOrBool("LOG_PAYLOADS", logPayloads), "Include message payloads in trace logs (true|false)")
 	flag.StringVar(&caRootCertFile, "root-ca",
 		LookupEnvOrString("ROOT_CA", caRootCertFile), "Path to root CA certificate (pubkey)")
 	flag.StringVar(&mqttCaClientCertFile, "mqtt-client-cert",
@@ -57,64 +163,309 @@ func main() {
 	flag.BoolVar(&mqttTls, "mqtt-tls",
 		LookupEnvOrBool("MQTT_TLS", mqttTls), "Tls (true|false)")
 	flag.StringVar(&mqttBroker, "mqtt-broker",
-		LookupEnvOrString("MQTT_BROKER", mqttBroker), "MQTT broker hostname")
+		LookupEnvOrString("MQTT_BROKER", mqttBroker), "MQTT broker hostnames (host or host:port, comma separated, in order of preference)")
+	flag.DurationVar(&mqttPreferPrimaryAfter, "mqtt-prefer-primary-after",
+		LookupEnvOrDuration("MQTT_PREFER_PRIMARY_AFTER", mqttPreferPrimaryAfter), "Move back to the first MQTT broker after this long on another one (0 disables)")
 	flag.IntVar(&mqttPort, "mqtt-port",
 		LookupEnvOrInt("MQTT_PORT", mqttPort), "Mqtt broker port.")
+	flag.StringVar(&mqttUrl, "mqtt-url",
+		LookupEnvOrString("MQTT_URL", mqttUrl), "Full MQTT broker URLs, e.g. wss://broker/mqtt, comma separated. Overrides broker, port and transport")
+	flag.StringVar(&mqttTransport, "mqtt-transport",
+		LookupEnvOrString("MQTT_TRANSPORT", mqttTransport), "MQTT transport (tcp|ws)")
+	flag.StringVar(&mqttWsPath, "mqtt-ws-path",
+		LookupEnvOrString("MQTT_WS_PATH", mqttWsPath), "Path for the MQTT websocket transport")
+	flag.StringVar(&mqttWsHeaders, "mqtt-ws-headers",
+		LookupEnvOrString("MQTT_WS_HEADERS", mqttWsHeaders), "Extra HTTP headers for the websocket handshake, e.g. 'Authorization: Bearer abc'")
+	flag.StringVar(&mqttWsProxy, "mqtt-ws-proxy",
+		LookupEnvOrString("MQTT_WS_PROXY", mqttWsProxy), "Proxy URL for MQTT websockets (empty uses HTTPS_PROXY etc, 'direct' disables)")
+	flag.IntVar(&mqttProtocolVersion, "mqtt-protocol-version",
+		LookupEnvOrInt("MQTT_PROTOCOL_VERSION", mqttProtocolVersion), "MQTT protocol version (4 for MQTT 3.1.1, or 5)")
+	flag.StringVar(&mqttSources, "mqtt-sources",
+		LookupEnvOrString("MQTT_SOURCES", mqttSources), "Names of the MQTT sources, comma separated. Each is configured with MQTT_<NAME>_* variables")
+	flag.StringVar(&mqttUsername, "mqtt-username",
+		LookupEnvOrString("MQTT_USERNAME", mqttUsername), "MQTT username")
+	flag.StringVar(&mqttPassword, "mqtt-password",
+		LookupEnvOrString("MQTT_PASSWORD", mqttPassword), "MQTT password")
 	flag.StringVar(&mqttTopic, "mqtt-topic",
 		LookupEnvOrString("MQTT_TOPIC", mqttTopic), "MQTT topic to listen to (wildcards ok)")
+	flag.StringVar(&mqttStatusTopic, "mqtt-status-topic",
+		LookupEnvOrString("MQTT_STATUS_TOPIC", mqttStatusTopic), "MQTT topic for the bridge status and last will (empty disables it)")
+	flag.DurationVar(&mqttStatusInterval, "mqtt-status-interval",
+		LookupEnvOrDuration("MQTT_STATUS_INTERVAL", mqttStatusInterval), "How often the status is published to the status topic (0 disables)")
 	flag.StringVar(&mqttClientId, "mqtt-client-id",
 		LookupEnvOrString("MQTT_CLIENT_ID", mqttClientId), "MQTT client id")
 	flag.StringVar(&kafkaBroker, "kafka-broker",
-		LookupEnvOrString("KAFKA_BROKER", kafkaBroker), "Kafka broker hostname")
+		LookupEnvOrString("KAFKA_BROKER", kafkaBroker), "Kafka bootstrap brokers (host or host:port, comma separated)")
 	flag.IntVar(&kafkaPort, "kakfa-port",
 		LookupEnvOrInt("KAFKA_PORT", kafkaPort), "Kafka broker port")
+	flag.StringVar(&kafkaSecondaryBrokers, "kafka-secondary-brokers",
+		LookupEnvOrString("KAFKA_SECONDARY_BROKERS", kafkaSecondaryBrokers), "Secondary Kafka cluster to fail over to (comma separated)")
+	flag.DurationVar(&kafkaFailoverAfter, "kafka-failover-after",
+		LookupEnvOrDuration("KAFKA_FAILOVER_AFTER", kafkaFailoverAfter), "Fail over to the secondary cluster when writes have failed this long")
 	flag.StringVar(&kafkaTopic, "kafka-topic",
 		LookupEnvOrString("KAFKA_TOPIC", kafkaTopic), "Kafka topic to write to")
+	flag.StringVar(&kafkaTopicCheck, "kafka-topic-check",
+		LookupEnvOrString("KAFKA_TOPIC_CHECK", kafkaTopicCheck), "What to do if the Kafka topics can't be found at startup (fail|warn|off)")
+	flag.BoolVar(&kafkaCreateTopics, "kafka-create-topics",
+		LookupEnvOrBool("KAFKA_CREATE_TOPICS", kafkaCreateTopics), "Create missing Kafka topics at startup (true|false)")
+	flag.IntVar(&kafkaTopicPartitions, "kafka-topic-partitions",
+		LookupEnvOrInt("KAFKA_TOPIC_PARTITIONS", kafkaTopicPartitions), "Partitions for created topics (-1 is the broker default)")
+	flag.IntVar(&kafkaTopicReplication, "kafka-topic-replication",
+		LookupEnvOrInt("KAFKA_TOPIC_REPLICATION", kafkaTopicReplication), "Replication factor for created topics (-1 is the broker default)")
+	flag.DurationVar(&kafkaTopicRetention, "kafka-topic-retention",
+		LookupEnvOrDuration("KAFKA_TOPIC_RETENTION", kafkaTopicRetention), "Retention for created topics (0 is the broker default)")
 	flag.IntVar(&kafkaRetryInterval, "kafka-retry-interval",
 		LookupEnvOrInt("KAFKA_RETRY_INTERVAL", kafkaRetryInterval), "Kafka retry interval in case of failure (seconds)")
 	flag.IntVar(&healthPort, "health-port",
 		LookupEnvOrInt("HEALTH_PORT", healthPort), "HTTP port for healthz and prometheus")
+	flag.StringVar(&healthAddr, "health-addr",
+		LookupEnvOrString("HEALTH_ADDR", healthAddr), "Listen address (host:port) for healthz and prometheus. Overrides health-port")
+	flag.StringVar(&healthTlsCert, "health-tls-cert",
+		LookupEnvOrString("HEALTH_TLS_CERT", healthTlsCert), "Path to certificate. Enables https for healthz and prometheus")
+	flag.StringVar(&healthTlsKey, "health-tls-key",
+		LookupEnvOrString("HEALTH_TLS_KEY", healthTlsKey), "Path to key for health-tls-cert")
+	flag.StringVar(&healthAuthUser, "health-auth-user",
+		LookupEnvOrString("HEALTH_AUTH_USER", healthAuthUser), "Basic auth user for /metrics")
+	flag.StringVar(&healthAuthPassword, "health-auth-password",
+		LookupEnvOrString("HEALTH_AUTH_PASSWORD", healthAuthPassword), "Basic auth password for /metrics")
+	flag.StringVar(&healthAuthToken, "health-auth-token",
+		LookupEnvOrString("HEALTH_AUTH_TOKEN", healthAuthToken), "Bearer token for /metrics")
 	flag.IntVar(&kafkaBatchSize, "kafka-batch-size",
 		LookupEnvOrInt("KAFKA_BATCH_SIZE", kafkaBatchSize), "Kafka batch size")
 	flag.IntVar(&kafkaMaxBatchSize, "kafka-max-batch-size",
 		LookupEnvOrInt("KAFKA_MAX_BATCH_SIZE", kafkaMaxBatchSize), "Kafka MAX batch size (used when un-spooling after failure)")
-	flag.IntVar(&kafkaInterval, "kafka-interval",
-		LookupEnvOrInt("KAFKA_INTERVAL", kafkaInterval), "Kafka interval. How often a write is triggered (seconds)")
+	flag.IntVar(&kafkaWorkers, "kafka-workers",
+		LookupEnvOrInt("KAFKA_WORKERS", kafkaWorkers), "Parallel Kafka pipelines. Messages are sharded by MQTT topic")
+	flag.StringVar(&mqttBackpressure, "mqtt-backpressure",
+		LookupEnvOrString("MQTT_BACKPRESSURE", mqttBackpressure), "What to do when the queue to Kafka is full (block|slow|spill)")
+	flag.StringVar(&mqttSpillDir, "mqtt-spill-dir",
+		LookupEnvOrString("MQTT_SPILL_DIR", mqttSpillDir), "Directory for spilled messages")
+	flag.IntVar(&mqttSpillMaxBytes, "mqtt-spill-max-bytes",
+		LookupEnvOrInt("MQTT_SPILL_MAX_BYTES", mqttSpillMaxBytes), "Max size of spilled messages per source (0 is no limit)")
+	flag.IntVar(&mqttSlowMaxHandlers, "mqtt-slow-max-handlers",
+		LookupEnvOrInt("MQTT_SLOW_MAX_HANDLERS", mqttSlowMaxHandlers), "Max messages waiting for room with slow backpressure, per source")
+	flag.IntVar(&channelSize, "channel-size",
+		LookupEnvOrInt("CHANNEL_SIZE", channelSize), "Size of the queues between MQTT and Kafka")
+	flag.IntVar(&kafkaMaxInFlight, "kafka-max-in-flight",
+		LookupEnvOrInt("KAFKA_MAX_IN_FLIGHT", kafkaMaxInFlight), "Max buffered messages per Kafka pipeline (0 is no limit)")
+	kafkaInterval = LookupEnvOrSeconds("KAFKA_INTERVAL", kafkaInterval)
+	flag.Var((*secondsFlag)(&kafkaInterval), "kafka-interval",
+		"Kafka linger. Max time a message waits before it's written (duration, e.g. 50ms. Plain numbers are seconds)")
+	flag.IntVar(&kafkaBatchBytes, "kafka-batch-bytes",
+		LookupEnvOrInt("KAFKA_BATCH_BYTES", kafkaBatchBytes), "Write when this many bytes are buffered (0 disables)")
+	flag.IntVar(&kafkaMaxRequestBytes, "kafka-max-request-bytes",
+		LookupEnvOrInt("KAFKA_MAX_REQUEST_BYTES", kafkaMaxRequestBytes), "Max size of a Kafka produce request. Larger batches are split")
+	flag.StringVar(&kafkaCompression, "kafka-compression",
+		LookupEnvOrString("KAFKA_COMPRESSION", kafkaCompression), "Kafka compression (none|gzip|snappy|lz4|zstd)")
+	flag.StringVar(&kafkaCompressionRoutes, "kafka-compression-routes",
+		LookupEnvOrString("KAFKA_COMPRESSION_ROUTES", kafkaCompressionRoutes), "Compression per MQTT topic filter, e.g. logs/#=zstd,raw/+=none")
 	flag.StringVar(&testMessageTopic, "test-message-topic",
 		LookupEnvOrString("TEST_MESSAGE_TOPIC", testMessageTopic), "Test message topic for test messages when checking Kafka")
+	flag.BoolVar(&testMessage, "test-message",
+		LookupEnvOrBool("TEST_MESSAGE", testMessage), "Write a test message to Kafka at startup (true|false)")
+	flag.DurationVar(&heartbeatInterval, "heartbeat-interval",
+		LookupEnvOrDuration("HEARTBEAT_INTERVAL", heartbeatInterval), "Write a heartbeat to Kafka this often (0 disables)")
+	flag.StringVar(&heartbeatTopic, "heartbeat-topic",
+		LookupEnvOrString("HEARTBEAT_TOPIC", heartbeatTopic), "Kafka topic for heartbeats (defaults to kafka-topic)")
+	flag.DurationVar(&dedupeWindow, "dedupe-window",
+		LookupEnvOrDuration("DEDUPE_WINDOW", dedupeWindow), "Drop duplicate messages seen within this window (0 disables)")
+	flag.StringVar(&dedupeKey, "dedupe-key",
+		LookupEnvOrString("DEDUPE_KEY", dedupeKey), "Dedupe fingerprint (hash|json:<field>)")
+	flag.IntVar(&dedupeMaxEntries, "dedupe-max-entries",
+		LookupEnvOrInt("DEDUPE_MAX_ENTRIES", dedupeMaxEntries), "Max number of fingerprints kept for deduplication")
+	flag.StringVar(&processorsFile, "processors-file",
+		LookupEnvOrString("PROCESSORS_FILE", processorsFile), "JSON file with the processor chain per MQTT topic filter (empty disables processing)")
+	flag.StringVar(&kafkaDeadLetterTopic, "kafka-dead-letter-topic",
+		LookupEnvOrString("KAFKA_DEAD_LETTER_TOPIC", kafkaDeadLetterTopic), "Kafka topic for messages that failed processing")
+	flag.StringVar(&rateLimits, "rate-limits",
+		LookupEnvOrString("RATE_LIMITS", rateLimits), "Token bucket rate limits per MQTT topic filter, e.g. 'devices/#=10/s key=level:1 action=drop', comma separated")
+	flag.IntVar(&rateLimitTopK, "rate-limit-top-k",
+		LookupEnvOrInt("RATE_LIMIT_TOP_K", rateLimitTopK), "Number of rate limited keys per filter exported as metrics")
+	flag.StringVar(&kafkaQuarantineTopic, "kafka-quarantine-topic",
+		LookupEnvOrString("KAFKA_QUARANTINE_TOPIC", kafkaQuarantineTopic), "Kafka topic for messages over a rate limit with the quarantine action")
+	flag.StringVar(&kafkaEncoding, "kafka-encoding",
+		LookupEnvOrString("KAFKA_ENCODING", kafkaEncoding), "Encoding of the Kafka records (json|avro|protobuf)")
+	flag.StringVar(&kafkaInlineJson, "kafka-inline-json",
+		LookupEnvOrString("KAFKA_INLINE_JSON", kafkaInlineJson), "MQTT topic filters where JSON payloads are written as JSON instead of base64, comma separated")
+	flag.StringVar(&schemaRegistryUrl, "schema-registry-url",
+		LookupEnvOrString("SCHEMA_REGISTRY_URL", schemaRegistryUrl), "Schema registry for avro and protobuf, e.g. http://registry:8081")
+	flag.StringVar(&schemaRegistryUser, "schema-registry-username",
+		LookupEnvOrString("SCHEMA_REGISTRY_USERNAME", schemaRegistryUser), "Basic auth user for the schema registry")
+	flag.StringVar(&schemaRegistryPassword, "schema-registry-password",
+		LookupEnvOrString("SCHEMA_REGISTRY_PASSWORD", schemaRegistryPassword), "Basic auth password for the schema registry")
+	flag.StringVar(&schemaSubject, "schema-subject",
+		LookupEnvOrString("SCHEMA_SUBJECT", schemaSubject), "Subject of the envelope schema (defaults to <kafka-topic>-value)")
+	flag.BoolVar(&schemaAutoRegister, "schema-auto-register",
+		LookupEnvOrBool("SCHEMA_AUTO_REGISTER", schemaAutoRegister), "Register the schemas, instead of requiring them to be registered")
+	flag.StringVar(&schemaRoutes, "schema-routes",
+		LookupEnvOrString("SCHEMA_ROUTES", schemaRoutes), "Payload schema files per MQTT topic filter, e.g. devices/+/telemetry=telemetry.avsc")
+	flag.IntVar(&adminPort, "admin-port",
+		LookupEnvOrInt("ADMIN_PORT", adminPort), "HTTP port for the admin API (0 disables)")
+	flag.StringVar(&adminToken, "admin-token",
+		LookupEnvOrString("ADMIN_TOKEN", adminToken), "Bearer token for the admin API")
+	flag.StringVar(&tracingEndpoint, "tracing-endpoint",
+		LookupEnvOrString("TRACING_ENDPOINT", tracingEndpoint), "OTLP/HTTP endpoint for traces, e.g. http://localhost:4318 (empty disables tracing)")
+	flag.Float64Var(&tracingSampleRatio, "tracing-sample-ratio",
+		LookupEnvOrFloat("TRACING_SAMPLE_RATIO", tracingSampleRatio), "Ratio of messages to trace (0-1)")
+	flag.StringVar(&tracingService, "tracing-service",
+		LookupEnvOrString("TRACING_SERVICE", tracingService), "Service name reported in traces")
+	flag.DurationVar(&tlsReloadInterval, "tls-reload-interval",
+		LookupEnvOrDuration("TLS_RELOAD_INTERVAL", tlsReloadInterval), "Check the MQTT TLS files for changes this often (0 disables)")
 	flag.Parse()
 
 	setLoglevel(logLevel)
+	if err := logging.Configure(logFormat, log.GetLevel(), logModuleLevels); err != nil {
+		log.Fatalf("Configuring logging: %s", err)
+	}
+	logging.SetTraceSampleRate(logTraceSample)
+	logging.SetLogPayloads(logPayloads)
 
-	if mqttTls {
+	defaultSource := bridge.MqttSource{
+		Broker:             mqttBroker,
+		Port:               mqttPort,
+		PreferPrimaryAfter: mqttPreferPrimaryAfter,
+		Url:                mqttUrl,
+		Transport:          mqttTransport,
+		WsPath:             mqttWsPath,
+		WsHeaders:          mqttWsHeaders,
+		WsProxy:            mqttWsProxy,
+		ProtocolVersion:    mqttProtocolVersion,
+		Tls:                mqttTls,
+		RootCrtFile:        caRootCertFile,
+		ClientCertFile:     mqttCaClientCertFile,
+		ClientKeyFile:      mqttCaClientKeyFile,
+		Username:           mqttUsername,
+		Password:           mqttPassword,
+		Topic:              mqttTopic,
+		ClientId:           mqttClientId,
+	}
+	sources, err := lookupMqttSources(mqttSources, defaultSource)
+	if err != nil {
+		log.Fatalf("MQTT_SOURCES: %s", err)
+	}
+	if len(sources) == 0 && mqttTls {
 		CheckSet(caRootCertFile, "ROOT_CA", "tls is enabled")
 		CheckSet(mqttCaClientCertFile, "MQTT_CLIENT_CERT", "tls is enabled")
 		CheckSet(mqttCaClientKeyFile, "MQTT_CLIENT_KEY", "tls is enabled")
 	}
+	for _, s := range sources {
+		if s.Tls {
+			prefix := sourceEnvPrefix(s.Name)
+			CheckSet(s.RootCrtFile, prefix+"ROOT_CA", "tls is enabled")
+			CheckSet(s.ClientCertFile, prefix+"CLIENT_CERT", "tls is enabled")
+			CheckSet(s.ClientKeyFile, prefix+"CLIENT_KEY", "tls is enabled")
+		}
+	}
+
+	if mqttBackpressure == "spill" {
+		CheckSet(mqttSpillDir, "MQTT_SPILL_DIR", "MQTT_BACKPRESSURE is spill")
+	}
+
+	if kafkaEncoding != "json" {
+		CheckSet(schemaRegistryUrl, "SCHEMA_REGISTRY_URL", "KAFKA_ENCODING is "+kafkaEncoding)
+	}
+
+	if adminPort > 0 {
+		CheckSet(adminToken, "ADMIN_TOKEN", "the admin API is enabled")
+	}
 
 	runConfig := bridge.Params{
-		MqttBroker:         mqttBroker,
-		MqttPort:           mqttPort,
-		MqttTopic:          mqttTopic,
-		MqttTls:            mqttTls,
-		MqttClientId:       mqttClientId,
-		TlsRootCrtFile:     caRootCertFile,
-		MqttClientCertFile: mqttCaClientCertFile,
-		MqttClientKeyFile:  mqttCaClientKeyFile,
-		KafkaBroker:        kafkaBroker,
-		KafkaPort:          kafkaPort,
-		KafkaTopic:         kafkaTopic,
-		KafkaRetryInterval: time.Duration(kafkaRetryInterval) * time.Second,
-		KafkaInterval:      time.Duration(kafkaInterval) * time.Second,
-		KafkaBatchSize:     kafkaBatchSize,
-		KafkaMaxBatchSize:  kafkaMaxBatchSize,
-		HealthPort:         healthPort,
-		TestMessageTopic:   testMessageTopic,
+		MqttSources:            sources,
+		MqttUsername:           mqttUsername,
+		MqttPassword:           mqttPassword,
+		MqttBroker:             mqttBroker,
+		MqttPreferPrimaryAfter: mqttPreferPrimaryAfter,
+		MqttPort:               mqttPort,
+		MqttUrl:                mqttUrl,
+		MqttTransport:          mqttTransport,
+		MqttWsPath:             mqttWsPath,
+		MqttWsHeaders:          mqttWsHeaders,
+		MqttWsProxy:            mqttWsProxy,
+		MqttProtocolVersion:    mqttProtocolVersion,
+		MqttTopic:              mqttTopic,
+		MqttStatusTopic:        mqttStatusTopic,
+		MqttStatusInterval:     mqttStatusInterval,
+		MqttTls:                mqttTls,
+		MqttClientId:           mqttClientId,
+		TlsRootCrtFile:         caRootCertFile,
+		MqttClientCertFile:     mqttCaClientCertFile,
+		MqttClientKeyFile:      mqttCaClientKeyFile,
+		KafkaBroker:            kafkaBroker,
+		KafkaPort:              kafkaPort,
+		KafkaTopic:             kafkaTopic,
+		KafkaSecondaryBrokers:  kafkaSecondaryBrokers,
+		KafkaFailoverAfter:     kafkaFailoverAfter,
+		KafkaTopicCheck:        kafkaTopicCheck,
+		KafkaCreateTopics:      kafkaCreateTopics,
+		KafkaTopicPartitions:   kafkaTopicPartitions,
+		KafkaTopicReplication:  kafkaTopicReplication,
+		KafkaTopicRetention:    kafkaTopicRetention,
+		KafkaRetryInterval:     time.Duration(kafkaRetryInterval) * time.Second,
+		KafkaInterval:          kafkaInterval,
+		KafkaBatchBytes:        kafkaBatchBytes,
+		KafkaMaxRequestBytes:   kafkaMaxRequestBytes,
+		KafkaBatchSize:         kafkaBatchSize,
+		KafkaMaxBatchSize:      kafkaMaxBatchSize,
+		KafkaWorkers:           kafkaWorkers,
+		KafkaMaxInFlight:       kafkaMaxInFlight,
+		MqttBackpressure:       mqttBackpressure,
+		MqttSpillDir:           mqttSpillDir,
+		MqttSpillMaxBytes:      int64(mqttSpillMaxBytes),
+		MqttSlowMaxHandlers:    mqttSlowMaxHandlers,
+		ChannelSize:            channelSize,
+		KafkaCompression:       kafkaCompression,
+		KafkaCompressionRoutes: kafkaCompressionRoutes,
+		HealthPort:             healthPort,
+		HealthAddr:             healthAddr,
+		HealthTlsCertFile:      healthTlsCert,
+		HealthTlsKeyFile:       healthTlsKey,
+		HealthAuthUser:         healthAuthUser,
+		HealthAuthPassword:     healthAuthPassword,
+		HealthAuthToken:        healthAuthToken,
+		TestMessageTopic:       testMessageTopic,
+		NoTestMessage:          !testMessage,
+		HeartbeatInterval:      heartbeatInterval,
+		HeartbeatTopic:         heartbeatTopic,
+		Version:                embeddedVersion,
+		DedupeWindow:           dedupeWindow,
+		DedupeKey:              dedupeKey,
+		DedupeMaxEntries:       dedupeMaxEntries,
+		AdminPort:              adminPort,
+		AdminToken:             adminToken,
+		TracingEndpoint:        tracingEndpoint,
+		TracingSampleRatio:     tracingSampleRatio,
+		TracingService:         tracingService,
+		TlsReloadInterval:      tlsReloadInterval,
+		ProcessorsFile:         processorsFile,
+		KafkaDeadLetterTopic:   kafkaDeadLetterTopic,
+		KafkaEncoding:          kafkaEncoding,
+		KafkaInlineJson:        kafkaInlineJson,
+		RateLimits:             rateLimits,
+		RateLimitTopK:          rateLimitTopK,
+		KafkaQuarantineTopic:   kafkaQuarantineTopic,
+		SchemaRegistryUrl:      schemaRegistryUrl,
+		SchemaRegistryUser:     schemaRegistryUser,
+		SchemaRegistryPassword: schemaRegistryPassword,
+		SchemaSubject:          schemaSubject,
+		SchemaAutoRegister:     schemaAutoRegister,
+		SchemaRoutes:           schemaRoutes,
 	}
 	log.Infof("Startup options: %v", runConfig)
 	log.Debug("Starting bridge")
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
+	reload := make(chan bridge.Reloadable)
+	runConfig.Reload = reload
+	current := bridge.Reloadable{
+		LogLevel:               logLevel,
+		LogModuleLevels:        logModuleLevels,
+		KafkaCompressionRoutes: kafkaCompressionRoutes,
+		MqttTopics:             map[string]string{"": mqttTopic},
+	}
+	for _, s := range sources {
+		current.MqttTopics[s.Name] = s.Topic
+	}
+	go reloadOnHup(ctx, reload, envFile, current, sources)
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
@@ -149,6 +500,62 @@ func LookupEnvOrInt(key string, defaultVal int) int {
 	}
 	return defaultVal
 }
+
+func LookupEnvOrDuration(key string, defaultVal time.Duration) time.Duration {
+	if val, ok := os.LookupEnv(key); ok {
+		v, err := time.ParseDuration(val)
+		if err != nil {
+			log.Fatalf("LookupEnvOrDuration[%s]: %v", key, err)
+		}
+		return v
+	}
+	return defaultVal
+}
+
+// LookupEnvOrSeconds reads a duration. Plain numbers are taken as seconds, as that's what we used to accept.
+func LookupEnvOrSeconds(key string, defaultVal time.Duration) time.Duration {
+	if val, ok := os.LookupEnv(key); ok {
+		v, err := parseSeconds(val)
+		if err != nil {
+			log.Fatalf("LookupEnvOrSeconds[%s]: %v", key, err)
+		}
+		return v
+	}
+	return defaultVal
+}
+
+func parseSeconds(s string) (time.Duration, error) {
+	if secs, err := strconv.Atoi(s); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// secondsFlag is a duration flag which also accepts plain numbers as seconds.
+type secondsFlag time.Duration
+
+func (f *secondsFlag) String() string { return time.Duration(*f).String() }
+
+func (f *secondsFlag) Set(s string) error {
+	d, err := parseSeconds(s)
+	if err != nil {
+		return err
+	}
+	*f = secondsFlag(d)
+	return nil
+}
+
+func LookupEnvOrFloat(key string, defaultVal float64) float64 {
+	if val, ok := os.LookupEnv(key); ok {
+		v, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			log.Fatalf("LookupEnvOrFloat[%s]: %v", key, err)
+		}
+		return v
+	}
+	return defaultVal
+}
+
 func LookupEnvOrBool(key string, defaultVal bool) bool {
 	if val, ok := os.LookupEnv(key); ok {
 		return strings.ToUpper(val) == "TRUE"
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/celerway/metamorphosis/bridge"
+	is2 "github.com/matryer/is"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseSeconds(t *testing.T) {
+	is := is2.New(t)
+	d, err := parseSeconds("5")
+	is.NoErr(err)
+	is.Equal(d, 5*time.Second)
+	d, err = parseSeconds("50ms")
+	is.NoErr(err)
+	is.Equal(d, 50*time.Millisecond)
+	_, err = parseSeconds("soon")
+	is.True(err != nil)
+	var f secondsFlag
+	is.NoErr(f.Set("2"))
+	is.Equal(f.String(), "2s")
+}
+
+func TestLookupMqttSources(t *testing.T) {
+	is := is2.New(t)
+	t.Setenv("MQTT_EU_WEST_BROKER", "eu.example.com")
+	t.Setenv("MQTT_US_TOPIC", "sensors/#")
+	t.Setenv("MQTT_US_TLS", "false")
+	def := bridge.MqttSource{Broker: "default", Port: 8883, Tls: true, Topic: "#", ClientId: "metamorphosis"}
+	sources, err := lookupMqttSources(" eu-west, us,", def)
+	is.NoErr(err)
+	is.Equal(len(sources), 2)
+	is.Equal(sources[0].Name, "eu-west")
+	is.Equal(sources[0].Broker, "eu.example.com")
+	is.Equal(sources[0].Topic, "#")
+	is.True(sources[0].Tls)
+	is.Equal(sources[1].Broker, "default")
+	is.Equal(sources[1].Topic, "sensors/#")
+	is.True(!sources[1].Tls)
+	is.Equal(sources[1].ClientId, "metamorphosis")
+	sources, err = lookupMqttSources("", def)
+	is.NoErr(err)
+	is.Equal(len(sources), 0)
+	for _, bad := range []string{"eu,eu", "eu-west,eu_west", "eu/west"} {
+		_, err = lookupMqttSources(bad, def)
+		is.True(err != nil) // bad or duplicate name
+	}
+}
+
+func TestReadReloadable(t *testing.T) {
+	is := is2.New(t)
+	envFile := filepath.Join(t.TempDir(), ".env")
+	is.NoErr(os.WriteFile(envFile, []byte("LOG_LEVEL=debug\nMQTT_TOPIC=\"new/#\"\nMQTT_US_TOPIC=us/new\n"), 0o600))
+	current := bridge.Reloadable{LogLevel: "info", KafkaCompressionRoutes: "logs/#=zstd", MqttTopics: map[string]string{"": "old/#"}}
+	settings := readReloadable(envFile, current, nil)
+	is.Equal(settings.LogLevel, "debug")
+	is.Equal(settings.KafkaCompressionRoutes, "logs/#=zstd") // not in the file, kept
+	is.Equal(settings.MqttTopics, map[string]string{"": "new/#"})
+
+	t.Setenv("MQTT_EU_TOPIC", "eu/old")
+	sources := []bridge.MqttSource{{Name: "eu"}, {Name: "us"}, {Name: "asia"}}
+	current.MqttTopics = map[string]string{"eu": "eu/old", "us": "us/old", "asia": "old/#"}
+	settings = readReloadable(envFile, current, sources)
+	is.Equal(settings.MqttTopics, map[string]string{
+		"eu":   "eu/old", // has its own topic, which isn't in the file
+		"us":   "us/new",
+		"asia": "new/#", // follows MQTT_TOPIC
+	})
+
+	settings = readReloadable(filepath.Join(t.TempDir(), "missing"), current, sources)
+	is.Equal(settings.LogLevel, "info")
+	is.Equal(settings.MqttTopics, current.MqttTopics)
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/celerway/metamorphosis/bridge"
+	"github.com/celerway/metamorphosis/consumer"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/joho/godotenv"
+	gokafka "github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+	"io"
+	mrand "math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// publish generates synthetic MQTT traffic so we can benchmark a deployed bridge or rehearse an outage.
+// Every payload carries a run id, a sequence number and the send time. With -verify we read the Kafka
+// topic at the same time and report end-to-end latency and lost or duplicated sequence numbers.
+
+type publishOptions struct {
+	rate         float64
+	count        int
+	duration     time.Duration
+	qos          byte
+	topics       *topicPattern
+	sizes        sizeDist
+	verify       bool
+	kafkaBrokers []string
+	kafkaTopic   string
+	drain        time.Duration
+}
+
+// loadPayload is the JSON we publish. Pad is only there to reach the requested size.
+type loadPayload struct {
+	Run  string `json:"run"`
+	Seq  uint64 `json:"seq"`
+	Sent int64  `json:"sent"` // unix nanoseconds
+	Pad  string `json:"pad,omitempty"`
+}
+
+func publishCmd(args []string) int {
+	_ = godotenv.Load()
+	var (
+		broker       = LookupEnvOrString("MQTT_BROKER", "")
+		port         = LookupEnvOrInt("MQTT_PORT", 8883)
+		useTls       = LookupEnvOrBool("MQTT_TLS", true)
+		caFile       = LookupEnvOrString("ROOT_CA", "")
+		certFile     = LookupEnvOrString("MQTT_CLIENT_CERT", "")
+		keyFile      = LookupEnvOrString("MQTT_CLIENT_KEY", "")
+		clientId     = "metamorphosis-publish"
+		pattern      = "loadtest/{1..100}/telemetry"
+		sizeSpec     = "256"
+		qos          = 0
+		kafkaBrokers = kafkaBrokerDefault()
+		opts         = publishOptions{rate: 100, duration: time.Minute, drain: 30 * time.Second}
+		fs           = flag.NewFlagSet("publish", flag.ContinueOnError)
+	)
+	fs.StringVar(&broker, "broker", broker, "MQTT broker hostname. Defaults to MQTT_BROKER")
+	fs.IntVar(&port, "port", port, "MQTT broker port. Defaults to MQTT_PORT")
+	fs.BoolVar(&useTls, "tls", useTls, "Use TLS (true|false). Defaults to MQTT_TLS")
+	fs.StringVar(&caFile, "root-ca", caFile, "Path to root CA certificate. Defaults to ROOT_CA")
+	fs.StringVar(&certFile, "client-cert", certFile, "Path to client cert. Defaults to MQTT_CLIENT_CERT")
+	fs.StringVar(&keyFile, "client-key", keyFile, "Path to client key. Defaults to MQTT_CLIENT_KEY")
+	fs.StringVar(&clientId, "client-id", clientId, "MQTT client id")
+	fs.StringVar(&pattern, "topic", pattern, "Topic pattern. {a..b} expands to a range, e.g. devices/{1..5000}/telemetry")
+	fs.StringVar(&sizeSpec, "size", sizeSpec, "Payload size in bytes: N, MIN-MAX (uniform) or normal:MEAN,STDDEV")
+	fs.IntVar(&qos, "qos", qos, "MQTT QoS (0|1|2)")
+	fs.Float64Var(&opts.rate, "rate", opts.rate, "Messages per second")
+	fs.IntVar(&opts.count, "n", 0, "Stop after this many messages (0 is no limit)")
+	fs.DurationVar(&opts.duration, "duration", opts.duration, "Stop after this long (0 is no limit)")
+	fs.BoolVar(&opts.verify, "verify", false, "Read the Kafka topic and report latency, lost and duplicated messages")
+	fs.StringVar(&kafkaBrokers, "kafka-brokers", kafkaBrokers, "Kafka brokers for -verify. Defaults to KAFKA_BROKER:KAFKA_PORT")
+	fs.StringVar(&opts.kafkaTopic, "kafka-topic", LookupEnvOrString("KAFKA_TOPIC", ""), "Kafka topic for -verify")
+	fs.DurationVar(&opts.drain, "drain", opts.drain, "How long to wait for the last messages to show up in Kafka")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	var err error
+	if opts.topics, err = parseTopicPattern(pattern); err != nil {
+		fmt.Fprintf(os.Stderr, "-topic: %s\n", err)
+		return 2
+	}
+	if opts.sizes, err = parseSizeDist(sizeSpec); err != nil {
+		fmt.Fprintf(os.Stderr, "-size: %s\n", err)
+		return 2
+	}
+	if qos < 0 || qos > 2 {
+		fmt.Fprintf(os.Stderr, "-qos: must be 0, 1 or 2\n")
+		return 2
+	}
+	opts.qos = byte(qos)
+	if opts.rate <= 0 {
+		fmt.Fprintf(os.Stderr, "-rate: must be positive\n")
+		return 2
+	}
+	if opts.count == 0 && opts.duration == 0 {
+		fmt.Fprintln(os.Stderr, "publish: one of -n and -duration is required")
+		return 2
+	}
+	if broker == "" {
+		fmt.Fprintln(os.Stderr, "publish: -broker is required")
+		return 2
+	}
+	opts.kafkaBrokers = splitList(kafkaBrokers)
+	if opts.verify && (len(opts.kafkaBrokers) == 0 || opts.kafkaTopic == "") {
+		fmt.Fprintln(os.Stderr, "publish: -verify needs -kafka-brokers and -kafka-topic")
+		return 2
+	}
+
+	mqttOpts := paho.NewClientOptions()
+	if useTls {
+		logger := log.WithField("module", "publish")
+		mqttOpts.SetTLSConfig(bridge.NewTlsConfig(caFile, certFile, keyFile, logger))
+		mqttOpts.AddBroker(fmt.Sprintf("ssl://%s:%d", broker, port))
+	} else {
+		mqttOpts.AddBroker(fmt.Sprintf("mqtt://%s:%d", broker, port))
+	}
+	mqttOpts.SetClientID(clientId)
+	client := paho.NewClient(mqttOpts)
+	token := client.Connect()
+	if !token.WaitTimeout(10 * time.Second) {
+		fmt.Fprintf(os.Stderr, "publish: timed out connecting to %s:%d\n", broker, port)
+		return 1
+	}
+	if token.Error() != nil {
+		fmt.Fprintf(os.Stderr, "publish: connecting to %s:%d: %s\n", broker, port, token.Error())
+		return 1
+	}
+	defer client.Disconnect(1000)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if err := runLoad(ctx, opts, client, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "publish: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runLoad publishes until the count or duration is reached, and then prints a report.
+func runLoad(ctx context.Context, opts publishOptions, client paho.Client, out io.Writer) error {
+	run := newRunId()
+	start := time.Now()
+	var (
+		v          *verifier
+		verifyDone = make(chan error, 1)
+	)
+	verifyCtx, verifyCancel := context.WithCancel(context.Background())
+	defer verifyCancel()
+	if opts.verify {
+		v = newVerifier(run)
+		partitions, err := readPartitions(ctx, opts.kafkaBrokers, opts.kafkaTopic)
+		if err != nil {
+			return err
+		}
+		go func() {
+			verifyDone <- v.run(verifyCtx, tailOptions{brokers: opts.kafkaBrokers, topic: opts.kafkaTopic, since: start}, partitions)
+		}()
+	}
+	fmt.Fprintf(out, "Run %s: publishing %.0f msg/s to %s\n", run, opts.rate, opts.topics)
+
+	pubCtx := ctx
+	if opts.duration > 0 {
+		var pubCancel context.CancelFunc
+		pubCtx, pubCancel = context.WithTimeout(ctx, opts.duration)
+		defer pubCancel()
+	}
+	sent, errs := publishLoad(pubCtx, opts, run, client)
+	elapsed := time.Since(start)
+	fmt.Fprintf(out, "Published %d messages in %s (%.1f msg/s), %d publish errors\n",
+		sent, elapsed.Round(time.Millisecond), float64(sent)/elapsed.Seconds(), errs)
+	if v == nil {
+		return nil
+	}
+	// Wait for the stragglers. The bridge batches, so this takes at least the Kafka interval.
+	drainCtx, drainCancel := context.WithTimeout(ctx, opts.drain)
+	defer drainCancel()
+	v.waitFor(drainCtx, sent)
+	verifyCancel()
+	if err := <-verifyDone; err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	fmt.Fprint(out, v.report(sent))
+	return nil
+}
+
+// publishLoad paces the messages so we keep the rate over time, catching up if we fall behind.
+// Returns the number of messages published and the number that failed.
+func publishLoad(ctx context.Context, opts publishOptions, run string, client paho.Client) (uint64, uint64) {
+	interval := time.Duration(float64(time.Second) / opts.rate)
+	rnd := mrand.New(mrand.NewSource(time.Now().UnixNano()))
+	tokens := make(chan paho.Token, 10000)
+	var errCount uint64
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() { // check the tokens so we don't block on QoS 1 and 2 acks.
+		defer wg.Done()
+		for token := range tokens {
+			token.Wait()
+			if token.Error() != nil {
+				errCount++
+			}
+		}
+	}()
+	start := time.Now()
+	var seq uint64
+	for opts.count == 0 || seq < uint64(opts.count) {
+		if wait := time.Until(start.Add(time.Duration(seq) * interval)); wait > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(wait):
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		payload := makePayload(run, seq, time.Now(), opts.sizes.next(rnd))
+		tokens <- client.Publish(opts.topics.topic(seq), opts.qos, false, payload)
+		seq++
+	}
+	close(tokens)
+	wg.Wait()
+	return seq, errCount
+}
+
+// makePayload builds a JSON payload which is padded to size. It won't be smaller than the
+// payload without padding (~60 bytes).
+func makePayload(run string, seq uint64, sent time.Time, size int) []byte {
+	p := loadPayload{Run: run, Seq: seq, Sent: sent.UnixNano()}
+	payload, _ := json.Marshal(p)
+	const padOverhead = len(`,"pad":""`)
+	if missing := size - len(payload) - padOverhead; missing > 0 {
+		p.Pad = strings.Repeat("x", missing)
+		payload, _ = json.Marshal(p)
+	}
+	return payload
+}
+
+func newRunId() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// topicPattern expands {a..b} ranges. Topics are handed out round-robin over every combination.
+type topicPattern struct {
+	pattern string
+	parts   []topicPart
+	total   uint64
+}
+
+type topicPart struct {
+	literal string
+	lo, n   int // a range of n numbers starting at lo, if n > 0.
+}
+
+func parseTopicPattern(pattern string) (*topicPattern, error) {
+	tp := &topicPattern{pattern: pattern, total: 1}
+	rest := pattern
+	for {
+		open := strings.Index(rest, "{")
+		if open < 0 {
+			break
+		}
+		end := strings.Index(rest[open:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated '{' in '%s'", pattern)
+		}
+		loStr, hiStr, ok := strings.Cut(rest[open+1:open+end], "..")
+		if !ok {
+			return nil, fmt.Errorf("'%s' isn't a range like {1..10}", rest[open:open+end+1])
+		}
+		lo, err1 := strconv.Atoi(loStr)
+		hi, err2 := strconv.Atoi(hiStr)
+		if err1 != nil || err2 != nil || hi < lo {
+			return nil, fmt.Errorf("'%s' isn't a range like {1..10}", rest[open:open+end+1])
+		}
+		tp.parts = append(tp.parts, topicPart{literal: rest[:open]}, topicPart{lo: lo, n: hi - lo + 1})
+		tp.total *= uint64(hi - lo + 1)
+		rest = rest[open+end+1:]
+	}
+	tp.parts = append(tp.parts, topicPart{literal: rest})
+	if strings.ContainsAny(pattern, "+#") {
+		return nil, errors.New("can't publish to wildcards")
+	}
+	return tp, nil
+}
+
+// topic returns the topic for the i'th message. The last range varies fastest.
+func (tp *topicPattern) topic(i uint64) string {
+	i %= tp.total
+	parts := make([]string, len(tp.parts))
+	for j := len(tp.parts) - 1; j >= 0; j-- {
+		part := tp.parts[j]
+		if part.n == 0 {
+			parts[j] = part.literal
+			continue
+		}
+		parts[j] = strconv.Itoa(part.lo + int(i%uint64(part.n)))
+		i /= uint64(part.n)
+	}
+	return strings.Join(parts, "")
+}
+
+func (tp *topicPattern) String() string {
+	return fmt.Sprintf("%s (%d topics)", tp.pattern, tp.total)
+}
+
+// sizeDist picks payload sizes.
+type sizeDist struct {
+	min, max     int     // uniform between min and max, inclusive.
+	mean, stddev float64 // normal distribution if stddev > 0.
+}
+
+func parseSizeDist(spec string) (sizeDist, error) {
+	if strings.HasPrefix(spec, "normal:") {
+		meanStr, stddevStr, _ := strings.Cut(strings.TrimPrefix(spec, "normal:"), ",")
+		mean, err1 := strconv.ParseFloat(meanStr, 64)
+		stddev, err2 := strconv.ParseFloat(stddevStr, 64)
+		if err1 != nil || err2 != nil || mean < 0 || stddev <= 0 {
+			return sizeDist{}, fmt.Errorf("'%s' should look like normal:MEAN,STDDEV", spec)
+		}
+		return sizeDist{mean: mean, stddev: stddev}, nil
+	}
+	minStr, maxStr, isRange := strings.Cut(spec, "-")
+	lo, err := strconv.Atoi(minStr)
+	if err != nil || lo < 0 {
+		return sizeDist{}, fmt.Errorf("'%s' should be N, MIN-MAX or normal:MEAN,STDDEV", spec)
+	}
+	hi := lo
+	if isRange {
+		if hi, err = strconv.Atoi(maxStr); err != nil || hi < lo {
+			return sizeDist{}, fmt.Errorf("'%s' should be N, MIN-MAX or normal:MEAN,STDDEV", spec)
+		}
+	}
+	return sizeDist{min: lo, max: hi}, nil
+}
+
+func (d sizeDist) next(rnd *mrand.Rand) int {
+	if d.stddev > 0 {
+		size := int(rnd.NormFloat64()*d.stddev + d.mean)
+		if size < 0 {
+			return 0
+		}
+		return size
+	}
+	return d.min + rnd.Intn(d.max-d.min+1)
+}
+
+// verifier reads the Kafka topic and keeps track of the messages from our run.
+type verifier struct {
+	runId     string
+	mu        sync.Mutex
+	seen      map[uint64]int
+	received  uint64
+	latencies []time.Duration
+	notify    chan struct{} // poked when a message arrives, so waitFor can check.
+	now       func() time.Time
+}
+
+func newVerifier(run string) *verifier {
+	return &verifier{
+		runId:  run,
+		seen:   make(map[uint64]int),
+		notify: make(chan struct{}, 1),
+		now:    time.Now,
+	}
+}
+
+// run reads all partitions until the context is cancelled.
+func (v *verifier) run(ctx context.Context, opts tailOptions, partitions []gokafka.Partition) error {
+	records := make(chan gokafka.Message)
+	errCh := make(chan error, len(partitions))
+	wg := sync.WaitGroup{}
+	for _, p := range partitions {
+		wg.Add(1)
+		go func(partition int) {
+			defer wg.Done()
+			if err := readPartition(ctx, opts, partition, records); err != nil {
+				errCh <- fmt.Errorf("partition %d: %w", partition, err)
+			}
+		}(p.ID)
+	}
+	go func() {
+		wg.Wait()
+		close(records)
+	}()
+	for record := range records {
+		v.record(record)
+	}
+	select {
+	case err := <-errCh:
+		return err
+	default:
+		return nil
+	}
+}
+
+func (v *verifier) record(record gokafka.Message) {
+	msg, err := consumer.Decode(record)
+	var p loadPayload
+	if err == nil {
+		err = json.Unmarshal(msg.Payload, &p)
+	}
+	if err != nil || p.Run != v.runId {
+		return // test messages or someone else's traffic.
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.received++
+	v.seen[p.Seq]++
+	if v.seen[p.Seq] == 1 {
+		v.latencies = append(v.latencies, v.now().Sub(time.Unix(0, p.Sent)))
+	}
+	select {
+	case v.notify <- struct{}{}:
+	default:
+	}
+}
+
+// waitFor blocks until all sent messages have been seen or the context is done.
+func (v *verifier) waitFor(ctx context.Context, sent uint64) {
+	for {
+		v.mu.Lock()
+		done := uint64(len(v.seen)) >= sent
+		v.mu.Unlock()
+		if done {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-v.notify:
+		}
+	}
+}
+
+// report summarizes what we've seen, given that sequence numbers 0..sent-1 were published.
+func (v *verifier) report(sent uint64) string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var lost, duplicates uint64
+	for seq := uint64(0); seq < sent; seq++ {
+		switch n := v.seen[seq]; {
+		case n == 0:
+			lost++
+		case n > 1:
+			duplicates += uint64(n - 1)
+		}
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Received %d messages: %d lost, %d duplicates\n", v.received, lost, duplicates)
+	if len(v.latencies) == 0 {
+		return sb.String()
+	}
+	lat := append([]time.Duration(nil), v.latencies...)
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+	fmt.Fprintf(&sb, "Latency: p50 %s, p90 %s, p99 %s, max %s\n",
+		percentile(lat, 50), percentile(lat, 90), percentile(lat, 99), lat[len(lat)-1])
+	return sb.String()
+}
+
+// percentile uses the nearest rank method. The slice must be sorted.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1].Round(time.Millisecond)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	is2 "github.com/matryer/is"
+	gokafka "github.com/segmentio/kafka-go"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopicPattern(t *testing.T) {
+	is := is2.New(t)
+	tp, err := parseTopicPattern("devices/{1..3}/sensor/{0..1}")
+	is.NoErr(err)
+	is.Equal(tp.total, uint64(6))
+	is.Equal(tp.topic(0), "devices/1/sensor/0")
+	is.Equal(tp.topic(1), "devices/1/sensor/1")
+	is.Equal(tp.topic(2), "devices/2/sensor/0")
+	is.Equal(tp.topic(5), "devices/3/sensor/1")
+	is.Equal(tp.topic(6), "devices/1/sensor/0") // wraps around
+	tp, err = parseTopicPattern("plain/topic")
+	is.NoErr(err)
+	is.Equal(tp.topic(42), "plain/topic")
+	for _, bad := range []string{"a/{1..", "a/{x..2}", "a/{5..1}", "a/{1-5}", "a/#"} {
+		_, err = parseTopicPattern(bad)
+		is.True(err != nil)
+	}
+}
+
+func TestSizeDist(t *testing.T) {
+	is := is2.New(t)
+	rnd := rand.New(rand.NewSource(1))
+	d, err := parseSizeDist("100")
+	is.NoErr(err)
+	is.Equal(d.next(rnd), 100)
+	d, err = parseSizeDist("10-20")
+	is.NoErr(err)
+	for i := 0; i < 100; i++ {
+		size := d.next(rnd)
+		is.True(size >= 10 && size <= 20)
+	}
+	d, err = parseSizeDist("normal:500,50")
+	is.NoErr(err)
+	sum := 0
+	for i := 0; i < 1000; i++ {
+		sum += d.next(rnd)
+	}
+	is.True(sum/1000 > 480 && sum/1000 < 520)
+	for _, bad := range []string{"", "x", "20-10", "normal:500", "normal:a,b"} {
+		_, err = parseSizeDist(bad)
+		is.True(err != nil)
+	}
+}
+
+func TestMakePayload(t *testing.T) {
+	is := is2.New(t)
+	now := time.Now()
+	payload := makePayload("run1", 7, now, 1000)
+	is.Equal(len(payload), 1000)
+	var p loadPayload
+	is.NoErr(json.Unmarshal(payload, &p))
+	is.Equal(p.Seq, uint64(7))
+	is.Equal(p.Sent, now.UnixNano())
+	small := makePayload("run1", 7, now, 10) // can't go below the size of the header.
+	is.True(!strings.Contains(string(small), "pad"))
+}
+
+// envelope wraps a payload the way the bridge does.
+func envelope(t *testing.T, payload []byte) gokafka.Message {
+	b, err := json.Marshal(struct {
+		Topic   string `json:"topic"`
+		Content []byte `json:"content"`
+	}{Topic: "loadtest/1", Content: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gokafka.Message{Value: b}
+}
+
+func TestVerifier(t *testing.T) {
+	is := is2.New(t)
+	sent := time.Unix(1000, 0)
+	v := newVerifier("run1")
+	v.now = func() time.Time { return sent.Add(100 * time.Millisecond) }
+	for _, seq := range []uint64{0, 1, 1, 3} {
+		v.record(envelope(t, makePayload("run1", seq, sent, 0)))
+	}
+	v.record(envelope(t, makePayload("other", 2, sent, 0))) // another run, ignored.
+	v.record(envelope(t, []byte("test message")))
+	report := v.report(4)
+	is.True(strings.Contains(report, "Received 4 messages: 1 lost, 1 duplicates"))
+	is.True(strings.Contains(report, "p99 100ms"))
+}
+
+func TestPercentile(t *testing.T) {
+	is := is2.New(t)
+	var lat []time.Duration
+	for i := 1; i <= 100; i++ {
+		lat = append(lat, time.Duration(i)*time.Millisecond)
+	}
+	is.Equal(percentile(lat, 50), 50*time.Millisecond)
+	is.Equal(percentile(lat, 99), 99*time.Millisecond)
+	is.Equal(percentile(lat[:1], 90), time.Millisecond)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"github.com/celerway/metamorphosis/bridge"
+	"github.com/joho/godotenv"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reloadOnHup sends new settings to the bridge on SIGHUP until the context is cancelled.
+func reloadOnHup(ctx context.Context, ch chan<- bridge.Reloadable, envFile string, current bridge.Reloadable, sources []bridge.MqttSource) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Infof("Got SIGHUP, reading %s", envFile)
+			current = readReloadable(envFile, current, sources)
+			select {
+			case ch <- current:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// readReloadable reads the reloadable settings from the env file. Settings that aren't in the file keep
+// their current value.
+func readReloadable(envFile string, current bridge.Reloadable, sources []bridge.MqttSource) bridge.Reloadable {
+	fileEnv, err := godotenv.Read(envFile)
+	if err != nil {
+		log.Warnf("Could not read %s, only reloading TLS files: %s", envFile, err)
+		fileEnv = map[string]string{}
+	}
+	lookup := func(key, def string) string {
+		if v, ok := fileEnv[key]; ok {
+			return v
+		}
+		return def
+	}
+	settings := bridge.Reloadable{
+		LogLevel:               lookup("LOG_LEVEL", current.LogLevel),
+		LogModuleLevels:        lookup("LOG_MODULE_LEVELS", current.LogModuleLevels),
+		KafkaCompressionRoutes: lookup("KAFKA_COMPRESSION_ROUTES", current.KafkaCompressionRoutes),
+		MqttTopics:             make(map[string]string),
+	}
+	if len(sources) == 0 {
+		settings.MqttTopics[""] = lookup("MQTT_TOPIC", current.MqttTopics[""])
+	}
+	for _, s := range sources {
+		prefix := sourceEnvPrefix(s.Name)
+		topic := current.MqttTopics[s.Name]
+		if _, own := os.LookupEnv(prefix + "TOPIC"); !own {
+			topic = lookup("MQTT_TOPIC", topic) // the source follows MQTT_TOPIC
+		}
+		settings.MqttTopics[s.Name] = lookup(prefix+"TOPIC", topic)
+	}
+	return settings
+}
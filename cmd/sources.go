@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"github.com/celerway/metamorphosis/bridge"
+	"regexp"
+	"strings"
+)
+
+var sourceNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+
+// lookupMqttSources reads the sources named in names, e.g. "eu,us". A source is configured with the
+// MQTT_<NAME>_* variables, like MQTT_EU_BROKER. Anything left out is taken from the MQTT_* variables in def.
+func lookupMqttSources(names string, def bridge.MqttSource) ([]bridge.MqttSource, error) {
+	var sources []bridge.MqttSource
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !sourceNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid source name '%s' (letters, digits, '-' and '_')", name)
+		}
+		prefix := sourceEnvPrefix(name)
+		if seen[prefix] {
+			return nil, fmt.Errorf("duplicate source '%s'", name)
+		}
+		seen[prefix] = true
+		sources = append(sources, bridge.MqttSource{
+			Name:               name,
+			Broker:             LookupEnvOrString(prefix+"BROKER", def.Broker),
+			Port:               LookupEnvOrInt(prefix+"PORT", def.Port),
+			PreferPrimaryAfter: LookupEnvOrDuration(prefix+"PREFER_PRIMARY_AFTER", def.PreferPrimaryAfter),
+			Url:                LookupEnvOrString(prefix+"URL", def.Url),
+			Transport:          LookupEnvOrString(prefix+"TRANSPORT", def.Transport),
+			WsPath:             LookupEnvOrString(prefix+"WS_PATH", def.WsPath),
+			WsHeaders:          LookupEnvOrString(prefix+"WS_HEADERS", def.WsHeaders),
+			WsProxy:            LookupEnvOrString(prefix+"WS_PROXY", def.WsProxy),
+			ProtocolVersion:    LookupEnvOrInt(prefix+"PROTOCOL_VERSION", def.ProtocolVersion),
+			Tls:                LookupEnvOrBool(prefix+"TLS", def.Tls),
+			RootCrtFile:        LookupEnvOrString(prefix+"ROOT_CA", def.RootCrtFile),
+			ClientCertFile:     LookupEnvOrString(prefix+"CLIENT_CERT", def.ClientCertFile),
+			ClientKeyFile:      LookupEnvOrString(prefix+"CLIENT_KEY", def.ClientKeyFile),
+			Username:           LookupEnvOrString(prefix+"USERNAME", def.Username),
+			Password:           LookupEnvOrString(prefix+"PASSWORD", def.Password),
+			Topic:              LookupEnvOrString(prefix+"TOPIC", def.Topic),
+			ClientId:           LookupEnvOrString(prefix+"CLIENT_ID", def.ClientId),
+		})
+	}
+	return sources, nil
+}
+
+// sourceEnvPrefix returns the prefix of the variables for a source: "eu-west" is MQTT_EU_WEST_.
+func sourceEnvPrefix(name string) string {
+	return "MQTT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+}
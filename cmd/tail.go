@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/celerway/metamorphosis/bridge/kafka"
+	"github.com/celerway/metamorphosis/bridge/topic"
+	"github.com/celerway/metamorphosis/consumer"
+	"github.com/joho/godotenv"
+	gokafka "github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tail reads a Kafka topic written by the bridge, decodes the envelope and prints the messages.
+// Every partition is read, so the output is only ordered within a partition.
+
+// idleTimeout is how long we wait for more messages once we're past -until.
+const idleTimeout = 3 * time.Second
+
+type tailOptions struct {
+	brokers      []string
+	topic        string
+	filter       string
+	format       string
+	since        time.Time
+	until        time.Time
+	fromStart    bool
+	limit        int
+	testMessages bool
+	testTopic    string
+}
+
+func tailCmd(args []string) int {
+	_ = godotenv.Load()
+	var (
+		brokers = kafkaBrokerDefault()
+		since   string
+		until   string
+		opts    tailOptions
+		fs      = flag.NewFlagSet("tail", flag.ContinueOnError)
+	)
+	fs.StringVar(&brokers, "brokers", brokers, "Kafka brokers (host:port,host:port). Defaults to KAFKA_BROKER:KAFKA_PORT")
+	fs.StringVar(&opts.topic, "topic", LookupEnvOrString("KAFKA_TOPIC", ""), "Kafka topic to read")
+	fs.StringVar(&opts.filter, "filter", "#", "Only show messages with an MQTT topic matching this filter")
+	fs.StringVar(&opts.format, "format", "text", "Payload format (text|hex|json)")
+	fs.StringVar(&since, "since", "", "Start at this time (RFC3339) or this long ago (e.g. 15m)")
+	fs.StringVar(&until, "until", "", "Stop at this time (RFC3339) or this long ago (e.g. 5m)")
+	fs.BoolVar(&opts.fromStart, "from-beginning", false, "Start at the oldest message instead of only showing new ones")
+	fs.IntVar(&opts.limit, "n", 0, "Stop after this many messages (0 is no limit)")
+	fs.BoolVar(&opts.testMessages, "test-messages", false, "Also show the test messages written by the bridge")
+	fs.StringVar(&opts.testTopic, "test-message-topic", LookupEnvOrString("TEST_MESSAGE_TOPIC", "test"), "MQTT topic of the test messages")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	var err error
+	now := time.Now()
+	if opts.since, err = parseTimeArg(since, now); err != nil {
+		fmt.Fprintf(os.Stderr, "-since: %s\n", err)
+		return 2
+	}
+	if opts.until, err = parseTimeArg(until, now); err != nil {
+		fmt.Fprintf(os.Stderr, "-until: %s\n", err)
+		return 2
+	}
+	if err := topic.ValidateFilter(opts.filter); err != nil {
+		fmt.Fprintf(os.Stderr, "-filter: %s\n", err)
+		return 2
+	}
+	switch opts.format {
+	case "text", "hex", "json":
+	default:
+		fmt.Fprintf(os.Stderr, "-format: unknown format '%s' (text|hex|json)\n", opts.format)
+		return 2
+	}
+	opts.brokers = splitList(brokers)
+	if len(opts.brokers) == 0 || opts.topic == "" {
+		fmt.Fprintln(os.Stderr, "tail: -brokers and -topic are required")
+		return 2
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if err := tail(ctx, opts, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "tail: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// tail reads all partitions of the topic and prints matching messages until the context is cancelled,
+// every partition has passed opts.until or the limit is reached.
+func tail(ctx context.Context, opts tailOptions, out io.Writer) error {
+	partitions, err := readPartitions(ctx, opts.brokers, opts.topic)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	records := make(chan gokafka.Message)
+	errCh := make(chan error, len(partitions))
+	wg := sync.WaitGroup{}
+	for _, p := range partitions {
+		wg.Add(1)
+		go func(partition int) {
+			defer wg.Done()
+			if err := readPartition(ctx, opts, partition, records); err != nil {
+				errCh <- fmt.Errorf("partition %d: %w", partition, err)
+				cancel()
+			}
+		}(p.ID)
+	}
+	go func() {
+		wg.Wait()
+		close(records)
+	}()
+	shown := 0
+	for record := range records {
+		msg, err := consumer.Decode(record)
+		if err != nil {
+			fmt.Fprintf(out, "%s [%d/%d] undecodable record: %s\n", record.Time.Format(time.RFC3339Nano),
+				record.Partition, record.Offset, err)
+			continue
+		}
+		if !opts.testMessages && msg.Topic == opts.testTopic {
+			continue
+		}
+		if !topic.Match(opts.filter, msg.Topic) {
+			continue
+		}
+		fmt.Fprintln(out, formatMessage(msg, opts.format))
+		shown++
+		if opts.limit > 0 && shown >= opts.limit {
+			cancel()
+			break
+		}
+	}
+	for range records { // let the readers finish.
+	}
+	select {
+	case err := <-errCh:
+		return err
+	default:
+		return nil
+	}
+}
+
+func readPartitions(ctx context.Context, brokers []string, kafkaTopic string) ([]gokafka.Partition, error) {
+	var lastErr error
+	for _, broker := range brokers {
+		conn, err := gokafka.DialContext(ctx, "tcp", broker)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		partitions, err := conn.ReadPartitions(kafkaTopic)
+		_ = conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return partitions, nil
+	}
+	return nil, fmt.Errorf("reading partitions of '%s': %w", kafkaTopic, lastErr)
+}
+
+func readPartition(ctx context.Context, opts tailOptions, partition int, records chan<- gokafka.Message) error {
+	startOffset := gokafka.LastOffset
+	if opts.fromStart {
+		startOffset = gokafka.FirstOffset
+	}
+	reader := gokafka.NewReader(gokafka.ReaderConfig{
+		Brokers:     opts.brokers,
+		Topic:       opts.topic,
+		Partition:   partition,
+		StartOffset: startOffset,
+		MaxWait:     500 * time.Millisecond,
+	})
+	defer reader.Close()
+	if !opts.since.IsZero() {
+		if err := reader.SetOffsetAt(ctx, opts.since); err != nil {
+			return fmt.Errorf("seeking to %s: %w", opts.since.Format(time.RFC3339), err)
+		}
+	}
+	for {
+		readCtx, cancel := ctx, context.CancelFunc(func() {})
+		if !opts.until.IsZero() && time.Now().After(opts.until) {
+			// Nothing new will show up before until, so if the partition stays quiet we're done.
+			readCtx, cancel = context.WithTimeout(ctx, idleTimeout)
+		}
+		record, err := reader.ReadMessage(readCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) || errors.Is(err, context.DeadlineExceeded) {
+				return nil
+			}
+			return err
+		}
+		if !opts.until.IsZero() && record.Time.After(opts.until) {
+			return nil
+		}
+		select {
+		case records <- record:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// formatMessage formats a message as a single line (or several for pretty JSON).
+func formatMessage(msg consumer.Message, format string) string {
+	var payload string
+	switch format {
+	case "hex":
+		payload = hex.EncodeToString(msg.Payload)
+	case "json":
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, msg.Payload, "", "  "); err != nil {
+			payload = strconv.Quote(string(msg.Payload)) // not JSON, show it as a string.
+		} else {
+			payload = buf.String()
+		}
+	default:
+		payload = string(msg.Payload)
+	}
+	return fmt.Sprintf("%s %s %s", msg.Time.Format(time.RFC3339Nano), msg.Topic, payload)
+}
+
+// parseTimeArg parses either a RFC3339 timestamp or a duration, which is taken as "this long ago".
+func parseTimeArg(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		if d < 0 {
+			return time.Time{}, fmt.Errorf("duration '%s' can't be negative", s)
+		}
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("'%s' is neither a duration nor a RFC3339 time", s)
+	}
+	return t, nil
+}
+
+func kafkaBrokerDefault() string {
+	brokers, err := kafka.ParseBrokers(LookupEnvOrString("KAFKA_BROKER", ""), LookupEnvOrInt("KAFKA_PORT", 9092))
+	if err != nil {
+		log.Fatalf("KAFKA_BROKER: %s", err)
+	}
+	return strings.Join(brokers, ",")
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
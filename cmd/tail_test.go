@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/celerway/metamorphosis/consumer"
+	is2 "github.com/matryer/is"
+	"testing"
+	"time"
+)
+
+func TestParseTimeArg(t *testing.T) {
+	is := is2.New(t)
+	now := time.Date(2022, 10, 4, 12, 0, 0, 0, time.UTC)
+	ts, err := parseTimeArg("", now)
+	is.NoErr(err)
+	is.True(ts.IsZero())
+	ts, err = parseTimeArg("15m", now)
+	is.NoErr(err)
+	is.Equal(ts, now.Add(-15*time.Minute))
+	ts, err = parseTimeArg("2022-10-04T10:00:00Z", now)
+	is.NoErr(err)
+	is.Equal(ts, now.Add(-2*time.Hour))
+	_, err = parseTimeArg("-5m", now)
+	is.True(err != nil)
+	_, err = parseTimeArg("yesterday", now)
+	is.True(err != nil)
+}
+
+func TestFormatMessage(t *testing.T) {
+	is := is2.New(t)
+	ts := time.Date(2022, 10, 4, 12, 0, 0, 0, time.UTC)
+	msg := consumer.Message{Topic: "a/b", Payload: []byte(`{"x":1}`), Time: ts}
+	is.Equal(formatMessage(msg, "text"), `2022-10-04T12:00:00Z a/b {"x":1}`)
+	is.Equal(formatMessage(msg, "hex"), `2022-10-04T12:00:00Z a/b 7b2278223a317d`)
+	is.Equal(formatMessage(msg, "json"), "2022-10-04T12:00:00Z a/b {\n  \"x\": 1\n}")
+	msg.Payload = []byte("plain")
+	is.Equal(formatMessage(msg, "json"), `2022-10-04T12:00:00Z a/b "plain"`)
+}
@@ -0,0 +1,89 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/celerway/metamorphosis/bridge/logging"
+	gokafka "github.com/segmentio/kafka-go"
+	"time"
+)
+
+// New creates a consumer that reads from Kafka and passes the decoded messages to the handler,
+// typically a Router.
+func New(cfg Config, handler Handler) (*Consumer, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, errors.New("consumer: no brokers")
+	}
+	if cfg.Topic == "" {
+		return nil, errors.New("consumer: no topic")
+	}
+	reader := gokafka.NewReader(gokafka.ReaderConfig{
+		Brokers: cfg.Brokers,
+		Topic:   cfg.Topic,
+		GroupID: cfg.GroupID,
+		MaxWait: time.Second,
+	})
+	return newConsumer(cfg, reader, handler), nil
+}
+
+func newConsumer(cfg Config, reader *gokafka.Reader, handler Handler) *Consumer {
+	c := &Consumer{
+		reader:           reader,
+		handler:          handler,
+		testMessageTopic: cfg.TestMessageTopic,
+		errorHandler:     cfg.ErrorHandler,
+		commit:           cfg.GroupID != "",
+		logger:           cfg.Logger,
+	}
+	if c.testMessageTopic == "" {
+		c.testMessageTopic = "test"
+	}
+	if c.logger == nil {
+		c.logger = logging.Module("consumer")
+	}
+	if c.errorHandler == nil {
+		c.errorHandler = func(msg gokafka.Message, err error) error {
+			c.logger.Errorf("partition %d offset %d: %s", msg.Partition, msg.Offset, err)
+			return nil
+		}
+	}
+	return c
+}
+
+// Run consumes until the context is cancelled or the error handler returns an error.
+func (c *Consumer) Run(ctx context.Context) error {
+	defer c.reader.Close()
+	for {
+		record, err := c.reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("consumer: fetching message: %w", err)
+		}
+		if err := c.process(ctx, record); err != nil {
+			return err
+		}
+		if c.commit {
+			if err := c.reader.CommitMessages(ctx, record); err != nil && ctx.Err() == nil {
+				return fmt.Errorf("consumer: committing offset: %w", err)
+			}
+		}
+	}
+}
+
+// process decodes and handles a single record.
+func (c *Consumer) process(ctx context.Context, record gokafka.Message) error {
+	msg, err := Decode(record)
+	if err != nil {
+		return c.errorHandler(record, err)
+	}
+	if msg.Topic == c.testMessageTopic {
+		return nil // the bridge checking that Kafka is alive.
+	}
+	if err := c.handler.Handle(ctx, msg); err != nil {
+		return c.errorHandler(record, err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/celerway/metamorphosis/bridge/kafka"
+	"github.com/celerway/metamorphosis/bridge/schema"
+	"github.com/celerway/metamorphosis/bridge/schema/schematest"
+	is2 "github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	gokafka "github.com/segmentio/kafka-go"
+	"testing"
+)
+
+func makeRecord(t *testing.T, topic, payload string) gokafka.Message {
+	value, err := json.Marshal(kafka.Message{Topic: topic, Content: []byte(payload)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gokafka.Message{Value: value, Offset: 7}
+}
+
+func TestDecode(t *testing.T) {
+	is := is2.New(t)
+	record := makeRecord(t, "devices/1/telemetry", `{"temp":21}`)
+	record.Headers = []gokafka.Header{{Key: "traceparent", Value: []byte("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")}}
+	msg, err := Decode(record)
+	is.NoErr(err)
+	is.Equal(msg.Topic, "devices/1/telemetry")
+	is.Equal(string(msg.Payload), `{"temp":21}`)
+	is.Equal(msg.Offset, int64(7))
+	is.Equal(msg.Traceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	is.Equal(msg.Source, "") // single source bridges leave it out
+	msg, err = Decode(gokafka.Message{Value: []byte(`{"source":"eu","topic":"a","content":"Yg=="}`)})
+	is.NoErr(err)
+	is.Equal(msg.Source, "eu")
+	is.Equal(msg.Error, "")
+	msg, err = Decode(gokafka.Message{Value: []byte(`{"topic":"a","content":"Yg==","error":"processor 'gunzip': bad header"}`)})
+	is.NoErr(err)
+	is.Equal(msg.Error, "processor 'gunzip': bad header") // a dead letter
+	msg, err = Decode(gokafka.Message{Value: []byte(`{"topic":"a","payload":{"temp":21},"encoding":"json"}`)})
+	is.NoErr(err)
+	is.Equal(string(msg.Payload), `{"temp":21}`) // inlined JSON
+	registry := schematest.NewRegistry()
+	defer registry.Close()
+	enc, err := schema.NewEncoder(context.Background(), schema.Params{
+		Registry: schema.NewRegistry(registry.URL(), "", ""), Format: schema.FormatProtobuf, Subject: "mqtt-value", AutoRegister: true,
+	})
+	is.NoErr(err)
+	value, headers, err := enc.Encode(kafka.Message{Topic: "a", Content: []byte("b")})
+	is.NoErr(err)
+	msg, err = Decode(gokafka.Message{Value: value, Headers: headers})
+	is.NoErr(err)
+	is.Equal(msg.Topic, "a")
+	is.Equal(string(msg.Payload), "b")
+	is.Equal(msg.SchemaId, 1)
+	_, err = Decode(gokafka.Message{Value: []byte("not json")})
+	is.True(err != nil)
+	_, err = Decode(gokafka.Message{Value: []byte("{}")})
+	is.True(err != nil)
+}
+
+func TestDecodeHeartbeat(t *testing.T) {
+	is := is2.New(t)
+	msg, err := Decode(makeRecord(t, HeartbeatTopic, `{"id":"bridge-1","received":10,"written":9}`))
+	is.NoErr(err)
+	hb, err := DecodeHeartbeat(msg)
+	is.NoErr(err)
+	is.Equal(hb.Id, "bridge-1")
+	is.Equal(hb.Received, int64(10))
+	is.Equal(hb.Written, int64(9))
+	router := NewRouter()
+	called := false
+	_ = router.RouteFunc("#", func(ctx context.Context, msg Message) error { called = true; return nil })
+	is.NoErr(router.Handle(context.Background(), msg))
+	is.True(!called) // '#' doesn't match the heartbeats
+	msg.Topic = "devices/1"
+	_, err = DecodeHeartbeat(msg)
+	is.True(err != nil)
+}
+
+func TestRouter(t *testing.T) {
+	is := is2.New(t)
+	var got []string
+	handler := func(name string) HandlerFunc {
+		return func(_ context.Context, msg Message) error {
+			got = append(got, name+":"+msg.Topic)
+			return nil
+		}
+	}
+	r := NewRouter()
+	is.NoErr(r.Route("devices/+/telemetry", handler("telemetry")))
+	is.NoErr(r.Route("devices/#", handler("devices")))
+	is.True(r.Route("devices/#/bad", handler("bad")) != nil)
+	ctx := context.Background()
+	is.NoErr(r.Handle(ctx, Message{Topic: "devices/1/telemetry"}))
+	is.NoErr(r.Handle(ctx, Message{Topic: "devices/1/status"}))
+	is.NoErr(r.Handle(ctx, Message{Topic: "other"})) // dropped
+	r.NotFound(handler("notfound"))
+	is.NoErr(r.Handle(ctx, Message{Topic: "other"}))
+	is.Equal(got, []string{"telemetry:devices/1/telemetry", "devices:devices/1/status", "notfound:other"})
+	is.Equal(r.Routes(), []string{"devices/+/telemetry", "devices/#"})
+}
+
+func TestMiddleware(t *testing.T) {
+	is := is2.New(t)
+	var order []string
+	mw := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(ctx context.Context, msg Message) error {
+				order = append(order, name)
+				return next.Handle(ctx, msg)
+			})
+		}
+	}
+	reg := prometheus.NewRegistry()
+	metrics, err := NewMetrics(reg)
+	is.NoErr(err)
+	r := NewRouter()
+	r.Use(mw("outer"), mw("inner"), Recover(), metrics.Middleware(nil))
+	is.NoErr(r.RouteFunc("ok", func(_ context.Context, _ Message) error { return nil }))
+	is.NoErr(r.RouteFunc("panic", func(_ context.Context, _ Message) error { panic("boom") }))
+	is.NoErr(r.RouteFunc("fail", func(_ context.Context, _ Message) error { return errors.New("fail") }))
+	ctx := context.Background()
+	is.NoErr(r.Handle(ctx, Message{Topic: "ok"}))
+	is.Equal(order, []string{"outer", "inner"})
+	is.True(r.Handle(ctx, Message{Topic: "panic"}) != nil) // recovered
+	is.True(r.Handle(ctx, Message{Topic: "fail"}) != nil)
+	is.Equal(testutil.ToFloat64(metrics.handled.WithLabelValues("ok", "ok")), float64(1))
+	is.Equal(testutil.ToFloat64(metrics.handled.WithLabelValues("fail", "error")), float64(1))
+	_, err = NewMetrics(reg) // already registered
+	is.True(err != nil)
+}
+
+func TestConsumer_Process(t *testing.T) {
+	is := is2.New(t)
+	var handled []string
+	var errs []error
+	r := NewRouter()
+	is.NoErr(r.RouteFunc("#", func(_ context.Context, msg Message) error {
+		handled = append(handled, msg.Topic)
+		if msg.Topic == "fail" {
+			return errors.New("handler failed")
+		}
+		return nil
+	}))
+	c := newConsumer(Config{ErrorHandler: func(_ gokafka.Message, err error) error {
+		errs = append(errs, err)
+		return nil
+	}}, nil, r)
+	ctx := context.Background()
+	is.NoErr(c.process(ctx, makeRecord(t, "test", "Internal test to see if kafka is alive at startup")))
+	is.NoErr(c.process(ctx, makeRecord(t, "a/b", "hello")))
+	is.NoErr(c.process(ctx, makeRecord(t, "fail", "hello")))
+	is.NoErr(c.process(ctx, gokafka.Message{Value: []byte("garbage")}))
+	is.Equal(handled, []string{"a/b", "fail"}) // the test message is skipped
+	is.Equal(len(errs), 2)                     // handler error + decoding error
+
+	// An error handler returning an error stops the consumer.
+	stop := newConsumer(Config{ErrorHandler: func(_ gokafka.Message, err error) error { return err }}, nil, r)
+	is.True(stop.process(ctx, makeRecord(t, "fail", "hello")) != nil)
+}
@@ -0,0 +1,73 @@
+package consumer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/celerway/metamorphosis/bridge/kafka"
+	"github.com/celerway/metamorphosis/bridge/schema"
+	"github.com/celerway/metamorphosis/bridge/tracing"
+	gokafka "github.com/segmentio/kafka-go"
+)
+
+// Decode decodes a record written by the bridge.
+func Decode(record gokafka.Message) (Message, error) {
+	var envelope kafka.Message
+	var schemaId int
+	var err error
+	if isSchemaEncoded(record) {
+		envelope, schemaId, err = schema.Decode(record)
+	} else {
+		envelope, err = kafka.DecodeEnvelope(record.Value)
+	}
+	if err != nil {
+		return Message{}, fmt.Errorf("decoding envelope (partition %d, offset %d): %w", record.Partition, record.Offset, err)
+	}
+	if envelope.Topic == "" {
+		return Message{}, fmt.Errorf("decoding envelope (partition %d, offset %d): %w",
+			record.Partition, record.Offset, errors.New("no topic in envelope"))
+	}
+	msg := Message{
+		Source:    envelope.Source,
+		Topic:     envelope.Topic,
+		Payload:   envelope.Content,
+		Error:     envelope.Error,
+		SchemaId:  schemaId,
+		Time:      record.Time,
+		Partition: record.Partition,
+		Offset:    record.Offset,
+		Raw:       record,
+	}
+	for _, h := range record.Headers {
+		if h.Key == tracing.TraceparentHeader {
+			msg.Traceparent = string(h.Value)
+		}
+	}
+	return msg, nil
+}
+
+// HeartbeatTopic is the topic of the heartbeats written by the bridge. Add a route for it to get them,
+// wildcards don't match it.
+const HeartbeatTopic = kafka.HeartbeatTopic
+
+// isSchemaEncoded returns true for records in Avro or Protobuf, see KAFKA_ENCODING.
+func isSchemaEncoded(record gokafka.Message) bool {
+	for _, h := range record.Headers {
+		if h.Key == schema.EncodingHeader {
+			return true
+		}
+	}
+	return false
+}
+
+// DecodeHeartbeat decodes the payload of a message on HeartbeatTopic.
+func DecodeHeartbeat(msg Message) (kafka.Heartbeat, error) {
+	var hb kafka.Heartbeat
+	if msg.Topic != HeartbeatTopic {
+		return hb, fmt.Errorf("not a heartbeat: topic is '%s'", msg.Topic)
+	}
+	if err := json.Unmarshal(msg.Payload, &hb); err != nil {
+		return hb, fmt.Errorf("decoding heartbeat (partition %d, offset %d): %w", msg.Partition, msg.Offset, err)
+	}
+	return hb, nil
+}
@@ -0,0 +1,66 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"runtime/debug"
+	"time"
+)
+
+// Recover turns a panic in a handler into an error, so a bad message can't take down the consumer.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, msg Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic handling message on topic '%s': %v\n%s", msg.Topic, r, debug.Stack())
+				}
+			}()
+			return next.Handle(ctx, msg)
+		})
+	}
+}
+
+// NewMetrics creates and registers the collectors for the Metrics middleware.
+func NewMetrics(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		handled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "consumer_messages_handled",
+			Help: "Number of messages handled, by MQTT topic and result",
+		}, []string{"topic", "result"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "consumer_handler_duration_seconds",
+			Help:    "Time spent in handlers, by MQTT topic",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"topic"}),
+	}
+	for _, c := range []prometheus.Collector{m.handled, m.duration} {
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("registering consumer metrics: %w", err)
+		}
+	}
+	return m, nil
+}
+
+// Middleware counts messages and measures handler time. The label is the MQTT topic, so be
+// careful with cardinality if you have a topic per device; use a label func to group them.
+func (m *Metrics) Middleware(label func(topic string) string) Middleware {
+	if label == nil {
+		label = func(topic string) string { return topic }
+	}
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, msg Message) error {
+			l := label(msg.Topic)
+			start := time.Now()
+			err := next.Handle(ctx, msg)
+			m.duration.WithLabelValues(l).Observe(time.Since(start).Seconds())
+			result := "ok"
+			if err != nil {
+				result = "error"
+			}
+			m.handled.WithLabelValues(l, result).Inc()
+			return err
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package consumer
+
+import (
+	"context"
+	"github.com/celerway/metamorphosis/bridge/topic"
+)
+
+// NewRouter creates an empty router. Messages that don't match any route are dropped
+// unless a NotFound handler is set.
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Route registers a handler for a topic filter. Wildcards ('+' and '#') work as in MQTT.
+// Routes are tried in the order they are registered and the first match wins.
+func (r *Router) Route(filter string, h Handler) error {
+	if err := topic.ValidateFilter(filter); err != nil {
+		return err
+	}
+	r.routes = append(r.routes, route{filter: filter, handler: h})
+	return nil
+}
+
+// RouteFunc registers a function as the handler for a topic filter.
+func (r *Router) RouteFunc(filter string, f func(ctx context.Context, msg Message) error) error {
+	return r.Route(filter, HandlerFunc(f))
+}
+
+// NotFound sets the handler for messages that don't match any route.
+func (r *Router) NotFound(h Handler) {
+	r.notFound = h
+}
+
+// Use adds middleware. It wraps every handler, in the order given; the first one is the outermost.
+func (r *Router) Use(mw ...Middleware) {
+	r.middleware = append(r.middleware, mw...)
+}
+
+// Handle dispatches the message. The router is a Handler itself, so routers can be nested.
+func (r *Router) Handle(ctx context.Context, msg Message) error {
+	h := r.match(msg.Topic)
+	if h == nil {
+		return nil
+	}
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		h = r.middleware[i](h)
+	}
+	return h.Handle(ctx, msg)
+}
+
+func (r *Router) match(name string) Handler {
+	for _, rt := range r.routes {
+		if topic.Match(rt.filter, name) {
+			return rt.handler
+		}
+	}
+	return r.notFound
+}
+
+// Routes returns the registered filters, mostly useful for debugging.
+func (r *Router) Routes() []string {
+	filters := make([]string, len(r.routes))
+	for i, rt := range r.routes {
+		filters[i] = rt.filter
+	}
+	return filters
+}
@@ -0,0 +1,77 @@
+package consumer
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	gokafka "github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// Message is a decoded envelope.
+type Message struct {
+	Source      string    // the MQTT source the bridge read it from. Empty if the bridge has a single source.
+	Topic       string    // the MQTT topic the message was published on.
+	Payload     []byte    // the MQTT payload, decoded.
+	Error       string    // on dead letters: why the bridge couldn't process the message. Payload is the original.
+	Traceparent string    // W3C trace context from the bridge, if tracing is enabled.
+	SchemaId    int       // the schema registry id of the record, with Avro or Protobuf. 0 for JSON.
+	Time        time.Time // when the record was written to Kafka.
+	Partition   int
+	Offset      int64
+	Raw         gokafka.Message // the record as it was read from Kafka.
+}
+
+// Handler processes a message. Returning an error passes it to the ErrorHandler of the consumer.
+type Handler interface {
+	Handle(ctx context.Context, msg Message) error
+}
+
+// HandlerFunc lets a function be used as a Handler.
+type HandlerFunc func(ctx context.Context, msg Message) error
+
+func (f HandlerFunc) Handle(ctx context.Context, msg Message) error {
+	return f(ctx, msg)
+}
+
+// Middleware wraps a handler, e.g. to add metrics or recover from panics.
+type Middleware func(next Handler) Handler
+
+type route struct {
+	filter  string
+	handler Handler
+}
+
+// Router dispatches messages to handlers by MQTT topic filter.
+type Router struct {
+	routes     []route
+	notFound   Handler
+	middleware []Middleware
+}
+
+type Config struct {
+	Brokers          []string
+	Topic            string
+	GroupID          string // consumer group. Offsets are committed after the handler returns.
+	TestMessageTopic string // messages on this MQTT topic are skipped. Defaults to "test".
+	// ErrorHandler is called when decoding or handling fails. If it returns an error the consumer stops.
+	// The default logs the error and carries on.
+	ErrorHandler func(msg gokafka.Message, err error) error
+	Logger       *log.Entry
+}
+
+// Consumer reads envelopes from Kafka and hands them to a router.
+type Consumer struct {
+	reader           *gokafka.Reader
+	handler          Handler
+	testMessageTopic string
+	errorHandler     func(msg gokafka.Message, err error) error
+	commit           bool
+	logger           *log.Entry
+}
+
+// Metrics holds the collectors used by the Metrics middleware.
+type Metrics struct {
+	handled  *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}